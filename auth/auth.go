@@ -0,0 +1,85 @@
+// Package auth implements the pluggable authentication of the builds REST
+// API: callers are identified through HTTP basic authentication against a
+// local user file, through bearer tokens or through TLS client certificates,
+// and the resulting principal is made available to the request handlers.
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrorNoCredentials is returned by an Authenticator when the request
+	// carries no credentials of the kind it handles.
+	ErrorNoCredentials = fmt.Errorf("no credentials")
+	// ErrorInvalidCredentials is returned by an Authenticator when the
+	// request carries credentials it cannot verify.
+	ErrorInvalidCredentials = fmt.Errorf("invalid credentials")
+)
+
+// Authenticator identifies the caller of an HTTP request.
+type Authenticator interface {
+	// Authenticate returns the name of the user that issued the request;
+	// it returns ErrorNoCredentials if the request carries no credentials of
+	// the kind handled by the authenticator.
+	Authenticate(request *http.Request) (string, error)
+	// Challenge returns the WWW-Authenticate challenge inviting clients to
+	// provide credentials of the kind handled by the authenticator, if any.
+	Challenge() string
+}
+
+// principal is the key of the authenticated user name in the gin context.
+const principal = "auth.principal"
+
+// Authenticate returns a middleware identifying the caller through the first
+// authenticator finding credentials in the request; requests carrying no
+// credentials go through anonymously, those carrying invalid credentials are
+// rejected with 401 Unauthorized.
+func Authenticate(authenticators ...Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, authenticator := range authenticators {
+			user, err := authenticator.Authenticate(c.Request)
+			switch err {
+			case nil:
+				c.Set(principal, user)
+				c.Next()
+				return
+			case ErrorNoCredentials:
+				continue
+			default:
+				Unauthorized(c, authenticators, err)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// User returns the name of the authenticated user that issued the request,
+// and whether the request was authenticated at all.
+func User(c *gin.Context) (string, bool) {
+	if user, ok := c.Get(principal); ok {
+		return user.(string), true
+	}
+	return "", false
+}
+
+// Unauthorized interrupts the request with a 401 Unauthorized status code,
+// inviting the client to authenticate through any of the given
+// authenticators.
+func Unauthorized(c *gin.Context, authenticators []Authenticator, err error) {
+	challenges := make([]string, 0, len(authenticators))
+	for _, authenticator := range authenticators {
+		if challenge := authenticator.Challenge(); challenge != "" {
+			challenges = append(challenges, challenge)
+		}
+	}
+	if len(challenges) > 0 {
+		c.Header("WWW-Authenticate", strings.Join(challenges, ", "))
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+}
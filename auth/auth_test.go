@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authenticators returns the basic, token and certificate authenticators, the
+// former two reading users alice (password "secret") and bob (token "t0k3n")
+// from temporary files.
+func authenticators(t *testing.T) []Authenticator {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error hashing password: %v", err)
+	}
+	users := filepath.Join(dir, "users")
+	if err := os.WriteFile(users, []byte("# users\nalice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("error writing users: %v", err)
+	}
+	digest := sha256.Sum256([]byte("t0k3n"))
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(tokens, []byte("bob:"+hex.EncodeToString(digest[:])+"\n"), 0600); err != nil {
+		t.Fatalf("error writing tokens: %v", err)
+	}
+
+	basic, err := NewBasicAuthenticator(users)
+	if err != nil {
+		t.Fatalf("error loading users: %v", err)
+	}
+	token, err := NewTokenAuthenticator(tokens)
+	if err != nil {
+		t.Fatalf("error loading tokens: %v", err)
+	}
+	return []Authenticator{basic, token, NewCertificateAuthenticator()}
+}
+
+func TestAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Authenticate(authenticators(t)...))
+	router.GET("/", func(c *gin.Context) {
+		user, ok := User(c)
+		if !ok {
+			user = "anonymous"
+		}
+		c.String(http.StatusOK, user)
+	})
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		status  int
+		user    string
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusOK, "anonymous"},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK, "alice"},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized, ""},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("mallory", "secret") }, http.StatusUnauthorized, ""},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") }, http.StatusOK, "bob"},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized, ""},
+		{"certificate", func(r *http.Request) {
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		}, http.StatusOK, "carol"},
+		{"unverified certificate", func(r *http.Request) {
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+		}, http.StatusOK, "anonymous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			test.prepare(request)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("unexpected status %d", recorder.Code)
+			}
+			if test.status == http.StatusOK && recorder.Body.String() != test.user {
+				t.Fatalf("unexpected user %q", recorder.Body.String())
+			}
+			if test.status == http.StatusUnauthorized {
+				challenge := recorder.Header().Get("WWW-Authenticate")
+				if !strings.Contains(challenge, "Basic") || !strings.Contains(challenge, "Bearer") {
+					t.Fatalf("unexpected challenge %q", challenge)
+				}
+			}
+		})
+	}
+}
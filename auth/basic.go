@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthenticator authenticates users through HTTP basic authentication,
+// against the bcrypt password hashes in a local user file.
+type BasicAuthenticator struct {
+	users map[string][]byte
+}
+
+// NewBasicAuthenticator returns an authenticator checking the passwords of
+// users against the given file; the file has one "user:hash" entry per line,
+// where hash is a bcrypt hash as produced by "htpasswd -B".
+func NewBasicAuthenticator(path string) (*BasicAuthenticator, error) {
+	entries, err := readEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte, len(entries))
+	for user, hash := range entries {
+		users[user] = []byte(hash)
+	}
+	return &BasicAuthenticator{users: users}, nil
+}
+
+// Authenticate returns the name of the user whose credentials are in the
+// Authorization header of the request.
+func (a *BasicAuthenticator) Authenticate(request *http.Request) (string, error) {
+	user, password, ok := request.BasicAuth()
+	if !ok {
+		return "", ErrorNoCredentials
+	}
+	hash, ok := a.users[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", ErrorInvalidCredentials
+	}
+	return user, nil
+}
+
+// Challenge returns the basic authentication challenge.
+func (a *BasicAuthenticator) Challenge() string {
+	return `Basic realm="builds"`
+}
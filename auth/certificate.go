@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// CertificateAuthenticator authenticates users through TLS client
+// certificates; the user name is the common name of the certificate subject.
+//
+// Certificates are verified by the TLS stack against the pool returned by
+// LoadCertificatePool, which must be set as the ClientCAs of the server TLS
+// configuration, with ClientAuth set to tls.VerifyClientCertIfGiven (so that
+// other authenticators remain usable).
+type CertificateAuthenticator struct{}
+
+// NewCertificateAuthenticator returns an authenticator identifying users
+// through their TLS client certificates.
+func NewCertificateAuthenticator() *CertificateAuthenticator {
+	return &CertificateAuthenticator{}
+}
+
+// Authenticate returns the common name of the verified client certificate
+// the request was sent with.
+func (a *CertificateAuthenticator) Authenticate(request *http.Request) (string, error) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return "", ErrorNoCredentials
+	}
+	user := request.TLS.VerifiedChains[0][0].Subject.CommonName
+	if user == "" {
+		return "", ErrorInvalidCredentials
+	}
+	return user, nil
+}
+
+// Challenge returns no challenge, as certificates are requested by the TLS
+// handshake.
+func (a *CertificateAuthenticator) Challenge() string {
+	return ""
+}
+
+// LoadCertificatePool returns the pool of the PEM-encoded certificate
+// authorities in the given file.
+func LoadCertificatePool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading certificate authorities from %q", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no valid certificate authorities in %q", path)
+	}
+	return pool, nil
+}
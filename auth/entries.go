@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readEntries reads a file of "user:value" entries, one per line; empty lines
+// and lines starting with '#' are ignored.
+func readEntries(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening %q", path)
+	}
+	defer file.Close()
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, value, ok := strings.Cut(text, ":")
+		if !ok || user == "" || value == "" {
+			return nil, errors.Errorf("invalid entry at %s:%d", path, line)
+		}
+		if _, ok := entries[user]; ok {
+			return nil, errors.Errorf("duplicate user %q at %s:%d", user, path, line)
+		}
+		entries[user] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading %q", path)
+	}
+	return entries, nil
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// TokenAuthenticator authenticates users through bearer tokens, against the
+// token hashes in a local token file.
+type TokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewTokenAuthenticator returns an authenticator checking bearer tokens
+// against the given file; the file has one "user:hash" entry per line, where
+// hash is the hex-encoded SHA-256 digest of the user token (as produced by
+// "printf %s $TOKEN | sha256sum"), so that the file holds no secrets.
+func NewTokenAuthenticator(path string) (*TokenAuthenticator, error) {
+	entries, err := readEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string, len(entries))
+	for user, hash := range entries {
+		tokens[strings.ToLower(hash)] = user
+	}
+	return &TokenAuthenticator{tokens: tokens}, nil
+}
+
+// Authenticate returns the name of the user owning the bearer token in the
+// Authorization header of the request.
+func (a *TokenAuthenticator) Authenticate(request *http.Request) (string, error) {
+	header := request.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", ErrorNoCredentials
+	}
+	digest := sha256.Sum256([]byte(strings.TrimSpace(header[7:])))
+	hash := hex.EncodeToString(digest[:])
+	for candidate, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(hash)) == 1 {
+			return user, nil
+		}
+	}
+	return "", ErrorInvalidCredentials
+}
+
+// Challenge returns the bearer token authentication challenge.
+func (a *TokenAuthenticator) Challenge() string {
+	return `Bearer realm="builds"`
+}
@@ -0,0 +1,239 @@
+// Package blobs stores the contents of artifacts on the local filesystem,
+// addressed by their SHA-256 digest: each blob is written once, under
+// <root>/sha256/<first two hex digits>/<hex digest>, and shared by all the
+// artifacts having the same digest. Uploads are staged under <root>/uploads
+// and only moved into place once their digest has been verified.
+package blobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/files"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrorNotFound is returned when a blob is not in the store.
+	ErrorNotFound = errors.New("blob not found")
+	// ErrorDigestMismatch is returned when uploaded contents do not match
+	// their declared digest.
+	ErrorDigestMismatch = errors.New("digest mismatch")
+	// ErrorTooLarge is returned when uploaded contents exceed the given
+	// limit.
+	ErrorTooLarge = errors.New("blob too large")
+	// ErrorSizeMismatch is returned when uploaded contents do not have
+	// their declared size.
+	ErrorSizeMismatch = errors.New("size mismatch")
+)
+
+// Store is a content-addressable store of blobs in a local directory.
+type Store struct {
+	root string
+}
+
+// New returns a store of blobs in the given directory, which is created if
+// it does not exist.
+func New(root string) (*Store, error) {
+	if exists, err := files.Exists(root); err != nil {
+		return nil, errors.Wrapf(err, "error accessing blob store %q", root)
+	} else if exists {
+		if dir, err := files.IsDir(root); err != nil || !dir {
+			return nil, errors.Errorf("invalid blob store %q: not a directory", root)
+		}
+	}
+	s := &Store{root: root}
+	for _, dir := range []string{s.blobs(), s.uploads()} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, errors.Wrapf(err, "error creating blob store %q", root)
+		}
+	}
+	return s, nil
+}
+
+// Stat returns the size of the blob having the given digest; if it is not in
+// the store, ErrorNotFound is returned.
+func (s *Store) Stat(digest string) (int64, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, errors.Wrapf(ErrorNotFound, "error reading blob %q", digest)
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "error reading blob %q", digest)
+	}
+	return info.Size(), nil
+}
+
+// Open opens the blob having the given digest for reading, and returns it
+// along with its file information; if it is not in the store, ErrorNotFound
+// is returned.
+func (s *Store) Open(digest string) (*os.File, os.FileInfo, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, errors.Wrapf(ErrorNotFound, "error reading blob %q", digest)
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error reading blob %q", digest)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, errors.Wrapf(err, "error reading blob %q", digest)
+	}
+	return file, info, nil
+}
+
+// Put stores the given contents as the blob having the given digest, and
+// returns their size. If the contents exceed limit bytes (unless it is
+// negative), ErrorTooLarge is returned; if they are not expected bytes long
+// (unless it is negative), ErrorSizeMismatch is, and if they do not match the
+// digest, ErrorDigestMismatch is; in all cases nothing is stored. Storing a
+// blob which is already in the store succeeds without modifying its contents,
+// but restarts its grace period, so that Collect does not remove it before
+// it is referenced.
+func (s *Store) Put(digest string, contents io.Reader, expected int64, limit int64) (int64, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return 0, err
+	}
+	upload, err := os.CreateTemp(s.uploads(), "upload-")
+	if err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	}
+	defer os.Remove(upload.Name())
+	defer upload.Close()
+
+	hash := sha256.New()
+	reader := contents
+	if bound := limit; bound >= 0 || expected >= 0 {
+		if bound < 0 || expected >= 0 && expected < bound {
+			bound = expected
+		}
+		// read one more byte than allowed, to tell whether there are more
+		reader = io.LimitReader(contents, bound+1)
+	}
+	size, err := io.Copy(io.MultiWriter(upload, hash), reader)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	}
+	if limit >= 0 && size > limit {
+		return 0, errors.Wrapf(ErrorTooLarge, "error storing blob %q: more than %d bytes", digest, limit)
+	}
+	if expected >= 0 && size != expected {
+		return 0, errors.Wrapf(ErrorSizeMismatch, "error storing blob %q: contents are not %d bytes long", digest, expected)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return 0, errors.Wrapf(ErrorDigestMismatch, "error storing blob %q: contents have digest %q", digest, actual)
+	}
+	if err := upload.Close(); err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	}
+
+	if exists, err := files.Exists(path); err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	} else if exists {
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			return 0, errors.Wrapf(err, "error storing blob %q", digest)
+		}
+		return size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	}
+	if err := os.Rename(upload.Name(), path); err != nil {
+		return 0, errors.Wrapf(err, "error storing blob %q", digest)
+	}
+	return size, nil
+}
+
+// Delete removes the blob having the given digest from the store; if it is
+// not in the store, ErrorNotFound is returned.
+func (s *Store) Delete(digest string) error {
+	path, err := s.path(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return errors.Wrapf(ErrorNotFound, "error deleting blob %q", digest)
+	} else if err != nil {
+		return errors.Wrapf(err, "error deleting blob %q", digest)
+	}
+	return nil
+}
+
+// Collect removes the blobs which are not referenced, according to the given
+// function, along with abandoned uploads; only the files older than the given
+// grace period are removed, so that the contents uploaded in the meantime are
+// not lost. It returns the number of blobs removed and the bytes freed.
+func (s *Store) Collect(referenced func(digest string) bool, grace time.Duration) (int, int64, error) {
+	removed, freed := 0, int64(0)
+	threshold := time.Now().Add(-grace)
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.ModTime().After(threshold) {
+			return err
+		}
+		if filepath.Dir(path) != s.uploads() {
+			digest := "sha256:" + filepath.Base(path)
+			if !valid(digest) || referenced(digest) {
+				return nil
+			}
+			removed++
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, errors.Wrapf(err, "error collecting blobs in %q", s.root)
+	}
+	return removed, freed, nil
+}
+
+// blobs returns the directory holding the blobs.
+func (s *Store) blobs() string {
+	return filepath.Join(s.root, "sha256")
+}
+
+// uploads returns the directory holding the uploads in progress.
+func (s *Store) uploads() string {
+	return filepath.Join(s.root, "uploads")
+}
+
+// path returns the path of the blob having the given digest; if the digest
+// is invalid, an error is returned.
+func (s *Store) path(digest string) (string, error) {
+	if !valid(digest) {
+		return "", errors.Errorf("invalid digest %q", digest)
+	}
+	digits := strings.TrimPrefix(digest, "sha256:")
+	return filepath.Join(s.blobs(), digits[:2], digits), nil
+}
+
+// valid returns whether the given digest is "sha256:" followed by 64
+// lowercase hexadecimal digits.
+func valid(digest string) bool {
+	digits := strings.TrimPrefix(digest, "sha256:")
+	if len(digits) != 64 || len(digest) != len(digits)+7 {
+		return false
+	}
+	for _, c := range digits {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package blobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// digest returns the digest of the given contents.
+func digest(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestStore(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "blobs")
+	store, err := New(root)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	if _, err := New(root); err != nil {
+		t.Fatalf("error reopening store: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := New(file); err == nil {
+		t.Fatalf("expected a file to be rejected as a store")
+	}
+
+	contents := "hello, world\n"
+	if size, err := store.Put(digest(contents), strings.NewReader(contents), -1, -1); err != nil || size != int64(len(contents)) {
+		t.Fatalf("error storing blob: %d (%v)", size, err)
+	}
+	if size, err := store.Put(digest(contents), strings.NewReader(contents), int64(len(contents)), int64(len(contents))); err != nil || size != int64(len(contents)) {
+		t.Fatalf("error storing blob again: %d (%v)", size, err)
+	}
+	if _, err := store.Put(digest("other"), strings.NewReader(contents), -1, -1); errors.Cause(err) != ErrorDigestMismatch {
+		t.Fatalf("expected ErrorDigestMismatch, got %v", err)
+	}
+	if _, err := store.Put(digest("large"), strings.NewReader("large"), -1, 4); errors.Cause(err) != ErrorTooLarge {
+		t.Fatalf("expected ErrorTooLarge, got %v", err)
+	}
+	for _, expected := range []int64{4, 6} {
+		if _, err := store.Put(digest("large"), strings.NewReader("large"), expected, -1); errors.Cause(err) != ErrorSizeMismatch {
+			t.Fatalf("expected ErrorSizeMismatch for %d bytes, got %v", expected, err)
+		}
+	}
+	if _, err := store.Stat(digest("large")); errors.Cause(err) != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+	if _, err := store.Put("md5:0123", strings.NewReader(contents), -1, -1); err == nil {
+		t.Fatalf("expected invalid digest to be rejected")
+	}
+	if _, err := store.Stat(digest("other")); errors.Cause(err) != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+
+	blob, info, err := store.Open(digest(contents))
+	if err != nil || info.Size() != int64(len(contents)) {
+		t.Fatalf("error opening blob: %v", err)
+	}
+	read, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(read) != contents {
+		t.Fatalf("unexpected contents: %q", read)
+	}
+
+	// storing a blob again restarts its grace period
+	path, _ := store.path(digest(contents))
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, past, past)
+	if _, err := store.Put(digest(contents), strings.NewReader(contents), -1, -1); err != nil {
+		t.Fatalf("error storing blob again: %v", err)
+	}
+	if removed, _, err := store.Collect(func(string) bool { return false }, time.Hour); err != nil || removed != 0 {
+		t.Fatalf("blob stored again collected: %d (%v)", removed, err)
+	}
+
+	if _, err := store.Put(digest("unreferenced"), strings.NewReader("unreferenced"), -1, -1); err != nil {
+		t.Fatalf("error storing blob: %v", err)
+	}
+	abandoned, _ := os.CreateTemp(store.uploads(), "upload-")
+	abandoned.WriteString("partial")
+	abandoned.Close()
+	referenced := func(d string) bool { return d == digest(contents) }
+	if removed, freed, err := store.Collect(referenced, time.Hour); err != nil || removed != 0 || freed != 0 {
+		t.Fatalf("recent blobs collected: %d, %d (%v)", removed, freed, err)
+	}
+	removed, freed, err := store.Collect(referenced, -time.Second)
+	if err != nil || removed != 1 || freed != int64(len("unreferenced")+len("partial")) {
+		t.Fatalf("unexpected collection: %d, %d (%v)", removed, freed, err)
+	}
+	if _, err := store.Stat(digest("unreferenced")); errors.Cause(err) != ErrorNotFound {
+		t.Fatalf("unreferenced blob not collected")
+	}
+	if _, err := store.Stat(digest(contents)); err != nil {
+		t.Fatalf("referenced blob collected: %v", err)
+	}
+
+	if err := store.Delete(digest(contents)); err != nil {
+		t.Fatalf("error deleting blob: %v", err)
+	}
+	if err := store.Delete(digest(contents)); errors.Cause(err) != ErrorNotFound {
+		t.Fatalf("expected ErrorNotFound, got %v", err)
+	}
+}
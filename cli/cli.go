@@ -0,0 +1,1187 @@
+// Package cli implements the command-line client of the builds service,
+// which drives a builds server through its REST API.
+package cli
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dihedron/builds/client"
+	"github.com/dihedron/builds/signing"
+	"github.com/pkg/errors"
+)
+
+// CLI runs commands against a builds server.
+type CLI struct {
+	client *client.Client
+	output string
+	out    io.Writer
+}
+
+// New returns a CLI issuing requests through the given client, and writing
+// its results to out either as a table or as JSON, according to output.
+func New(client *client.Client, output string, out io.Writer) (*CLI, error) {
+	if output != "table" && output != "json" {
+		return nil, errors.Errorf("unsupported output format %q (expected table or json)", output)
+	}
+	return &CLI{client: client, output: output, out: out}, nil
+}
+
+// command is a CLI subcommand, e.g. "products list".
+type command struct {
+	// args lists the names of the positional arguments of the command.
+	args []string
+	// flags declares the options of the command, if any.
+	flags func(flags *flag.FlagSet) func() interface{}
+	// run executes the command with the given positional arguments and the
+	// result of flags (if any).
+	run func(c *CLI, args []string, options interface{}) error
+}
+
+// commands maps the subcommands onto their implementation.
+var commands = map[string]command{
+	"products list":         {run: (*CLI).listProducts},
+	"products get":          {args: []string{"product"}, run: (*CLI).getProduct},
+	"products create":       {args: []string{"product"}, flags: productFlags, run: (*CLI).createProduct},
+	"products delete":       {args: []string{"product"}, run: (*CLI).deleteProduct},
+	"products storage":      {args: []string{"product"}, run: (*CLI).getStorage},
+	"versions list":         {args: []string{"product"}, flags: rangeFlags, run: (*CLI).listVersions},
+	"versions latest":       {args: []string{"product"}, flags: rangeFlags, run: (*CLI).getLatestVersion},
+	"versions get":          {args: []string{"product", "version"}, run: (*CLI).getVersion},
+	"versions create":       {args: []string{"product", "version"}, flags: versionFlags, run: (*CLI).createVersion},
+	"versions next":         {args: []string{"product", "bump"}, flags: bumpFlags, run: (*CLI).suggestVersion},
+	"versions allocate":     {args: []string{"product", "bump"}, flags: allocationFlags, run: (*CLI).allocateVersion},
+	"versions delete":       {args: []string{"product", "version"}, run: (*CLI).deleteVersion},
+	"builds list":           {args: []string{"product", "version"}, run: (*CLI).listBuilds},
+	"builds get":            {args: []string{"product", "version", "number"}, run: (*CLI).getBuild},
+	"builds create":         {args: []string{"product", "version", "number"}, flags: buildFlags, run: (*CLI).createBuild},
+	"builds finish":         {args: []string{"product", "version", "number", "status"}, flags: finishFlags, run: (*CLI).finishBuild},
+	"builds delete":         {args: []string{"product", "version", "number"}, run: (*CLI).deleteBuild},
+	"artifacts list":        {args: []string{"product", "version", "build"}, run: (*CLI).listArtifacts},
+	"artifacts create":      {args: []string{"product", "version", "build", "name", "digest"}, flags: artifactFlags, run: (*CLI).createArtifact},
+	"artifacts delete":      {args: []string{"product", "version", "build", "name"}, run: (*CLI).deleteArtifact},
+	"artifacts find":        {args: []string{"digest"}, run: (*CLI).findArtifact},
+	"artifacts upload":      {args: []string{"product", "version", "build", "name", "file"}, run: (*CLI).uploadArtifact},
+	"artifacts download":    {args: []string{"product", "version", "build", "name", "file"}, run: (*CLI).downloadArtifact},
+	"blobs gc":              {run: (*CLI).collectBlobs},
+	"deployments list":      {args: []string{"product", "version"}, run: (*CLI).listDeployments},
+	"deployments get":       {args: []string{"product", "version", "order"}, run: (*CLI).getDeployment},
+	"deployments create":    {args: []string{"product", "version", "order", "environment"}, run: (*CLI).createDeployment},
+	"deployments approve":   {args: []string{"product", "version", "order"}, run: (*CLI).approveDeployment},
+	"deployments reject":    {args: []string{"product", "version", "order", "reason"}, run: transition((*client.Client).RejectDeployment)},
+	"deployments fail":      {args: []string{"product", "version", "order", "reason"}, run: transition((*client.Client).FailDeployment)},
+	"deployments rollback":  {args: []string{"product", "version", "order", "reason"}, run: transition((*client.Client).RollbackDeployment)},
+	"deployments cancel":    {args: []string{"product", "version", "order", "reason"}, run: transition((*client.Client).CancelDeployment)},
+	"deployments delete":    {args: []string{"product", "version", "order"}, run: (*CLI).deleteDeployment},
+	"deployments artifacts": {args: []string{"product", "version", "order", "digests"}, run: (*CLI).setDeploymentArtifacts},
+	"policies list":         {args: []string{"product"}, run: (*CLI).listPolicies},
+	"policies set":          {args: []string{"product", "environment", "approvals"}, flags: policyFlags, run: (*CLI).setPolicy},
+	"policies delete":       {args: []string{"product", "environment"}, run: (*CLI).deletePolicy},
+	"pipeline get":          {args: []string{"product"}, run: (*CLI).getPipeline},
+	"pipeline set":          {args: []string{"product", "environments"}, run: (*CLI).setPipeline},
+	"pipeline delete":       {args: []string{"product"}, run: (*CLI).deletePipeline},
+	"webhooks list":         {args: []string{"product"}, run: (*CLI).listWebhooks},
+	"webhooks create":       {args: []string{"product", "url"}, flags: webhookFlags, run: (*CLI).createWebhook},
+	"webhooks delete":       {args: []string{"product", "id"}, run: (*CLI).deleteWebhook},
+	"webhooks deliveries":   {args: []string{"product", "id"}, run: (*CLI).listDeliveries},
+	"preferences get":       {run: (*CLI).getPreferences},
+	"preferences set":       {args: []string{"email"}, flags: preferenceFlags, run: (*CLI).setPreferences},
+	"preferences delete":    {run: (*CLI).deletePreferences},
+	"assignments list":      {run: (*CLI).listAssignments},
+	"assignments create":    {args: []string{"user", "role"}, flags: assignmentFlags, run: (*CLI).createAssignment},
+	"assignments delete":    {args: []string{"id"}, run: (*CLI).deleteAssignment},
+	"audit list":            {flags: auditFlags, run: (*CLI).listAudit},
+	"tokens get":            {args: []string{"product", "version", "order"}, run: (*CLI).getToken},
+	"tokens verify":         {args: []string{"token"}, flags: verifyFlags, run: (*CLI).verifyToken},
+	"keys list":             {run: (*CLI).listKeys},
+}
+
+// Usage returns the synopsis of all the supported commands.
+func Usage() string {
+	lines := make([]string, 0, len(commands))
+	for name, command := range commands {
+		line := name
+		if command.flags != nil {
+			line += " [options]"
+		}
+		for _, arg := range command.args {
+			line += " <" + arg + ">"
+		}
+		lines = append(lines, "  "+line)
+	}
+	sort.Strings(lines)
+	return "commands:\n" + strings.Join(lines, "\n")
+}
+
+// Run executes the command described by the given arguments, e.g.
+// "products list" or "deployments approve gaia 1.0.0 3".
+func (c *CLI) Run(args []string) error {
+	if len(args) < 2 {
+		return errors.New("missing command\n" + Usage())
+	}
+	name := args[0] + " " + args[1]
+	command, ok := commands[name]
+	if !ok {
+		return errors.Errorf("unknown command %q\n%s", name, Usage())
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.out)
+	var options func() interface{}
+	if command.flags != nil {
+		options = command.flags(flags)
+	}
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+	if flags.NArg() != len(command.args) {
+		return errors.Errorf("usage: %s <%s>", name, strings.Join(command.args, "> <"))
+	}
+	if options != nil {
+		return command.run(c, flags.Args(), options())
+	}
+	return command.run(c, flags.Args(), nil)
+}
+
+// productFlags declares the options of the "products create" command.
+func productFlags(flags *flag.FlagSet) func() interface{} {
+	product := &client.Product{}
+	flags.StringVar(&product.Name, "name", "", "the product name")
+	flags.StringVar(&product.Description, "description", "", "the product description")
+	flags.StringVar(&product.Contact, "contact", "", "the e-mail address of the product owner")
+	flags.StringVar(&product.Repository, "repository", "", "the URL of the product source repository")
+	flags.StringVar(&product.WebSite, "website", "", "the URL of the product web site")
+	flags.Int64Var(&product.Quota, "quota", 0, "the bytes of uploaded artifacts the product can store (default: the server quota)")
+	return func() interface{} { return product }
+}
+
+// versionFlags declares the options of the "versions create" command.
+func versionFlags(flags *flag.FlagSet) func() interface{} {
+	version := &client.Version{}
+	flags.StringVar(&version.Description, "description", "", "the version description")
+	flags.StringVar(&version.Repository, "repository", "", "the URL of the version source repository")
+	flags.StringVar(&version.Branch, "branch", "", "the version branch")
+	flags.StringVar(&version.Author, "author", "", "the version author, ignored by servers authenticating users (default: the authenticated user)")
+	return func() interface{} { return version }
+}
+
+// bumpOptions are the options of the "versions next" and "versions allocate"
+// commands.
+type bumpOptions struct {
+	identifier string
+	version    client.Version
+}
+
+// bumpFlags declares the options of the "versions next" command.
+func bumpFlags(flags *flag.FlagSet) func() interface{} {
+	options := &bumpOptions{}
+	flags.StringVar(&options.identifier, "preid", "", "the identifier of pre-releases (default: rc)")
+	return func() interface{} { return options }
+}
+
+// allocationFlags declares the options of the "versions allocate" command.
+func allocationFlags(flags *flag.FlagSet) func() interface{} {
+	options := &bumpOptions{}
+	flags.StringVar(&options.identifier, "preid", "", "the identifier of pre-releases (default: rc)")
+	flags.StringVar(&options.version.Description, "description", "", "the version description")
+	flags.StringVar(&options.version.Repository, "repository", "", "the URL of the version source repository")
+	flags.StringVar(&options.version.Branch, "branch", "", "the version branch (default: ver_X_Y_Z after the version code)")
+	flags.StringVar(&options.version.Author, "author", "", "the version author, ignored by servers authenticating users (default: the authenticated user)")
+	return func() interface{} { return options }
+}
+
+// buildFlags declares the options of the "builds create" command.
+func buildFlags(flags *flag.FlagSet) func() interface{} {
+	build := &client.Build{}
+	flags.StringVar(&build.Commit, "commit", "", "the SHA of the commit being built")
+	flags.StringVar(&build.Status, "status", "", "the build status: RUNNING, SUCCEEDED, FAILED or ABORTED (default: RUNNING)")
+	flags.StringVar(&build.JobURL, "job-url", "", "the URL of the CI job running the build")
+	return func() interface{} { return build }
+}
+
+// finishOptions are the options of the "builds finish" command.
+type finishOptions struct {
+	log string
+}
+
+// finishFlags declares the options of the "builds finish" command.
+func finishFlags(flags *flag.FlagSet) func() interface{} {
+	options := &finishOptions{}
+	flags.StringVar(&options.log, "log", "", "an excerpt of the build log, or @file to read it from a file")
+	return func() interface{} { return options }
+}
+
+// artifactFlags declares the options of the "artifacts create" command.
+func artifactFlags(flags *flag.FlagSet) func() interface{} {
+	artifact := &client.Artifact{}
+	flags.StringVar(&artifact.Type, "type", "", "the kind of artifact, e.g. jar, rpm or oci-image")
+	flags.Int64Var(&artifact.Size, "size", 0, "the size of the artifact in bytes (default: the size of the @file digest)")
+	flags.StringVar(&artifact.URI, "uri", "", "the URI of the artifact in its storage")
+	flags.StringVar(&artifact.Image, "image", "", "the OCI image reference of the artifact, if it is an image")
+	return func() interface{} { return artifact }
+}
+
+// policyFlags declares the options of the "policies set" command.
+func policyFlags(flags *flag.FlagSet) func() interface{} {
+	policy := &client.Policy{}
+	flags.BoolVar(&policy.ExcludeAuthor, "exclude-author", false, "prevent the version author from approving its deployments")
+	return func() interface{} { return policy }
+}
+
+// assignmentFlags declares the options of the "assignments create" command.
+func assignmentFlags(flags *flag.FlagSet) func() interface{} {
+	assignment := &client.Assignment{}
+	flags.StringVar(&assignment.Product, "product", "", "the product the role is restricted to (default: all)")
+	flags.StringVar(&assignment.Environment, "environment", "", "the environment the role is restricted to (default: all)")
+	return func() interface{} { return assignment }
+}
+
+func (c *CLI) listProducts(args []string, _ interface{}) error {
+	products, err := c.client.GetProducts()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(products))
+	for _, product := range products {
+		rows = append(rows, []string{strconv.FormatUint(uint64(product.ID), 10), product.Code})
+	}
+	return c.render(products, []string{"ID", "CODE"}, rows)
+}
+
+func (c *CLI) getProduct(args []string, _ interface{}) error {
+	product, err := c.client.GetProduct(args[0])
+	if err != nil {
+		return err
+	}
+	versions := make([]string, 0, len(product.Versions))
+	for _, version := range product.Versions {
+		versions = append(versions, version.Code)
+	}
+	return c.render(product, []string{"CODE", "NAME", "CONTACT", "WEBSITE", "VERSIONS"}, [][]string{
+		{product.Code, product.Name, product.Contact, product.WebSite, strings.Join(versions, ", ")},
+	})
+}
+
+func (c *CLI) createProduct(args []string, options interface{}) error {
+	request := options.(*client.Product)
+	request.Code = args[0]
+	if request.Name == "" {
+		request.Name = request.Code
+	}
+	product, err := c.client.CreateProduct(*request)
+	if err != nil {
+		return err
+	}
+	return c.render(product, []string{"ID", "CODE", "NAME"}, [][]string{
+		{strconv.FormatUint(uint64(product.ID), 10), product.Code, product.Name},
+	})
+}
+
+func (c *CLI) deleteProduct(args []string, _ interface{}) error {
+	if err := c.client.DeleteProduct(args[0]); err != nil {
+		return err
+	}
+	return c.done("product %q deleted", args[0])
+}
+
+// rangeOptions are the options of the "versions list" and "versions latest"
+// commands.
+type rangeOptions struct {
+	versions string
+	stable   bool
+}
+
+// rangeFlags declares the options of the "versions list" and "versions
+// latest" commands.
+func rangeFlags(flags *flag.FlagSet) func() interface{} {
+	options := &rangeOptions{}
+	flags.StringVar(&options.versions, "range", "", "only consider the versions in the given semantic version range, e.g. '>=1.0.0 <2.0.0'")
+	flags.BoolVar(&options.stable, "stable", false, "only consider releases, not pre-releases")
+	return func() interface{} { return options }
+}
+
+func (c *CLI) listVersions(args []string, options interface{}) error {
+	query := options.(*rangeOptions)
+	versions, err := c.client.FindVersions(args[0], query.versions, query.stable)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(versions))
+	for _, version := range versions {
+		deployments := make([]string, 0, len(version.Deployments))
+		for _, deployment := range version.Deployments {
+			deployments = append(deployments, deployment.Environment+":"+deployment.Status)
+		}
+		rows = append(rows, []string{version.Code, version.Branch, strings.Join(deployments, " ")})
+	}
+	return c.render(versions, []string{"CODE", "BRANCH", "DEPLOYMENTS"}, rows)
+}
+
+func (c *CLI) getVersion(args []string, _ interface{}) error {
+	version, err := c.client.GetVersion(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return c.render(version, []string{"CODE", "DESCRIPTION", "REPOSITORY", "BRANCH", "AUTHOR"}, [][]string{
+		{version.Code, version.Description, version.Repository, version.Branch, version.Author},
+	})
+}
+
+func (c *CLI) getLatestVersion(args []string, options interface{}) error {
+	query := options.(*rangeOptions)
+	version, err := c.client.GetLatestVersion(args[0], query.versions, query.stable)
+	if err != nil {
+		return err
+	}
+	return c.render(version, []string{"CODE", "DESCRIPTION", "REPOSITORY", "BRANCH", "AUTHOR"}, [][]string{
+		{version.Code, version.Description, version.Repository, version.Branch, version.Author},
+	})
+}
+
+func (c *CLI) createVersion(args []string, options interface{}) error {
+	request := options.(*client.Version)
+	request.Code = args[1]
+	version, err := c.client.CreateVersion(args[0], *request)
+	if err != nil {
+		return err
+	}
+	return c.render(version, []string{"ID", "CODE", "BRANCH"}, [][]string{
+		{strconv.FormatUint(uint64(version.ID), 10), version.Code, version.Branch},
+	})
+}
+
+func (c *CLI) suggestVersion(args []string, options interface{}) error {
+	bump := options.(*bumpOptions)
+	version, err := c.client.SuggestVersion(args[0], args[1], bump.identifier)
+	if err != nil {
+		return err
+	}
+	return c.render(version, []string{"CODE", "BRANCH"}, [][]string{{version.Code, version.Branch}})
+}
+
+func (c *CLI) allocateVersion(args []string, options interface{}) error {
+	bump := options.(*bumpOptions)
+	version, err := c.client.AllocateVersion(args[0], args[1], bump.identifier, bump.version)
+	if err != nil {
+		return err
+	}
+	return c.render(version, []string{"ID", "CODE", "BRANCH"}, [][]string{
+		{strconv.FormatUint(uint64(version.ID), 10), version.Code, version.Branch},
+	})
+}
+
+func (c *CLI) deleteVersion(args []string, _ interface{}) error {
+	if err := c.client.DeleteVersion(args[0], args[1]); err != nil {
+		return err
+	}
+	return c.done("version %q of product %q deleted", args[1], args[0])
+}
+
+func (c *CLI) listBuilds(args []string, _ interface{}) error {
+	builds, err := c.client.GetBuilds(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(builds))
+	for _, build := range builds {
+		rows = append(rows, buildRow(build))
+	}
+	return c.render(builds, buildHeaders, rows)
+}
+
+func (c *CLI) getBuild(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	build, err := c.client.GetBuild(args[0], args[1], number)
+	if err != nil {
+		return err
+	}
+	if err := c.render(build, buildHeaders, [][]string{buildRow(build)}); err != nil {
+		return err
+	}
+	if c.output == "table" && build.Log != "" {
+		_, err = fmt.Fprintf(c.out, "\n%s\n", strings.TrimRight(build.Log, "\n"))
+	}
+	return err
+}
+
+func (c *CLI) createBuild(args []string, options interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	request := options.(*client.Build)
+	request.Number = number
+	build, err := c.client.CreateBuild(args[0], args[1], *request)
+	if err != nil {
+		return err
+	}
+	return c.render(build, buildHeaders, [][]string{buildRow(build)})
+}
+
+func (c *CLI) finishBuild(args []string, options interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	log := options.(*finishOptions).log
+	if strings.HasPrefix(log, "@") {
+		data, err := os.ReadFile(log[1:])
+		if err != nil {
+			return errors.Wrapf(err, "error reading build log")
+		}
+		// only the end of the log fits in the excerpt
+		if len(data) > maxLog {
+			data = data[len(data)-maxLog:]
+		}
+		log = string(data)
+	}
+	build, err := c.client.FinishBuild(args[0], args[1], number, args[3], log)
+	if err != nil {
+		return err
+	}
+	return c.render(build, buildHeaders, [][]string{buildRow(build)})
+}
+
+func (c *CLI) deleteBuild(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	if err := c.client.DeleteBuild(args[0], args[1], number); err != nil {
+		return err
+	}
+	return c.done("build %d of version %q of product %q deleted", number, args[1], args[0])
+}
+
+func (c *CLI) listArtifacts(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	artifacts, err := c.client.GetArtifacts(args[0], args[1], number)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		rows = append(rows, artifactRow(artifact))
+	}
+	return c.render(artifacts, artifactHeaders, rows)
+}
+
+func (c *CLI) createArtifact(args []string, options interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	request := options.(*client.Artifact)
+	request.Name, request.Digest = args[3], args[4]
+	if strings.HasPrefix(request.Digest, "@") {
+		// digest the local copy of the artifact
+		file, err := os.Open(request.Digest[1:])
+		if err != nil {
+			return errors.Wrapf(err, "error reading artifact")
+		}
+		defer file.Close()
+		hash := sha256.New()
+		size, err := io.Copy(hash, file)
+		if err != nil {
+			return errors.Wrapf(err, "error reading artifact")
+		}
+		request.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		if request.Size == 0 {
+			request.Size = size
+		}
+	}
+	artifact, err := c.client.CreateArtifact(args[0], args[1], number, *request)
+	if err != nil {
+		return err
+	}
+	return c.render(artifact, artifactHeaders, [][]string{artifactRow(artifact)})
+}
+
+func (c *CLI) deleteArtifact(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	if err := c.client.DeleteArtifact(args[0], args[1], number, args[3]); err != nil {
+		return err
+	}
+	return c.done("artifact %q of build %d of version %q of product %q deleted", args[3], number, args[1], args[0])
+}
+
+func (c *CLI) uploadArtifact(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	file, err := os.Open(args[4])
+	if err != nil {
+		return errors.Wrapf(err, "error reading artifact")
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "error reading artifact")
+	}
+	blob, err := c.client.UploadArtifact(args[0], args[1], number, args[3], file, info.Size())
+	if err != nil {
+		return err
+	}
+	return c.render(blob, []string{"DIGEST", "SIZE"}, [][]string{{blob.Digest, strconv.FormatInt(blob.Size, 10)}})
+}
+
+func (c *CLI) downloadArtifact(args []string, _ interface{}) error {
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid build number %q", args[2])
+	}
+	if args[4] == "-" {
+		_, err := c.client.DownloadArtifact(args[0], args[1], number, args[3], os.Stdout)
+		return err
+	}
+	// downloads go to a temporary file, renamed once complete
+	file, err := os.CreateTemp(filepath.Dir(args[4]), filepath.Base(args[4])+".*")
+	if err != nil {
+		return errors.Wrapf(err, "error writing artifact")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size, err := c.client.DownloadArtifact(args[0], args[1], number, args[3], file)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "error writing artifact")
+	}
+	if err := os.Rename(file.Name(), args[4]); err != nil {
+		return errors.Wrapf(err, "error writing artifact")
+	}
+	return c.done("artifact %q downloaded to %s (%d bytes)", args[3], args[4], size)
+}
+
+func (c *CLI) findArtifact(args []string, _ interface{}) error {
+	artifacts, deployments, err := c.client.FindArtifact(args[0])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(artifacts)+len(deployments))
+	for _, artifact := range artifacts {
+		rows = append(rows, []string{artifact.Product, artifact.Version, strconv.Itoa(artifact.Build), artifact.Name, "", "", ""})
+	}
+	for _, deployment := range deployments {
+		rows = append(rows, []string{deployment.Product, deployment.Version, "", "", strconv.Itoa(deployment.Order), deployment.Environment, deployment.Status})
+	}
+	result := map[string]interface{}{"artifacts": artifacts, "deployments": deployments}
+	return c.render(result, []string{"PRODUCT", "VERSION", "BUILD", "ARTIFACT", "DEPLOYMENT", "ENVIRONMENT", "STATUS"}, rows)
+}
+
+func (c *CLI) getStorage(args []string, _ interface{}) error {
+	storage, err := c.client.GetStorage(args[0])
+	if err != nil {
+		return err
+	}
+	quota := "-"
+	if storage.Quota > 0 {
+		quota = strconv.FormatInt(storage.Quota, 10)
+	}
+	return c.render(storage, []string{"QUOTA", "USED", "BLOBS"}, [][]string{{quota, strconv.FormatInt(storage.Used, 10), strconv.Itoa(storage.Blobs)}})
+}
+
+func (c *CLI) collectBlobs(_ []string, _ interface{}) error {
+	removed, freed, err := c.client.CollectBlobs()
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.render(map[string]interface{}{"removed": removed, "freed": freed}, nil, nil)
+	}
+	return c.done("%d blobs removed, %d bytes freed", removed, freed)
+}
+
+func (c *CLI) listDeployments(args []string, _ interface{}) error {
+	deployments, err := c.client.GetDeployments(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(deployments))
+	for _, deployment := range deployments {
+		rows = append(rows, deploymentRow(deployment))
+	}
+	return c.render(deployments, deploymentHeaders, rows)
+}
+
+func (c *CLI) getDeployment(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	deployment, err := c.client.GetDeployment(args[0], args[1], order)
+	if err != nil {
+		return err
+	}
+	return c.renderDeployment(deployment)
+}
+
+func (c *CLI) createDeployment(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	deployment, err := c.client.CreateDeployment(args[0], args[1], client.Deployment{Order: order, Environment: args[3]})
+	if err != nil {
+		return err
+	}
+	return c.render(deployment, deploymentHeaders, [][]string{deploymentRow(deployment)})
+}
+
+func (c *CLI) approveDeployment(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	deployment, err := c.client.ApproveDeployment(args[0], args[1], order)
+	if err != nil {
+		return err
+	}
+	return c.render(deployment, deploymentHeaders, [][]string{deploymentRow(deployment)})
+}
+
+// transition returns the implementation of a command changing the status of
+// a deployment through the given client method.
+func transition(change func(*client.Client, string, string, int, string) (client.Deployment, error)) func(c *CLI, args []string, _ interface{}) error {
+	return func(c *CLI, args []string, _ interface{}) error {
+		order, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errors.Errorf("invalid deployment order %q", args[2])
+		}
+		deployment, err := change(c.client, args[0], args[1], order, args[3])
+		if err != nil {
+			return err
+		}
+		return c.render(deployment, deploymentHeaders, [][]string{deploymentRow(deployment)})
+	}
+}
+
+func (c *CLI) setDeploymentArtifacts(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	var digests []string
+	if args[3] != "" {
+		digests = strings.Split(args[3], ",")
+	}
+	deployment, err := c.client.SetDeploymentArtifacts(args[0], args[1], order, digests)
+	if err != nil {
+		return err
+	}
+	return c.renderDeployment(deployment)
+}
+
+func (c *CLI) deleteDeployment(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	if err := c.client.DeleteDeployment(args[0], args[1], order); err != nil {
+		return err
+	}
+	return c.done("deployment %d of version %q of product %q deleted", order, args[1], args[0])
+}
+
+func (c *CLI) listPolicies(args []string, _ interface{}) error {
+	policies, err := c.client.GetPolicies(args[0])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(policies))
+	for _, policy := range policies {
+		rows = append(rows, policyRow(policy))
+	}
+	return c.render(policies, policyHeaders, rows)
+}
+
+func (c *CLI) setPolicy(args []string, options interface{}) error {
+	request := options.(*client.Policy)
+	request.Environment = args[1]
+	approvals, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid number of approvals %q", args[2])
+	}
+	request.Approvals = approvals
+	policy, err := c.client.SetPolicy(args[0], *request)
+	if err != nil {
+		return err
+	}
+	return c.render(policy, policyHeaders, [][]string{policyRow(policy)})
+}
+
+func (c *CLI) deletePolicy(args []string, _ interface{}) error {
+	if err := c.client.DeletePolicy(args[0], args[1]); err != nil {
+		return err
+	}
+	return c.done("policy of product %q for environment %q deleted", args[0], args[1])
+}
+
+// policyHeaders are the column headers of approval policy tables.
+var policyHeaders = []string{"ENVIRONMENT", "APPROVALS", "EXCLUDE AUTHOR"}
+
+// policyRow returns the cells of an approval policy in a policy table.
+func policyRow(policy client.Policy) []string {
+	return []string{policy.Environment, strconv.Itoa(policy.Approvals), strconv.FormatBool(policy.ExcludeAuthor)}
+}
+
+func (c *CLI) getPipeline(args []string, _ interface{}) error {
+	stages, err := c.client.GetPipeline(args[0])
+	if err != nil {
+		return err
+	}
+	return c.renderPipeline(stages)
+}
+
+func (c *CLI) setPipeline(args []string, _ interface{}) error {
+	stages, err := c.client.SetPipeline(args[0], strings.Split(args[1], ","))
+	if err != nil {
+		return err
+	}
+	return c.renderPipeline(stages)
+}
+
+func (c *CLI) deletePipeline(args []string, _ interface{}) error {
+	if err := c.client.DeletePipeline(args[0]); err != nil {
+		return err
+	}
+	return c.done("pipeline of product %q deleted", args[0])
+}
+
+func (c *CLI) listWebhooks(args []string, _ interface{}) error {
+	webhooks, err := c.client.GetWebhooks(args[0])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		rows = append(rows, webhookRow(webhook))
+	}
+	return c.render(webhooks, webhookHeaders, rows)
+}
+
+// webhookOptions are the options of the "webhooks create" command.
+type webhookOptions struct {
+	events   string
+	secret   string
+	inactive bool
+}
+
+// webhookFlags declares the options of the "webhooks create" command.
+func webhookFlags(flags *flag.FlagSet) func() interface{} {
+	options := &webhookOptions{}
+	flags.StringVar(&options.events, "events", "", "the comma-separated patterns of the events to deliver, e.g. version.created,deployment.* (default: all)")
+	flags.StringVar(&options.secret, "secret", "", "the secret deliveries are signed with (default: generated by the server)")
+	flags.BoolVar(&options.inactive, "inactive", false, "create the webhook without activating it")
+	return func() interface{} { return options }
+}
+
+func (c *CLI) createWebhook(args []string, options interface{}) error {
+	request := options.(*webhookOptions)
+	webhook := client.Webhook{URL: args[1], Secret: request.secret, Active: !request.inactive}
+	if request.events != "" {
+		webhook.Events = strings.Split(request.events, ",")
+	}
+	webhook, err := c.client.CreateWebhook(args[0], webhook)
+	if err != nil {
+		return err
+	}
+	return c.render(webhook, append(webhookHeaders, "SECRET"), [][]string{append(webhookRow(webhook), webhook.Secret)})
+}
+
+func (c *CLI) deleteWebhook(args []string, _ interface{}) error {
+	id, err := strconv.ParseUint(args[1], 10, 0)
+	if err != nil {
+		return errors.Errorf("invalid webhook id %q", args[1])
+	}
+	if err := c.client.DeleteWebhook(args[0], uint(id)); err != nil {
+		return err
+	}
+	return c.done("webhook %d deleted", id)
+}
+
+func (c *CLI) listDeliveries(args []string, _ interface{}) error {
+	id, err := strconv.ParseUint(args[1], 10, 0)
+	if err != nil {
+		return errors.Errorf("invalid webhook id %q", args[1])
+	}
+	deliveries, err := c.client.GetDeliveries(args[0], uint(id))
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result := delivery.Error
+		if result == "" {
+			result = strconv.Itoa(delivery.StatusCode)
+		}
+		rows = append(rows, []string{delivery.Timestamp.Local().Format(time.RFC3339), strconv.FormatUint(uint64(delivery.EventID), 10), delivery.Event, strconv.Itoa(delivery.Attempt), result})
+	}
+	return c.render(deliveries, []string{"TIMESTAMP", "EVENT ID", "EVENT", "ATTEMPT", "RESULT"}, rows)
+}
+
+// webhookHeaders are the column headers of webhook tables.
+var webhookHeaders = []string{"ID", "URL", "EVENTS", "ACTIVE"}
+
+// webhookRow returns the cells of a webhook in a webhook table.
+func webhookRow(webhook client.Webhook) []string {
+	events := strings.Join(webhook.Events, ",")
+	if events == "" {
+		events = "*"
+	}
+	return []string{strconv.FormatUint(uint64(webhook.ID), 10), webhook.URL, events, strconv.FormatBool(webhook.Active)}
+}
+
+func (c *CLI) getPreferences(_ []string, _ interface{}) error {
+	preference, err := c.client.GetPreferences()
+	if err != nil {
+		return err
+	}
+	return c.render(preference, preferenceHeaders, [][]string{preferenceRow(preference)})
+}
+
+// preferenceOptions are the options of the "preferences set" command.
+type preferenceOptions struct {
+	products string
+	events   string
+}
+
+// preferenceFlags declares the options of the "preferences set" command.
+func preferenceFlags(flags *flag.FlagSet) func() interface{} {
+	options := &preferenceOptions{}
+	flags.StringVar(&options.products, "products", "", "the comma-separated patterns of the products to be notified about (default: all)")
+	flags.StringVar(&options.events, "events", "deployment.*", "the comma-separated patterns of the events to be notified of, or none")
+	return func() interface{} { return options }
+}
+
+func (c *CLI) setPreferences(args []string, options interface{}) error {
+	request := options.(*preferenceOptions)
+	preference := client.Preference{Email: args[0]}
+	if request.products != "" {
+		preference.Products = strings.Split(request.products, ",")
+	}
+	if request.events != "" && request.events != "none" {
+		preference.Events = strings.Split(request.events, ",")
+	}
+	preference, err := c.client.SetPreferences(preference)
+	if err != nil {
+		return err
+	}
+	return c.render(preference, preferenceHeaders, [][]string{preferenceRow(preference)})
+}
+
+func (c *CLI) deletePreferences(_ []string, _ interface{}) error {
+	if err := c.client.DeletePreferences(); err != nil {
+		return err
+	}
+	return c.done("notification preferences deleted")
+}
+
+// preferenceHeaders are the column headers of notification preference tables.
+var preferenceHeaders = []string{"USER", "EMAIL", "PRODUCTS", "EVENTS"}
+
+// preferenceRow returns the cells of notification preferences in a table.
+func preferenceRow(preference client.Preference) []string {
+	products := strings.Join(preference.Products, ",")
+	if products == "" {
+		products = "*"
+	}
+	events := strings.Join(preference.Events, ",")
+	if events == "" {
+		events = "none"
+	}
+	return []string{preference.User, preference.Email, products, events}
+}
+
+// auditOptions are the options of the "audit list" command.
+type auditOptions struct {
+	product string
+	user    string
+	from    string
+	to      string
+}
+
+// auditFlags declares the options of the "audit list" command.
+func auditFlags(flags *flag.FlagSet) func() interface{} {
+	options := &auditOptions{}
+	flags.StringVar(&options.product, "product", "", "only list the changes to the given product")
+	flags.StringVar(&options.user, "user", "", "only list the changes made by the given user")
+	flags.StringVar(&options.from, "from", "", "only list the changes made since the given RFC 3339 time")
+	flags.StringVar(&options.to, "to", "", "only list the changes made until the given RFC 3339 time")
+	return func() interface{} { return options }
+}
+
+// renderPipeline outputs the stages of a promotion pipeline.
+func (c *CLI) renderPipeline(stages []client.Stage) error {
+	rows := make([][]string, 0, len(stages))
+	for _, stage := range stages {
+		rows = append(rows, []string{strconv.Itoa(stage.Stage), stage.Environment})
+	}
+	return c.render(stages, []string{"STAGE", "ENVIRONMENT"}, rows)
+}
+
+func (c *CLI) listAssignments(args []string, _ interface{}) error {
+	assignments, err := c.client.GetAssignments()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(assignments))
+	for _, assignment := range assignments {
+		rows = append(rows, assignmentRow(assignment))
+	}
+	return c.render(assignments, assignmentHeaders, rows)
+}
+
+func (c *CLI) createAssignment(args []string, options interface{}) error {
+	request := options.(*client.Assignment)
+	request.User = args[0]
+	request.Role = strings.ToUpper(args[1])
+	assignment, err := c.client.CreateAssignment(*request)
+	if err != nil {
+		return err
+	}
+	return c.render(assignment, assignmentHeaders, [][]string{assignmentRow(assignment)})
+}
+
+func (c *CLI) deleteAssignment(args []string, _ interface{}) error {
+	id, err := strconv.ParseUint(args[0], 10, 0)
+	if err != nil {
+		return errors.Errorf("invalid role assignment id %q", args[0])
+	}
+	if err := c.client.DeleteAssignment(uint(id)); err != nil {
+		return err
+	}
+	return c.done("role assignment %d deleted", id)
+}
+
+func (c *CLI) listAudit(args []string, options interface{}) error {
+	request := options.(*auditOptions)
+	query := client.AuditQuery{Product: request.product, User: request.user}
+	for _, bound := range []struct {
+		value string
+		time  *time.Time
+	}{{request.from, &query.From}, {request.to, &query.To}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return errors.Errorf("invalid time %q (expected RFC 3339, e.g. 2006-01-02T15:04:05Z)", bound.value)
+		}
+		*bound.time = t
+	}
+	records, err := c.client.GetAudit(query)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, []string{strconv.FormatUint(uint64(record.ID), 10), record.Timestamp.Local().Format(time.RFC3339), record.User, record.Action, record.Entity, record.Key})
+	}
+	return c.render(records, []string{"ID", "TIMESTAMP", "USER", "ACTION", "ENTITY", "KEY"}, rows)
+}
+
+func (c *CLI) getToken(args []string, _ interface{}) error {
+	order, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Errorf("invalid deployment order %q", args[2])
+	}
+	token, err := c.client.GetDeploymentToken(args[0], args[1], order)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.render(map[string]string{"token": token}, nil, nil)
+	}
+	// the bare token, so that it can be stored as it is
+	_, err = fmt.Fprintln(c.out, token)
+	return err
+}
+
+// verifyOptions are the options of the "tokens verify" command.
+type verifyOptions struct {
+	keys        string
+	product     string
+	version     string
+	environment string
+}
+
+// verifyFlags declares the options of the "tokens verify" command.
+func verifyFlags(flags *flag.FlagSet) func() interface{} {
+	options := &verifyOptions{}
+	flags.StringVar(&options.keys, "keys", "", "the file of PEM-encoded public keys to verify the token against, instead of those published by the server")
+	flags.StringVar(&options.product, "product", "", "the product the token must grant")
+	flags.StringVar(&options.version, "version", "", "the version the token must grant")
+	flags.StringVar(&options.environment, "environment", "", "the environment the token must grant")
+	return func() interface{} { return options }
+}
+
+func (c *CLI) verifyToken(args []string, options interface{}) error {
+	request := options.(*verifyOptions)
+	var keys []ed25519.PublicKey
+	var err error
+	if request.keys != "" {
+		keys, err = signing.LoadPublicKeys(request.keys)
+	} else {
+		keys, err = c.client.GetKeys()
+	}
+	if err != nil {
+		return err
+	}
+	claims, err := signing.Verify(args[0], keys)
+	if err != nil {
+		return err
+	}
+	if err := claims.Check(request.product, request.version, request.environment); err != nil {
+		return err
+	}
+	row := []string{claims.Product, claims.Version, strconv.Itoa(claims.Order), claims.Environment, strings.Join(claims.Approvers, ", "), claims.GrantedBy, claims.Granted.Local().Format(time.RFC3339), claims.Expires.Local().Format(time.RFC3339)}
+	return c.render(claims, []string{"PRODUCT", "VERSION", "ORDER", "ENVIRONMENT", "APPROVED BY", "GRANTED BY", "GRANTED", "EXPIRES"}, [][]string{row})
+}
+
+func (c *CLI) listKeys(args []string, _ interface{}) error {
+	keys, err := c.client.GetKeys()
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		jwks := make([]signing.JWK, 0, len(keys))
+		for _, key := range keys {
+			jwks = append(jwks, signing.NewJWK(key))
+		}
+		return c.render(jwks, nil, nil)
+	}
+	// PEM blocks, so that the output can be handed to "tokens verify -keys"
+	for _, key := range keys {
+		if _, err := c.out.Write(signing.EncodePublicKey(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignmentHeaders are the column headers of role assignment tables.
+var assignmentHeaders = []string{"ID", "USER", "ROLE", "PRODUCT", "ENVIRONMENT"}
+
+// assignmentRow returns the cells of a role assignment in a role assignment
+// table.
+func assignmentRow(assignment client.Assignment) []string {
+	product, environment := assignment.Product, assignment.Environment
+	if product == "" {
+		product = "*"
+	}
+	if environment == "" {
+		environment = "*"
+	}
+	return []string{strconv.FormatUint(uint64(assignment.ID), 10), assignment.User, assignment.Role, product, environment}
+}
+
+// maxLog is the maximum length of the build log excerpts the server accepts.
+const maxLog = 4096
+
+// buildHeaders are the headers of build tables.
+var buildHeaders = []string{"NUMBER", "STATUS", "COMMIT", "STARTED", "FINISHED", "JOB"}
+
+// buildRow returns the cells of a build in a build table.
+func buildRow(build client.Build) []string {
+	started, finished := "", ""
+	if build.Started != nil {
+		started = build.Started.Local().Format(time.RFC3339)
+	}
+	if build.Finished != nil {
+		finished = build.Finished.Local().Format(time.RFC3339)
+	}
+	return []string{strconv.Itoa(build.Number), build.Status, build.Commit, started, finished, build.JobURL}
+}
+
+// artifactHeaders are the headers of artifact tables.
+var artifactHeaders = []string{"NAME", "TYPE", "SIZE", "DIGEST", "LOCATION"}
+
+// artifactRow returns the cells of an artifact in an artifact table; its
+// location is its image reference, if any, or its URI.
+func artifactRow(artifact client.Artifact) []string {
+	location := artifact.Image
+	if location == "" {
+		location = artifact.URI
+	}
+	return []string{artifact.Name, artifact.Type, strconv.FormatInt(artifact.Size, 10), artifact.Digest, location}
+}
+
+// deploymentHeaders are the column headers of deployment tables.
+var deploymentHeaders = []string{"ORDER", "ENVIRONMENT", "STATUS", "APPROVED BY", "GRANTED BY", "TIMESTAMP"}
+
+// deploymentRow returns the cells of a deployment in a deployment table.
+func deploymentRow(deployment client.Deployment) []string {
+	timestamp := ""
+	if !deployment.Timestamp.IsZero() {
+		timestamp = deployment.Timestamp.Local().Format(time.RFC3339)
+	}
+	approvers := make([]string, 0, len(deployment.Approvals))
+	for _, approval := range deployment.Approvals {
+		approvers = append(approvers, approval.User)
+	}
+	return []string{strconv.Itoa(deployment.Order), deployment.Environment, deployment.Status, strings.Join(approvers, ", "), deployment.GrantedBy, timestamp}
+}
+
+// renderDeployment writes a deployment as render does, followed in table
+// mode by the digests of the artifacts it deployed, if any.
+func (c *CLI) renderDeployment(deployment client.Deployment) error {
+	if err := c.render(deployment, deploymentHeaders, [][]string{deploymentRow(deployment)}); err != nil {
+		return err
+	}
+	if c.output == "table" && len(deployment.Artifacts) > 0 {
+		fmt.Fprintln(c.out, "\nARTIFACTS")
+		for _, artifact := range deployment.Artifacts {
+			fmt.Fprintln(c.out, artifact.Digest)
+		}
+	}
+	return nil
+}
+
+// render writes the given value either as JSON or as a table having the
+// given headers and rows, according to the output format.
+func (c *CLI) render(value interface{}, headers []string, rows [][]string) error {
+	if c.output == "json" {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	writer := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// done reports the successful completion of a command having no output; in
+// JSON mode nothing is written.
+func (c *CLI) done(format string, args ...interface{}) error {
+	if c.output == "table" {
+		fmt.Fprintf(c.out, format+"\n", args...)
+	}
+	return nil
+}
@@ -0,0 +1,1043 @@
+// Package client implements a client of the builds REST API; it has no
+// dependency on the server-side model, so that it can be embedded in small,
+// self-contained tools such as the Concourse resource.
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/signing"
+	"github.com/pkg/errors"
+)
+
+// Product is the client-side representation of a product.
+type Product struct {
+	ID          uint      `json:"id,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Contact     string    `json:"contact,omitempty"`
+	Repository  string    `json:"repository,omitempty"`
+	WebSite     string    `json:"website,omitempty"`
+	Quota       int64     `json:"quota,omitempty"`
+	Versions    []Version `json:"versions,omitempty"`
+}
+
+// Version is the client-side representation of a product version.
+type Version struct {
+	ID          uint         `json:"id,omitempty"`
+	Code        string       `json:"code,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Repository  string       `json:"repository,omitempty"`
+	Branch      string       `json:"branch,omitempty"`
+	Author      string       `json:"author,omitempty"`
+	Deployments []Deployment `json:"deployments,omitempty"`
+}
+
+// Build is the client-side representation of a build of a version; Started
+// defaults to the time the build is registered.
+type Build struct {
+	Number   int        `json:"number"`
+	Commit   string     `json:"commit,omitempty"`
+	Status   string     `json:"status,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	JobURL   string     `json:"jobUrl,omitempty"`
+	Log      string     `json:"log,omitempty"`
+}
+
+// Artifact is the client-side representation of an artifact produced by a
+// build, identified by the SHA-256 digest of its contents ("sha256:<hex>").
+type Artifact struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+	URI    string `json:"uri,omitempty"`
+	Image  string `json:"image,omitempty"`
+}
+
+// Blob is the client-side representation of the stored contents of an
+// artifact.
+type Blob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// Storage is the client-side representation of the storage used by the
+// artifacts of a product; a Quota of 0 means that it is not limited.
+type Storage struct {
+	Quota int64 `json:"quota"`
+	Used  int64 `json:"used"`
+	Blobs int   `json:"blobs"`
+}
+
+// ArtifactMatch is an artifact found by its digest, along with the product,
+// version and build it belongs to.
+type ArtifactMatch struct {
+	Product string `json:"product"`
+	Version string `json:"version"`
+	Build   int    `json:"build"`
+	Artifact
+}
+
+// DeploymentMatch is a deployment found by the digest of one of the artifacts
+// it deployed, along with the product and version it belongs to.
+type DeploymentMatch struct {
+	Product     string    `json:"product"`
+	Version     string    `json:"version"`
+	Order       int       `json:"order"`
+	Environment string    `json:"environment,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Timestamp   time.Time `json:"timestamp,omitempty"`
+}
+
+// Deployment is the client-side representation of a deployment.
+type Deployment struct {
+	Order       int                `json:"order"`
+	Environment string             `json:"environment,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	GrantedBy   string             `json:"grantedBy,omitempty"`
+	Timestamp   time.Time          `json:"timestamp,omitempty"`
+	Approvals   []Approval         `json:"approvals,omitempty"`
+	Transitions []Transition       `json:"transitions,omitempty"`
+	Artifacts   []DeployedArtifact `json:"artifacts,omitempty"`
+}
+
+// DeployedArtifact is the client-side representation of an artifact deployed
+// by a deployment.
+type DeployedArtifact struct {
+	Digest string `json:"digest"`
+}
+
+// Approval is the client-side representation of the approval of a
+// deployment.
+type Approval struct {
+	User      string    `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Transition is the client-side representation of a change of the status of
+// a deployment.
+type Transition struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	User      string    `json:"user,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Policy is the client-side representation of an approval policy; the
+// environment "*" stands for all environments having no policy of their own.
+type Policy struct {
+	Environment   string `json:"environment,omitempty"`
+	Approvals     int    `json:"approvals"`
+	ExcludeAuthor bool   `json:"excludeAuthor"`
+}
+
+// Stage is the client-side representation of a stage of the promotion
+// pipeline of a product.
+type Stage struct {
+	Stage       int    `json:"stage"`
+	Environment string `json:"environment"`
+}
+
+// Webhook is the client-side representation of a webhook subscribed to the
+// events of a product; the Secret its deliveries are signed with is only
+// returned when the webhook is created.
+type Webhook struct {
+	ID     uint     `json:"id,omitempty"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Active bool     `json:"active"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// Delivery is the client-side representation of an attempt to deliver an
+// event to a webhook.
+type Delivery struct {
+	EventID    uint      `json:"eventId"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Preference is the client-side representation of the notification
+// preferences of the user: the patterns of the codes of the products (all of
+// them, if empty) and of the types of the events (none of them, if empty) to
+// be notified of at Email.
+type Preference struct {
+	User     string   `json:"user,omitempty"`
+	Email    string   `json:"email"`
+	Products []string `json:"products,omitempty"`
+	Events   []string `json:"events,omitempty"`
+}
+
+// Assignment is the client-side representation of a role assignment; an
+// empty product or environment stands for all products or environments.
+type Assignment struct {
+	ID          uint   `json:"id,omitempty"`
+	User        string `json:"user,omitempty"`
+	Product     string `json:"product,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Role        string `json:"role,omitempty"`
+}
+
+// AuditRecord is the client-side representation of an audit record; Before
+// and After hold the JSON representations of the entity before and after the
+// change, and Previous is the Hash of the previous record.
+type AuditRecord struct {
+	ID        uint            `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	User      string          `json:"user,omitempty"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	Product   string          `json:"product,omitempty"`
+	Key       string          `json:"key"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Previous  string          `json:"previous,omitempty"`
+	Hash      string          `json:"hash"`
+}
+
+// AuditQuery selects the audit records about a product, by a user and
+// between two points in time; empty fields select all records.
+type AuditQuery struct {
+	Product string
+	User    string
+	From    time.Time
+	To      time.Time
+}
+
+// Error is returned when the server responds with an error status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+// Error returns the status code and the message returned by the server.
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("server returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound returns whether the given error was caused by the server
+// reporting that the requested item does not exist.
+func IsNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Client is a client of the builds REST API.
+type Client struct {
+	url           string
+	http          *http.Client
+	authorization string
+}
+
+// New returns a client of the builds server at the given base URL, e.g.
+// "http://builds.example.com:9080".
+func New(url string) *Client {
+	return &Client{
+		url:  strings.TrimRight(url, "/"),
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SetBasicAuth makes the client authenticate with the given user name and
+// password.
+func (c *Client) SetBasicAuth(user string, password string) {
+	c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// SetBearerToken makes the client authenticate with the given bearer token.
+func (c *Client) SetBearerToken(token string) {
+	c.authorization = "Bearer " + token
+}
+
+// SetTLSConfig makes the client use the given TLS configuration, e.g. to
+// authenticate with a client certificate or to trust a private certificate
+// authority.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.http.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+}
+
+// GetProducts returns the list of all products.
+func (c *Client) GetProducts() ([]Product, error) {
+	var response struct {
+		Products []Product `json:"products"`
+	}
+	if err := c.do(http.MethodGet, path("products"), nil, &response); err != nil {
+		return nil, errors.Wrap(err, "error listing products")
+	}
+	return response.Products, nil
+}
+
+// GetProduct returns the product with the given code.
+func (c *Client) GetProduct(product string) (Product, error) {
+	var response struct {
+		Product Product `json:"product"`
+	}
+	if err := c.do(http.MethodGet, path("products", product), nil, &response); err != nil {
+		return Product{}, errors.Wrapf(err, "error reading product %q", product)
+	}
+	return response.Product, nil
+}
+
+// CreateProduct registers a new product.
+func (c *Client) CreateProduct(product Product) (Product, error) {
+	var response struct {
+		Product Product `json:"product"`
+	}
+	if err := c.do(http.MethodPost, path("products"), product, &response); err != nil {
+		return Product{}, errors.Wrapf(err, "error creating product %q", product.Code)
+	}
+	return response.Product, nil
+}
+
+// DeleteProduct deletes a product, along with all its versions.
+func (c *Client) DeleteProduct(product string) error {
+	if err := c.do(http.MethodDelete, path("products", product), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting product %q", product)
+	}
+	return nil
+}
+
+// GetVersions returns the versions of the given product, along with their
+// deployments.
+func (c *Client) GetVersions(product string) ([]Version, error) {
+	var response struct {
+		Versions []Version `json:"versions"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing versions of product %q", product)
+	}
+	return response.Versions, nil
+}
+
+// FindVersions returns the versions of the given product in the given
+// semantic version range (e.g. ">=1.0.0 <2.0.0"), if any, and only the
+// releases if stable is set, sorted by precedence.
+func (c *Client) FindVersions(product string, versions string, stable bool) ([]Version, error) {
+	var response struct {
+		Versions []Version `json:"versions"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions")+versionsQuery(versions, stable), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error finding versions of product %q", product)
+	}
+	return response.Versions, nil
+}
+
+// GetLatestVersion returns the version of the given product with the highest
+// precedence in the given semantic version range, if any, and only among the
+// releases if stable is set.
+func (c *Client) GetLatestVersion(product string, versions string, stable bool) (Version, error) {
+	latest := "latest"
+	if stable {
+		latest = "latest-stable"
+	}
+	var response struct {
+		Version Version `json:"version"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", latest)+versionsQuery(versions, false), nil, &response); err != nil {
+		return Version{}, errors.Wrapf(err, "error reading %s version of product %q", latest, product)
+	}
+	return response.Version, nil
+}
+
+// GetVersion returns a version of the given product, along with its
+// deployments.
+func (c *Client) GetVersion(product string, version string) (Version, error) {
+	var response struct {
+		Version Version `json:"version"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version), nil, &response); err != nil {
+		return Version{}, errors.Wrapf(err, "error reading version %q of product %q", version, product)
+	}
+	return response.Version, nil
+}
+
+// CreateVersion registers a new version of the given product.
+func (c *Client) CreateVersion(product string, version Version) (Version, error) {
+	var response struct {
+		Version Version `json:"version"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions"), version, &response); err != nil {
+		return Version{}, errors.Wrapf(err, "error creating version %q of product %q", version.Code, product)
+	}
+	return response.Version, nil
+}
+
+// SuggestVersion returns the code and default branch of the version which
+// would follow the latest version of the given product, by incrementing the
+// given part ("major", "minor", "patch" or "prerelease"); pre-releases are
+// labelled with the given identifier, if any.
+func (c *Client) SuggestVersion(product string, bump string, identifier string) (Version, error) {
+	query := url.Values{"bump": {bump}}
+	if identifier != "" {
+		query.Set("preid", identifier)
+	}
+	var response struct {
+		Version Version `json:"version"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", "next")+"?"+query.Encode(), nil, &response); err != nil {
+		return Version{}, errors.Wrapf(err, "error suggesting %s version of product %q", bump, product)
+	}
+	return response.Version, nil
+}
+
+// AllocateVersion registers the version following the latest version of the
+// given product, by incrementing the given part as SuggestVersion does; the
+// code of the given version is ignored, its branch defaults to one named after
+// the allocated code. Concurrent allocations get different versions.
+func (c *Client) AllocateVersion(product string, bump string, identifier string, version Version) (Version, error) {
+	request := struct {
+		Bump        string `json:"bump"`
+		Identifier  string `json:"preid,omitempty"`
+		Description string `json:"description,omitempty"`
+		Repository  string `json:"repository,omitempty"`
+		Branch      string `json:"branch,omitempty"`
+		Author      string `json:"author,omitempty"`
+	}{bump, identifier, version.Description, version.Repository, version.Branch, version.Author}
+	var response struct {
+		Version Version `json:"version"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions", "next"), request, &response); err != nil {
+		return Version{}, errors.Wrapf(err, "error allocating %s version of product %q", bump, product)
+	}
+	return response.Version, nil
+}
+
+// DeleteVersion deletes a version of a product, along with its deployments.
+func (c *Client) DeleteVersion(product string, version string) error {
+	if err := c.do(http.MethodDelete, path("products", product, "versions", version), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting version %q of product %q", version, product)
+	}
+	return nil
+}
+
+// GetBuilds returns the builds of a version of a product, without their logs.
+func (c *Client) GetBuilds(product string, version string) ([]Build, error) {
+	var response struct {
+		Builds []Build `json:"builds"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "builds"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing builds of version %q of product %q", version, product)
+	}
+	return response.Builds, nil
+}
+
+// GetBuild returns the build having the given number within a version of a
+// product.
+func (c *Client) GetBuild(product string, version string, number int) (Build, error) {
+	var response struct {
+		Build Build `json:"build"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "builds", strconv.Itoa(number)), nil, &response); err != nil {
+		return Build{}, errors.Wrapf(err, "error reading build %d of version %q of product %q", number, version, product)
+	}
+	return response.Build, nil
+}
+
+// CreateBuild registers a new build of a version of a product.
+func (c *Client) CreateBuild(product string, version string, build Build) (Build, error) {
+	var response struct {
+		Build Build `json:"build"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions", version, "builds"), build, &response); err != nil {
+		return Build{}, errors.Wrapf(err, "error creating build %d of version %q of product %q", build.Number, version, product)
+	}
+	return response.Build, nil
+}
+
+// FinishBuild records the outcome of a build, i.e. its final status (e.g.
+// SUCCEEDED) and an excerpt of its log, if not empty; the build is finished
+// as of now.
+func (c *Client) FinishBuild(product string, version string, number int, status string, log string) (Build, error) {
+	var response struct {
+		Build Build `json:"build"`
+	}
+	request := map[string]interface{}{"status": status, "finished": time.Now()}
+	if log != "" {
+		request["log"] = log
+	}
+	if err := c.do(http.MethodPatch, path("products", product, "versions", version, "builds", strconv.Itoa(number)), request, &response); err != nil {
+		return Build{}, errors.Wrapf(err, "error finishing build %d of version %q of product %q", number, version, product)
+	}
+	return response.Build, nil
+}
+
+// DeleteBuild deletes a build of a version of a product.
+func (c *Client) DeleteBuild(product string, version string, number int) error {
+	if err := c.do(http.MethodDelete, path("products", product, "versions", version, "builds", strconv.Itoa(number)), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting build %d of version %q of product %q", number, version, product)
+	}
+	return nil
+}
+
+// GetArtifacts returns the artifacts produced by a build of a version of a
+// product.
+func (c *Client) GetArtifacts(product string, version string, number int) ([]Artifact, error) {
+	var response struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "builds", strconv.Itoa(number), "artifacts"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing artifacts of build %d of version %q of product %q", number, version, product)
+	}
+	return response.Artifacts, nil
+}
+
+// CreateArtifact registers an artifact produced by a build of a version of a
+// product.
+func (c *Client) CreateArtifact(product string, version string, number int, artifact Artifact) (Artifact, error) {
+	var response struct {
+		Artifact Artifact `json:"artifact"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions", version, "builds", strconv.Itoa(number), "artifacts"), artifact, &response); err != nil {
+		return Artifact{}, errors.Wrapf(err, "error creating artifact %q of build %d of version %q of product %q", artifact.Name, number, version, product)
+	}
+	return response.Artifact, nil
+}
+
+// DeleteArtifact deletes an artifact of a build of a version of a product.
+func (c *Client) DeleteArtifact(product string, version string, number int, name string) error {
+	if err := c.do(http.MethodDelete, path("products", product, "versions", version, "builds", strconv.Itoa(number), "artifacts", name), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting artifact %q of build %d of version %q of product %q", name, number, version, product)
+	}
+	return nil
+}
+
+// UploadArtifact stores the given contents of a registered artifact of a build
+// of a version of a product, which must match the artifact digest; size is
+// the length of the contents, or -1 if unknown.
+func (c *Client) UploadArtifact(product string, version string, number int, name string, contents io.Reader, size int64) (Blob, error) {
+	request, err := http.NewRequest(http.MethodPut, c.url+path("products", product, "versions", version, "builds", strconv.Itoa(number), "artifacts", name, "content"), contents)
+	if err != nil {
+		return Blob{}, errors.Wrap(err, "error preparing request")
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		request.ContentLength = size
+	}
+	response, err := c.send(request)
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "error uploading artifact %q of build %d of version %q of product %q", name, number, version, product)
+	}
+	defer response.Body.Close()
+	var result struct {
+		Blob Blob `json:"blob"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return Blob{}, errors.Wrap(err, "error decoding response")
+	}
+	return result.Blob, nil
+}
+
+// DownloadArtifact writes the stored contents of an artifact of a build of a
+// version of a product to the given writer, and returns their size.
+func (c *Client) DownloadArtifact(product string, version string, number int, name string, out io.Writer) (int64, error) {
+	request, err := http.NewRequest(http.MethodGet, c.url+path("products", product, "versions", version, "builds", strconv.Itoa(number), "artifacts", name, "content"), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error preparing request")
+	}
+	response, err := c.send(request)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error downloading artifact %q of build %d of version %q of product %q", name, number, version, product)
+	}
+	defer response.Body.Close()
+	size, err := io.Copy(out, response.Body)
+	if err != nil {
+		return size, errors.Wrapf(err, "error downloading artifact %q of build %d of version %q of product %q", name, number, version, product)
+	}
+	return size, nil
+}
+
+// GetStorage returns the storage used by the artifacts of a product, along
+// with its quota.
+func (c *Client) GetStorage(product string) (Storage, error) {
+	var response struct {
+		Storage Storage `json:"storage"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "storage"), nil, &response); err != nil {
+		return Storage{}, errors.Wrapf(err, "error reading storage of product %q", product)
+	}
+	return response.Storage, nil
+}
+
+// CollectBlobs removes the stored artifact contents no artifact refers to any
+// longer, and returns the number of blobs removed and the bytes freed.
+func (c *Client) CollectBlobs() (int, int64, error) {
+	var response struct {
+		Removed int   `json:"removed"`
+		Freed   int64 `json:"freed"`
+	}
+	if err := c.do(http.MethodPost, path("blobs", "gc"), nil, &response); err != nil {
+		return 0, 0, errors.Wrap(err, "error collecting blobs")
+	}
+	return response.Removed, response.Freed, nil
+}
+
+// FindArtifact returns the artifacts having the given digest, along with the
+// deployments which deployed them, among the products the user can view.
+func (c *Client) FindArtifact(digest string) ([]ArtifactMatch, []DeploymentMatch, error) {
+	var response struct {
+		Artifacts   []ArtifactMatch   `json:"artifacts"`
+		Deployments []DeploymentMatch `json:"deployments"`
+	}
+	if err := c.do(http.MethodGet, path("artifacts", digest), nil, &response); err != nil {
+		return nil, nil, errors.Wrapf(err, "error finding artifact %q", digest)
+	}
+	return response.Artifacts, response.Deployments, nil
+}
+
+// GetDeployments returns the deployments of a version of a product.
+func (c *Client) GetDeployments(product string, version string) ([]Deployment, error) {
+	var response struct {
+		Deployments []Deployment `json:"deployments"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "deployments"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing deployments of version %q of product %q", version, product)
+	}
+	return response.Deployments, nil
+}
+
+// GetDeployment returns the deployment having the given order within a
+// version of a product.
+func (c *Client) GetDeployment(product string, version string, order int) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "deployments", strconv.Itoa(order)), nil, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error reading deployment %d of version %q of product %q", order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// CreateDeployment registers a new deployment of a version of a product.
+func (c *Client) CreateDeployment(product string, version string, deployment Deployment) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions", version, "deployments"), deployment, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error creating deployment %d of version %q of product %q", deployment.Order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// SetDeploymentArtifacts records the digests of the artifacts actually
+// deployed by a deployment, replacing the previous ones; all of them must have
+// been produced by a build of the version.
+func (c *Client) SetDeploymentArtifacts(product string, version string, order int, digests []string) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	request := map[string][]string{"digests": digests}
+	if err := c.do(http.MethodPut, path("products", product, "versions", version, "deployments", strconv.Itoa(order), "artifacts"), request, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error setting artifacts of deployment %d of version %q of product %q", order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// SetDeploymentStatus changes the status of a deployment, e.g. to record that
+// it was PERFORMED.
+func (c *Client) SetDeploymentStatus(product string, version string, order int, status string) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	request := map[string]string{"status": status}
+	if err := c.do(http.MethodPatch, path("products", product, "versions", version, "deployments", strconv.Itoa(order)), request, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error setting status of deployment %d of version %q of product %q", order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// DeleteDeployment deletes a deployment of a version of a product.
+func (c *Client) DeleteDeployment(product string, version string, order int) error {
+	if err := c.do(http.MethodDelete, path("products", product, "versions", version, "deployments", strconv.Itoa(order)), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting deployment %d of version %q of product %q", order, version, product)
+	}
+	return nil
+}
+
+// ApproveDeployment records the approval of a deployment by the user the
+// client authenticates as; the deployment is granted once it has collected
+// the approvals required by the policy of its environment.
+func (c *Client) ApproveDeployment(product string, version string, order int) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "versions", version, "deployments", strconv.Itoa(order), "approve"), nil, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error approving deployment %d of version %q of product %q", order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// RejectDeployment denies (or withdraws) the authorisation of a deployment
+// for the given reason.
+func (c *Client) RejectDeployment(product string, version string, order int, reason string) (Deployment, error) {
+	return c.transition(product, version, order, "reject", reason)
+}
+
+// FailDeployment records that a deployment could not be carried out, or that
+// it turned out to be faulty, for the given reason.
+func (c *Client) FailDeployment(product string, version string, order int, reason string) (Deployment, error) {
+	return c.transition(product, version, order, "fail", reason)
+}
+
+// RollbackDeployment records that a deployment has been reverted for the
+// given reason.
+func (c *Client) RollbackDeployment(product string, version string, order int, reason string) (Deployment, error) {
+	return c.transition(product, version, order, "rollback", reason)
+}
+
+// CancelDeployment records that a deployment is no longer going to be carried
+// out, for the given reason.
+func (c *Client) CancelDeployment(product string, version string, order int, reason string) (Deployment, error) {
+	return c.transition(product, version, order, "cancel", reason)
+}
+
+// transition changes the status of a deployment through the endpoint of the
+// given action, e.g. "reject".
+func (c *Client) transition(product string, version string, order int, action string, reason string) (Deployment, error) {
+	var response struct {
+		Deployment Deployment `json:"deployment"`
+	}
+	request := map[string]string{"reason": reason}
+	if err := c.do(http.MethodPost, path("products", product, "versions", version, "deployments", strconv.Itoa(order), action), request, &response); err != nil {
+		return Deployment{}, errors.Wrapf(err, "error executing %s on deployment %d of version %q of product %q", action, order, version, product)
+	}
+	return response.Deployment, nil
+}
+
+// GetDeploymentToken returns the signed approval token of a GRANTED
+// deployment, which can be verified offline with signing.Verify.
+func (c *Client) GetDeploymentToken(product string, version string, order int) (string, error) {
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "versions", version, "deployments", strconv.Itoa(order), "token"), nil, &response); err != nil {
+		return "", errors.Wrapf(err, "error reading token of deployment %d of version %q of product %q", order, version, product)
+	}
+	return response.Token, nil
+}
+
+// GetKeys returns the public keys the approval tokens issued by the server
+// are verified against.
+func (c *Client) GetKeys() ([]ed25519.PublicKey, error) {
+	var response struct {
+		Keys []signing.JWK `json:"keys"`
+	}
+	if err := c.do(http.MethodGet, path("keys"), nil, &response); err != nil {
+		return nil, errors.Wrap(err, "error reading signing keys")
+	}
+	keys := make([]ed25519.PublicKey, 0, len(response.Keys))
+	for _, jwk := range response.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signing key %q", jwk.KeyID)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// GetPolicies returns the list of approval policies of a product.
+func (c *Client) GetPolicies(product string) ([]Policy, error) {
+	var response struct {
+		Policies []Policy `json:"policies"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "policies"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing policies of product %q", product)
+	}
+	return response.Policies, nil
+}
+
+// SetPolicy creates or replaces the approval policy of a product for the
+// policy environment.
+func (c *Client) SetPolicy(product string, policy Policy) (Policy, error) {
+	var response struct {
+		Policy Policy `json:"policy"`
+	}
+	if err := c.do(http.MethodPut, path("products", product, "policies", policy.Environment), policy, &response); err != nil {
+		return Policy{}, errors.Wrapf(err, "error setting policy of product %q for environment %q", product, policy.Environment)
+	}
+	return response.Policy, nil
+}
+
+// DeletePolicy deletes the approval policy of a product for an environment.
+func (c *Client) DeletePolicy(product string, environment string) error {
+	if err := c.do(http.MethodDelete, path("products", product, "policies", environment), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting policy of product %q for environment %q", product, environment)
+	}
+	return nil
+}
+
+// GetPipeline returns the stages of the promotion pipeline of a product.
+func (c *Client) GetPipeline(product string) ([]Stage, error) {
+	var response struct {
+		Pipeline []Stage `json:"pipeline"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "pipeline"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error reading pipeline of product %q", product)
+	}
+	return response.Pipeline, nil
+}
+
+// SetPipeline replaces the promotion pipeline of a product with the given
+// environments, in promotion order.
+func (c *Client) SetPipeline(product string, environments []string) ([]Stage, error) {
+	request := struct {
+		Environments []string `json:"environments"`
+	}{
+		Environments: environments,
+	}
+	var response struct {
+		Pipeline []Stage `json:"pipeline"`
+	}
+	if err := c.do(http.MethodPut, path("products", product, "pipeline"), request, &response); err != nil {
+		return nil, errors.Wrapf(err, "error setting pipeline of product %q", product)
+	}
+	return response.Pipeline, nil
+}
+
+// DeletePipeline removes the promotion pipeline of a product.
+func (c *Client) DeletePipeline(product string) error {
+	if err := c.do(http.MethodDelete, path("products", product, "pipeline"), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting pipeline of product %q", product)
+	}
+	return nil
+}
+
+// GetWebhooks returns the list of webhooks of a product.
+func (c *Client) GetWebhooks(product string) ([]Webhook, error) {
+	var response struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "webhooks"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing webhooks of product %q", product)
+	}
+	return response.Webhooks, nil
+}
+
+// CreateWebhook subscribes a new webhook to the events of a product; unless
+// provided, its secret is generated by the server and returned.
+func (c *Client) CreateWebhook(product string, webhook Webhook) (Webhook, error) {
+	var response struct {
+		Webhook Webhook `json:"webhook"`
+	}
+	if err := c.do(http.MethodPost, path("products", product, "webhooks"), webhook, &response); err != nil {
+		return Webhook{}, errors.Wrapf(err, "error creating webhook of product %q", product)
+	}
+	return response.Webhook, nil
+}
+
+// DeleteWebhook deletes a webhook of a product.
+func (c *Client) DeleteWebhook(product string, id uint) error {
+	if err := c.do(http.MethodDelete, path("products", product, "webhooks", strconv.FormatUint(uint64(id), 10)), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting webhook %d of product %q", id, product)
+	}
+	return nil
+}
+
+// GetDeliveries returns the latest attempts to deliver events to a webhook of
+// a product, newest first.
+func (c *Client) GetDeliveries(product string, id uint) ([]Delivery, error) {
+	var response struct {
+		Deliveries []Delivery `json:"deliveries"`
+	}
+	if err := c.do(http.MethodGet, path("products", product, "webhooks", strconv.FormatUint(uint64(id), 10), "deliveries"), nil, &response); err != nil {
+		return nil, errors.Wrapf(err, "error listing deliveries of webhook %d of product %q", id, product)
+	}
+	return response.Deliveries, nil
+}
+
+// GetPreferences returns the notification preferences of the user.
+func (c *Client) GetPreferences() (Preference, error) {
+	var response struct {
+		Preferences Preference `json:"preferences"`
+	}
+	if err := c.do(http.MethodGet, path("preferences"), nil, &response); err != nil {
+		return Preference{}, errors.Wrap(err, "error reading notification preferences")
+	}
+	return response.Preferences, nil
+}
+
+// SetPreferences creates or replaces the notification preferences of the
+// user.
+func (c *Client) SetPreferences(preference Preference) (Preference, error) {
+	var response struct {
+		Preferences Preference `json:"preferences"`
+	}
+	if err := c.do(http.MethodPut, path("preferences"), preference, &response); err != nil {
+		return Preference{}, errors.Wrap(err, "error setting notification preferences")
+	}
+	return response.Preferences, nil
+}
+
+// DeletePreferences deletes the notification preferences of the user.
+func (c *Client) DeletePreferences() error {
+	if err := c.do(http.MethodDelete, path("preferences"), nil, nil); err != nil {
+		return errors.Wrap(err, "error deleting notification preferences")
+	}
+	return nil
+}
+
+// GetAssignments returns the list of role assignments visible to the user,
+// that is all of them for administrators, the user's own otherwise.
+func (c *Client) GetAssignments() ([]Assignment, error) {
+	var response struct {
+		Assignments []Assignment `json:"assignments"`
+	}
+	if err := c.do(http.MethodGet, path("assignments"), nil, &response); err != nil {
+		return nil, errors.Wrap(err, "error listing role assignments")
+	}
+	return response.Assignments, nil
+}
+
+// CreateAssignment assigns a role to a user.
+func (c *Client) CreateAssignment(assignment Assignment) (Assignment, error) {
+	var response struct {
+		Assignment Assignment `json:"assignment"`
+	}
+	if err := c.do(http.MethodPost, path("assignments"), assignment, &response); err != nil {
+		return Assignment{}, errors.Wrapf(err, "error assigning role %s to user %q", assignment.Role, assignment.User)
+	}
+	return response.Assignment, nil
+}
+
+// DeleteAssignment revokes a role assignment.
+func (c *Client) DeleteAssignment(id uint) error {
+	if err := c.do(http.MethodDelete, path("assignments", strconv.FormatUint(uint64(id), 10)), nil, nil); err != nil {
+		return errors.Wrapf(err, "error deleting role assignment %d", id)
+	}
+	return nil
+}
+
+// GetAudit returns the audit records selected by the given query, oldest
+// first.
+func (c *Client) GetAudit(query AuditQuery) ([]AuditRecord, error) {
+	values := url.Values{}
+	if query.Product != "" {
+		values.Set("product", query.Product)
+	}
+	if query.User != "" {
+		values.Set("user", query.User)
+	}
+	if !query.From.IsZero() {
+		values.Set("from", query.From.Format(time.RFC3339))
+	}
+	if !query.To.IsZero() {
+		values.Set("to", query.To.Format(time.RFC3339))
+	}
+	target := path("audit")
+	if len(values) > 0 {
+		target += "?" + values.Encode()
+	}
+	var response struct {
+		Audit []AuditRecord `json:"audit"`
+	}
+	if err := c.do(http.MethodGet, target, nil, &response); err != nil {
+		return nil, errors.Wrap(err, "error reading audit log")
+	}
+	return response.Audit, nil
+}
+
+// do sends a request to the server, encoding the input (if any) as JSON and
+// decoding the JSON response into the output (if any).
+func (c *Client) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "error encoding request")
+		}
+		body = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return errors.Wrap(err, "error preparing request")
+	}
+	request.Header.Set("Accept", "application/json")
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if out != nil && response.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			return errors.Wrap(err, "error decoding response")
+		}
+	}
+	return nil
+}
+
+// send authenticates and sends the given request, and returns the response,
+// whose body the caller must close; error responses are returned as an Error.
+func (c *Client) send(request *http.Request) (*http.Response, error) {
+	if c.authorization != "" {
+		request.Header.Set("Authorization", c.authorization)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "error contacting server")
+	}
+	if response.StatusCode >= 400 {
+		defer response.Body.Close()
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return nil, &Error{StatusCode: response.StatusCode, Message: failure.Error}
+	}
+	return response, nil
+}
+
+// versionsQuery returns the query string selecting the versions in the given
+// range, and only the releases if stable is set.
+func versionsQuery(versions string, stable bool) string {
+	query := url.Values{}
+	if versions != "" {
+		query.Set("range", versions)
+	}
+	if stable {
+		query.Set("stable", "true")
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// path returns the URL path made of the given elements, each one escaped.
+func path(elements ...string) string {
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return "/" + strings.Join(elements, "/")
+}
@@ -0,0 +1,27 @@
+// Command check implements the check script of the builds Concourse resource;
+// it is installed as /opt/resource/check.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/dihedron/builds/concourse"
+)
+
+func main() {
+	var request concourse.CheckRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		log.Fatalf("error reading request: %v\n", err)
+	}
+
+	response, err := concourse.Check(request)
+	if err != nil {
+		log.Fatalf("error checking for new versions: %v\n", err)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		log.Fatalf("error writing response: %v\n", err)
+	}
+}
@@ -0,0 +1,32 @@
+// Command out implements the out script of the builds Concourse resource; it
+// is installed as /opt/resource/out and invoked with the build's sources
+// directory as its only argument.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/dihedron/builds/concourse"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: %s <sources directory>\n", os.Args[0])
+	}
+
+	var request concourse.OutRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		log.Fatalf("error reading request: %v\n", err)
+	}
+
+	response, err := concourse.Out(os.Args[1], request)
+	if err != nil {
+		log.Fatalf("error updating version: %v\n", err)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		log.Fatalf("error writing response: %v\n", err)
+	}
+}
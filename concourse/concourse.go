@@ -0,0 +1,398 @@
+// Package concourse implements a Concourse CI resource type on top of the
+// builds REST API: check emits the deployments of a product that have been
+// GRANTED for an environment, in fetches their metadata, out registers new
+// versions and records deployments as PERFORMED.
+package concourse
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dihedron/builds/client"
+	"github.com/pkg/errors"
+)
+
+// Source is the configuration of the resource, as declared in the pipeline.
+type Source struct {
+	// URL is the base URL of the builds server.
+	URL string `json:"url"`
+	// Product is the code of the product whose deployments are tracked.
+	Product string `json:"product"`
+	// Environment is the environment whose deployments are tracked, e.g.
+	// "Production".
+	Environment string `json:"environment"`
+	// Username and Password are the credentials the resource authenticates
+	// with, if the server requires HTTP basic authentication.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Token is the bearer token the resource authenticates with, if the
+	// server requires token authentication.
+	Token string `json:"token,omitempty"`
+}
+
+// validate checks that all the mandatory attributes of the source are set.
+func (s Source) validate() error {
+	switch {
+	case s.URL == "":
+		return errors.New("missing source url")
+	case s.Product == "":
+		return errors.New("missing source product")
+	case s.Environment == "":
+		return errors.New("missing source environment")
+	}
+	return nil
+}
+
+// client returns a client of the builds server, authenticating with the
+// configured credentials (if any).
+func (s Source) client() *client.Client {
+	builds := client.New(s.URL)
+	switch {
+	case s.Token != "":
+		builds.SetBearerToken(s.Token)
+	case s.Username != "":
+		builds.SetBasicAuth(s.Username, s.Password)
+	}
+	return builds
+}
+
+// Version identifies a granted deployment: the version code, the order of
+// the deployment within the version and the time it was granted, so that
+// deployments granted again (e.g. after a rollback) count as new versions.
+type Version struct {
+	Version string `json:"version"`
+	Order   string `json:"order,omitempty"`
+	Granted string `json:"granted,omitempty"`
+}
+
+// MetadataField is a name/value pair displayed by Concourse in its UI.
+type MetadataField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CheckRequest is the input of the check script.
+type CheckRequest struct {
+	Source  Source   `json:"source"`
+	Version *Version `json:"version"`
+}
+
+// CheckResponse is the output of the check script.
+type CheckResponse []Version
+
+// InRequest is the input of the in script.
+type InRequest struct {
+	Source  Source  `json:"source"`
+	Version Version `json:"version"`
+}
+
+// InResponse is the output of the in script.
+type InResponse struct {
+	Version  Version         `json:"version"`
+	Metadata []MetadataField `json:"metadata"`
+}
+
+// OutParams are the parameters of the put step.
+type OutParams struct {
+	// Action is either "register", to create a new version of the product,
+	// or "perform", to record that the deployment of a version onto the
+	// source environment has been carried out.
+	Action string `json:"action"`
+	// Version is the code of the version to register or deploy.
+	Version string `json:"version,omitempty"`
+	// VersionFile is the path of a file containing the code of the version,
+	// relative to the build's sources directory; it is used if Version is
+	// not provided.
+	VersionFile string `json:"version_file,omitempty"`
+	// OrderFile is the path of a file containing the order of the deployment
+	// to perform, relative to the build's sources directory, such as the
+	// order file written by in; without it, the GRANTED deployment of the
+	// version onto the source environment is performed.
+	OrderFile string `json:"order_file,omitempty"`
+	// Description, Repository and Branch describe a version to register.
+	Description string `json:"description,omitempty"`
+	Repository  string `json:"repository,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	// Author is the author of a version to register, e.g. the committer of
+	// its sources; AuthorFile is the path of a file containing it (such as
+	// the .git/committer file written by the git resource), relative to the
+	// build's sources directory, and is used if Author is not provided.
+	// Servers authenticating users ignore both, and record the user of the
+	// resource as the author.
+	Author     string `json:"author,omitempty"`
+	AuthorFile string `json:"author_file,omitempty"`
+	// Environments lists, in promotion order, the environments a registered
+	// version will be deployed onto; a PENDING deployment is created for
+	// each of them.
+	Environments []string `json:"environments,omitempty"`
+}
+
+// OutRequest is the input of the out script.
+type OutRequest struct {
+	Source Source    `json:"source"`
+	Params OutParams `json:"params"`
+}
+
+// OutResponse is the output of the out script.
+type OutResponse struct {
+	Version  Version         `json:"version"`
+	Metadata []MetadataField `json:"metadata"`
+}
+
+// Check returns the deployments of the source product that have been granted
+// for the source environment, oldest first: if the request refers to a
+// previous version, those granted since then (including it) are returned,
+// otherwise only the latest one.
+func Check(request CheckRequest) (CheckResponse, error) {
+	if err := request.Source.validate(); err != nil {
+		return nil, err
+	}
+
+	versions, err := request.Source.client().GetVersions(request.Source.Product)
+	if err != nil {
+		return nil, err
+	}
+
+	type grant struct {
+		version    string
+		deployment client.Deployment
+	}
+	var grants []grant
+	for _, version := range versions {
+		for _, deployment := range version.Deployments {
+			if deployment.Environment == request.Source.Environment && deployment.Status == "GRANTED" {
+				grants = append(grants, grant{version: version.Code, deployment: deployment})
+			}
+		}
+	}
+	sort.SliceStable(grants, func(i, j int) bool {
+		return grants[i].deployment.Timestamp.Before(grants[j].deployment.Timestamp)
+	})
+
+	response := CheckResponse{}
+	for _, grant := range grants {
+		response = append(response, Version{
+			Version: grant.version,
+			Order:   strconv.Itoa(grant.deployment.Order),
+			Granted: grant.deployment.Timestamp.UTC().Format(time.RFC3339Nano),
+		})
+	}
+
+	if request.Version == nil || request.Version.Granted == "" {
+		if len(response) > 1 {
+			response = response[len(response)-1:]
+		}
+		return response, nil
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, request.Version.Granted)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid granted timestamp %q", request.Version.Granted)
+	}
+	for i, grant := range grants {
+		if !grant.deployment.Timestamp.Before(since) {
+			return response[i:], nil
+		}
+	}
+	return CheckResponse{}, nil
+}
+
+// In fetches the version and deployment identified by the request into the
+// destination directory: the files product, version, environment and (if a
+// deployment exists) order contain the respective codes, whereas
+// deployment.json contains the full version and deployment metadata; GRANTED
+// deployments also come with the signed approval token in the token file, if
+// the server issues them.
+func In(destination string, request InRequest) (*InResponse, error) {
+	if err := request.Source.validate(); err != nil {
+		return nil, err
+	}
+
+	builds := request.Source.client()
+	version, err := builds.GetVersion(request.Source.Product, request.Version.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployment *client.Deployment
+	for i, d := range version.Deployments {
+		if request.Version.Order != "" && strconv.Itoa(d.Order) == request.Version.Order ||
+			request.Version.Order == "" && d.Environment == request.Source.Environment {
+			deployment = &version.Deployments[i]
+			break
+		}
+	}
+	if request.Version.Order != "" && deployment == nil {
+		return nil, errors.Errorf("deployment %s of version %q not found", request.Version.Order, version.Code)
+	}
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return nil, errors.Wrapf(err, "error creating directory %q", destination)
+	}
+	files := map[string]string{
+		"product":     request.Source.Product,
+		"version":     version.Code,
+		"environment": request.Source.Environment,
+	}
+	metadata := []MetadataField{
+		{Name: "product", Value: request.Source.Product},
+		{Name: "version", Value: version.Code},
+	}
+	if version.Branch != "" {
+		metadata = append(metadata, MetadataField{Name: "branch", Value: version.Branch})
+	}
+	if deployment != nil {
+		files["order"] = strconv.Itoa(deployment.Order)
+		metadata = append(metadata,
+			MetadataField{Name: "environment", Value: deployment.Environment},
+			MetadataField{Name: "status", Value: deployment.Status},
+		)
+		if deployment.GrantedBy != "" {
+			metadata = append(metadata,
+				MetadataField{Name: "grantedBy", Value: deployment.GrantedBy},
+				MetadataField{Name: "granted", Value: deployment.Timestamp.UTC().Format(time.RFC3339)},
+			)
+		}
+		if deployment.Status == "GRANTED" {
+			token, err := builds.GetDeploymentToken(request.Source.Product, version.Code, deployment.Order)
+			if e, ok := errors.Cause(err).(*client.Error); err != nil && !(ok && e.StatusCode == http.StatusNotImplemented) {
+				return nil, err
+			}
+			// servers without a signing key issue no tokens
+			if token != "" {
+				files["token"] = token
+			}
+		}
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(destination, name), []byte(content), 0644); err != nil {
+			return nil, errors.Wrapf(err, "error writing file %q", name)
+		}
+	}
+
+	data, err := json.MarshalIndent(struct {
+		Product    string             `json:"product"`
+		Version    client.Version     `json:"version"`
+		Deployment *client.Deployment `json:"deployment,omitempty"`
+	}{
+		Product:    request.Source.Product,
+		Version:    version,
+		Deployment: deployment,
+	}, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding deployment metadata")
+	}
+	if err := os.WriteFile(filepath.Join(destination, "deployment.json"), data, 0644); err != nil {
+		return nil, errors.Wrap(err, "error writing file \"deployment.json\"")
+	}
+
+	return &InResponse{Version: request.Version, Metadata: metadata}, nil
+}
+
+// Out either registers a new version of the source product, or records the
+// deployment of a version onto the source environment as PERFORMED; sources
+// is the directory containing the build's inputs.
+func Out(sources string, request OutRequest) (*OutResponse, error) {
+	if err := request.Source.validate(); err != nil {
+		return nil, err
+	}
+
+	code := request.Params.Version
+	if code == "" && request.Params.VersionFile != "" {
+		data, err := os.ReadFile(filepath.Join(sources, request.Params.VersionFile))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading version file %q", request.Params.VersionFile)
+		}
+		code = string(bytes.TrimSpace(data))
+	}
+	if code == "" {
+		return nil, errors.New("missing version or version_file parameter")
+	}
+
+	builds := request.Source.client()
+	switch request.Params.Action {
+	case "register":
+		author := request.Params.Author
+		if author == "" && request.Params.AuthorFile != "" {
+			data, err := os.ReadFile(filepath.Join(sources, request.Params.AuthorFile))
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading author file %q", request.Params.AuthorFile)
+			}
+			author = string(bytes.TrimSpace(data))
+		}
+		version, err := builds.CreateVersion(request.Source.Product, client.Version{
+			Code:        code,
+			Description: request.Params.Description,
+			Repository:  request.Params.Repository,
+			Branch:      request.Params.Branch,
+			Author:      author,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for order, environment := range request.Params.Environments {
+			if _, err := builds.CreateDeployment(request.Source.Product, version.Code, client.Deployment{Order: order, Environment: environment}); err != nil {
+				return nil, err
+			}
+		}
+		return &OutResponse{
+			Version: Version{Version: version.Code},
+			Metadata: []MetadataField{
+				{Name: "product", Value: request.Source.Product},
+				{Name: "version", Value: version.Code},
+			},
+		}, nil
+	case "perform":
+		order := -1
+		if request.Params.OrderFile != "" {
+			data, err := os.ReadFile(filepath.Join(sources, request.Params.OrderFile))
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading order file %q", request.Params.OrderFile)
+			}
+			if order, err = strconv.Atoi(string(bytes.TrimSpace(data))); err != nil {
+				return nil, errors.Errorf("invalid deployment order %q in file %q", bytes.TrimSpace(data), request.Params.OrderFile)
+			}
+		}
+		version, err := builds.GetVersion(request.Source.Product, code)
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range version.Deployments {
+			if deployment.Environment != request.Source.Environment || (order < 0 && deployment.Status != "GRANTED") || (order >= 0 && deployment.Order != order) {
+				continue
+			}
+			if deployment.Status != "GRANTED" {
+				return nil, errors.Errorf("deployment %d of version %q onto %q is %s, not GRANTED", deployment.Order, version.Code, deployment.Environment, deployment.Status)
+			}
+			granted := deployment.Timestamp
+			deployment, err := builds.SetDeploymentStatus(request.Source.Product, version.Code, deployment.Order, "PERFORMED")
+			if err != nil {
+				return nil, err
+			}
+			return &OutResponse{
+				Version: Version{
+					Version: version.Code,
+					Order:   strconv.Itoa(deployment.Order),
+					Granted: granted.UTC().Format(time.RFC3339Nano),
+				},
+				Metadata: []MetadataField{
+					{Name: "product", Value: request.Source.Product},
+					{Name: "version", Value: version.Code},
+					{Name: "environment", Value: deployment.Environment},
+					{Name: "status", Value: deployment.Status},
+				},
+			}, nil
+		}
+		if order >= 0 {
+			return nil, errors.Errorf("version %q has no deployment %d onto %q", version.Code, order, request.Source.Environment)
+		}
+		return nil, errors.Errorf("version %q has no GRANTED deployment onto %q", version.Code, request.Source.Environment)
+	}
+	return nil, errors.Errorf("unsupported action %q (expected register or perform)", request.Params.Action)
+}
@@ -0,0 +1,103 @@
+package concourse
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/dihedron/builds/server"
+	"github.com/dihedron/builds/signing"
+	"github.com/gin-gonic/gin"
+)
+
+// serve starts a builds server on an in-memory store holding a product with
+// a version deployed onto Integration and Production, signing approval tokens
+// with the returned key.
+func serve(t *testing.T) (*httptest.Server, ed25519.PublicKey) {
+	gin.SetMode(gin.TestMode)
+	store := model.NewMemoryStore()
+	product := model.Product{
+		Code: "gaia",
+		Versions: []model.Version{
+			{
+				Code: "1.0.0",
+				Deployments: []model.Deployment{
+					{Order: 0, Environment: "Integration", Status: model.PERFORMED},
+					{Order: 1, Environment: "Production", Status: model.CANCELLED},
+					{Order: 2, Environment: "Production", Status: model.GRANTED, GrantedBy: "d093154", Timestamp: time.Now()},
+				},
+			},
+		},
+	}
+	if err := store.CreateProduct(&product); err != nil {
+		t.Fatalf("error creating product: %v", err)
+	}
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating signing key: %v", err)
+	}
+	ts := httptest.NewServer(server.New(store, server.WithSigner(signing.NewSigner(private))))
+	t.Cleanup(ts.Close)
+	return ts, public
+}
+
+func TestCheckInOut(t *testing.T) {
+	ts, key := serve(t)
+	source := Source{URL: ts.URL, Product: "gaia", Environment: "Production"}
+
+	versions, err := Check(CheckRequest{Source: source})
+	if err != nil {
+		t.Fatalf("error checking: %v", err)
+	}
+	if len(versions) != 1 || versions[0].Version != "1.0.0" || versions[0].Order != "2" {
+		t.Fatalf("unexpected versions: %v", versions)
+	}
+
+	destination := t.TempDir()
+	if _, err := In(destination, InRequest{Source: source, Version: versions[0]}); err != nil {
+		t.Fatalf("error fetching: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(destination, "version")); err != nil || string(data) != "1.0.0" {
+		t.Fatalf("unexpected version file: %q (%v)", data, err)
+	}
+	token, err := os.ReadFile(filepath.Join(destination, "token"))
+	if err != nil {
+		t.Fatalf("error reading token file: %v", err)
+	}
+	if claims, err := signing.Verify(string(token), []ed25519.PublicKey{key}); err != nil || claims.Check("gaia", "1.0.0", "Production") != nil {
+		t.Fatalf("unexpected token claims: %v (%v)", claims, err)
+	}
+
+	sources := t.TempDir()
+	os.WriteFile(filepath.Join(sources, "next"), []byte("1.0.1\n"), 0644)
+	out, err := Out(sources, OutRequest{Source: source, Params: OutParams{
+		Action:       "register",
+		VersionFile:  "next",
+		Environments: []string{"Integration", "Production"},
+	}})
+	if err != nil || out.Version.Version != "1.0.1" {
+		t.Fatalf("unexpected result registering version: %v (%v)", out, err)
+	}
+
+	os.WriteFile(filepath.Join(sources, "order"), []byte("1\n"), 0644)
+	if _, err := Out(sources, OutRequest{Source: source, Params: OutParams{Action: "perform", Version: "1.0.0", OrderFile: "order"}}); err == nil {
+		t.Fatalf("expected CANCELLED deployment not to be performed")
+	}
+	out, err = Out(sources, OutRequest{Source: source, Params: OutParams{Action: "perform", Version: "1.0.0"}})
+	if err != nil {
+		t.Fatalf("error performing deployment: %v", err)
+	}
+	if out.Version.Order != "2" {
+		t.Fatalf("unexpected version: %v", out.Version)
+	}
+
+	versions, err = Check(CheckRequest{Source: source, Version: &versions[0]})
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("expected no granted deployments left, got %v (%v)", versions, err)
+	}
+}
@@ -1,11 +1,14 @@
+// Package files provides helpers to inspect the local filesystem.
 package files
 
-import "os"
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 // Exists returns whether the given file or directory exists.
 func Exists(path string) (bool, error) {
-	if path == nil {
+	if path == "" {
 		return false, fmt.Errorf("invalid input path")
 	}
 	if _, err := os.Stat(path); err != nil {
@@ -18,9 +21,9 @@ func Exists(path string) (bool, error) {
 	return true, nil
 }
 
-// Exists returns whether the given file or directory exists.
+// IsFile returns whether the given path exists and is not a directory.
 func IsFile(path string) (bool, error) {
-	if path == nil {
+	if path == "" {
 		return false, fmt.Errorf("invalid input path")
 	}
 	stat, err := os.Stat(path)
@@ -34,9 +37,9 @@ func IsFile(path string) (bool, error) {
 	return !stat.IsDir(), nil
 }
 
-// Exists returns whether the given file or directory exists.
+// IsDir returns whether the given path exists and is a directory.
 func IsDir(path string) (bool, error) {
-	if path == nil {
+	if path == "" {
 		return false, fmt.Errorf("invalid input path")
 	}
 	stat, err := os.Stat(path)
@@ -0,0 +1,45 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(file, []byte("contents"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		path   string
+		exists bool
+		file   bool
+		dir    bool
+	}{
+		{file, true, true, false},
+		{dir, true, false, true},
+		{missing, false, false, false},
+	}
+	for _, test := range tests {
+		if exists, err := Exists(test.path); err != nil || exists != test.exists {
+			t.Errorf("expected Exists(%q) to be %t, got %t (%v)", test.path, test.exists, exists, err)
+		}
+		if file, err := IsFile(test.path); err != nil || file != test.file {
+			t.Errorf("expected IsFile(%q) to be %t, got %t (%v)", test.path, test.file, file, err)
+		}
+		if dir, err := IsDir(test.path); err != nil || dir != test.dir {
+			t.Errorf("expected IsDir(%q) to be %t, got %t (%v)", test.path, test.dir, dir, err)
+		}
+	}
+
+	if _, err := Exists(""); err == nil {
+		t.Errorf("expected empty path to be rejected")
+	}
+	if _, err := IsDir(""); err == nil {
+		t.Errorf("expected empty path to be rejected")
+	}
+}
@@ -1,589 +1,309 @@
 package main
 
 import (
-	"fmt"
-	"github.com/dihedron/builds/model"
-)
-
-func main() {
-	fmt.Println("hallo, wworld!")
-
-	model.New("test.sqlite")
-	defer model.Close()
-
-	product := model.Product{
-		Code:        "gaia",
-		Name:        "G.A.I.A. - Servizi per il Personale",
-		Description: "GAIA è il portale web dei servizi aziendali non altrimenti disponibili su piattaforma SAP.",
-		Contact:     "fabio.angeli@bancaditalia.it",
-		Repository:  "https://gitlab.utenze.bankit.it/gaia",
-		WebSite:     "http://infogaia/",
-		Versions: []model.Version{
-			{
-				Code:        "1.0.0",
-				Description: "First major release, 1.0 series",
-				Repository:  "https://gitlab.utenze.bankit.it/gaia",
-				Branch:      "ver_1_0_0",
-			},
-			{
-				Code:        "1.0.1",
-				Description: "First bugfix release of the 1.0 series",
-				Branch:      "ver_1_0_1",
-			},
-		},
-	}
-	model.CreateProduct(&product)
-	fmt.Printf("product after save: %s\n", product)
-
-	product = model.Product{
-		Code:        "siparium",
-		Name:        "SIPARIUM - Sistema Integrato Processi Aziendali per le Risorse UMane",
-		Description: "GAIA è il portale web dei servizi aziendali per le risorse umane su piattaforma SAP.",
-		Contact:     "roberto iapichino@bancaditalia.it",
-		Repository:  "https://gitlab.utenze.bankit.it/siparium",
-		WebSite:     "http://portale-sap/",
-		Versions: []model.Version{
-			{
-				Code:        "1.0.0",
-				Description: "First major release, 1.0 series",
-				Repository:  "https://gitlab.utenze.bankit.it/siparium",
-				Branch:      "ver_1_0_0",
-			},
-			{
-				Code:        "1.0.1",
-				Description: "First bugfix release of the 1.0 series",
-				Branch:      "ver_1_0_1",
-			},
-		},
-	}
-	model.CreateProduct(&product)
-	fmt.Printf("product after save: %s\n", product)
-
-}
-
-/*
-import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/user"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/blobs"
+	"github.com/dihedron/builds/cli"
+	"github.com/dihedron/builds/client"
 	"github.com/dihedron/builds/model"
-	"github.com/gin-gonic/gin"
+	"github.com/dihedron/builds/notify"
+	"github.com/dihedron/builds/server"
+	"github.com/dihedron/builds/signing"
+	"github.com/dihedron/builds/webhooks"
 )
 
+func main() {
 
-type Link struct {
-	Relation string `json:"rel,omitempty"`
-	URI      string `json:"href,omitempty"`
-}
-
-func GetProducts(c *gin.Context) {
-
-	products, err := model.GetAllProducts()
-
-	type ProductInfo struct {
-		ID   string `json:"id,omitempty"`
-		Self Link   `json:"_link,omitempty"`
+	mode := flag.String("mode", "server", "the application mode (server, client, seed, migrate, assign, verify-audit, keygen)")
+	driver := flag.String("driver", "sqlite3", "the database driver (sqlite3, postgres, mysql, memory)")
+	dsn := flag.String("dsn", "./builds.db", "the data source name, e.g. the path to the SQLITE3 database")
+	address := flag.String("address", ":9080", "the address the server listens on")
+	to := flag.Int("to", -1, "the schema version to migrate to (default: latest)")
+	url := flag.String("url", "http://localhost:9080", "the URL of the server the client connects to")
+	output := flag.String("output", "table", "the client output format (table, json)")
+	users := flag.String("users", "", "the file of users allowed to authenticate with a password, as user:bcrypt-hash lines")
+	tokens := flag.String("tokens", "", "the file of users allowed to authenticate with a bearer token, as user:sha256-hash lines")
+	clientCA := flag.String("client-ca", "", "the certificate authorities of the users allowed to authenticate with a client certificate")
+	certificate := flag.String("cert", "", "the TLS certificate of the server, or the client certificate of the client")
+	key := flag.String("key", "", "the TLS private key of the server, or the client certificate key of the client")
+	ca := flag.String("ca", "", "the certificate authorities the client trusts, in addition to the system ones")
+	username := flag.String("user", "", "the user the client authenticates as; the password is read from $BUILDS_PASSWORD")
+	token := flag.String("token", os.Getenv("BUILDS_TOKEN"), "the bearer token the client authenticates with")
+	signingKey := flag.String("signing-key", "", "the Ed25519 private key the server signs approval tokens with, or the file keygen writes it to")
+	retiredKeys := flag.String("retired-keys", "", "the file of PEM-encoded public keys of former signing keys, still published by the server")
+	tokenLifetime := flag.Duration("token-lifetime", 15*time.Minute, "the time the approval tokens issued by the server are valid for")
+	webhookAttempts := flag.Int("webhook-attempts", 5, "the number of attempts made to deliver each event to a webhook")
+	webhookBackoff := flag.Duration("webhook-backoff", 2*time.Second, "the delay before retrying a failed webhook delivery, doubled at each further attempt")
+	smtpAddress := flag.String("smtp", "", "the host:port of the SMTP server deployment notifications are sent through (default: no notifications)")
+	smtpFrom := flag.String("smtp-from", "builds@localhost", "the sender address of deployment notifications")
+	smtpUser := flag.String("smtp-user", "", "the user authenticating to the SMTP server; the password is read from $BUILDS_SMTP_PASSWORD")
+	mailTemplates := flag.String("mail-templates", "", "the directory of the <event>.tmpl templates overriding the default notifications")
+	publicURL := flag.String("public-url", "", "the public URL of the server, linked in deployment notifications")
+	blobDir := flag.String("blobs", "", "the directory the server stores uploaded artifacts in (default: no artifact storage)")
+	blobQuota := flag.Int64("blob-quota", 0, "the bytes of uploaded artifacts each product can store, unless it has its own quota (default: no limit)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] [command]\noptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "assign arguments:\n  <user> <role> [<product> [<environment>]]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "client %s\n", cli.Usage())
 	}
+	flag.Parse()
 
-	if err == nil && len(products) > 0 {
-		results := make([]ProductInfo, 0, len(products))
-		for _, product := range products {
-			results = append(results, ProductInfo{
-				ID: product.ID,
-				Self: Link{
-					Relation: "self",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-				},
-			})
+	switch *mode {
+	case "server":
+		store, err := model.Open(*driver, *dsn)
+		if err != nil {
+			log.Fatalf("error opening database: %v\n", err)
 		}
-		c.JSON(http.StatusOK, gin.H{"products": results})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"products": []ProductInfo{}})
-}
-
-func GetProduct(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-
-	if productId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
+		defer store.Close()
 
-	product, err := model.GetProductByID(productId)
-
-	type VersionInfo struct {
-		ID   string `json:"id,omitempty"`
-		Link Link   `json:"_link,omitempty"`
-	}
-
-	type ProductInfo struct {
-		ID          string        `json:"id,omitempty"`
-		Description string        `json:"description,omitempty"`
-		Links       []Link        `json:"_links,omitempty"`
-		Versions    []VersionInfo `json:"versions,omitempty"`
-	}
-
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusOK, gin.H{"product": ProductInfo{}})
-		return
-	}
-
-	var versions []VersionInfo
-	if len(product.Versions) > 0 {
-		versions = make([]VersionInfo, 0, 32)
-		for _, version := range product.Versions {
-			versions = append(versions, VersionInfo{
-				ID: version.ID,
-				Link: Link{
-					Relation: "self",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID,
-				},
+		authenticators := []auth.Authenticator{}
+		if *users != "" {
+			authenticator, err := auth.NewBasicAuthenticator(*users)
+			if err != nil {
+				log.Fatalf("error loading users: %v\n", err)
+			}
+			authenticators = append(authenticators, authenticator)
+		}
+		if *tokens != "" {
+			authenticator, err := auth.NewTokenAuthenticator(*tokens)
+			if err != nil {
+				log.Fatalf("error loading tokens: %v\n", err)
+			}
+			authenticators = append(authenticators, authenticator)
+		}
+		listener := &http.Server{Addr: *address}
+		if *clientCA != "" {
+			pool, err := auth.LoadCertificatePool(*clientCA)
+			if err != nil {
+				log.Fatalf("error loading client certificate authorities: %v\n", err)
+			}
+			listener.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+			authenticators = append(authenticators, auth.NewCertificateAuthenticator())
+		}
+		options := []server.Option{
+			server.WithAuthenticators(authenticators...),
+			server.WithListeners(webhooks.NewDispatcher(store, *webhookAttempts, *webhookBackoff)),
+		}
+		if *smtpAddress != "" {
+			notifier, err := notify.NewNotifier(store, notify.Config{
+				Address:   *smtpAddress,
+				From:      *smtpFrom,
+				Username:  *smtpUser,
+				Password:  os.Getenv("BUILDS_SMTP_PASSWORD"),
+				Templates: *mailTemplates,
+				URL:       *publicURL,
 			})
+			if err != nil {
+				log.Fatalf("error configuring notifications: %v\n", err)
+			}
+			options = append(options, server.WithListeners(notifier))
 		}
-	}
-
-	result := ProductInfo{
-		ID:          product.ID,
-		Description: product.Description,
-		Links: []Link{
-			{
-				Relation: "self",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-			},
-			{
-				Relation: "collection",
-				URI:      "http://" + c.Request.Host + "/products",
-			},
-			{
-				Relation: "versions",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions",
-			},
-		},
-		Versions: versions,
-	}
-
-	c.JSON(http.StatusOK, gin.H{"product": result})
-}
-
-func GetVersions(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-
-	if productId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
-
-	product, err := model.GetProductByID(productId)
-
-	// if no product found, return error code
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
-
-	type DeploymentInfo struct {
-		Order int  `json:"order"`
-		Link  Link `json:"_link,omitempty"`
-	}
-
-	type VersionInfo struct {
-		ID          string           `json:"id,omitempty"`
-		Links       []Link           `json:"_links,omitempty"`
-		Deployments []DeploymentInfo `json:"deployments,omitempty"`
-	}
-
-	var versions []VersionInfo
-
-	if len(product.Versions) > 0 {
-		versions = make([]VersionInfo, 0, 32)
-		for _, version := range product.Versions {
-
-			var deployments []DeploymentInfo
-			if len(version.Deployments) > 0 {
-				deployments = make([]DeploymentInfo, 0, 32)
-				for _, deployment := range version.Deployments {
-					deployments = append(deployments, DeploymentInfo{
-						Order: deployment.Order,
-						Link: Link{
-							Relation: "self",
-							URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments/" + strconv.Itoa(deployment.Order),
-						},
-					})
+		if *signingKey != "" {
+			key, err := signing.LoadPrivateKey(*signingKey)
+			if err != nil {
+				log.Fatalf("error loading signing key: %v\n", err)
+			}
+			var retired []ed25519.PublicKey
+			if *retiredKeys != "" {
+				if retired, err = signing.LoadPublicKeys(*retiredKeys); err != nil {
+					log.Fatalf("error loading retired keys: %v\n", err)
 				}
 			}
-			versions = append(versions, VersionInfo{
-				ID: version.ID,
-				Links: []Link{
-					{
-						Relation: "self",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID,
-					},
-					{
-						Relation: "collection",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions",
-					},
-					{
-						Relation: "product",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-					},
-					{
-						Relation: "deployments",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments",
-					},
-				},
-				Deployments: deployments,
-			})
+			options = append(options, server.WithSigner(signing.NewSigner(key), retired...), server.WithTokenLifetime(*tokenLifetime))
 		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{"versions": versions})
-}
-
-func GetVersion(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-	versionId := c.Params.ByName("versionId")
-
-	if productId == "" || versionId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
+		if *blobDir != "" {
+			storage, err := blobs.New(*blobDir)
+			if err != nil {
+				log.Fatalf("error opening artifact storage: %v\n", err)
+			}
+			options = append(options, server.WithBlobs(storage, *blobQuota))
+		}
+		listener.Handler = server.New(store, options...)
 
-	product, err := model.GetProductByID(productId)
+		if *certificate != "" {
+			err = listener.ListenAndServeTLS(*certificate, *key)
+		} else if *clientCA != "" {
+			log.Fatalf("client certificates require a server certificate\n")
+		} else {
+			err = listener.ListenAndServe()
+		}
+		if err != nil {
+			log.Fatalf("error running server: %v\n", err)
+		}
+	case "seed":
+		store, err := model.Open(*driver, *dsn)
+		if err != nil {
+			log.Fatalf("error opening database: %v\n", err)
+		}
+		defer store.Close()
 
-	// if no product found, return error code
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
+		seed(store)
+	case "migrate":
+		store, err := model.NewGormStore(*driver, *dsn)
+		if err != nil {
+			log.Fatalf("error opening database: %v\n", err)
+		}
+		defer store.Close()
 
-	version, err := model.GetVersionByID(productId, versionId)
-	if err != nil || version.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
+		migrate(store, *to)
+	case "assign":
+		store, err := model.Open(*driver, *dsn)
+		if err != nil {
+			log.Fatalf("error opening database: %v\n", err)
+		}
+		defer store.Close()
 
-	type DeploymentInfo struct {
-		Order int  `json:"order"`
-		Link  Link `json:"_link,omitempty"`
-	}
+		assign(store, flag.Args())
+	case "verify-audit":
+		store, err := model.Open(*driver, *dsn)
+		if err != nil {
+			log.Fatalf("error opening database: %v\n", err)
+		}
+		defer store.Close()
 
-	type VersionInfo struct {
-		ID          string           `json:"id,omitempty"`
-		Description string           `json:"description,omitempty"`
-		Links       []Link           `json:"_links,omitempty"`
-		Deployments []DeploymentInfo `json:"deployments,omitempty"`
-	}
+		count, err := model.VerifyAuditLog(store)
+		if err != nil {
+			log.Fatalf("audit log broken after %d valid records: %v\n", count, err)
+		}
+		log.Printf("audit log verified: %d records\n", count)
+	case "keygen":
+		if *signingKey == "" {
+			log.Fatalf("missing -signing-key file to write the private key to\n")
+		}
+		public, err := signing.GenerateKey(*signingKey)
+		if err != nil {
+			log.Fatalf("error generating signing key: %v\n", err)
+		}
+		log.Printf("private key %s written to %s\n", signing.KeyID(public), *signingKey)
+		os.Stdout.Write(signing.EncodePublicKey(public))
+	case "client":
+		builds := client.New(*url)
+		switch {
+		case *token != "":
+			builds.SetBearerToken(*token)
+		case *username != "":
+			builds.SetBasicAuth(*username, os.Getenv("BUILDS_PASSWORD"))
+		}
+		if *certificate != "" || *ca != "" {
+			config, err := clientTLS(*certificate, *key, *ca)
+			if err != nil {
+				log.Fatalf("error loading TLS configuration: %v\n", err)
+			}
+			builds.SetTLSConfig(config)
+		}
 
-	var deployments []DeploymentInfo
-	if len(version.Deployments) > 0 {
-		deployments = make([]DeploymentInfo, 0, 32)
-		for _, deployment := range version.Deployments {
-			deployments = append(deployments, DeploymentInfo{
-				Order: deployment.Order,
-				Link: Link{
-					Relation: "self",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments/" + strconv.Itoa(deployment.Order),
-				},
-			})
+		command, err := cli.New(builds, *output, os.Stdout)
+		if err != nil {
+			log.Fatalf("error starting client: %v\n", err)
 		}
+		if err := command.Run(flag.Args()); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	default:
+		log.Fatalf("unsupported mode: %q\n", *mode)
 	}
-	result := VersionInfo{
-		ID:          version.ID,
-		Description: version.Description,
-		Links: []Link{
-			{
-				Relation: "self",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID,
-			},
-			{
-				Relation: "collection",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions",
-			},
-			{
-				Relation: "product",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-			},
-			{
-				Relation: "deployments",
-				URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments",
-			},
-		},
-		Deployments: deployments,
-	}
-
-	c.JSON(http.StatusOK, gin.H{"version": result})
 }
 
-func GetDeployments(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-	versionId := c.Params.ByName("versionId")
-
-	if productId == "" || versionId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
-
-	product, err := model.GetProductByID(productId)
-
-	// if no product found, return error code
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
+// migrate brings the database schema to the given version, or to the latest
+// one if the version is negative.
+func migrate(store *model.GormStore, to int) {
+	version := model.LatestSchemaVersion()
+	if to >= 0 {
+		version = uint(to)
 	}
 
-	version, err := model.GetVersionByID(productId, versionId)
-	if err != nil || version.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
-
-	type DeploymentInfo struct {
-		Order int    `json:"order"`
-		Links []Link `json:"_links,omitempty"`
-	}
-
-	var deployments []DeploymentInfo
-	if len(version.Deployments) > 0 {
-		deployments = make([]DeploymentInfo, 0, len(version.Deployments))
+	current, err := store.SchemaVersion()
+	if err != nil {
+		log.Fatalf("error reading schema version: %v\n", err)
 	}
+	log.Printf("migrating database schema from version %d to %d\n", current, version)
 
-	for _, deployment := range version.Deployments {
-		deployments = append(deployments, DeploymentInfo{
-			Order: deployment.Order,
-			Links: []Link{
-				{
-					Relation: "self",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments/" + strconv.Itoa(deployment.Order),
-				},
-				{
-					Relation: "collection",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments",
-				},
-				{
-					Relation: "version",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID,
-				},
-				{
-					Relation: "product",
-					URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-				},
-			},
-		})
+	if err := store.Migrate(version); err != nil {
+		log.Fatalf("error migrating database schema: %v\n", err)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"deployments": deployments})
+	log.Printf("database schema is at version %d\n", version)
 }
 
-func GetDeployment(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-	versionId := c.Params.ByName("versionId")
-	deploymentId := c.Params.ByName("deploymentId")
-
-	if productId == "" || versionId == "" || deploymentId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
-
-	product, err := model.GetProductByID(productId)
-
-	// if no product found, return error code
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
-
-	version, err := model.GetVersionByID(productId, versionId)
-	if err != nil || version.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
-	}
-
-	deployOrder, err := strconv.Atoi(deploymentId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, nil)
-		return
-	}
-
-	for _, deployment := range version.Deployments {
-		if deployment.Order == deployOrder {
-			// found
-			type DeploymentInfo struct {
-				Order       int          `json:"order"`
-				Environment string       `json:"environment,omitempty"`
-				Status      model.Status `json:"status,omitempty"`
-				GrantedBy   string       `json:"grantedBy,omitempty"`
-				Timestamp   time.Time    `json:"timestamp,omitempty"`
-				Links       []Link       `json:"_links,omitempty"`
-			}
-
-			result := DeploymentInfo{
-				Order:       deployment.Order,
-				Environment: deployment.Environment,
-				Status:      deployment.Status,
-				GrantedBy:   deployment.GrantedBy,
-				Timestamp:   deployment.Timestamp,
-				Links: []Link{
-					{
-						Relation: "self",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments/" + strconv.Itoa(deployment.Order),
-					},
-					{
-						Relation: "collection",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID + "/deployments",
-					},
-					{
-						Relation: "version",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID + "/versions/" + version.ID,
-					},
-					{
-						Relation: "product",
-						URI:      "http://" + c.Request.Host + "/products/" + product.ID,
-					},
-				},
-			}
-
-			c.JSON(http.StatusOK, gin.H{"deployment": result})
-			return
+// assign grants a role to a user directly in the database, e.g. to appoint
+// the first administrator; the arguments are the user, the role and
+// optionally the product and the environment the role is restricted to.
+func assign(store model.Store, args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		log.Fatalf("usage: assign <user> <role> [<product> [<environment>]]\n")
+	}
+	assignment := model.Assignment{User: args[0], Role: model.Role(strings.ToUpper(args[1]))}
+	if !assignment.Role.Valid() {
+		log.Fatalf("unsupported role: %q\n", args[1])
+	}
+	var product model.Product
+	if len(args) > 2 {
+		var err error
+		if product, err = store.GetProductByCode(args[2]); err != nil {
+			log.Fatalf("error reading product: %v\n", err)
 		}
+		assignment.ProductID = product.ID
 	}
-	c.JSON(http.StatusNotFound, nil)
-}
-
-func ApproveDeployment(c *gin.Context) {
-	productId := c.Params.ByName("productId")
-	versionId := c.Params.ByName("versionId")
-	deploymentId := c.Params.ByName("deploymentId")
-
-	if productId == "" || versionId == "" || deploymentId == "" {
-		c.JSON(http.StatusBadRequest, nil)
-		return
+	if len(args) > 3 {
+		assignment.Environment = args[3]
 	}
-
-	product, err := model.GetProductByID(productId)
-
-	// if no product found, return error code
-	if err != nil || product.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
+	if err := store.CreateAssignment(&assignment); err != nil {
+		log.Fatalf("error assigning role: %v\n", err)
 	}
-
-	version, err := model.GetVersionByID(productId, versionId)
-	if err != nil || version.ID == "" {
-		c.JSON(http.StatusNotFound, nil)
-		return
+	// the role is assigned directly in the database, on behalf of the local
+	// user running the command
+	operator := ""
+	if current, err := user.Current(); err == nil {
+		operator = current.Username
+	}
+	record, err := model.NewAuditRecord(operator, model.CREATE, "assignment", product.Code, strconv.FormatUint(uint64(assignment.ID), 10), nil, assignment)
+	if err == nil {
+		err = store.AppendAuditRecord(&record)
 	}
-
-	deployOrder, err := strconv.Atoi(deploymentId)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, nil)
-		return
+		log.Fatalf("error recording role assignment: %v\n", err)
 	}
+	log.Printf("role %s assigned to user %q\n", assignment.Role, assignment.User)
+}
 
-	for _, deployment := range version.Deployments {
-		if deployment.Order == deployOrder {
-			deployment.Status = model.GRANTED
-			deployment.GrantedBy = "d093154" // TODO: use remote user for authenticated requests
-			deployment.Timestamp = time.Now()
-
-			model.UpdateDeployment(productId, versionId, deployment)
-
-			c.JSON(http.StatusAccepted, nil)
-			return
+// clientTLS returns the TLS configuration of the client, authenticating with
+// the given client certificate (if any) and trusting the given certificate
+// authorities (if any) in addition to the system ones.
+func clientTLS(certificate string, key string, ca string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certificate != "" {
+		pair, err := tls.LoadX509KeyPair(certificate, key)
+		if err != nil {
+			return nil, err
 		}
+		config.Certificates = []tls.Certificate{pair}
 	}
-	c.JSON(http.StatusNotFound, nil)
-
-}
-
-const DBPATH string = "./builds.db"
-
-func main() {
-
-	mode := flag.String("mode", "server", "the application mode")
-	flag.Parse()
-
-	switch *mode {
-	case "server":
-		router := gin.Default()
-		router.GET("/products", GetProducts)
-		router.GET("/products/:productId", GetProduct)
-		router.GET("/products/:productId/versions", GetVersions)
-		router.GET("/products/:productId/versions/:versionId", GetVersion)
-		router.GET("/products/:productId/versions/:versionId/deployments", GetDeployments)
-		router.GET("/products/:productId/versions/:versionId/deployments/:deploymentId", GetDeployment)
-		router.GET("/products/:productId/versions/:versionId/deployments/:deploymentId/approve")
-		// Listen and Server in 0.0.0.0:8080
-		router.Run(":9080")
-	case "client":
-		// open database if existing, otherwise create one
-		if _, err := os.Stat(DBPATH); err != nil {
-			if os.IsNotExist(err) {
-				// database does not exist, create one
-				model.New(DBPATH)
-			} else {
-				log.Printf("error checking for database: %v\n", err)
-				return
-			}
-		} else {
-			// file exists
-			model.Load(DBPATH)
+	if ca != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
 		}
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid certificate authorities in %q", ca)
+		}
+		config.RootCAs = pool
 	}
-
-	/*
-		// list all builds
-		router.GET("/builds", func(c *gin.Context) {
-			c.String(200, "pong")
-		})
-
-		// Ping test
-		router.GET("/ping", func(c *gin.Context) {
-			c.String(200, "pong")
-		})
-
-		// Get user value
-		router.GET("/user/:name", func(c *gin.Context) {
-			user := c.Params.ByName("name")
-			value, ok := DB[user]
-			if ok {
-				c.JSON(200, gin.H{"user": user, "value": value})
-			} else {
-				c.JSON(200, gin.H{"user": user, "status": "no value"})
-			}
-		})
-
-		// Authorized group (uses gin.BasicAuth() middleware)
-		// Same than:
-		// authorized := r.Group("/")
-		// authorized.Use(gin.BasicAuth(gin.Credentials{
-		//	  "foo":  "bar",
-		//	  "manu": "123",
-		//}))
-		authorized := router.Group("/", gin.BasicAuth(gin.Accounts{
-			"foo":  "bar", // user:foo password:bar
-			"manu": "123", // user:manu password:123
-		}))
-
-		authorized.POST("admin", func(c *gin.Context) {
-			user := c.MustGet(gin.AuthUserKey).(string)
-
-			// Parse JSON
-			var json struct {
-				Value string `json:"value" binding:"required"`
-			}
-
-			if c.Bind(&json) == nil {
-				DB[user] = json.Value
-				c.JSON(200, gin.H{"status": "ok"})
-			}
-		})
-
-
+	return config, nil
 }
-*/
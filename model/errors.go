@@ -2,8 +2,65 @@ package model
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
 var (
+	// ErrorNotFound is returned when the requested item does not exist.
 	ErrorNotFound = fmt.Errorf("item not found")
+	// ErrorDuplicate is returned when an item cannot be stored because it
+	// would violate a uniqueness constraint, e.g. a product code already in
+	// use.
+	ErrorDuplicate = fmt.Errorf("duplicate item")
+	// ErrorConstraint is returned when an item cannot be stored because it
+	// would violate some other integrity constraint, e.g. a version referring
+	// to a non-existing product.
+	ErrorConstraint = fmt.Errorf("constraint violation")
+	// ErrorIO is returned when the database could not be read or written.
+	ErrorIO = fmt.Errorf("database I/O error")
 )
+
+// classify maps an error returned by the database layer onto one of the
+// errors above, so that callers can tell them apart via errors.Cause; errors
+// that have already been classified are returned as they are.
+func classify(err error) error {
+	switch errors.Cause(err) {
+	case ErrorNotFound, ErrorDuplicate, ErrorConstraint, ErrorIO:
+		return err
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrorNotFound
+	}
+	message := err.Error()
+	switch e := errors.Cause(err).(type) {
+	case *pq.Error:
+		switch {
+		case e.Code == "23505": // unique_violation
+			return errors.Wrap(ErrorDuplicate, message)
+		case e.Code.Class() == "23": // integrity_constraint_violation
+			return errors.Wrap(ErrorConstraint, message)
+		}
+		return errors.Wrap(ErrorIO, message)
+	case *mysql.MySQLError:
+		switch e.Number {
+		case 1062: // ER_DUP_ENTRY
+			return errors.Wrap(ErrorDuplicate, message)
+		case 1048, 1216, 1217, 1451, 1452: // ER_BAD_NULL_ERROR and foreign key errors
+			return errors.Wrap(ErrorConstraint, message)
+		}
+		return errors.Wrap(ErrorIO, message)
+	}
+	// SQLITE3 errors are only distinguishable by their message
+	switch {
+	case strings.Contains(message, "UNIQUE constraint failed"):
+		return errors.Wrap(ErrorDuplicate, message)
+	case strings.Contains(message, "constraint failed"):
+		return errors.Wrap(ErrorConstraint, message)
+	}
+	return errors.Wrap(ErrorIO, message)
+}
@@ -0,0 +1,1219 @@
+package model
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/semver"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"    // register the "mysql" driver
+	_ "github.com/jinzhu/gorm/dialects/postgres" // register the "postgres" driver
+	_ "github.com/jinzhu/gorm/dialects/sqlite"   // don't refer to SQLITE3
+	"github.com/pkg/errors"
+)
+
+// ensure GormStore implements Store.
+var _ Store = (*GormStore)(nil)
+
+// GormStore is a Store backed by a relational database, accessed through
+// gorm.
+type GormStore struct {
+	db *gorm.DB
+	// mutex serialises the appends to the audit log, which must each read
+	// the last record in order to chain to it.
+	mutex sync.Mutex
+	// allocation serialises the version allocations within the process, so
+	// that they only race with those of other processes.
+	allocation sync.Mutex
+}
+
+// NewGormStore connects to the database identified by the given driver
+// ("sqlite3", "postgres" or "mysql") and data source name; for SQLITE3 the
+// DSN is the path to the database file, which is created if not existing,
+// whereas MySQL DSNs must include the parseTime=True parameter. The schema
+// is left untouched: see Migrate.
+func NewGormStore(driver string, dsn string) (*GormStore, error) {
+
+	db, err := gorm.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load database driver")
+	}
+
+	if err = db.DB().Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to connect to database manager")
+	}
+
+	return &GormStore{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *GormStore) Close() error {
+	if err := s.db.Close(); err != nil {
+		return errors.Wrap(err, "error closing the database")
+	}
+	return nil
+}
+
+// Atomically makes the changes of the given function, which it makes through
+// the store it is passed, in a single database transaction: if the function
+// returns an error, the transaction is rolled back and the error returned.
+// Transactions are serialised with the appends to the audit log, which must
+// each read the last record in order to chain to it, since the records
+// appended in a transaction are only visible once it is committed.
+func (s *GormStore) Atomically(changes func(store Store) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return changes(&GormStore{db: tx})
+	})
+}
+
+// GetProducts returns the full list of products.
+func (s *GormStore) GetProducts() ([]Product, error) {
+	var products []Product
+	if err := s.db.Find(&products).Error; err != nil {
+		return nil, errors.Wrap(classify(err), "error listing products")
+	}
+	return products, nil
+}
+
+// GetProductByCode returns the product with the given code, along with its
+// versions; if no such product exists, ErrorNotFound is returned.
+func (s *GormStore) GetProductByCode(code string) (Product, error) {
+	var product Product
+	if err := s.db.Where(&Product{Code: code}).Preload("Versions").First(&product).Error; err != nil {
+		return Product{}, errors.Wrapf(classify(err), "error reading product %q", code)
+	}
+	SortVersions(product.Versions)
+	return product, nil
+}
+
+// GetVersions returns the list of versions of the given product, along with
+// their deployments, sorted by precedence.
+func (s *GormStore) GetVersions(product Product) ([]Version, error) {
+	var versions []Version
+	err := s.db.Where(&Version{ProductID: product.ID}).Preload("Deployments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("ordinal")
+	}).Preload("Deployments.Approvals", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Find(&versions).Error
+	if err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing versions of product %q", product.Code)
+	}
+	SortVersions(versions)
+	return versions, nil
+}
+
+// GetVersionByCode returns the version of the given product having the given
+// code, along with its deployments; if no such version exists, ErrorNotFound
+// is returned.
+func (s *GormStore) GetVersionByCode(product Product, code string) (Version, error) {
+	var version Version
+	err := s.db.Where(&Version{ProductID: product.ID, Code: code}).Preload("Deployments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("ordinal")
+	}).Preload("Deployments.Approvals", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&version).Error
+	if err != nil {
+		return Version{}, errors.Wrapf(classify(err), "error reading version %q of product %q", code, product.Code)
+	}
+	return version, nil
+}
+
+// GetDeploymentByOrder returns the deployment of the given version having the
+// given order, along with its approvals, status transitions and deployed
+// artifacts; if no such deployment exists, ErrorNotFound is returned.
+func (s *GormStore) GetDeploymentByOrder(version Version, order int) (Deployment, error) {
+	var deployment Deployment
+	if err := s.db.Where("version_id = ? AND ordinal = ?", version.ID, order).Preload("Approvals", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Preload("Transitions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Preload("Artifacts", func(db *gorm.DB) *gorm.DB {
+		return db.Order("digest")
+	}).First(&deployment).Error; err != nil {
+		return Deployment{}, errors.Wrapf(classify(err), "error reading deployment %d of version %q", order, version.Code)
+	}
+	return deployment, nil
+}
+
+// CreateProduct creates a new Product; if it contains Version references,
+// those are created too. If the product code is already in use, ErrorDuplicate
+// is returned.
+func (s *GormStore) CreateProduct(product *Product) error {
+	if err := s.db.Create(product).Error; err != nil {
+		return errors.Wrapf(classify(err), "error creating product %q", product.Code)
+	}
+	return nil
+}
+
+// UpdateProduct updates an existing product; if it contains Versions,
+// those are updated as well. If the product does not exist, ErrorNotFound
+// is returned; if its new code is already in use, ErrorDuplicate is.
+func (s *GormStore) UpdateProduct(product *Product) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Product{}, product.ID); err != nil {
+			return err
+		}
+		return tx.Save(product).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating product %q", product.Code)
+	}
+	return nil
+}
+
+// DeleteProduct deletes an existing product from the database; any existing
+// linked Version, Policy, Stage, Webhook (along with its deliveries) and
+// Assignment objects are deleted as well (cascade). If the product does not
+// exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteProduct(product *Product) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Product{}, product.ID); err != nil {
+			return err
+		}
+		versions := tx.Table("versions").Select("id").Where("product_id = ?", product.ID).SubQuery()
+		deployments := tx.Table("deployments").Select("id").Where("version_id IN ?", versions).SubQuery()
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&Approval{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&Transition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&DeployedArtifact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("version_id IN ?", versions).Delete(&Deployment{}).Error; err != nil {
+			return err
+		}
+		builds := tx.Table("builds").Select("id").Where("version_id IN ?", versions).SubQuery()
+		if err := tx.Where("build_id IN ?", builds).Delete(&Artifact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("version_id IN ?", versions).Delete(&Build{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Policy{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Stage{}).Error; err != nil {
+			return err
+		}
+		webhooks := tx.Table("webhooks").Select("id").Where("product_id = ?", product.ID).SubQuery()
+		if err := tx.Where("webhook_id IN ?", webhooks).Delete(&Delivery{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Webhook{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Version{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Assignment{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", product.ID).Delete(&Product{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting product %q", product.Code)
+	}
+	return nil
+}
+
+// CreateVersion creates a new Version; the version must refer to an existing
+// Product through its ProductID, otherwise ErrorConstraint is returned; if it
+// contains Deployment references, those are created too. If the version code
+// is already in use for the product, ErrorDuplicate is returned.
+func (s *GormStore) CreateVersion(version *Version) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Product{}, version.ProductID); err != nil {
+			return err
+		}
+		return tx.Create(version).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating version %q", version.Code)
+	}
+	return nil
+}
+
+// AllocateVersion atomically creates a new Version of a product, whose code
+// follows that of its latest version by incrementing the given part (see
+// NextCode) and whose Branch, unless given, is the default one. The version
+// must refer to an existing Product through its ProductID, otherwise
+// ErrorConstraint is returned. Allocations racing with other processes on the
+// same product are retried.
+func (s *GormStore) AllocateVersion(version *Version, part semver.Part, identifier string) error {
+	s.allocation.Lock()
+	defer s.allocation.Unlock()
+	branch := version.Branch
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			if err := references(tx, &Product{}, version.ProductID); err != nil {
+				return err
+			}
+			var versions []Version
+			if err := tx.Where(&Version{ProductID: version.ProductID}).Find(&versions).Error; err != nil {
+				return err
+			}
+			code, err := NextCode(versions, part, identifier)
+			if err != nil {
+				return errors.Wrap(ErrorConstraint, err.Error())
+			}
+			version.ID, version.Code, version.Branch = 0, code, branch
+			if version.Branch == "" {
+				version.Branch = DefaultBranch(code)
+			}
+			return tx.Create(version).Error
+		})
+		if err == nil || errors.Cause(classify(err)) != ErrorDuplicate {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(classify(err), "error allocating %s version of product %d", part, version.ProductID)
+	}
+	return nil
+}
+
+// UpdateVersion updates an existing version; if it contains Deployments,
+// those are updated as well. If the version does not exist, ErrorNotFound is
+// returned; if its new code is already in use, ErrorDuplicate is, and if it is
+// not a semantic version (unless it is the unchanged code of a legacy
+// version), ErrorConstraint is.
+func (s *GormStore) UpdateVersion(version *Version) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Version{}, version.ID); err != nil {
+			return err
+		}
+		// legacy versions keep their mark only as long as their code
+		var current Version
+		if err := tx.Select("code, legacy").Where("id = ?", version.ID).First(&current).Error; err != nil {
+			return err
+		}
+		version.Legacy = current.Legacy && version.Code == current.Code
+		return tx.Save(version).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating version %q", version.Code)
+	}
+	return nil
+}
+
+// DeleteVersion deletes an existing version from the database; any existing
+// linked Deployment and Build objects are deleted as well (cascade), along
+// with their own. If the version does not exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteVersion(version *Version) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Version{}, version.ID); err != nil {
+			return err
+		}
+		deployments := tx.Table("deployments").Select("id").Where("version_id = ?", version.ID).SubQuery()
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&Approval{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&Transition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id IN ?", deployments).Delete(&DeployedArtifact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("version_id = ?", version.ID).Delete(&Deployment{}).Error; err != nil {
+			return err
+		}
+		builds := tx.Table("builds").Select("id").Where("version_id = ?", version.ID).SubQuery()
+		if err := tx.Where("build_id IN ?", builds).Delete(&Artifact{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("version_id = ?", version.ID).Delete(&Build{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", version.ID).Delete(&Version{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting version %q", version.Code)
+	}
+	return nil
+}
+
+// GetBuilds returns the list of builds of the given version, sorted by their
+// number.
+func (s *GormStore) GetBuilds(version Version) ([]Build, error) {
+	var builds []Build
+	if err := s.db.Where(&Build{VersionID: version.ID}).Order("number").Find(&builds).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing builds of version %q", version.Code)
+	}
+	return builds, nil
+}
+
+// GetBuildByNumber returns the build of the given version having the given
+// number; if no such build exists, ErrorNotFound is returned.
+func (s *GormStore) GetBuildByNumber(version Version, number int) (Build, error) {
+	var build Build
+	if err := s.db.Where("version_id = ? AND number = ?", version.ID, number).First(&build).Error; err != nil {
+		return Build{}, errors.Wrapf(classify(err), "error reading build %d of version %q", number, version.Code)
+	}
+	return build, nil
+}
+
+// CreateBuild creates a new Build; the build must refer to an existing
+// Version through its VersionID, otherwise ErrorConstraint is returned; if no
+// Status is provided, the build is created as RUNNING. If the build number is
+// already in use for the version, ErrorDuplicate is returned.
+func (s *GormStore) CreateBuild(build *Build) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Version{}, build.VersionID); err != nil {
+			return err
+		}
+		return tx.Create(build).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating build %d", build.Number)
+	}
+	return nil
+}
+
+// UpdateBuild updates an existing build, e.g. to record its outcome. If the
+// build does not exist, ErrorNotFound is returned; if its new number is
+// already in use, ErrorDuplicate is.
+func (s *GormStore) UpdateBuild(build *Build) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Build{}, build.ID); err != nil {
+			return err
+		}
+		return tx.Save(build).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating build %d", build.Number)
+	}
+	return nil
+}
+
+// DeleteBuild deletes an existing build from the database; any existing
+// linked Artifact objects are deleted as well (cascade). If the build does not
+// exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteBuild(build *Build) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Build{}, build.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("build_id = ?", build.ID).Delete(&Artifact{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", build.ID).Delete(&Build{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting build %d", build.Number)
+	}
+	return nil
+}
+
+// GetArtifacts returns the list of artifacts of the given build, sorted by
+// name.
+func (s *GormStore) GetArtifacts(build Build) ([]Artifact, error) {
+	var artifacts []Artifact
+	if err := s.db.Where(&Artifact{BuildID: build.ID}).Order("name").Find(&artifacts).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing artifacts of build %d", build.Number)
+	}
+	return artifacts, nil
+}
+
+// GetArtifactByName returns the artifact of the given build having the given
+// name; if no such artifact exists, ErrorNotFound is returned.
+func (s *GormStore) GetArtifactByName(build Build, name string) (Artifact, error) {
+	var artifact Artifact
+	if err := s.db.Where("build_id = ? AND name = ?", build.ID, name).First(&artifact).Error; err != nil {
+		return Artifact{}, errors.Wrapf(classify(err), "error reading artifact %q of build %d", name, build.Number)
+	}
+	return artifact, nil
+}
+
+// CreateArtifact creates a new Artifact; the artifact must refer to an
+// existing Build through its BuildID, otherwise ErrorConstraint is returned.
+// If the artifact name is already in use for the build, ErrorDuplicate is
+// returned.
+func (s *GormStore) CreateArtifact(artifact *Artifact) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Build{}, artifact.BuildID); err != nil {
+			return err
+		}
+		return tx.Create(artifact).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating artifact %q", artifact.Name)
+	}
+	return nil
+}
+
+// DeleteArtifact deletes an existing artifact from the database; the
+// deployments which deployed it keep its digest. If the artifact does not
+// exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteArtifact(artifact *Artifact) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Artifact{}, artifact.ID); err != nil {
+			return err
+		}
+		return tx.Where("id = ?", artifact.ID).Delete(&Artifact{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting artifact %q", artifact.Name)
+	}
+	return nil
+}
+
+// FindArtifacts returns the artifacts having the given digest, across all
+// products, oldest first.
+func (s *GormStore) FindArtifacts(digest string) ([]ArtifactMatch, error) {
+	matches := []ArtifactMatch{}
+	if err := s.db.Table("artifacts").
+		Select("artifacts.*, versions.product_id, products.code AS product_code, versions.code AS version_code, builds.number AS build_number").
+		Joins("JOIN builds ON builds.id = artifacts.build_id").
+		Joins("JOIN versions ON versions.id = builds.version_id").
+		Joins("JOIN products ON products.id = versions.product_id").
+		Where("artifacts.digest = ?", digest).
+		Order("artifacts.id").
+		Scan(&matches).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error finding artifacts %q", digest)
+	}
+	return matches, nil
+}
+
+// GetArtifactDigests returns the distinct digests of the artifacts of the
+// given product, or of all products if its ID is 0, sorted.
+func (s *GormStore) GetArtifactDigests(product Product) ([]string, error) {
+	digests := []string{}
+	db := s.db.Table("artifacts")
+	if product.ID != 0 {
+		db = db.Joins("JOIN builds ON builds.id = artifacts.build_id").
+			Joins("JOIN versions ON versions.id = builds.version_id").
+			Where("versions.product_id = ?", product.ID)
+	}
+	if err := db.Order("artifacts.digest").Pluck("DISTINCT artifacts.digest", &digests).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing artifact digests of product %q", product.Code)
+	}
+	return digests, nil
+}
+
+// FindDeployments returns the deployments which deployed the artifact having
+// the given digest, across all products, oldest first.
+func (s *GormStore) FindDeployments(digest string) ([]DeploymentMatch, error) {
+	matches := []DeploymentMatch{}
+	if err := s.db.Table("deployments").
+		Select("deployments.*, versions.product_id, products.code AS product_code, versions.code AS version_code").
+		Joins("JOIN deployed_artifacts ON deployed_artifacts.deployment_id = deployments.id").
+		Joins("JOIN versions ON versions.id = deployments.version_id").
+		Joins("JOIN products ON products.id = versions.product_id").
+		Where("deployed_artifacts.digest = ?", digest).
+		Order("deployments.id").
+		Scan(&matches).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error finding deployments of artifact %q", digest)
+	}
+	return matches, nil
+}
+
+// GetDeployedDigests returns the distinct digests of the artifacts deployed
+// by all deployments, sorted.
+func (s *GormStore) GetDeployedDigests() ([]string, error) {
+	digests := []string{}
+	if err := s.db.Table("deployed_artifacts").Order("digest").Pluck("DISTINCT digest", &digests).Error; err != nil {
+		return nil, errors.Wrap(classify(err), "error listing deployed digests")
+	}
+	return digests, nil
+}
+
+// GetDeployments returns the list of deployments of the given version,
+// sorted by their order.
+func (s *GormStore) GetDeployments(version Version) ([]Deployment, error) {
+	var deployments []Deployment
+	if err := s.db.Where(&Deployment{VersionID: version.ID}).Order("ordinal").Preload("Approvals", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Find(&deployments).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing deployments of version %q", version.Code)
+	}
+	return deployments, nil
+}
+
+// CreateDeployment creates a new Deployment; the deployment must refer to an
+// existing Version through its VersionID, otherwise ErrorConstraint is
+// returned; if no Status is provided, the deployment is created as PENDING.
+// If the deployment order is already in use for the version, ErrorDuplicate
+// is returned.
+func (s *GormStore) CreateDeployment(deployment *Deployment) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Version{}, deployment.VersionID); err != nil {
+			return err
+		}
+		return tx.Create(deployment).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// UpdateDeployment updates an existing deployment, e.g. to record its change
+// of Status. If the deployment does not exist, ErrorNotFound is returned; if
+// its new order is already in use, ErrorDuplicate is.
+func (s *GormStore) UpdateDeployment(deployment *Deployment) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Deployment{}, deployment.ID); err != nil {
+			return err
+		}
+		return tx.Save(deployment).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// DeleteDeployment deletes an existing deployment from the database; any
+// existing linked Approval, Transition and DeployedArtifact objects are
+// deleted as well (cascade). If the deployment does not exist, ErrorNotFound
+// is returned.
+func (s *GormStore) DeleteDeployment(deployment *Deployment) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Deployment{}, deployment.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id = ?", deployment.ID).Delete(&Approval{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id = ?", deployment.ID).Delete(&Transition{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id = ?", deployment.ID).Delete(&DeployedArtifact{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", deployment.ID).Delete(&Deployment{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// SetDeploymentArtifacts replaces the artifacts deployed by an existing
+// deployment with those having the given digests; the deployment is reloaded
+// along with all its approvals, status transitions and artifacts. If the
+// deployment does not exist, ErrorNotFound is returned; if it is no longer
+// PENDING, or any of the digests is not that of an artifact of the builds of
+// its version, ErrorConstraint is.
+func (s *GormStore) SetDeploymentArtifacts(deployment *Deployment, digests []string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// touch the deployment first, so that its status cannot change
+		// until its artifacts are set
+		result := tx.Model(&Deployment{}).Where("id = ?", deployment.ID).UpdateColumn("updated_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrorNotFound
+		}
+		var current Deployment
+		if err := tx.Where("id = ?", deployment.ID).First(&current).Error; err != nil {
+			return err
+		}
+		if current.Status != PENDING {
+			return errors.Wrapf(ErrorConstraint, "deployment is %s: its artifacts can only change while %s", current.Status, PENDING)
+		}
+		var built []string
+		if len(digests) > 0 {
+			if err := tx.Table("artifacts").Joins("JOIN builds ON builds.id = artifacts.build_id").
+				Where("builds.version_id = ? AND artifacts.digest IN (?)", current.VersionID, digests).
+				Pluck("artifacts.digest", &built).Error; err != nil {
+				return err
+			}
+		}
+		if err := checkDigests(digests, built); err != nil {
+			return err
+		}
+		if err := tx.Where("deployment_id = ?", current.ID).Delete(&DeployedArtifact{}).Error; err != nil {
+			return err
+		}
+		for _, digest := range uniqueDigests(digests) {
+			if err := tx.Create(&DeployedArtifact{DeploymentID: current.ID, Digest: digest}).Error; err != nil {
+				return err
+			}
+		}
+		*deployment = current
+		return reload(tx, deployment)
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error setting artifacts of deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// ApproveDeployment records the approval of an existing PENDING deployment
+// and, once the deployment has collected the given number of approvals,
+// grants it on behalf of the last approver, recording the transition; the
+// deployment is reloaded along with all its approvals and status transitions.
+// If the deployment does not exist, ErrorNotFound is returned; if it is not
+// PENDING, ErrorConstraint is; if the user has already approved it,
+// ErrorDuplicate is.
+func (s *GormStore) ApproveDeployment(deployment *Deployment, approval *Approval, required int) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// touch the deployment first, so that concurrent approvals of the
+		// same deployment are serialised by the row lock
+		result := tx.Model(&Deployment{}).Where("id = ?", deployment.ID).UpdateColumn("updated_at", approval.Timestamp)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrorNotFound
+		}
+		var current Deployment
+		if err := tx.Where("id = ?", deployment.ID).First(&current).Error; err != nil {
+			return err
+		}
+		if current.Status != PENDING {
+			return errors.Wrapf(ErrorConstraint, "deployment is %s, not %s", current.Status, PENDING)
+		}
+
+		approval.DeploymentID = deployment.ID
+		if err := tx.Create(approval).Error; err != nil {
+			return err
+		}
+		var approvers []string
+		if err := tx.Model(&Approval{}).Where("deployment_id = ?", deployment.ID).Order("id").Pluck("username", &approvers).Error; err != nil {
+			return err
+		}
+		if len(approvers) >= required {
+			if err := applyTransition(tx, &current, &Transition{
+				To:        GRANTED,
+				User:      approval.User,
+				Reason:    "approved by " + strings.Join(approvers, ", "),
+				Timestamp: approval.Timestamp,
+			}); err != nil {
+				return err
+			}
+		}
+		*deployment = current
+		return reload(tx, deployment)
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error approving deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// TransitionDeployment moves an existing deployment to the status the given
+// transition leads to, provided that the state machine allows it from its
+// current one, and records the transition; deployments moving to GRANTED are
+// granted on behalf of the user of the transition. The deployment is reloaded
+// along with all its approvals and status transitions. If the deployment does
+// not exist, ErrorNotFound is returned; if the transition is not allowed,
+// ErrorConstraint is.
+func (s *GormStore) TransitionDeployment(deployment *Deployment, transition *Transition) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// touch the deployment first, so that concurrent transitions of the
+		// same deployment are serialised by the row lock
+		result := tx.Model(&Deployment{}).Where("id = ?", deployment.ID).UpdateColumn("updated_at", transition.Timestamp)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrorNotFound
+		}
+		var current Deployment
+		if err := tx.Where("id = ?", deployment.ID).First(&current).Error; err != nil {
+			return err
+		}
+		if err := applyTransition(tx, &current, transition); err != nil {
+			return err
+		}
+		*deployment = current
+		return reload(tx, deployment)
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error changing status of deployment %d to %s", deployment.Order, transition.To)
+	}
+	return nil
+}
+
+// ChangeDeployment updates the order and environment of an existing deployment
+// and moves it to the status the given transition leads to, if any, in a
+// single transaction; since they were given for what the deployment was, its
+// approvals are withdrawn if its order or environment change. The deployment
+// is reloaded along with all its approvals, status transitions and artifacts.
+// If the deployment does not exist, ErrorNotFound is returned; if its order or
+// environment change once it is no longer PENDING, or the transition is not
+// allowed, ErrorConstraint is; if its new order is already in use,
+// ErrorDuplicate is.
+func (s *GormStore) ChangeDeployment(deployment *Deployment, transition *Transition) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// touch the deployment first, so that concurrent changes of the same
+		// deployment are serialised by the row lock
+		result := tx.Model(&Deployment{}).Where("id = ?", deployment.ID).UpdateColumn("updated_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrorNotFound
+		}
+		var current Deployment
+		if err := tx.Where("id = ?", deployment.ID).First(&current).Error; err != nil {
+			return err
+		}
+		if current.Order != deployment.Order || current.Environment != deployment.Environment {
+			if current.Status != PENDING {
+				return errors.Wrapf(ErrorConstraint, "deployment is %s: its order and environment can only change while %s", current.Status, PENDING)
+			}
+			if err := tx.Where("deployment_id = ?", current.ID).Delete(&Approval{}).Error; err != nil {
+				return err
+			}
+			current.Order = deployment.Order
+			current.Environment = deployment.Environment
+			if err := tx.Save(&current).Error; err != nil {
+				return err
+			}
+		}
+		if transition != nil {
+			if err := applyTransition(tx, &current, transition); err != nil {
+				return err
+			}
+		}
+		*deployment = current
+		return reload(tx, deployment)
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error changing deployment %d", deployment.Order)
+	}
+	return nil
+}
+
+// GetPolicies returns the list of approval policies of the given product.
+func (s *GormStore) GetPolicies(product Product) ([]Policy, error) {
+	var policies []Policy
+	if err := s.db.Where(&Policy{ProductID: product.ID}).Order("environment").Find(&policies).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing policies of product %q", product.Code)
+	}
+	return policies, nil
+}
+
+// CreatePolicy creates a new approval Policy; the policy must refer to an
+// existing Product through its ProductID, otherwise ErrorConstraint is
+// returned. If the product already has a policy for the environment,
+// ErrorDuplicate is returned.
+func (s *GormStore) CreatePolicy(policy *Policy) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Product{}, policy.ProductID); err != nil {
+			return err
+		}
+		return tx.Create(policy).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating policy for environment %q", policy.Environment)
+	}
+	return nil
+}
+
+// UpdatePolicy updates an existing approval policy. If the policy does not
+// exist, ErrorNotFound is returned; if its product already has a policy for
+// its new environment, ErrorDuplicate is.
+func (s *GormStore) UpdatePolicy(policy *Policy) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Policy{}, policy.ID); err != nil {
+			return err
+		}
+		return tx.Save(policy).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating policy for environment %q", policy.Environment)
+	}
+	return nil
+}
+
+// DeletePolicy deletes an existing approval policy from the database. If the
+// policy does not exist, ErrorNotFound is returned.
+func (s *GormStore) DeletePolicy(policy *Policy) error {
+	result := s.db.Where("id = ?", policy.ID).Delete(&Policy{})
+	if result.Error != nil {
+		return errors.Wrapf(classify(result.Error), "error deleting policy for environment %q", policy.Environment)
+	}
+	if result.RowsAffected == 0 {
+		return errors.Wrapf(ErrorNotFound, "error deleting policy for environment %q", policy.Environment)
+	}
+	return nil
+}
+
+// GetPipeline returns the stages of the promotion pipeline of the given
+// product, sorted by position; products without a pipeline have none.
+func (s *GormStore) GetPipeline(product Product) ([]Stage, error) {
+	var stages []Stage
+	if err := s.db.Where(&Stage{ProductID: product.ID}).Order("position").Find(&stages).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error reading pipeline of product %q", product.Code)
+	}
+	return stages, nil
+}
+
+// SetPipeline replaces the promotion pipeline of the given product with the
+// given stages, in order; their positions are assigned accordingly. The
+// product must exist, otherwise ErrorNotFound is returned; if an environment
+// appears more than once, ErrorDuplicate is.
+func (s *GormStore) SetPipeline(product Product, stages []Stage) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Product{}, product.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", product.ID).Delete(&Stage{}).Error; err != nil {
+			return err
+		}
+		for i := range stages {
+			stages[i].ID = 0
+			stages[i].ProductID = product.ID
+			stages[i].Position = i + 1
+			if err := tx.Create(&stages[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error setting pipeline of product %q", product.Code)
+	}
+	return nil
+}
+
+// GetAssignments returns the list of role assignments of the given user, or
+// of all users if the user is empty.
+func (s *GormStore) GetAssignments(user string) ([]Assignment, error) {
+	var assignments []Assignment
+	db := s.db.Order("id")
+	if user != "" {
+		db = db.Where("username = ?", user)
+	}
+	if err := db.Find(&assignments).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing role assignments of user %q", user)
+	}
+	return assignments, nil
+}
+
+// GetAssignment returns the role assignment having the given ID; if no such
+// assignment exists, ErrorNotFound is returned.
+func (s *GormStore) GetAssignment(id uint) (Assignment, error) {
+	var assignment Assignment
+	if err := s.db.Where("id = ?", id).First(&assignment).Error; err != nil {
+		return Assignment{}, errors.Wrapf(classify(err), "error reading role assignment %d", id)
+	}
+	return assignment, nil
+}
+
+// CreateAssignment creates a new role Assignment; unless it spans all
+// products, the assignment must refer to an existing Product through its
+// ProductID, otherwise ErrorConstraint is returned. If the user already has a
+// role on the same product and environment, ErrorDuplicate is returned.
+func (s *GormStore) CreateAssignment(assignment *Assignment) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if assignment.ProductID != 0 {
+			if err := references(tx, &Product{}, assignment.ProductID); err != nil {
+				return err
+			}
+		}
+		return tx.Create(assignment).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error assigning role %s to user %q", assignment.Role, assignment.User)
+	}
+	return nil
+}
+
+// DeleteAssignment deletes an existing role assignment from the database. If
+// the assignment does not exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteAssignment(assignment *Assignment) error {
+	result := s.db.Where("id = ?", assignment.ID).Delete(&Assignment{})
+	if result.Error != nil {
+		return errors.Wrapf(classify(result.Error), "error deleting role assignment %d", assignment.ID)
+	}
+	if result.RowsAffected == 0 {
+		return errors.Wrapf(ErrorNotFound, "error deleting role assignment %d", assignment.ID)
+	}
+	return nil
+}
+
+// BeforeSave is invoked by gorm before inserting or updating a version,
+// including those created along with their product, and sets the components
+// of its code; versions whose code is not a valid semantic version are
+// refused with ErrorConstraint.
+func (v *Version) BeforeSave() error {
+	return v.parse()
+}
+
+// BeforeCreate is invoked by gorm before inserting a deployment, including
+// those created along with their version or product, and makes new
+// deployments PENDING unless otherwise specified.
+func (d *Deployment) BeforeCreate() error {
+	if d.Status == "" {
+		d.Status = PENDING
+	}
+	return nil
+}
+
+// BeforeCreate is invoked by gorm before inserting a build, and makes new
+// builds RUNNING unless otherwise specified.
+func (b *Build) BeforeCreate() error {
+	if b.Status == "" {
+		b.Status = BUILD_RUNNING
+	}
+	return nil
+}
+
+// GetAuditRecords returns the audit records selected by the given filter,
+// oldest first.
+func (s *GormStore) GetAuditRecords(filter AuditFilter) ([]AuditRecord, error) {
+	db := s.db
+	if filter.Product != "" {
+		db = db.Where("product = ?", filter.Product)
+	}
+	if filter.User != "" {
+		db = db.Where("username = ?", filter.User)
+	}
+	if !filter.Since.IsZero() {
+		db = db.Where("timestamp >= ?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		db = db.Where("timestamp <= ?", filter.Until.UTC())
+	}
+	if filter.After != 0 {
+		db = db.Where("id > ?", filter.After)
+	}
+	var records []AuditRecord
+	if err := db.Order("id").Find(&records).Error; err != nil {
+		return nil, errors.Wrap(classify(err), "error reading audit log")
+	}
+	return records, nil
+}
+
+// AppendAuditRecord appends a new record to the audit log, chaining it to the
+// last one through its Previous and Hash; the unique index on Previous makes
+// sure that concurrent appends (e.g. by different processes) cannot fork the
+// chain, one of them failing with ErrorDuplicate instead.
+func (s *GormStore) AppendAuditRecord(record *AuditRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var last AuditRecord
+		if err := tx.Order("id DESC").First(&last).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		record.Previous = last.Hash
+		record.Hash = record.Digest()
+		return tx.Create(record).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error recording %s of %s %q", record.Action, record.Entity, record.Key)
+	}
+	return nil
+}
+
+// GetWebhooks returns the list of webhooks of the given product.
+func (s *GormStore) GetWebhooks(product Product) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := s.db.Where("product_id = ?", product.ID).Order("id").Find(&webhooks).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing webhooks of product %q", product.Code)
+	}
+	return webhooks, nil
+}
+
+// GetWebhook returns the webhook having the given ID; if no such webhook
+// exists, ErrorNotFound is returned.
+func (s *GormStore) GetWebhook(id uint) (Webhook, error) {
+	var webhook Webhook
+	if err := s.db.Where("id = ?", id).First(&webhook).Error; err != nil {
+		return Webhook{}, errors.Wrapf(classify(err), "error reading webhook %d", id)
+	}
+	return webhook, nil
+}
+
+// CreateWebhook creates a new Webhook; the webhook must refer to an existing
+// Product through its ProductID, otherwise ErrorConstraint is returned.
+func (s *GormStore) CreateWebhook(webhook *Webhook) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Product{}, webhook.ProductID); err != nil {
+			return err
+		}
+		return tx.Create(webhook).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error creating webhook for %q", webhook.URL)
+	}
+	return nil
+}
+
+// UpdateWebhook updates an existing webhook. If the webhook does not exist,
+// ErrorNotFound is returned.
+func (s *GormStore) UpdateWebhook(webhook *Webhook) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Webhook{}, webhook.ID); err != nil {
+			return err
+		}
+		return tx.Save(webhook).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error updating webhook %d", webhook.ID)
+	}
+	return nil
+}
+
+// DeleteWebhook deletes an existing webhook from the database, along with its
+// deliveries. If the webhook does not exist, ErrorNotFound is returned.
+func (s *GormStore) DeleteWebhook(webhook *Webhook) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := exists(tx, &Webhook{}, webhook.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&Delivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", webhook.ID).Delete(&Webhook{}).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error deleting webhook %d", webhook.ID)
+	}
+	return nil
+}
+
+// GetDeliveries returns the most recent deliveries to the given webhook,
+// newest first and at most limit of them (all of them if limit is 0).
+func (s *GormStore) GetDeliveries(webhook Webhook, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+	query := s.db.Where("webhook_id = ?", webhook.ID).Order("id DESC")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&deliveries).Error; err != nil {
+		return nil, errors.Wrapf(classify(err), "error listing deliveries of webhook %d", webhook.ID)
+	}
+	return deliveries, nil
+}
+
+// CreateDelivery records a new delivery attempt; the delivery must refer to
+// an existing Webhook through its WebhookID, otherwise ErrorConstraint is
+// returned.
+func (s *GormStore) CreateDelivery(delivery *Delivery) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := references(tx, &Webhook{}, delivery.WebhookID); err != nil {
+			return err
+		}
+		return tx.Create(delivery).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error recording delivery of event %d to webhook %d", delivery.EventID, delivery.WebhookID)
+	}
+	return nil
+}
+
+// GetPreferences returns the notification preferences of all users.
+func (s *GormStore) GetPreferences() ([]Preference, error) {
+	var preferences []Preference
+	if err := s.db.Order("username").Find(&preferences).Error; err != nil {
+		return nil, errors.Wrap(classify(err), "error listing notification preferences")
+	}
+	return preferences, nil
+}
+
+// GetPreference returns the notification preferences of the given user; if
+// the user has none, ErrorNotFound is returned.
+func (s *GormStore) GetPreference(user string) (Preference, error) {
+	var preference Preference
+	if err := s.db.Where("username = ?", user).First(&preference).Error; err != nil {
+		return Preference{}, errors.Wrapf(classify(err), "error reading notification preferences of user %q", user)
+	}
+	return preference, nil
+}
+
+// SetPreference creates or replaces the notification preferences of the user
+// they belong to.
+func (s *GormStore) SetPreference(preference *Preference) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var current Preference
+		err := tx.Where("username = ?", preference.User).First(&current).Error
+		switch {
+		case gorm.IsRecordNotFoundError(err):
+			preference.ID = 0
+			return tx.Create(preference).Error
+		case err != nil:
+			return err
+		}
+		preference.ID = current.ID
+		preference.CreatedAt = current.CreatedAt
+		return tx.Save(preference).Error
+	})
+	if err != nil {
+		return errors.Wrapf(classify(err), "error setting notification preferences of user %q", preference.User)
+	}
+	return nil
+}
+
+// DeletePreference deletes the notification preferences of a user from the
+// database. If the user has none, ErrorNotFound is returned.
+func (s *GormStore) DeletePreference(preference *Preference) error {
+	result := s.db.Where("username = ?", preference.User).Delete(&Preference{})
+	if result.Error != nil {
+		return errors.Wrapf(classify(result.Error), "error deleting notification preferences of user %q", preference.User)
+	}
+	if result.RowsAffected == 0 {
+		return errors.Wrapf(ErrorNotFound, "error deleting notification preferences of user %q", preference.User)
+	}
+	return nil
+}
+
+// applyTransition moves a deployment to the status the given transition leads
+// to, if allowed by the state machine, and records the transition.
+func applyTransition(tx *gorm.DB, deployment *Deployment, transition *Transition) error {
+	if !deployment.Status.CanTransition(transition.To) {
+		return errors.Wrapf(ErrorConstraint, "deployment cannot move from %s to %s", deployment.Status, transition.To)
+	}
+	transition.DeploymentID = deployment.ID
+	transition.From = deployment.Status
+	deployment.Status = transition.To
+	if transition.To == GRANTED {
+		deployment.GrantedBy = transition.User
+		deployment.Timestamp = transition.Timestamp
+	}
+	if err := tx.Save(deployment).Error; err != nil {
+		return err
+	}
+	return tx.Create(transition).Error
+}
+
+// reload reads the approvals and status transitions of a deployment.
+func reload(tx *gorm.DB, deployment *Deployment) error {
+	if err := tx.Model(deployment).Order("id").Related(&deployment.Approvals).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(deployment).Order("id").Related(&deployment.Transitions).Error; err != nil {
+		return err
+	}
+	return tx.Model(deployment).Order("digest").Related(&deployment.Artifacts).Error
+}
+
+// exists checks whether the row having the given ID exists in the table of
+// the given entity, returning ErrorNotFound if it doesn't.
+func exists(tx *gorm.DB, entity interface{}, id uint) error {
+	var count int
+	if err := tx.Model(entity).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// references checks whether the row having the given ID, which is referenced
+// by some other entity, exists in the table of the given entity, returning
+// ErrorConstraint if it doesn't.
+func references(tx *gorm.DB, entity interface{}, id uint) error {
+	if err := exists(tx, entity, id); err != nil {
+		if err == ErrorNotFound {
+			return errors.Wrapf(ErrorConstraint, "reference to non-existing %s %d", tx.NewScope(entity).TableName(), id)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,1490 @@
+package model
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/semver"
+	"github.com/pkg/errors"
+)
+
+// ensure MemoryStore implements Store.
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store that keeps all its data in memory; since its
+// contents are lost when the process exits, it is mostly useful for tests
+// and demos.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	sequences   map[string]uint
+	products    map[uint]Product
+	versions    map[uint]Version
+	builds      map[uint]Build
+	artifacts   map[uint]Artifact
+	deployments map[uint]Deployment
+	deployed    map[uint]DeployedArtifact
+	approvals   map[uint]Approval
+	transitions map[uint]Transition
+	policies    map[uint]Policy
+	stages      map[uint]Stage
+	assignments map[uint]Assignment
+	records     []AuditRecord
+	webhooks    map[uint]Webhook
+	deliveries  map[uint]Delivery
+	preferences map[string]Preference
+}
+
+// NewMemoryStore returns a new, empty in-memory Store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sequences:   map[string]uint{},
+		products:    map[uint]Product{},
+		versions:    map[uint]Version{},
+		builds:      map[uint]Build{},
+		artifacts:   map[uint]Artifact{},
+		deployments: map[uint]Deployment{},
+		deployed:    map[uint]DeployedArtifact{},
+		approvals:   map[uint]Approval{},
+		transitions: map[uint]Transition{},
+		policies:    map[uint]Policy{},
+		stages:      map[uint]Stage{},
+		assignments: map[uint]Assignment{},
+		webhooks:    map[uint]Webhook{},
+		deliveries:  map[uint]Delivery{},
+		preferences: map[string]Preference{},
+	}
+}
+
+// Close releases the contents of the store.
+func (s *MemoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.products = map[uint]Product{}
+	s.versions = map[uint]Version{}
+	s.builds = map[uint]Build{}
+	s.artifacts = map[uint]Artifact{}
+	s.deployments = map[uint]Deployment{}
+	s.deployed = map[uint]DeployedArtifact{}
+	s.approvals = map[uint]Approval{}
+	s.transitions = map[uint]Transition{}
+	s.policies = map[uint]Policy{}
+	s.stages = map[uint]Stage{}
+	s.assignments = map[uint]Assignment{}
+	s.records = nil
+	s.webhooks = map[uint]Webhook{}
+	s.deliveries = map[uint]Delivery{}
+	s.preferences = map[string]Preference{}
+	return nil
+}
+
+// Atomically makes the changes of the given function, which it makes through
+// the store it is passed, all at once: they are made to a copy of the contents
+// of the store, which replaces them only if the function succeeds, otherwise
+// the error it returns is returned. The store is locked in the meantime, so
+// the function must only access it through the store it is passed.
+func (s *MemoryStore) Atomically(changes func(store Store) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := s.copy()
+	if err := changes(tx); err != nil {
+		return err
+	}
+	s.sequences, s.products, s.versions, s.builds = tx.sequences, tx.products, tx.versions, tx.builds
+	s.artifacts, s.deployments, s.deployed = tx.artifacts, tx.deployments, tx.deployed
+	s.approvals, s.transitions, s.policies, s.stages = tx.approvals, tx.transitions, tx.policies, tx.stages
+	s.assignments, s.records, s.webhooks = tx.assignments, tx.records, tx.webhooks
+	s.deliveries, s.preferences = tx.deliveries, tx.preferences
+	return nil
+}
+
+// GetProducts returns the full list of products.
+func (s *MemoryStore) GetProducts() ([]Product, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	products := make([]Product, 0, len(s.products))
+	for _, product := range s.products {
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	return products, nil
+}
+
+// GetProductByCode returns the product with the given code, along with its
+// versions; if no such product exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetProductByCode(code string) (Product, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	product, ok := s.productByCode(code)
+	if !ok {
+		return Product{}, errors.Wrapf(ErrorNotFound, "error reading product %q", code)
+	}
+	for _, version := range s.versionsOf(product.ID) {
+		version.Deployments = nil
+		product.Versions = append(product.Versions, version)
+	}
+	return product, nil
+}
+
+// CreateProduct creates a new Product; if it contains Version references,
+// those are created too. If the product code is already in use, ErrorDuplicate
+// is returned.
+func (s *MemoryStore) CreateProduct(product *Product) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.productByCode(product.Code); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating product %q", product.Code)
+	}
+	if err := checkVersions(product.Versions); err != nil {
+		return errors.Wrapf(err, "error creating product %q", product.Code)
+	}
+	product.ID = s.next("products")
+	product.CreatedAt = time.Now()
+	product.UpdatedAt = product.CreatedAt
+	s.products[product.ID] = detachProduct(*product)
+	for i := range product.Versions {
+		product.Versions[i].ProductID = product.ID
+		s.insertVersion(&product.Versions[i])
+	}
+	return nil
+}
+
+// UpdateProduct updates an existing product. If the product does not exist,
+// ErrorNotFound is returned; if its new code is already in use,
+// ErrorDuplicate is.
+func (s *MemoryStore) UpdateProduct(product *Product) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.products[product.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating product %q", product.Code)
+	}
+	if other, ok := s.productByCode(product.Code); ok && other.ID != product.ID {
+		return errors.Wrapf(ErrorDuplicate, "error updating product %q", product.Code)
+	}
+	product.CreatedAt = current.CreatedAt
+	product.UpdatedAt = time.Now()
+	s.products[product.ID] = detachProduct(*product)
+	return nil
+}
+
+// DeleteProduct deletes an existing product; any existing linked Version,
+// Policy, Stage, Webhook (along with its deliveries) and Assignment objects
+// are deleted as well (cascade). If the product does not exist, ErrorNotFound
+// is returned.
+func (s *MemoryStore) DeleteProduct(product *Product) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[product.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting product %q", product.Code)
+	}
+	for _, version := range s.versionsOf(product.ID) {
+		s.deleteVersion(version.ID)
+	}
+	for id, policy := range s.policies {
+		if policy.ProductID == product.ID {
+			delete(s.policies, id)
+		}
+	}
+	s.deleteStages(product.ID)
+	for id, webhook := range s.webhooks {
+		if webhook.ProductID == product.ID {
+			s.deleteWebhook(id)
+		}
+	}
+	for id, assignment := range s.assignments {
+		if assignment.ProductID == product.ID {
+			delete(s.assignments, id)
+		}
+	}
+	delete(s.products, product.ID)
+	return nil
+}
+
+// GetVersions returns the list of versions of the given product, along with
+// their deployments, sorted by precedence.
+func (s *MemoryStore) GetVersions(product Product) ([]Version, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.versionsOf(product.ID), nil
+}
+
+// GetVersionByCode returns the version of the given product having the given
+// code, along with its deployments; if no such version exists, ErrorNotFound
+// is returned.
+func (s *MemoryStore) GetVersionByCode(product Product, code string) (Version, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, version := range s.versionsOf(product.ID) {
+		if version.Code == code {
+			return version, nil
+		}
+	}
+	return Version{}, errors.Wrapf(ErrorNotFound, "error reading version %q of product %q", code, product.Code)
+}
+
+// CreateVersion creates a new Version; the version must refer to an existing
+// Product through its ProductID, otherwise ErrorConstraint is returned; if it
+// contains Deployment references, those are created too. If the version code
+// is already in use for the product, ErrorDuplicate is returned.
+func (s *MemoryStore) CreateVersion(version *Version) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[version.ProductID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating version %q: reference to non-existing products %d", version.Code, version.ProductID)
+	}
+	if _, ok := s.versionByCode(version.ProductID, version.Code); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating version %q", version.Code)
+	}
+	if err := version.parse(); err != nil {
+		return errors.Wrapf(err, "error creating version %q", version.Code)
+	}
+	if err := checkDeployments(version.Deployments); err != nil {
+		return errors.Wrapf(err, "error creating version %q", version.Code)
+	}
+	s.insertVersion(version)
+	return nil
+}
+
+// AllocateVersion atomically creates a new Version of a product, whose code
+// follows that of its latest version by incrementing the given part (see
+// NextCode) and whose Branch, unless given, is the default one. The version
+// must refer to an existing Product through its ProductID, otherwise
+// ErrorConstraint is returned.
+func (s *MemoryStore) AllocateVersion(version *Version, part semver.Part, identifier string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[version.ProductID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error allocating %s version: reference to non-existing product %d", part, version.ProductID)
+	}
+	code, err := NextCode(s.versionsOf(version.ProductID), part, identifier)
+	if err != nil {
+		return errors.Wrapf(ErrorConstraint, "error allocating %s version: %v", part, err)
+	}
+	version.Code = code
+	if version.Branch == "" {
+		version.Branch = DefaultBranch(code)
+	}
+	if err := version.parse(); err != nil {
+		return errors.Wrapf(err, "error allocating %s version", part)
+	}
+	if err := checkDeployments(version.Deployments); err != nil {
+		return errors.Wrapf(err, "error allocating %s version", part)
+	}
+	s.insertVersion(version)
+	return nil
+}
+
+// UpdateVersion updates an existing version. If the version does not exist,
+// ErrorNotFound is returned; if its new code is already in use,
+// ErrorDuplicate is, and if it is not a semantic version (unless it is the
+// unchanged code of a legacy version), ErrorConstraint is.
+func (s *MemoryStore) UpdateVersion(version *Version) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.versions[version.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating version %q", version.Code)
+	}
+	if other, ok := s.versionByCode(version.ProductID, version.Code); ok && other.ID != version.ID {
+		return errors.Wrapf(ErrorDuplicate, "error updating version %q", version.Code)
+	}
+	version.Legacy = current.Legacy && version.Code == current.Code
+	if err := version.parse(); err != nil {
+		return errors.Wrapf(err, "error updating version %q", version.Code)
+	}
+	version.CreatedAt = current.CreatedAt
+	version.UpdatedAt = time.Now()
+	s.versions[version.ID] = detachVersion(*version)
+	return nil
+}
+
+// DeleteVersion deletes an existing version; any existing linked Deployment
+// and Build objects are deleted as well (cascade). If the version does not
+// exist, ErrorNotFound is returned.
+func (s *MemoryStore) DeleteVersion(version *Version) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.versions[version.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting version %q", version.Code)
+	}
+	s.deleteVersion(version.ID)
+	return nil
+}
+
+// GetBuilds returns the list of builds of the given version, sorted by their
+// number.
+func (s *MemoryStore) GetBuilds(version Version) ([]Build, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var builds []Build
+	for _, build := range s.builds {
+		if build.VersionID == version.ID {
+			builds = append(builds, build)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Number < builds[j].Number })
+	return builds, nil
+}
+
+// GetBuildByNumber returns the build of the given version having the given
+// number; if no such build exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetBuildByNumber(version Version, number int) (Build, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if build, ok := s.buildByNumber(version.ID, number); ok {
+		return build, nil
+	}
+	return Build{}, errors.Wrapf(ErrorNotFound, "error reading build %d of version %q", number, version.Code)
+}
+
+// CreateBuild creates a new Build; the build must refer to an existing
+// Version through its VersionID, otherwise ErrorConstraint is returned; if no
+// Status is provided, the build is created as RUNNING. If the build number is
+// already in use for the version, ErrorDuplicate is returned.
+func (s *MemoryStore) CreateBuild(build *Build) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.versions[build.VersionID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating build %d: reference to non-existing version %d", build.Number, build.VersionID)
+	}
+	if _, ok := s.buildByNumber(build.VersionID, build.Number); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating build %d", build.Number)
+	}
+	if build.Status == "" {
+		build.Status = BUILD_RUNNING
+	}
+	build.ID = s.next("builds")
+	build.CreatedAt = time.Now()
+	build.UpdatedAt = build.CreatedAt
+	s.builds[build.ID] = *build
+	return nil
+}
+
+// UpdateBuild updates an existing build, e.g. to record its outcome. If the
+// build does not exist, ErrorNotFound is returned; if its new number is
+// already in use, ErrorDuplicate is.
+func (s *MemoryStore) UpdateBuild(build *Build) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.builds[build.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating build %d", build.Number)
+	}
+	if other, ok := s.buildByNumber(build.VersionID, build.Number); ok && other.ID != build.ID {
+		return errors.Wrapf(ErrorDuplicate, "error updating build %d", build.Number)
+	}
+	build.CreatedAt = current.CreatedAt
+	build.UpdatedAt = time.Now()
+	s.builds[build.ID] = *build
+	return nil
+}
+
+// DeleteBuild deletes an existing build; any existing linked Artifact
+// objects are deleted as well (cascade). If the build does not exist,
+// ErrorNotFound is returned.
+func (s *MemoryStore) DeleteBuild(build *Build) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.builds[build.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting build %d", build.Number)
+	}
+	s.deleteBuild(build.ID)
+	return nil
+}
+
+// GetArtifacts returns the list of artifacts of the given build, sorted by
+// name.
+func (s *MemoryStore) GetArtifacts(build Build) ([]Artifact, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var artifacts []Artifact
+	for _, artifact := range s.artifacts {
+		if artifact.BuildID == build.ID {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// GetArtifactByName returns the artifact of the given build having the given
+// name; if no such artifact exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetArtifactByName(build Build, name string) (Artifact, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if artifact, ok := s.artifactByName(build.ID, name); ok {
+		return artifact, nil
+	}
+	return Artifact{}, errors.Wrapf(ErrorNotFound, "error reading artifact %q of build %d", name, build.Number)
+}
+
+// CreateArtifact creates a new Artifact; the artifact must refer to an
+// existing Build through its BuildID, otherwise ErrorConstraint is returned.
+// If the artifact name is already in use for the build, ErrorDuplicate is
+// returned.
+func (s *MemoryStore) CreateArtifact(artifact *Artifact) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.builds[artifact.BuildID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating artifact %q: reference to non-existing build %d", artifact.Name, artifact.BuildID)
+	}
+	if _, ok := s.artifactByName(artifact.BuildID, artifact.Name); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating artifact %q", artifact.Name)
+	}
+	artifact.ID = s.next("artifacts")
+	artifact.CreatedAt = time.Now()
+	artifact.UpdatedAt = artifact.CreatedAt
+	s.artifacts[artifact.ID] = *artifact
+	return nil
+}
+
+// DeleteArtifact deletes an existing artifact; the deployments which
+// deployed it keep its digest. If the artifact does not exist, ErrorNotFound
+// is returned.
+func (s *MemoryStore) DeleteArtifact(artifact *Artifact) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.artifacts[artifact.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting artifact %q", artifact.Name)
+	}
+	delete(s.artifacts, artifact.ID)
+	return nil
+}
+
+// FindArtifacts returns the artifacts having the given digest, across all
+// products, oldest first.
+func (s *MemoryStore) FindArtifacts(digest string) ([]ArtifactMatch, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matches := []ArtifactMatch{}
+	for _, artifact := range s.artifacts {
+		if artifact.Digest != digest {
+			continue
+		}
+		build := s.builds[artifact.BuildID]
+		version := s.versions[build.VersionID]
+		matches = append(matches, ArtifactMatch{
+			Artifact:    artifact,
+			ProductID:   version.ProductID,
+			ProductCode: s.products[version.ProductID].Code,
+			VersionCode: version.Code,
+			BuildNumber: build.Number,
+		})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches, nil
+}
+
+// GetArtifactDigests returns the distinct digests of the artifacts of the
+// given product, or of all products if its ID is 0, sorted.
+func (s *MemoryStore) GetArtifactDigests(product Product) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var digests []string
+	for _, artifact := range s.artifacts {
+		if product.ID == 0 || s.versions[s.builds[artifact.BuildID].VersionID].ProductID == product.ID {
+			digests = append(digests, artifact.Digest)
+		}
+	}
+	return uniqueDigests(digests), nil
+}
+
+// FindDeployments returns the deployments which deployed the artifact having
+// the given digest, across all products, oldest first.
+func (s *MemoryStore) FindDeployments(digest string) ([]DeploymentMatch, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matches := []DeploymentMatch{}
+	for _, deployed := range s.deployed {
+		if deployed.Digest != digest {
+			continue
+		}
+		deployment := s.deployments[deployed.DeploymentID]
+		version := s.versions[deployment.VersionID]
+		matches = append(matches, DeploymentMatch{
+			Deployment:  deployment,
+			ProductID:   version.ProductID,
+			ProductCode: s.products[version.ProductID].Code,
+			VersionCode: version.Code,
+		})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches, nil
+}
+
+// GetDeployedDigests returns the distinct digests of the artifacts deployed
+// by all deployments, sorted.
+func (s *MemoryStore) GetDeployedDigests() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var digests []string
+	for _, deployed := range s.deployed {
+		digests = append(digests, deployed.Digest)
+	}
+	return uniqueDigests(digests), nil
+}
+
+// GetDeployments returns the list of deployments of the given version,
+// sorted by their order.
+func (s *MemoryStore) GetDeployments(version Version) ([]Deployment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.deploymentsOf(version.ID), nil
+}
+
+// GetDeploymentByOrder returns the deployment of the given version having the
+// given order, along with its approvals, status transitions and deployed
+// artifacts; if no such deployment exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetDeploymentByOrder(version Version, order int) (Deployment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if deployment, ok := s.deploymentByOrder(version.ID, order); ok {
+		deployment.Approvals = s.approvalsOf(deployment.ID)
+		deployment.Transitions = s.transitionsOf(deployment.ID)
+		deployment.Artifacts = s.artifactsOf(deployment.ID)
+		return deployment, nil
+	}
+	return Deployment{}, errors.Wrapf(ErrorNotFound, "error reading deployment %d of version %q", order, version.Code)
+}
+
+// CreateDeployment creates a new Deployment; the deployment must refer to an
+// existing Version through its VersionID, otherwise ErrorConstraint is
+// returned; if no Status is provided, the deployment is created as PENDING.
+// If the deployment order is already in use for the version, ErrorDuplicate
+// is returned.
+func (s *MemoryStore) CreateDeployment(deployment *Deployment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.versions[deployment.VersionID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating deployment %d: reference to non-existing versions %d", deployment.Order, deployment.VersionID)
+	}
+	if _, ok := s.deploymentByOrder(deployment.VersionID, deployment.Order); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating deployment %d", deployment.Order)
+	}
+	s.insertDeployment(deployment)
+	return nil
+}
+
+// UpdateDeployment updates an existing deployment, e.g. to record its change
+// of Status. If the deployment does not exist, ErrorNotFound is returned; if
+// its new order is already in use, ErrorDuplicate is.
+func (s *MemoryStore) UpdateDeployment(deployment *Deployment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.deployments[deployment.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating deployment %d", deployment.Order)
+	}
+	if other, ok := s.deploymentByOrder(deployment.VersionID, deployment.Order); ok && other.ID != deployment.ID {
+		return errors.Wrapf(ErrorDuplicate, "error updating deployment %d", deployment.Order)
+	}
+	deployment.CreatedAt = current.CreatedAt
+	deployment.UpdatedAt = time.Now()
+	s.deployments[deployment.ID] = detachDeployment(*deployment)
+	return nil
+}
+
+// DeleteDeployment deletes an existing deployment; any existing linked
+// Approval, Transition and DeployedArtifact objects are deleted as well
+// (cascade). If the deployment does not exist, ErrorNotFound is returned.
+func (s *MemoryStore) DeleteDeployment(deployment *Deployment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.deployments[deployment.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting deployment %d", deployment.Order)
+	}
+	s.deleteDeployment(deployment.ID)
+	return nil
+}
+
+// SetDeploymentArtifacts replaces the artifacts deployed by an existing
+// deployment with those having the given digests; the deployment is reloaded
+// along with all its approvals, status transitions and artifacts. If the
+// deployment does not exist, ErrorNotFound is returned; if it is no longer
+// PENDING, or any of the digests is not that of an artifact of the builds of
+// its version, ErrorConstraint is.
+func (s *MemoryStore) SetDeploymentArtifacts(deployment *Deployment, digests []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.deployments[deployment.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error setting artifacts of deployment %d", deployment.Order)
+	}
+	if current.Status != PENDING {
+		return errors.Wrapf(ErrorConstraint, "error setting artifacts of deployment %d: deployment is %s: its artifacts can only change while %s", deployment.Order, current.Status, PENDING)
+	}
+	var built []string
+	for _, artifact := range s.artifacts {
+		if s.builds[artifact.BuildID].VersionID == current.VersionID {
+			built = append(built, artifact.Digest)
+		}
+	}
+	if err := checkDigests(digests, built); err != nil {
+		return errors.Wrapf(err, "error setting artifacts of deployment %d", deployment.Order)
+	}
+
+	s.deleteDeployed(current.ID)
+	for _, digest := range uniqueDigests(digests) {
+		id := s.next("deployed_artifacts")
+		s.deployed[id] = DeployedArtifact{ID: id, DeploymentID: current.ID, Digest: digest}
+	}
+	*deployment = current
+	deployment.Approvals = s.approvalsOf(deployment.ID)
+	deployment.Transitions = s.transitionsOf(deployment.ID)
+	deployment.Artifacts = s.artifactsOf(deployment.ID)
+	return nil
+}
+
+// ApproveDeployment records the approval of an existing PENDING deployment
+// and, once the deployment has collected the given number of approvals,
+// grants it on behalf of the last approver, recording the transition; the
+// deployment is reloaded along with all its approvals and status transitions.
+// If the deployment does not exist, ErrorNotFound is returned; if it is not
+// PENDING, ErrorConstraint is; if the user has already approved it,
+// ErrorDuplicate is.
+func (s *MemoryStore) ApproveDeployment(deployment *Deployment, approval *Approval, required int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.deployments[deployment.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error approving deployment %d", deployment.Order)
+	}
+	if current.Status != PENDING {
+		return errors.Wrapf(ErrorConstraint, "error approving deployment %d: deployment is %s, not %s", deployment.Order, current.Status, PENDING)
+	}
+	approvals := s.approvalsOf(deployment.ID)
+	for _, other := range approvals {
+		if other.User == approval.User {
+			return errors.Wrapf(ErrorDuplicate, "error approving deployment %d", deployment.Order)
+		}
+	}
+
+	approval.DeploymentID = deployment.ID
+	s.insertApproval(approval)
+	current.UpdatedAt = approval.Timestamp
+	if approvals = s.approvalsOf(deployment.ID); len(approvals) >= required {
+		approvers := make([]string, 0, len(approvals))
+		for _, approval := range approvals {
+			approvers = append(approvers, approval.User)
+		}
+		s.applyTransition(&current, &Transition{
+			To:        GRANTED,
+			User:      approval.User,
+			Reason:    "approved by " + strings.Join(approvers, ", "),
+			Timestamp: approval.Timestamp,
+		})
+	}
+	s.deployments[current.ID] = current
+	*deployment = current
+	deployment.Approvals = approvals
+	deployment.Transitions = s.transitionsOf(deployment.ID)
+	deployment.Artifacts = s.artifactsOf(deployment.ID)
+	return nil
+}
+
+// TransitionDeployment moves an existing deployment to the status the given
+// transition leads to, provided that the state machine allows it from its
+// current one, and records the transition; deployments moving to GRANTED are
+// granted on behalf of the user of the transition. The deployment is reloaded
+// along with all its approvals and status transitions. If the deployment does
+// not exist, ErrorNotFound is returned; if the transition is not allowed,
+// ErrorConstraint is.
+func (s *MemoryStore) TransitionDeployment(deployment *Deployment, transition *Transition) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.deployments[deployment.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error changing status of deployment %d to %s", deployment.Order, transition.To)
+	}
+	if !current.Status.CanTransition(transition.To) {
+		return errors.Wrapf(ErrorConstraint, "error changing status of deployment %d to %s: deployment cannot move from %s to %s", deployment.Order, transition.To, current.Status, transition.To)
+	}
+
+	current.UpdatedAt = transition.Timestamp
+	s.applyTransition(&current, transition)
+	s.deployments[current.ID] = current
+	*deployment = current
+	deployment.Approvals = s.approvalsOf(deployment.ID)
+	deployment.Transitions = s.transitionsOf(deployment.ID)
+	deployment.Artifacts = s.artifactsOf(deployment.ID)
+	return nil
+}
+
+// ChangeDeployment updates the order and environment of an existing deployment
+// and moves it to the status the given transition leads to, if any, all at
+// once; since they were given for what the deployment was, its approvals are
+// withdrawn if its order or environment change. The deployment is reloaded
+// along with all its approvals, status transitions and artifacts. If the
+// deployment does not exist, ErrorNotFound is returned; if its order or
+// environment change once it is no longer PENDING, or the transition is not
+// allowed, ErrorConstraint is; if its new order is already in use,
+// ErrorDuplicate is.
+func (s *MemoryStore) ChangeDeployment(deployment *Deployment, transition *Transition) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.deployments[deployment.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error changing deployment %d", deployment.Order)
+	}
+	if current.Order != deployment.Order || current.Environment != deployment.Environment {
+		if current.Status != PENDING {
+			return errors.Wrapf(ErrorConstraint, "error changing deployment %d: deployment is %s: its order and environment can only change while %s", deployment.Order, current.Status, PENDING)
+		}
+		if other, ok := s.deploymentByOrder(current.VersionID, deployment.Order); ok && other.ID != current.ID {
+			return errors.Wrapf(ErrorDuplicate, "error changing deployment %d", deployment.Order)
+		}
+	}
+	if transition != nil && !current.Status.CanTransition(transition.To) {
+		return errors.Wrapf(ErrorConstraint, "error changing deployment %d: deployment cannot move from %s to %s", deployment.Order, current.Status, transition.To)
+	}
+
+	if current.Order != deployment.Order || current.Environment != deployment.Environment {
+		for id, approval := range s.approvals {
+			if approval.DeploymentID == current.ID {
+				delete(s.approvals, id)
+			}
+		}
+	}
+	current.Order = deployment.Order
+	current.Environment = deployment.Environment
+	current.UpdatedAt = time.Now()
+	if transition != nil {
+		s.applyTransition(&current, transition)
+	}
+	s.deployments[current.ID] = current
+	*deployment = current
+	deployment.Approvals = s.approvalsOf(deployment.ID)
+	deployment.Transitions = s.transitionsOf(deployment.ID)
+	deployment.Artifacts = s.artifactsOf(deployment.ID)
+	return nil
+}
+
+// GetPolicies returns the list of approval policies of the given product.
+func (s *MemoryStore) GetPolicies(product Product) ([]Policy, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	policies := []Policy{}
+	for _, policy := range s.policies {
+		if policy.ProductID == product.ID {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Environment < policies[j].Environment })
+	return policies, nil
+}
+
+// CreatePolicy creates a new approval Policy; the policy must refer to an
+// existing Product through its ProductID, otherwise ErrorConstraint is
+// returned. If the product already has a policy for the environment,
+// ErrorDuplicate is returned.
+func (s *MemoryStore) CreatePolicy(policy *Policy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[policy.ProductID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating policy for environment %q: reference to non-existing products %d", policy.Environment, policy.ProductID)
+	}
+	if _, ok := s.policyOf(policy.ProductID, policy.Environment); ok {
+		return errors.Wrapf(ErrorDuplicate, "error creating policy for environment %q", policy.Environment)
+	}
+	policy.ID = s.next("policies")
+	policy.CreatedAt = time.Now()
+	policy.UpdatedAt = policy.CreatedAt
+	s.policies[policy.ID] = *policy
+	return nil
+}
+
+// UpdatePolicy updates an existing approval policy. If the policy does not
+// exist, ErrorNotFound is returned; if its product already has a policy for
+// its new environment, ErrorDuplicate is.
+func (s *MemoryStore) UpdatePolicy(policy *Policy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.policies[policy.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating policy for environment %q", policy.Environment)
+	}
+	if other, ok := s.policyOf(policy.ProductID, policy.Environment); ok && other.ID != policy.ID {
+		return errors.Wrapf(ErrorDuplicate, "error updating policy for environment %q", policy.Environment)
+	}
+	policy.CreatedAt = current.CreatedAt
+	policy.UpdatedAt = time.Now()
+	s.policies[policy.ID] = *policy
+	return nil
+}
+
+// DeletePolicy deletes an existing approval policy. If the policy does not
+// exist, ErrorNotFound is returned.
+func (s *MemoryStore) DeletePolicy(policy *Policy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.policies[policy.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting policy for environment %q", policy.Environment)
+	}
+	delete(s.policies, policy.ID)
+	return nil
+}
+
+// GetPipeline returns the stages of the promotion pipeline of the given
+// product, sorted by position; products without a pipeline have none.
+func (s *MemoryStore) GetPipeline(product Product) ([]Stage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stages := []Stage{}
+	for _, stage := range s.stages {
+		if stage.ProductID == product.ID {
+			stages = append(stages, stage)
+		}
+	}
+	sort.Slice(stages, func(i, j int) bool { return stages[i].Position < stages[j].Position })
+	return stages, nil
+}
+
+// SetPipeline replaces the promotion pipeline of the given product with the
+// given stages, in order; their positions are assigned accordingly. The
+// product must exist, otherwise ErrorNotFound is returned; if an environment
+// appears more than once, ErrorDuplicate is.
+func (s *MemoryStore) SetPipeline(product Product, stages []Stage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[product.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error setting pipeline of product %q", product.Code)
+	}
+	environments := map[string]bool{}
+	for _, stage := range stages {
+		if environments[stage.Environment] {
+			return errors.Wrapf(ErrorDuplicate, "error setting pipeline of product %q: duplicate environment %q", product.Code, stage.Environment)
+		}
+		environments[stage.Environment] = true
+	}
+	s.deleteStages(product.ID)
+	for i := range stages {
+		stages[i].ID = s.next("stages")
+		stages[i].ProductID = product.ID
+		stages[i].Position = i + 1
+		stages[i].CreatedAt = time.Now()
+		stages[i].UpdatedAt = stages[i].CreatedAt
+		s.stages[stages[i].ID] = stages[i]
+	}
+	return nil
+}
+
+// GetAssignments returns the list of role assignments of the given user, or
+// of all users if the user is empty.
+func (s *MemoryStore) GetAssignments(user string) ([]Assignment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	assignments := []Assignment{}
+	for _, assignment := range s.assignments {
+		if user == "" || assignment.User == user {
+			assignments = append(assignments, assignment)
+		}
+	}
+	sort.Slice(assignments, func(i, j int) bool { return assignments[i].ID < assignments[j].ID })
+	return assignments, nil
+}
+
+// GetAssignment returns the role assignment having the given ID; if no such
+// assignment exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetAssignment(id uint) (Assignment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if assignment, ok := s.assignments[id]; ok {
+		return assignment, nil
+	}
+	return Assignment{}, errors.Wrapf(ErrorNotFound, "error reading role assignment %d", id)
+}
+
+// CreateAssignment creates a new role Assignment; unless it spans all
+// products, the assignment must refer to an existing Product through its
+// ProductID, otherwise ErrorConstraint is returned. If the user already has a
+// role on the same product and environment, ErrorDuplicate is returned.
+func (s *MemoryStore) CreateAssignment(assignment *Assignment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[assignment.ProductID]; !ok && assignment.ProductID != 0 {
+		return errors.Wrapf(ErrorConstraint, "error assigning role %s to user %q: reference to non-existing products %d", assignment.Role, assignment.User, assignment.ProductID)
+	}
+	for _, other := range s.assignments {
+		if other.User == assignment.User && other.ProductID == assignment.ProductID && other.Environment == assignment.Environment {
+			return errors.Wrapf(ErrorDuplicate, "error assigning role %s to user %q", assignment.Role, assignment.User)
+		}
+	}
+	assignment.ID = s.next("assignments")
+	assignment.CreatedAt = time.Now()
+	assignment.UpdatedAt = assignment.CreatedAt
+	s.assignments[assignment.ID] = *assignment
+	return nil
+}
+
+// DeleteAssignment deletes an existing role assignment. If the assignment
+// does not exist, ErrorNotFound is returned.
+func (s *MemoryStore) DeleteAssignment(assignment *Assignment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.assignments[assignment.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting role assignment %d", assignment.ID)
+	}
+	delete(s.assignments, assignment.ID)
+	return nil
+}
+
+// GetAuditRecords returns the audit records selected by the given filter,
+// oldest first.
+func (s *MemoryStore) GetAuditRecords(filter AuditFilter) ([]AuditRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	records := []AuditRecord{}
+	for _, record := range s.records {
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// AppendAuditRecord appends a new record to the audit log, chaining it to the
+// last one through its Previous and Hash.
+func (s *MemoryStore) AppendAuditRecord(record *AuditRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record.ID = s.next("audit_records")
+	record.Previous = ""
+	if len(s.records) > 0 {
+		record.Previous = s.records[len(s.records)-1].Hash
+	}
+	record.Hash = record.Digest()
+	s.records = append(s.records, *record)
+	return nil
+}
+
+// GetWebhooks returns the list of webhooks of the given product.
+func (s *MemoryStore) GetWebhooks(product Product) ([]Webhook, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	webhooks := []Webhook{}
+	for _, webhook := range s.webhooks {
+		if webhook.ProductID == product.ID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+// GetWebhook returns the webhook having the given ID; if no such webhook
+// exists, ErrorNotFound is returned.
+func (s *MemoryStore) GetWebhook(id uint) (Webhook, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if webhook, ok := s.webhooks[id]; ok {
+		return webhook, nil
+	}
+	return Webhook{}, errors.Wrapf(ErrorNotFound, "error reading webhook %d", id)
+}
+
+// CreateWebhook creates a new Webhook; the webhook must refer to an existing
+// Product through its ProductID, otherwise ErrorConstraint is returned.
+func (s *MemoryStore) CreateWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.products[webhook.ProductID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error creating webhook for %q: reference to non-existing products %d", webhook.URL, webhook.ProductID)
+	}
+	webhook.ID = s.next("webhooks")
+	webhook.CreatedAt = time.Now()
+	webhook.UpdatedAt = webhook.CreatedAt
+	s.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+// UpdateWebhook updates an existing webhook. If the webhook does not exist,
+// ErrorNotFound is returned.
+func (s *MemoryStore) UpdateWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.webhooks[webhook.ID]
+	if !ok {
+		return errors.Wrapf(ErrorNotFound, "error updating webhook %d", webhook.ID)
+	}
+	webhook.CreatedAt = current.CreatedAt
+	webhook.UpdatedAt = time.Now()
+	s.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+// DeleteWebhook deletes an existing webhook, along with its deliveries. If
+// the webhook does not exist, ErrorNotFound is returned.
+func (s *MemoryStore) DeleteWebhook(webhook *Webhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.webhooks[webhook.ID]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting webhook %d", webhook.ID)
+	}
+	s.deleteWebhook(webhook.ID)
+	return nil
+}
+
+// GetDeliveries returns the most recent deliveries to the given webhook,
+// newest first and at most limit of them (all of them if limit is 0).
+func (s *MemoryStore) GetDeliveries(webhook Webhook, limit int) ([]Delivery, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	deliveries := []Delivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.WebhookID == webhook.ID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// CreateDelivery records a new delivery attempt; the delivery must refer to
+// an existing Webhook through its WebhookID, otherwise ErrorConstraint is
+// returned.
+func (s *MemoryStore) CreateDelivery(delivery *Delivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.webhooks[delivery.WebhookID]; !ok {
+		return errors.Wrapf(ErrorConstraint, "error recording delivery of event %d to webhook %d: reference to non-existing webhooks %d", delivery.EventID, delivery.WebhookID, delivery.WebhookID)
+	}
+	delivery.ID = s.next("deliveries")
+	s.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+// GetPreferences returns the notification preferences of all users.
+func (s *MemoryStore) GetPreferences() ([]Preference, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	preferences := make([]Preference, 0, len(s.preferences))
+	for _, preference := range s.preferences {
+		preferences = append(preferences, preference)
+	}
+	sort.Slice(preferences, func(i, j int) bool { return preferences[i].User < preferences[j].User })
+	return preferences, nil
+}
+
+// GetPreference returns the notification preferences of the given user; if
+// the user has none, ErrorNotFound is returned.
+func (s *MemoryStore) GetPreference(user string) (Preference, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if preference, ok := s.preferences[user]; ok {
+		return preference, nil
+	}
+	return Preference{}, errors.Wrapf(ErrorNotFound, "error reading notification preferences of user %q", user)
+}
+
+// SetPreference creates or replaces the notification preferences of the user
+// they belong to.
+func (s *MemoryStore) SetPreference(preference *Preference) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if current, ok := s.preferences[preference.User]; ok {
+		preference.ID = current.ID
+		preference.CreatedAt = current.CreatedAt
+		preference.UpdatedAt = time.Now()
+	} else {
+		preference.ID = s.next("preferences")
+		preference.CreatedAt = time.Now()
+		preference.UpdatedAt = preference.CreatedAt
+	}
+	s.preferences[preference.User] = *preference
+	return nil
+}
+
+// DeletePreference deletes the notification preferences of a user. If the
+// user has none, ErrorNotFound is returned.
+func (s *MemoryStore) DeletePreference(preference *Preference) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.preferences[preference.User]; !ok {
+		return errors.Wrapf(ErrorNotFound, "error deleting notification preferences of user %q", preference.User)
+	}
+	delete(s.preferences, preference.User)
+	return nil
+}
+
+// copy returns a new store holding a copy of the contents of the store, which
+// shares none of its maps.
+func (s *MemoryStore) copy() *MemoryStore {
+	c := NewMemoryStore()
+	for table, id := range s.sequences {
+		c.sequences[table] = id
+	}
+	for id, product := range s.products {
+		c.products[id] = product
+	}
+	for id, version := range s.versions {
+		c.versions[id] = version
+	}
+	for id, build := range s.builds {
+		c.builds[id] = build
+	}
+	for id, artifact := range s.artifacts {
+		c.artifacts[id] = artifact
+	}
+	for id, deployment := range s.deployments {
+		c.deployments[id] = deployment
+	}
+	for id, deployed := range s.deployed {
+		c.deployed[id] = deployed
+	}
+	for id, approval := range s.approvals {
+		c.approvals[id] = approval
+	}
+	for id, transition := range s.transitions {
+		c.transitions[id] = transition
+	}
+	for id, policy := range s.policies {
+		c.policies[id] = policy
+	}
+	for id, stage := range s.stages {
+		c.stages[id] = stage
+	}
+	for id, assignment := range s.assignments {
+		c.assignments[id] = assignment
+	}
+	c.records = append([]AuditRecord(nil), s.records...)
+	for id, webhook := range s.webhooks {
+		c.webhooks[id] = webhook
+	}
+	for id, delivery := range s.deliveries {
+		c.deliveries[id] = delivery
+	}
+	for user, preference := range s.preferences {
+		c.preferences[user] = preference
+	}
+	return c
+}
+
+// next returns the next identifier in the sequence of the given table.
+func (s *MemoryStore) next(table string) uint {
+	s.sequences[table]++
+	return s.sequences[table]
+}
+
+// productByCode returns the product having the given code, if any.
+func (s *MemoryStore) productByCode(code string) (Product, bool) {
+	for _, product := range s.products {
+		if product.Code == code {
+			return product, true
+		}
+	}
+	return Product{}, false
+}
+
+// versionByCode returns the version of the given product having the given
+// code, if any.
+func (s *MemoryStore) versionByCode(productID uint, code string) (Version, bool) {
+	for _, version := range s.versions {
+		if version.ProductID == productID && version.Code == code {
+			return version, true
+		}
+	}
+	return Version{}, false
+}
+
+// deploymentByOrder returns the deployment of the given version having the
+// given order, if any.
+func (s *MemoryStore) deploymentByOrder(versionID uint, order int) (Deployment, bool) {
+	for _, deployment := range s.deployments {
+		if deployment.VersionID == versionID && deployment.Order == order {
+			return deployment, true
+		}
+	}
+	return Deployment{}, false
+}
+
+// buildByNumber returns the build of the given version having the given
+// number, if any.
+func (s *MemoryStore) buildByNumber(versionID uint, number int) (Build, bool) {
+	for _, build := range s.builds {
+		if build.VersionID == versionID && build.Number == number {
+			return build, true
+		}
+	}
+	return Build{}, false
+}
+
+// artifactByName returns the artifact of the given build having the given
+// name, if any.
+func (s *MemoryStore) artifactByName(buildID uint, name string) (Artifact, bool) {
+	for _, artifact := range s.artifacts {
+		if artifact.BuildID == buildID && artifact.Name == name {
+			return artifact, true
+		}
+	}
+	return Artifact{}, false
+}
+
+// versionsOf returns the versions of the given product, sorted by precedence
+// and along with their deployments.
+func (s *MemoryStore) versionsOf(productID uint) []Version {
+	var versions []Version
+	for _, version := range s.versions {
+		if version.ProductID == productID {
+			version.Deployments = s.deploymentsOf(version.ID)
+			versions = append(versions, version)
+		}
+	}
+	SortVersions(versions)
+	return versions
+}
+
+// deploymentsOf returns the deployments of the given version, sorted by
+// their order.
+func (s *MemoryStore) deploymentsOf(versionID uint) []Deployment {
+	var deployments []Deployment
+	for _, deployment := range s.deployments {
+		if deployment.VersionID == versionID {
+			deployment.Approvals = s.approvalsOf(deployment.ID)
+			deployments = append(deployments, deployment)
+		}
+	}
+	sort.Slice(deployments, func(i, j int) bool { return deployments[i].Order < deployments[j].Order })
+	return deployments
+}
+
+// approvalsOf returns the approvals of the given deployment, sorted by ID.
+func (s *MemoryStore) approvalsOf(deploymentID uint) []Approval {
+	var approvals []Approval
+	for _, approval := range s.approvals {
+		if approval.DeploymentID == deploymentID {
+			approvals = append(approvals, approval)
+		}
+	}
+	sort.Slice(approvals, func(i, j int) bool { return approvals[i].ID < approvals[j].ID })
+	return approvals
+}
+
+// transitionsOf returns the status transitions of the given deployment,
+// sorted by ID.
+func (s *MemoryStore) transitionsOf(deploymentID uint) []Transition {
+	var transitions []Transition
+	for _, transition := range s.transitions {
+		if transition.DeploymentID == deploymentID {
+			transitions = append(transitions, transition)
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].ID < transitions[j].ID })
+	return transitions
+}
+
+// artifactsOf returns the artifacts deployed by the given deployment, sorted
+// by digest.
+func (s *MemoryStore) artifactsOf(deploymentID uint) []DeployedArtifact {
+	var artifacts []DeployedArtifact
+	for _, artifact := range s.deployed {
+		if artifact.DeploymentID == deploymentID {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Digest < artifacts[j].Digest })
+	return artifacts
+}
+
+// policyOf returns the approval policy of the given product for the given
+// environment, if any.
+func (s *MemoryStore) policyOf(productID uint, environment string) (Policy, bool) {
+	for _, policy := range s.policies {
+		if policy.ProductID == productID && policy.Environment == environment {
+			return policy, true
+		}
+	}
+	return Policy{}, false
+}
+
+// insertVersion stores a new version along with its deployments, assigning
+// the identifiers and timestamps.
+func (s *MemoryStore) insertVersion(version *Version) {
+	version.ID = s.next("versions")
+	version.CreatedAt = time.Now()
+	version.UpdatedAt = version.CreatedAt
+	s.versions[version.ID] = detachVersion(*version)
+	for i := range version.Deployments {
+		version.Deployments[i].VersionID = version.ID
+		s.insertDeployment(&version.Deployments[i])
+	}
+}
+
+// insertDeployment stores a new deployment, assigning its identifier and
+// timestamps.
+func (s *MemoryStore) insertDeployment(deployment *Deployment) {
+	if deployment.Status == "" {
+		deployment.Status = PENDING
+	}
+	deployment.ID = s.next("deployments")
+	deployment.CreatedAt = time.Now()
+	deployment.UpdatedAt = deployment.CreatedAt
+	s.deployments[deployment.ID] = detachDeployment(*deployment)
+	for i := range deployment.Approvals {
+		deployment.Approvals[i].DeploymentID = deployment.ID
+		s.insertApproval(&deployment.Approvals[i])
+	}
+	for i := range deployment.Transitions {
+		transition := &deployment.Transitions[i]
+		transition.ID = s.next("transitions")
+		transition.DeploymentID = deployment.ID
+		transition.CreatedAt = time.Now()
+		transition.UpdatedAt = transition.CreatedAt
+		s.transitions[transition.ID] = *transition
+	}
+}
+
+// insertApproval stores a new approval, assigning its identifier and
+// timestamps.
+func (s *MemoryStore) insertApproval(approval *Approval) {
+	approval.ID = s.next("approvals")
+	approval.CreatedAt = time.Now()
+	approval.UpdatedAt = approval.CreatedAt
+	s.approvals[approval.ID] = *approval
+}
+
+// deleteWebhook removes a webhook, along with its deliveries.
+func (s *MemoryStore) deleteWebhook(webhookID uint) {
+	for id, delivery := range s.deliveries {
+		if delivery.WebhookID == webhookID {
+			delete(s.deliveries, id)
+		}
+	}
+	delete(s.webhooks, webhookID)
+}
+
+// applyTransition moves a deployment to the status the given transition leads
+// to and records the transition, assigning its identifier and timestamps.
+func (s *MemoryStore) applyTransition(deployment *Deployment, transition *Transition) {
+	transition.ID = s.next("transitions")
+	transition.DeploymentID = deployment.ID
+	transition.From = deployment.Status
+	transition.CreatedAt = time.Now()
+	transition.UpdatedAt = transition.CreatedAt
+	s.transitions[transition.ID] = *transition
+	deployment.Status = transition.To
+	if transition.To == GRANTED {
+		deployment.GrantedBy = transition.User
+		deployment.Timestamp = transition.Timestamp
+	}
+}
+
+// deleteVersion removes a version along with its deployments and builds.
+func (s *MemoryStore) deleteVersion(versionID uint) {
+	for id, deployment := range s.deployments {
+		if deployment.VersionID == versionID {
+			s.deleteDeployment(id)
+		}
+	}
+	for id, build := range s.builds {
+		if build.VersionID == versionID {
+			s.deleteBuild(id)
+		}
+	}
+	delete(s.versions, versionID)
+}
+
+// deleteBuild removes a build along with its artifacts.
+func (s *MemoryStore) deleteBuild(buildID uint) {
+	for id, artifact := range s.artifacts {
+		if artifact.BuildID == buildID {
+			delete(s.artifacts, id)
+		}
+	}
+	delete(s.builds, buildID)
+}
+
+// deleteDeployed removes the records of the artifacts deployed by a
+// deployment.
+func (s *MemoryStore) deleteDeployed(deploymentID uint) {
+	for id, artifact := range s.deployed {
+		if artifact.DeploymentID == deploymentID {
+			delete(s.deployed, id)
+		}
+	}
+}
+
+// deleteStages removes the promotion pipeline of a product.
+func (s *MemoryStore) deleteStages(productID uint) {
+	for id, stage := range s.stages {
+		if stage.ProductID == productID {
+			delete(s.stages, id)
+		}
+	}
+}
+
+// deleteDeployment removes a deployment along with its approvals, status
+// transitions and deployed artifacts.
+func (s *MemoryStore) deleteDeployment(deploymentID uint) {
+	for id, approval := range s.approvals {
+		if approval.DeploymentID == deploymentID {
+			delete(s.approvals, id)
+		}
+	}
+	for id, transition := range s.transitions {
+		if transition.DeploymentID == deploymentID {
+			delete(s.transitions, id)
+		}
+	}
+	s.deleteDeployed(deploymentID)
+	delete(s.deployments, deploymentID)
+}
+
+// checkVersions verifies that the codes of a set of new versions, and the
+// orders of their deployments, do not clash with one another.
+func checkVersions(versions []Version) error {
+	codes := map[string]bool{}
+	for i, version := range versions {
+		if err := versions[i].parse(); err != nil {
+			return err
+		}
+		if codes[version.Code] {
+			return errors.Wrapf(ErrorDuplicate, "duplicate version %q", version.Code)
+		}
+		codes[version.Code] = true
+		if err := checkDeployments(version.Deployments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDeployments verifies that the orders of a set of new deployments do
+// not clash with one another.
+func checkDeployments(deployments []Deployment) error {
+	orders := map[int]bool{}
+	for _, deployment := range deployments {
+		if orders[deployment.Order] {
+			return errors.Wrapf(ErrorDuplicate, "duplicate deployment %d", deployment.Order)
+		}
+		orders[deployment.Order] = true
+	}
+	return nil
+}
+
+// detachProduct returns a copy of the product without its versions, as it is
+// stored in the product table.
+func detachProduct(product Product) Product {
+	product.Versions = nil
+	return product
+}
+
+// detachVersion returns a copy of the version without its deployments, as it
+// is stored in the version table.
+func detachVersion(version Version) Version {
+	version.Deployments = nil
+	return version
+}
+
+// detachDeployment returns a copy of the deployment without its approvals,
+// status transitions and artifacts, as it is stored in the deployment table.
+func detachDeployment(deployment Deployment) Deployment {
+	deployment.Approvals = nil
+	deployment.Transitions = nil
+	deployment.Artifacts = nil
+	return deployment
+}
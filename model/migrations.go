@@ -0,0 +1,596 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/semver"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Migration is a numbered, reversible change to the database schema.
+//
+// Migrations must not refer to the entity types in this package, which
+// always reflect the latest schema: each migration declares a snapshot of
+// the tables it creates, as they were at the time it was written.
+type Migration struct {
+	// ID is the sequence number of the migration; it is also the schema
+	// version of a database once the migration has been applied.
+	ID uint
+	// Description briefly explains what the migration does.
+	Description string
+	// Up applies the migration.
+	Up func(tx *gorm.DB) error
+	// Down reverts the migration.
+	Down func(tx *gorm.DB) error
+}
+
+// migrations is the ordered list of all schema migrations.
+var migrations = []Migration{
+	{
+		ID:          1,
+		Description: "create products and versions",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Table("products").CreateTable(&struct {
+				ID          uint   `gorm:"primary_key;unique_index:products_pk"`
+				Code        string `gorm:"size:63;unique_index:uix_pcode"`
+				Name        string
+				Description string
+				Contact     string
+				Repository  string
+				WebSite     string
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("versions").CreateTable(&struct {
+				ID          uint   `gorm:"primary_key;unique_index:versions_pk"`
+				ProductID   uint   `gorm:"unique_index:uix_pv"`
+				Code        string `gorm:"unique_index:uix_pv"`
+				Description string `gorm:"type:varchar(1024)"`
+				Repository  string
+				Branch      string
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("versions", "products").Error
+		},
+	},
+	{
+		ID:          2,
+		Description: "create deployments",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("deployments").CreateTable(&struct {
+				ID          uint   `gorm:"primary_key;unique_index:deployments_pk"`
+				VersionID   uint   `gorm:"unique_index:uix_vo"`
+				Order       int    `gorm:"column:ordinal;unique_index:uix_vo"`
+				Environment string `gorm:"size:63"`
+				Status      string `gorm:"size:15"`
+				GrantedBy   string
+				Timestamp   time.Time
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("deployments").Error
+		},
+	},
+	{
+		ID:          3,
+		Description: "create role assignments",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("assignments").CreateTable(&struct {
+				ID          uint   `gorm:"primary_key;unique_index:assignments_pk"`
+				User        string `gorm:"column:username;unique_index:uix_upe"`
+				ProductID   uint   `gorm:"unique_index:uix_upe"`
+				Environment string `gorm:"size:63;unique_index:uix_upe"`
+				Role        string `gorm:"size:15"`
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("assignments").Error
+		},
+	},
+	{
+		ID:          4,
+		Description: "add version authors, approval policies and approvals",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE versions ADD COLUMN author VARCHAR(255) NOT NULL DEFAULT ''").Error; err != nil {
+				return err
+			}
+			if err := tx.Table("policies").CreateTable(&struct {
+				ID            uint   `gorm:"primary_key;unique_index:policies_pk"`
+				ProductID     uint   `gorm:"unique_index:uix_ppe"`
+				Environment   string `gorm:"size:63;unique_index:uix_ppe"`
+				Approvals     int
+				ExcludeAuthor bool
+				CreatedAt     time.Time
+				UpdatedAt     time.Time
+			}{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("approvals").CreateTable(&struct {
+				ID           uint   `gorm:"primary_key;unique_index:approvals_pk"`
+				DeploymentID uint   `gorm:"unique_index:uix_du"`
+				User         string `gorm:"column:username;unique_index:uix_du"`
+				Timestamp    time.Time
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTableIfExists("approvals", "policies").Error; err != nil {
+				return err
+			}
+			return dropColumn(tx, "versions", "author", &struct {
+				ID          uint   `gorm:"primary_key;unique_index:versions_pk"`
+				ProductID   uint   `gorm:"unique_index:uix_pv"`
+				Code        string `gorm:"unique_index:uix_pv"`
+				Description string `gorm:"type:varchar(1024)"`
+				Repository  string
+				Branch      string
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{})
+		},
+	},
+	{
+		ID:          5,
+		Description: "create promotion pipeline stages",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("stages").CreateTable(&struct {
+				ID          uint   `gorm:"primary_key;unique_index:stages_pk"`
+				ProductID   uint   `gorm:"unique_index:uix_pp;unique_index:uix_pse"`
+				Position    int    `gorm:"unique_index:uix_pp"`
+				Environment string `gorm:"size:63;unique_index:uix_pse"`
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("stages").Error
+		},
+	},
+	{
+		ID:          6,
+		Description: "create deployment status transitions",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("transitions").CreateTable(&struct {
+				ID           uint   `gorm:"primary_key;unique_index:transitions_pk"`
+				DeploymentID uint   `gorm:"index:ix_td"`
+				From         string `gorm:"column:from_status;size:15"`
+				To           string `gorm:"column:to_status;size:15"`
+				User         string `gorm:"column:username"`
+				Reason       string `gorm:"type:varchar(1024)"`
+				Timestamp    time.Time
+				CreatedAt    time.Time
+				UpdatedAt    time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("transitions").Error
+		},
+	},
+	{
+		ID:          7,
+		Description: "create audit log",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("audit_records").CreateTable(&struct {
+				ID        uint      `gorm:"primary_key;unique_index:audit_records_pk"`
+				Timestamp time.Time `gorm:"index:ix_at"`
+				User      string    `gorm:"column:username;index:ix_au"`
+				Action    string    `gorm:"size:15"`
+				Entity    string    `gorm:"size:31"`
+				Product   string    `gorm:"size:63;index:ix_ap"`
+				Key       string    `gorm:"column:entity_key"`
+				Before    string    `gorm:"type:text"`
+				After     string    `gorm:"type:text"`
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("audit_records").Error
+		},
+	},
+	{
+		ID:          8,
+		Description: "chain audit records through their hashes",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE audit_records ADD COLUMN previous VARCHAR(64) NOT NULL DEFAULT ''").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE audit_records ADD COLUMN hash VARCHAR(64) NOT NULL DEFAULT ''").Error; err != nil {
+				return err
+			}
+			// chain the existing records, oldest first
+			var records []struct {
+				ID        uint
+				Timestamp time.Time
+				User      string `gorm:"column:username"`
+				Action    string
+				Entity    string
+				Product   string
+				Key       string `gorm:"column:entity_key"`
+				Before    string
+				After     string
+			}
+			if err := tx.Table("audit_records").Order("id").Find(&records).Error; err != nil {
+				return err
+			}
+			previous := ""
+			for _, record := range records {
+				hash := auditDigest(previous, record.Timestamp, record.User, record.Action, record.Entity, record.Product, record.Key, record.Before, record.After)
+				if err := tx.Table("audit_records").Where("id = ?", record.ID).UpdateColumns(map[string]interface{}{"previous": previous, "hash": hash}).Error; err != nil {
+					return err
+				}
+				previous = hash
+			}
+			return tx.Table("audit_records").AddUniqueIndex("uix_aprev", "previous").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("audit_records").RemoveIndex("uix_aprev").Error; err != nil {
+				return err
+			}
+			snapshot := &struct {
+				ID        uint      `gorm:"primary_key;unique_index:audit_records_pk"`
+				Timestamp time.Time `gorm:"index:ix_at"`
+				User      string    `gorm:"column:username;index:ix_au"`
+				Action    string    `gorm:"size:15"`
+				Entity    string    `gorm:"size:31"`
+				Product   string    `gorm:"size:63;index:ix_ap"`
+				Key       string    `gorm:"column:entity_key"`
+				Before    string    `gorm:"type:text"`
+				After     string    `gorm:"type:text"`
+			}{}
+			if err := dropColumn(tx, "audit_records", "hash", snapshot); err != nil {
+				return err
+			}
+			return dropColumn(tx, "audit_records", "previous", snapshot)
+		},
+	},
+	{
+		ID:          9,
+		Description: "create webhooks and their delivery log",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Table("webhooks").CreateTable(&struct {
+				ID        uint   `gorm:"primary_key;unique_index:webhooks_pk"`
+				ProductID uint   `gorm:"index:ix_wp"`
+				URL       string `gorm:"type:varchar(1024)"`
+				Events    string `gorm:"type:varchar(1024)"`
+				Secret    string
+				Active    bool
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("deliveries").CreateTable(&struct {
+				ID         uint `gorm:"primary_key;unique_index:deliveries_pk"`
+				WebhookID  uint `gorm:"index:ix_dw"`
+				EventID    uint
+				Event      string `gorm:"size:63"`
+				Attempt    int
+				StatusCode int
+				Error      string `gorm:"type:varchar(1024)"`
+				Timestamp  time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.DropTableIfExists("deliveries").Error; err != nil {
+				return err
+			}
+			return tx.DropTableIfExists("webhooks").Error
+		},
+	},
+	{
+		ID:          10,
+		Description: "create notification preferences",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("preferences").CreateTable(&struct {
+				ID        uint   `gorm:"primary_key;unique_index:preferences_pk"`
+				User      string `gorm:"column:username;unique_index:uix_pu"`
+				Email     string `gorm:"size:255"`
+				Products  string `gorm:"type:varchar(1024)"`
+				Events    string `gorm:"type:varchar(1024)"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("preferences").Error
+		},
+	},
+	{
+		ID:          11,
+		Description: "add the semantic version components of version codes",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"major", "minor", "patch"} {
+				if err := tx.Exec("ALTER TABLE versions ADD COLUMN " + column + " BIGINT NOT NULL DEFAULT 0").Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec("ALTER TABLE versions ADD COLUMN pre_release VARCHAR(255) NOT NULL DEFAULT ''").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE versions ADD COLUMN legacy BOOLEAN NOT NULL DEFAULT FALSE").Error; err != nil {
+				return err
+			}
+			// codes which are not semantic versions are kept, but their
+			// versions are marked as legacy ones, which sort before all
+			// others (see CompareVersions)
+			var versions []struct {
+				ID   uint
+				Code string
+			}
+			if err := tx.Table("versions").Order("id").Find(&versions).Error; err != nil {
+				return err
+			}
+			for _, version := range versions {
+				semantic, err := semver.Parse(version.Code)
+				if err != nil {
+					if err := tx.Table("versions").Where("id = ?", version.ID).UpdateColumn("legacy", true).Error; err != nil {
+						return err
+					}
+					continue
+				}
+				if err := tx.Table("versions").Where("id = ?", version.ID).UpdateColumns(map[string]interface{}{
+					"major":       semantic.Major,
+					"minor":       semantic.Minor,
+					"patch":       semantic.Patch,
+					"pre_release": strings.Join(semantic.PreRelease, "."),
+				}).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Table("versions").AddIndex("ix_vsem", "product_id", "major", "minor", "patch").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Table("versions").RemoveIndex("ix_vsem").Error; err != nil {
+				return err
+			}
+			snapshot := &struct {
+				ID          uint   `gorm:"primary_key;unique_index:versions_pk"`
+				ProductID   uint   `gorm:"unique_index:uix_pv"`
+				Code        string `gorm:"unique_index:uix_pv"`
+				Description string `gorm:"type:varchar(1024)"`
+				Repository  string
+				Branch      string
+				Author      string
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{}
+			for _, column := range []string{"legacy", "pre_release", "patch", "minor", "major"} {
+				if err := dropColumn(tx, "versions", column, snapshot); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          12,
+		Description: "create builds",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("builds").CreateTable(&struct {
+				ID         uint   `gorm:"primary_key;unique_index:builds_pk"`
+				VersionID  uint   `gorm:"unique_index:uix_vn"`
+				Number     int    `gorm:"unique_index:uix_vn"`
+				Commit     string `gorm:"column:commit_sha;size:64"`
+				Status     string `gorm:"size:15"`
+				StartedAt  time.Time
+				FinishedAt time.Time
+				JobURL     string `gorm:"type:varchar(1024)"`
+				Log        string `gorm:"type:varchar(4096)"`
+				CreatedAt  time.Time
+				UpdatedAt  time.Time
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("builds").Error
+		},
+	},
+	{
+		ID:          13,
+		Description: "create build artifacts and the artifacts of deployments",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Table("artifacts").CreateTable(&struct {
+				ID        uint   `gorm:"primary_key;unique_index:artifacts_pk"`
+				BuildID   uint   `gorm:"unique_index:uix_bn"`
+				Name      string `gorm:"size:255;unique_index:uix_bn"`
+				Type      string `gorm:"size:63"`
+				Size      int64
+				Digest    string `gorm:"size:71;index:ix_ad"`
+				URI       string `gorm:"type:varchar(1024)"`
+				Image     string `gorm:"type:varchar(1024)"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("deployed_artifacts").CreateTable(&struct {
+				ID           uint   `gorm:"primary_key;unique_index:deployed_artifacts_pk"`
+				DeploymentID uint   `gorm:"unique_index:uix_dd"`
+				Digest       string `gorm:"size:71;unique_index:uix_dd;index:ix_dad"`
+			}{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists("deployed_artifacts", "artifacts").Error
+		},
+	},
+	{
+		ID:          14,
+		Description: "add product storage quotas",
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE products ADD COLUMN quota BIGINT NOT NULL DEFAULT 0").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumn(tx, "products", "quota", &struct {
+				ID          uint   `gorm:"primary_key;unique_index:products_pk"`
+				Code        string `gorm:"size:63;unique_index:uix_pcode"`
+				Name        string
+				Description string
+				Contact     string
+				Repository  string
+				WebSite     string
+				CreatedAt   time.Time
+				UpdatedAt   time.Time
+			}{})
+		},
+	},
+}
+
+// dropColumn removes a column from a table; since SQLITE3 cannot drop columns
+// (before version 3.35), there the table is rebuilt from the given snapshot of
+// its schema without the column, and its rows copied over.
+func dropColumn(tx *gorm.DB, table string, column string, snapshot interface{}) error {
+	if tx.Dialect().GetName() != "sqlite3" {
+		return tx.Table(table).DropColumn(column).Error
+	}
+
+	// the indexes of the old table must go before the new table can reuse
+	// their names
+	var indexes []struct{ Name string }
+	if err := tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table).Scan(&indexes).Error; err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := tx.Exec("DROP INDEX " + tx.Dialect().Quote(index.Name)).Error; err != nil {
+			return err
+		}
+	}
+	old := table + "_old"
+	if err := tx.Exec("ALTER TABLE " + tx.Dialect().Quote(table) + " RENAME TO " + tx.Dialect().Quote(old)).Error; err != nil {
+		return err
+	}
+	if err := tx.Table(table).CreateTable(snapshot).Error; err != nil {
+		return err
+	}
+	var columns []string
+	for _, field := range tx.NewScope(snapshot).Fields() {
+		if !field.IsIgnored && field.IsNormal {
+			columns = append(columns, tx.Dialect().Quote(field.DBName))
+		}
+	}
+	list := strings.Join(columns, ", ")
+	if err := tx.Exec("INSERT INTO " + tx.Dialect().Quote(table) + " (" + list + ") SELECT " + list + " FROM " + tx.Dialect().Quote(old)).Error; err != nil {
+		return err
+	}
+	return tx.DropTable(old).Error
+}
+
+// schemaMigration records the application of a migration to the database.
+type schemaMigration struct {
+	ID          uint `gorm:"primary_key;auto_increment:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+// TableName returns the name of the table holding the migrations history.
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// LatestSchemaVersion returns the schema version resulting from the
+// application of all the available migrations.
+func LatestSchemaVersion() uint {
+	return migrations[len(migrations)-1].ID
+}
+
+// SchemaVersion returns the current version of the database schema, that is
+// the ID of the last migration applied; 0 means no migration was applied.
+func (s *GormStore) SchemaVersion() (uint, error) {
+	if err := s.initMigrations(); err != nil {
+		return 0, err
+	}
+	var applied []schemaMigration
+	if err := s.db.Order("id desc").Limit(1).Find(&applied).Error; err != nil {
+		return 0, errors.Wrap(classify(err), "error reading schema version")
+	}
+	if len(applied) == 0 {
+		return 0, nil
+	}
+	return applied[0].ID, nil
+}
+
+// Migrate brings the database schema to the given version, applying or
+// reverting migrations one at a time, each within its own transaction;
+// version 0 is the empty schema.
+func (s *GormStore) Migrate(version uint) error {
+	if version > LatestSchemaVersion() {
+		return errors.Errorf("unknown schema version %d (latest is %d)", version, LatestSchemaVersion())
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if migration.ID > current && migration.ID <= version {
+			err := s.db.Transaction(func(tx *gorm.DB) error {
+				if err := migration.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&schemaMigration{ID: migration.ID, Description: migration.Description, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return errors.Wrapf(classify(err), "error applying migration %d (%s)", migration.ID, migration.Description)
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.ID <= current && migration.ID > version {
+			err := s.db.Transaction(func(tx *gorm.DB) error {
+				if err := migration.Down(tx); err != nil {
+					return err
+				}
+				return tx.Where("id = ?", migration.ID).Delete(&schemaMigration{}).Error
+			})
+			if err != nil {
+				return errors.Wrapf(classify(err), "error reverting migration %d (%s)", migration.ID, migration.Description)
+			}
+		}
+	}
+	return nil
+}
+
+// legacyTables maps the migrations that reproduce the schemas generated by
+// gorm's AutoMigrate, before the introduction of migrations, onto the table
+// each of them creates.
+var legacyTables = map[uint]string{
+	1: "products",
+	2: "deployments",
+}
+
+// initMigrations creates the migrations history table if it does not exist;
+// in databases created before the introduction of migrations, the migrations
+// whose tables already exist are recorded as applied.
+func (s *GormStore) initMigrations() error {
+	if s.db.HasTable(&schemaMigration{}) {
+		return nil
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateTable(&schemaMigration{}).Error; err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			table, ok := legacyTables[migration.ID]
+			if !ok || !tx.HasTable(table) {
+				break
+			}
+			if err := tx.Create(&schemaMigration{ID: migration.ID, Description: migration.Description, AppliedAt: time.Now()}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(classify(err), "error initialising migrations history")
+	}
+	return nil
+}
@@ -1,422 +1,898 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite" // don't refer to SQLITE3
+	"github.com/dihedron/builds/semver"
 	"github.com/pkg/errors"
 )
 
 // Product represents a product.
 type Product struct {
-	ID          uint      `gorm:"primary_key;unique_index:products_pk" json:"id"`
-	Code        string    `gorm:"size:63;unique_index:uix_pcode" json:"code,omitempty"`
-	Name        string    `json:"name,omitempty"`
-	Description string    `json:"description,omitempty"`
-	Contact     string    `json:"contact,omitempty"`
-	Repository  string    `json:"repository,omitempty"`
-	WebSite     string    `json:"website,omitempty"`
-	Versions    []Version `json:"versions,omitempty"`
-	CreatedAt   time.Time `json:"created,omitempty"`
-	UpdatedAt   time.Time `json:"updated,omitempty"`
+	ID          uint   `gorm:"primary_key;unique_index:products_pk" json:"id"`
+	Code        string `gorm:"size:63;unique_index:uix_pcode" json:"code,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Contact     string `json:"contact,omitempty"`
+	Repository  string `json:"repository,omitempty"`
+	WebSite     string `json:"website,omitempty"`
+	// Quota is the maximum size, in bytes, of the artifact contents stored
+	// for the product; if 0, the default quota of the server applies.
+	Quota     int64     `json:"quota,omitempty"`
+	Versions  []Version `json:"versions,omitempty"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
 }
 
 // Version represents a product version.
 type Version struct {
-	ID          uint      `gorm:"primary_key;unique_index:versions_pk"  json:"id"`
-	ProductID   uint      `gorm:"unique_index:uix_pv"  json:"pid"`
-	Code        string    `gorm:"unique_index:uix_pv" json:"code,omitempty"`
-	Description string    `gorm:"type:varchar(1024)" json:"description,omitempty"`
-	Repository  string    `json:"repository,omitempty"`
-	Branch      string    `json:"branch,omitempty"`
-	CreatedAt   time.Time `json:"created,omitempty"`
-	UpdatedAt   time.Time `json:"updated,omitempty"`
+	ID          uint         `gorm:"primary_key;unique_index:versions_pk"  json:"id"`
+	ProductID   uint         `gorm:"unique_index:uix_pv;index:ix_vsem"  json:"pid"`
+	Code        string       `gorm:"unique_index:uix_pv" json:"code,omitempty"`
+	Description string       `gorm:"type:varchar(1024)" json:"description,omitempty"`
+	Repository  string       `json:"repository,omitempty"`
+	Branch      string       `json:"branch,omitempty"`
+	Author      string       `json:"author,omitempty"`
+	Deployments []Deployment `json:"deployments,omitempty"`
+	// Major, Minor, Patch and PreRelease are the components of the Code,
+	// parsed as a semantic version, by which versions are sorted.
+	Major      uint64 `gorm:"index:ix_vsem" json:"-"`
+	Minor      uint64 `gorm:"index:ix_vsem" json:"-"`
+	Patch      uint64 `gorm:"index:ix_vsem" json:"-"`
+	PreRelease string `gorm:"size:255" json:"-"`
+	// Legacy marks the versions registered before codes had to be semantic
+	// versions, whose codes may not be; they sort before all others, and
+	// lose the mark once their code is changed.
+	Legacy    bool      `gorm:"not null;default:false" json:"legacy,omitempty"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
 }
 
-// String formats a Product as a JSON-encoded string.
-func (p Product) String() string {
-	bytes, err := json.MarshalIndent(p, "", "  ")
+// Semantic returns the code of the version parsed as a semantic version.
+func (v Version) Semantic() (semver.Version, error) {
+	return semver.Parse(v.Code)
+}
+
+// parse sets the components of the version from its code; if the code is not
+// a valid semantic version, ErrorConstraint is returned, unless the version is
+// a legacy one, whose components are then left as they are.
+func (v *Version) parse() error {
+	semantic, err := v.Semantic()
 	if err != nil {
-		return ""
+		if v.Legacy {
+			return nil
+		}
+		return errors.Wrap(ErrorConstraint, err.Error())
 	}
-	return string(bytes[:])
+	v.Major, v.Minor, v.Patch = semantic.Major, semantic.Minor, semantic.Patch
+	v.PreRelease = strings.Join(semantic.PreRelease, ".")
+	return nil
 }
 
-// String formats a Version as a JSON-encoded string.
-func (v Version) String() string {
-	bytes, err := json.MarshalIndent(v, "", "  ")
+// NextCode returns the code of the version following the latest of the given
+// versions (i.e. the one with the highest precedence), obtained by
+// incrementing the given part (see semver.Version.Next); without versions
+// whose code is a semantic version, the next version after 0.0.0 is returned.
+func NextCode(versions []Version, part semver.Part, identifier string) (string, error) {
+	var latest semver.Version
+	for _, version := range versions {
+		if semantic, err := version.Semantic(); err == nil && semver.Compare(semantic, latest) > 0 {
+			latest = semantic
+		}
+	}
+	next, err := latest.Next(part, identifier)
 	if err != nil {
-		return ""
+		return "", err
 	}
-	return string(bytes[:])
+	return next.String(), nil
+}
+
+// DefaultBranch returns the name of the branch of the version with the given
+// code, e.g. "ver_1_0_2" for version 1.0.2 and "ver_2_0_0_rc_1" for version
+// 2.0.0-rc.1.
+func DefaultBranch(code string) string {
+	return "ver_" + strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, code)
+}
+
+// CompareVersions returns -1, 0 or +1 depending on whether version a precedes,
+// has the same precedence as, or follows version b, according to their
+// semantic versions; legacy versions precede all others, and versions with
+// the same precedence are ordered by ID.
+func CompareVersions(a, b Version) int {
+	switch {
+	case a.Legacy && !b.Legacy:
+		return -1
+	case !a.Legacy && b.Legacy:
+		return 1
+	}
+	for _, pair := range [][2]uint64{{a.Major, b.Major}, {a.Minor, b.Minor}, {a.Patch, b.Patch}} {
+		switch {
+		case pair[0] < pair[1]:
+			return -1
+		case pair[0] > pair[1]:
+			return 1
+		}
+	}
+	if result := semver.ComparePreReleases(a.PreRelease, b.PreRelease); result != 0 {
+		return result
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
 }
 
-var db *gorm.DB
+// SortVersions sorts the given versions by precedence, oldest first.
+func SortVersions(versions []Version) {
+	sort.SliceStable(versions, func(i, j int) bool { return CompareVersions(versions[i], versions[j]) < 0 })
+}
 
-// New loads an existing SQLITE3 database from the given path, or creates
-// one if not existing, and upates the tables definitions according to
-// the current object model.
-func New(dbpath string) error {
+// Status represents the status of a deployment.
+type Status string
+
+const (
+	// PENDING is the status of a deployment that has not been authorised yet.
+	PENDING Status = "PENDING"
+	// GRANTED is the status of a deployment that has been authorised but not
+	// yet carried out.
+	GRANTED Status = "GRANTED"
+	// PERFORMED is the status of a deployment that has been carried out.
+	PERFORMED Status = "PERFORMED"
+	// REJECTED is the status of a deployment whose authorisation has been
+	// denied (or withdrawn before it was carried out).
+	REJECTED Status = "REJECTED"
+	// FAILED is the status of a deployment that could not be carried out, or
+	// that turned out to be faulty once carried out.
+	FAILED Status = "FAILED"
+	// ROLLED_BACK is the status of a deployment that has been reverted.
+	ROLLED_BACK Status = "ROLLED_BACK"
+	// CANCELLED is the status of a deployment that is no longer going to be
+	// carried out.
+	CANCELLED Status = "CANCELLED"
+)
 
-	var err error
-	if db, err = gorm.Open("sqlite3", dbpath); err != nil {
-		return errors.Wrap(err, "failed to load database driver")
+// transitions maps each status onto the ones a deployment can move to from
+// it; REJECTED, ROLLED_BACK and CANCELLED are final.
+var transitions = map[Status][]Status{
+	PENDING:   {GRANTED, REJECTED, CANCELLED},
+	GRANTED:   {PERFORMED, REJECTED, FAILED, CANCELLED},
+	PERFORMED: {FAILED, ROLLED_BACK},
+	FAILED:    {ROLLED_BACK},
+}
+
+// Valid returns whether the status is one of the known ones.
+func (s Status) Valid() bool {
+	switch s {
+	case PENDING, GRANTED, PERFORMED, REJECTED, FAILED, ROLLED_BACK, CANCELLED:
+		return true
 	}
+	return false
+}
 
-	if err = db.DB().Ping(); err != nil {
-		return errors.Wrap(err, "failed to connect to database manager")
+// CanTransition returns whether a deployment can move from the status to the
+// other one.
+func (s Status) CanTransition(other Status) bool {
+	for _, next := range transitions[s] {
+		if next == other {
+			return true
+		}
 	}
+	return false
+}
 
-	// instantiate or update the schema (does not drop anything)
-	db.AutoMigrate(&Product{}, &Version{})
+// Deployment represents the deployment of a product version onto an
+// environment; deployments are ordered (e.g. Integration, Quality,
+// Certification, Production) within each version.
+type Deployment struct {
+	ID          uint         `gorm:"primary_key;unique_index:deployments_pk" json:"id"`
+	VersionID   uint         `gorm:"unique_index:uix_vo" json:"vid"`
+	Order       int          `gorm:"column:ordinal;unique_index:uix_vo" json:"order"`
+	Environment string       `gorm:"size:63" json:"environment,omitempty"`
+	Status      Status       `gorm:"size:15" json:"status,omitempty"`
+	GrantedBy   string       `json:"grantedBy,omitempty"`
+	Timestamp   time.Time    `json:"timestamp,omitempty"`
+	Approvals   []Approval   `json:"approvals,omitempty"`
+	Transitions []Transition `json:"transitions,omitempty"`
+	// Artifacts lists the digests of the artifacts deployed, which can only
+	// change while the deployment is PENDING.
+	Artifacts []DeployedArtifact `json:"artifacts,omitempty"`
+	CreatedAt time.Time          `json:"created,omitempty"`
+	UpdatedAt time.Time          `json:"updated,omitempty"`
+}
 
-	return nil
+// Approval records that a user approved a deployment; each user can approve
+// a deployment only once.
+type Approval struct {
+	ID           uint      `gorm:"primary_key;unique_index:approvals_pk" json:"id"`
+	DeploymentID uint      `gorm:"unique_index:uix_du" json:"did"`
+	User         string    `gorm:"column:username;unique_index:uix_du" json:"user"`
+	Timestamp    time.Time `json:"timestamp,omitempty"`
+	CreatedAt    time.Time `json:"created,omitempty"`
+	UpdatedAt    time.Time `json:"updated,omitempty"`
 }
 
-// Close closes the current SQLITE3 database.
-func Close() error {
-	if err := db.Close(); err != nil {
-		return errors.Wrap(err, "error closing the database")
+// Transition records a change of the status of a deployment, along with the
+// user who made it and the reason why.
+type Transition struct {
+	ID           uint      `gorm:"primary_key;unique_index:transitions_pk" json:"id"`
+	DeploymentID uint      `gorm:"index:ix_td" json:"did"`
+	From         Status    `gorm:"column:from_status;size:15" json:"from"`
+	To           Status    `gorm:"column:to_status;size:15" json:"to"`
+	User         string    `gorm:"column:username" json:"user,omitempty"`
+	Reason       string    `gorm:"type:varchar(1024)" json:"reason,omitempty"`
+	Timestamp    time.Time `json:"timestamp,omitempty"`
+	CreatedAt    time.Time `json:"created,omitempty"`
+	UpdatedAt    time.Time `json:"updated,omitempty"`
+}
+
+// Policy defines the approvals required to grant the deployments of a product
+// onto an environment or, if its Environment is empty, onto all environments
+// having no policy of their own; without any policy, a single approval is
+// enough.
+type Policy struct {
+	ID          uint   `gorm:"primary_key;unique_index:policies_pk" json:"id"`
+	ProductID   uint   `gorm:"unique_index:uix_ppe" json:"pid"`
+	Environment string `gorm:"size:63;unique_index:uix_ppe" json:"environment,omitempty"`
+	// Approvals is the number of distinct users who must approve a
+	// deployment before it is granted.
+	Approvals int `json:"approvals"`
+	// ExcludeAuthor prevents the author of a version from approving its
+	// deployments.
+	ExcludeAuthor bool      `json:"excludeAuthor"`
+	CreatedAt     time.Time `json:"created,omitempty"`
+	UpdatedAt     time.Time `json:"updated,omitempty"`
+}
+
+// Stage is a step of the promotion pipeline of a product: the deployments of
+// a version onto the environment of a stage can only be granted once the
+// deployment onto the environment of the previous stage has been performed.
+type Stage struct {
+	ID          uint      `gorm:"primary_key;unique_index:stages_pk" json:"id"`
+	ProductID   uint      `gorm:"unique_index:uix_pp;unique_index:uix_pse" json:"pid"`
+	Position    int       `gorm:"unique_index:uix_pp" json:"position"`
+	Environment string    `gorm:"size:63;unique_index:uix_pse" json:"environment"`
+	CreatedAt   time.Time `json:"created,omitempty"`
+	UpdatedAt   time.Time `json:"updated,omitempty"`
+}
+
+// BuildStatus represents the status of a build.
+type BuildStatus string
+
+const (
+	// BUILD_RUNNING is the status of a build in progress.
+	BUILD_RUNNING BuildStatus = "RUNNING"
+	// BUILD_SUCCEEDED is the status of a build which produced a candidate.
+	BUILD_SUCCEEDED BuildStatus = "SUCCEEDED"
+	// BUILD_FAILED is the status of a build which ended with an error.
+	BUILD_FAILED BuildStatus = "FAILED"
+	// BUILD_ABORTED is the status of a build which was interrupted.
+	BUILD_ABORTED BuildStatus = "ABORTED"
+)
+
+// Valid returns whether the build status is one of the known ones.
+func (s BuildStatus) Valid() bool {
+	switch s {
+	case BUILD_RUNNING, BUILD_SUCCEEDED, BUILD_FAILED, BUILD_ABORTED:
+		return true
+	}
+	return false
+}
+
+// Build records a run of the continuous integration system producing a
+// candidate of a product version, from the commit of its source repository
+// identified by Commit; builds are numbered within each version, usually
+// after the number the CI job assigned them.
+type Build struct {
+	ID         uint        `gorm:"primary_key;unique_index:builds_pk" json:"id"`
+	VersionID  uint        `gorm:"unique_index:uix_vn" json:"vid"`
+	Number     int         `gorm:"unique_index:uix_vn" json:"number"`
+	Commit     string      `gorm:"column:commit_sha;size:64" json:"commit,omitempty"`
+	Status     BuildStatus `gorm:"size:15" json:"status,omitempty"`
+	StartedAt  time.Time   `json:"started,omitempty"`
+	FinishedAt time.Time   `json:"finished,omitempty"`
+	JobURL     string      `gorm:"type:varchar(1024)" json:"jobUrl,omitempty"`
+	// Log is an excerpt of the build log, e.g. its last lines.
+	Log       string    `gorm:"type:varchar(4096)" json:"log,omitempty"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
+}
+
+// Artifact describes a file, or an OCI image, produced by a build and stored
+// in an artifact registry; artifacts are named uniquely within each build, and
+// identified across builds by their Digest.
+type Artifact struct {
+	ID      uint   `gorm:"primary_key;unique_index:artifacts_pk" json:"id"`
+	BuildID uint   `gorm:"unique_index:uix_bn" json:"bid"`
+	Name    string `gorm:"size:255;unique_index:uix_bn" json:"name"`
+	// Type is the kind of artifact, e.g. "jar", "rpm" or "oci-image".
+	Type string `gorm:"size:63" json:"type,omitempty"`
+	Size int64  `json:"size"`
+	// Digest is the SHA-256 digest of the contents of the artifact, in the
+	// "sha256:<hex>" form used by OCI registries (see ValidDigest).
+	Digest string `gorm:"size:71;index:ix_ad" json:"digest"`
+	URI    string `gorm:"type:varchar(1024)" json:"uri,omitempty"`
+	// Image is the OCI image reference of the artifact, if it is an image,
+	// e.g. "registry.example.com/gaia@sha256:...".
+	Image     string    `gorm:"type:varchar(1024)" json:"image,omitempty"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
+}
+
+// ValidDigest returns whether the given digest is a SHA-256 digest in the
+// "sha256:<hex>" form, with 64 lowercase hexadecimal digits.
+func ValidDigest(digest string) bool {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) != 64 || len(digest) != len(hex)+len("sha256:") {
+		return false
+	}
+	for _, c := range hex {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// uniqueDigests returns the given digests, sorted and without duplicates.
+func uniqueDigests(digests []string) []string {
+	unique := make([]string, 0, len(digests))
+	for _, digest := range digests {
+		unique = append(unique, digest)
+	}
+	sort.Strings(unique)
+	for i := len(unique) - 1; i > 0; i-- {
+		if unique[i] == unique[i-1] {
+			unique = append(unique[:i], unique[i+1:]...)
+		}
+	}
+	return unique
+}
+
+// checkDigests verifies that all the given digests, which a deployment is
+// about to reference, are among those of the artifacts built for its version.
+func checkDigests(digests []string, built []string) error {
+	known := map[string]bool{}
+	for _, digest := range built {
+		known[digest] = true
+	}
+	for _, digest := range digests {
+		if !known[digest] {
+			return errors.Wrapf(ErrorConstraint, "reference to artifact %q, which was not built for the version", digest)
+		}
 	}
 	return nil
 }
 
-// GetProducts returns the full list of products.
-func GetProducts() []Product {
-	var products []Product
-	db.Find(&products)
-	return products
+// DeployedArtifact records that the artifact having the given digest was
+// part of a deployment.
+type DeployedArtifact struct {
+	ID           uint   `gorm:"primary_key;unique_index:deployed_artifacts_pk" json:"-"`
+	DeploymentID uint   `gorm:"unique_index:uix_dd" json:"-"`
+	Digest       string `gorm:"size:71;unique_index:uix_dd;index:ix_dad" json:"digest"`
 }
 
-// CreateProduct creates a new Product; if it contains Version references,
-// those are created too.
-func CreateProduct(product *Product) {
-	db.Create(product)
+// ArtifactMatch is an artifact found by its digest, along with the product,
+// version and build it belongs to.
+type ArtifactMatch struct {
+	Artifact
+	ProductID   uint
+	ProductCode string
+	VersionCode string
+	BuildNumber int
 }
 
-// ReadProduct reads an existing product from the database; the provided
-// object should contain the search criteria.
-func ReadProduct(product *Product) {
-	db.Find(product)
+// DeploymentMatch is a deployment found by the digest of one of its
+// artifacts, along with the product and version it belongs to.
+type DeploymentMatch struct {
+	Deployment
+	ProductID   uint
+	ProductCode string
+	VersionCode string
 }
 
-// UpdateProduct updates an existing product; if it contains Versions,
-// those are updated as well.
-func UpdateProduct(product *Product) {
-	db.Update(product)
+// Action represents the kind of change an audit record describes.
+type Action string
+
+const (
+	// CREATE is the action of audit records describing a new entity.
+	CREATE Action = "CREATE"
+	// UPDATE is the action of audit records describing a modified entity.
+	UPDATE Action = "UPDATE"
+	// DELETE is the action of audit records describing a deleted entity.
+	DELETE Action = "DELETE"
+	// APPROVE is the action of audit records describing the approval of a
+	// deployment.
+	APPROVE Action = "APPROVE"
+	// TRANSITION is the action of audit records describing a change of the
+	// status of a deployment.
+	TRANSITION Action = "TRANSITION"
+)
+
+// AuditRecord describes a change made by a user to an entity, e.g. a product
+// or a deployment, identified by its Key; Before and After hold the JSON
+// representations of the entity before and after the change, and are empty
+// when it is being created or deleted, respectively. Audit records are never
+// modified once appended to the audit log, and each one is chained to the
+// previous one through its Hash (see Digest), so that changes to the history
+// can be detected.
+type AuditRecord struct {
+	ID        uint      `gorm:"primary_key;unique_index:audit_records_pk" json:"id"`
+	Timestamp time.Time `gorm:"index:ix_at" json:"timestamp"`
+	User      string    `gorm:"column:username;index:ix_au" json:"user,omitempty"`
+	Action    Action    `gorm:"size:15" json:"action"`
+	Entity    string    `gorm:"size:31" json:"entity"`
+	Product   string    `gorm:"size:63;index:ix_ap" json:"product,omitempty"`
+	Key       string    `gorm:"column:entity_key" json:"key"`
+	Before    string    `gorm:"type:text" json:"before,omitempty"`
+	After     string    `gorm:"type:text" json:"after,omitempty"`
+	Previous  string    `gorm:"size:64;unique_index:uix_aprev" json:"previous,omitempty"`
+	Hash      string    `gorm:"size:64" json:"hash"`
 }
 
-// DeleteProduct deletes an existing product from the datavbase; any existing
-// linked Version objects are deleted as well (cascade).
-func DeleteProduct(product *Product) {
-	db.Delete(product)
+// Digest returns the hex-encoded SHA-256 digest of the record, covering all
+// its attributes but its ID and Hash, i.e. including the Hash of the previous
+// record; the timestamp is truncated to the second, the finest precision all
+// the supported databases retain.
+func (r AuditRecord) Digest() string {
+	return auditDigest(r.Previous, r.Timestamp, r.User, string(r.Action), r.Entity, r.Product, r.Key, r.Before, r.After)
 }
 
-/*
+// auditDigest returns the hex-encoded SHA-256 digest of the JSON array of the
+// given hash of the previous audit record, timestamp and attributes.
+func auditDigest(previous string, timestamp time.Time, attributes ...string) string {
+	data, _ := json.Marshal(append([]string{previous, timestamp.UTC().Truncate(time.Second).Format(time.RFC3339)}, attributes...))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
 
-func init() {
+// VerifyAuditLog walks the hash chain of the audit log from its first record
+// and returns the number of records it holds; if a record has been modified,
+// inserted or removed, the error reports the first broken link.
+func VerifyAuditLog(store AuditStore) (int, error) {
+	records, err := store.GetAuditRecords(AuditFilter{})
+	if err != nil {
+		return 0, err
+	}
+	previous := ""
+	for i, record := range records {
+		if record.Previous != previous {
+			if i == 0 {
+				return i, errors.Errorf("audit record %d is the first one, but refers to a previous record %s", record.ID, record.Previous)
+			}
+			return i, errors.Errorf("audit record %d does not follow record %d: it refers to a previous record %s, whereas record %d has hash %s", record.ID, records[i-1].ID, record.Previous, records[i-1].ID, previous)
+		}
+		if digest := record.Digest(); record.Hash != digest {
+			return i, errors.Errorf("audit record %d has been modified: its hash is %s, whereas its contents hash to %s", record.ID, record.Hash, digest)
+		}
+		previous = record.Hash
+	}
+	return len(records), nil
+}
 
-	model.New("test.sqlite")
+// NewAuditRecord returns the audit record of a change made now by a user to
+// an entity of a product, identified by key; before and after are the states
+// of the entity, and are nil when it is being created or deleted.
+func NewAuditRecord(user string, action Action, entity string, product string, key string, before interface{}, after interface{}) (AuditRecord, error) {
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		User:      user,
+		Action:    action,
+		Entity:    entity,
+		Product:   product,
+		Key:       key,
+	}
+	for _, state := range []struct {
+		value interface{}
+		field *string
+	}{{before, &record.Before}, {after, &record.After}} {
+		if state.value == nil {
+			continue
+		}
+		data, err := json.Marshal(state.value)
+		if err != nil {
+			return AuditRecord{}, errors.Wrapf(err, "error encoding %s %q", entity, key)
+		}
+		*state.field = string(data)
+	}
+	return record, nil
+}
 
-	product := Product{
-		Code:        "gaia",
-		Name:        "G.A.I.A. - Servizi per il Personale",
-		Description: "GAIA è il portale web dei servizi aziendali non altrimenti disponibili su piattaforma SAP.",
-		Contact:     "fabio.angeli@bancaditalia.it",
-		Repository:  "https://gitlab.utenze.bankit.it/gaia",
-		WebSite:     "http://infogaia/",
-		Versions: []Version{
-			{
-				Code:        "1.0.0",
-				Description: "First major release, 1.0 series",
-				Repository:  "https://gitlab.utenze.bankit.it/gaia",
-				Branch:      "ver_1_0_0",
-			},
-			{
-				Code:        "1.0.1",
-				Description: "First bugfix release of the 1.0 series",
-				Branch:      "ver_1_0_1",
-			},
-		},
+// AuditFilter selects audit records: only the records about the Product,
+// by the User, between Since and Until (inclusive) and following the record
+// with ID After are selected, unless the respective field is empty.
+type AuditFilter struct {
+	Product string
+	User    string
+	Since   time.Time
+	Until   time.Time
+	After   uint
+}
+
+// Matches returns whether the filter selects the given audit record.
+func (f AuditFilter) Matches(record AuditRecord) bool {
+	return (f.Product == "" || record.Product == f.Product) &&
+		(f.User == "" || record.User == f.User) &&
+		(f.Since.IsZero() || !record.Timestamp.Before(f.Since)) &&
+		(f.Until.IsZero() || !record.Timestamp.After(f.Until)) &&
+		record.ID > f.After
+}
+
+// EventType identifies the kind of change an Event notifies.
+type EventType string
+
+const (
+	// VERSION_CREATED is the type of the events notifying a new version.
+	VERSION_CREATED EventType = "version.created"
+	// DEPLOYMENT_CREATED is the type of the events notifying a new
+	// deployment.
+	DEPLOYMENT_CREATED EventType = "deployment.created"
+	// DEPLOYMENT_APPROVED is the type of the events notifying an approval of
+	// a deployment that has not granted it yet.
+	DEPLOYMENT_APPROVED EventType = "deployment.approved"
+)
+
+// StatusEvent returns the type of the events notifying that a deployment
+// moved to the given status, e.g. "deployment.granted".
+func StatusEvent(status Status) EventType {
+	return EventType("deployment." + strings.ToLower(string(status)))
+}
+
+// Event notifies a change made to a version or a deployment, as described by
+// the audit record it derives from, whose ID it shares; Data holds the state
+// of the entity after the change.
+type Event struct {
+	ID        uint            `json:"id"`
+	Type      EventType       `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	User      string          `json:"user,omitempty"`
+	Product   string          `json:"product"`
+	Key       string          `json:"key"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// NewEvent returns the event notifying the change described by the given
+// audit record, if it is the creation of a version or deployment, a change of
+// the status of a deployment or an approval; other changes are not notified.
+func NewEvent(record AuditRecord) (Event, bool) {
+	event := Event{
+		ID:        record.ID,
+		Timestamp: record.Timestamp,
+		User:      record.User,
+		Product:   record.Product,
+		Key:       record.Key,
+		Data:      json.RawMessage(record.After),
+	}
+	switch {
+	case record.Action == CREATE && record.Entity == "version":
+		event.Type = VERSION_CREATED
+	case record.Action == CREATE && record.Entity == "deployment":
+		event.Type = DEPLOYMENT_CREATED
+	case record.Entity == "deployment" && record.Before != "" && record.After != "":
+		var before, after struct {
+			Status Status `json:"status"`
+		}
+		if json.Unmarshal([]byte(record.Before), &before) != nil || json.Unmarshal([]byte(record.After), &after) != nil {
+			return Event{}, false
+		}
+		switch {
+		case before.Status != after.Status:
+			event.Type = StatusEvent(after.Status)
+		case record.Action == APPROVE:
+			event.Type = DEPLOYMENT_APPROVED
+		default:
+			return Event{}, false
+		}
+	default:
+		return Event{}, false
 	}
-	db.Create(&product)
+	return event, true
+}
 
-	product = Product{
-		Code:        "siparium",
-		Name:        "SIPARIUM - Sistema Integrato Processi Aziendali per le Risorse UMane",
-		Description: "GAIA è il portale web dei servizi aziendali per le risorse umane su piattaforma SAP.",
-		Contact:     "roberto iapichino@bancaditalia.it",
-		Repository:  "https://gitlab.utenze.bankit.it/siparium",
-		WebSite:     "http://portale-sap/",
-		Versions: []Version{
-			{
-				Code:        "1.0.0",
-				Description: "First major release, 1.0 series",
-				Repository:  "https://gitlab.utenze.bankit.it/siparium",
-				Branch:      "ver_1_0_0",
-			},
-			{
-				Code:        "1.0.1",
-				Description: "First bugfix release of the 1.0 series",
-				Branch:      "ver_1_0_1",
-			},
-		},
+// Webhook subscribes an external endpoint to the events of a product: while
+// the webhook is Active, the events whose type matches any of its Events are
+// POSTed to its URL, signed with its Secret.
+type Webhook struct {
+	ID        uint   `gorm:"primary_key;unique_index:webhooks_pk" json:"id"`
+	ProductID uint   `gorm:"index:ix_wp" json:"pid"`
+	URL       string `gorm:"type:varchar(1024)" json:"url"`
+	// Events is the comma-separated list of the patterns of the event types
+	// the webhook subscribes to, e.g. "version.created,deployment.*"; an empty
+	// list subscribes to all of them.
+	Events    string    `gorm:"type:varchar(1024)" json:"events,omitempty"`
+	Secret    string    `json:"-"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
+}
+
+// Patterns returns the patterns of the event types the webhook subscribes
+// to.
+func (w Webhook) Patterns() []string {
+	if w.Events == "" {
+		return nil
 	}
-	db.Create(&product)
+	return strings.Split(w.Events, ",")
 }
 
+// Subscribes returns whether the webhook is active and subscribed to the
+// events of the given type; patterns follow the syntax of path.Match, e.g.
+// "deployment.*".
+func (w Webhook) Subscribes(event EventType) bool {
+	if !w.Active {
+		return false
+	}
+	patterns := w.Patterns()
+	return len(patterns) == 0 || matches(patterns, string(event))
+}
 
+// matches returns whether the value matches any of the given patterns, whose
+// syntax is that of path.Match.
+func matches(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery records an attempt to deliver an event to a webhook: either the
+// HTTP status code the webhook responded with, or the Error preventing the
+// delivery.
+type Delivery struct {
+	ID         uint      `gorm:"primary_key;unique_index:deliveries_pk" json:"id"`
+	WebhookID  uint      `gorm:"index:ix_dw" json:"wid"`
+	EventID    uint      `json:"eid"`
+	Event      EventType `gorm:"size:63" json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `gorm:"type:varchar(1024)" json:"error,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Succeeded returns whether the event was delivered, i.e. whether the
+// webhook responded with a 2xx status code.
+func (d Delivery) Succeeded() bool {
+	return d.Error == "" && d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// Preference holds the e-mail notification preferences of a user: the
+// events of the products the user wants to be notified of at Email. Products
+// and Events are comma-separated lists of patterns (as in webhooks) of the
+// codes of the products, all of them if empty, and of the types of the events,
+// none of them if empty.
+type Preference struct {
+	ID        uint      `gorm:"primary_key;unique_index:preferences_pk" json:"id"`
+	User      string    `gorm:"column:username;unique_index:uix_pu" json:"user"`
+	Email     string    `gorm:"size:255" json:"email"`
+	Products  string    `gorm:"type:varchar(1024)" json:"products,omitempty"`
+	Events    string    `gorm:"type:varchar(1024)" json:"events,omitempty"`
+	CreatedAt time.Time `json:"created,omitempty"`
+	UpdatedAt time.Time `json:"updated,omitempty"`
+}
 
-func GetProducts() ([]Product, error) {
-	if len(model) == 0 {
-		return nil, ErrorNotFound
+// Subscribes returns whether the user wants to be notified of the events of
+// the given type about the given product.
+func (p Preference) Subscribes(product string, event EventType) bool {
+	if p.Events == "" || !matches(strings.Split(p.Events, ","), string(event)) {
+		return false
 	}
-	products := make([]Product, 0, len(model))
-	for _, product := range model {
-		products = append(products, product)
+	return p.Products == "" || matches(strings.Split(p.Products, ","), product)
+}
+
+// DefaultPolicy is the policy applying to the environments of products that
+// have no policy for them: a single approval, by anyone.
+var DefaultPolicy = Policy{Approvals: 1}
+
+// Role represents the set of operations a user is allowed to perform; roles
+// are hierarchical, each one allowing all the operations of the previous
+// ones.
+type Role string
+
+const (
+	// VIEWER is the role of users who can read products, versions and
+	// deployments.
+	VIEWER Role = "VIEWER"
+	// DEVELOPER is the role of users who can also register versions and their
+	// deployments, and record deployments as performed.
+	DEVELOPER Role = "DEVELOPER"
+	// RELEASE_MANAGER is the role of users who can also grant deployments.
+	RELEASE_MANAGER Role = "RELEASE_MANAGER"
+	// ADMIN is the role of users who can also modify products and assign
+	// roles.
+	ADMIN Role = "ADMIN"
+)
+
+// roles lists the roles from the least to the most privileged.
+var roles = []Role{VIEWER, DEVELOPER, RELEASE_MANAGER, ADMIN}
+
+// Includes returns whether the role allows all the operations of the other
+// one.
+func (r Role) Includes(other Role) bool {
+	return r.rank() >= other.rank() && other.rank() > 0
+}
+
+// Valid returns whether the role is one of the known ones.
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// rank returns the position of the role in the hierarchy, starting at 1; 0
+// means the role is unknown.
+func (r Role) rank() int {
+	for i, role := range roles {
+		if role == r {
+			return i + 1
+		}
 	}
-	return products, nil
+	return 0
 }
 
-func GetProductByID(productId string) (Product, error) {
-	product, ok := model[productId]
-	if !ok {
-		return Product{}, ErrorNotFound
+// Assignment grants a role to a user on a product, or on all products if its
+// ProductID is 0, and on an environment, or on all environments if its
+// Environment is empty; a user has at most one role per product and
+// environment.
+type Assignment struct {
+	ID          uint      `gorm:"primary_key;unique_index:assignments_pk" json:"id"`
+	User        string    `gorm:"column:username;unique_index:uix_upe" json:"user"`
+	ProductID   uint      `gorm:"unique_index:uix_upe" json:"pid,omitempty"`
+	Environment string    `gorm:"size:63;unique_index:uix_upe" json:"environment,omitempty"`
+	Role        Role      `gorm:"size:15" json:"role"`
+	CreatedAt   time.Time `json:"created,omitempty"`
+	UpdatedAt   time.Time `json:"updated,omitempty"`
+}
+
+// Allows returns whether the assignment grants the given role on the given
+// product and environment; an empty environment stands for operations that
+// do not concern any specific environment, which are only allowed by
+// assignments spanning all environments, except for reading, which is
+// allowed by any assignment on the product.
+func (a Assignment) Allows(role Role, productID uint, environment string) bool {
+	if a.ProductID != 0 && a.ProductID != productID {
+		return false
+	}
+	if a.Environment != "" && a.Environment != environment && role != VIEWER {
+		return false
 	}
-	return product, nil
+	return a.Role.Includes(role)
 }
 
-func GetVersionIDsByProduct(product Product) ([]string, error) {
-	return GetVersionIDsByProductID(product.ID)
+// String formats a Product as a JSON-encoded string.
+func (p Product) String() string {
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
 }
 
-func GetVersionIDsByProductID(productId string) ([]string, error) {
-	product, ok := model[productId]
-	if !ok {
-		return nil, ErrorNotFound
+// String formats a Version as a JSON-encoded string.
+func (v Version) String() string {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ""
 	}
-	versions := make([]string, 0, len(product.Versions))
-	for _, version := range product.Versions {
-		versions = append(versions, version.ID)
+	return string(bytes[:])
+}
+
+// String formats a Deployment as a JSON-encoded string.
+func (d Deployment) String() string {
+	bytes, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return ""
 	}
-	return versions, nil
+	return string(bytes[:])
 }
 
-func GetVersionByID(productId string, versionID string) (Version, error) {
-	product, err := GetProductByID(productId)
+// String formats an Assignment as a JSON-encoded string.
+func (a Assignment) String() string {
+	bytes, err := json.MarshalIndent(a, "", "  ")
 	if err != nil {
-		return Version{}, err
+		return ""
 	}
-	for _, version := range product.Versions {
-		if version.ID == versionID {
-			return version, nil
-		}
+	return string(bytes[:])
+}
+
+// String formats an Approval as a JSON-encoded string.
+func (a Approval) String() string {
+	bytes, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return ""
 	}
-	return Version{}, ErrorNotFound
+	return string(bytes[:])
 }
 
-func UpdateDeployment(productId, versionId string, deployment Deployment) error {
-	// do nothing
-	return nil
+// String formats a Transition as a JSON-encoded string.
+func (t Transition) String() string {
+	bytes, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats a Policy as a JSON-encoded string.
+func (p Policy) String() string {
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats a Stage as a JSON-encoded string.
+func (s Stage) String() string {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
 }
 
-// model is the current (in memory) data store.
-var model map[string]Product
-
-func init() {
-
-	model = make(map[string]Product)
-
-	model["gaia"] = Product{
-		ID:          "gaia",
-		Description: "Portale dei servizi aziendali per il personale",
-		Versions: []Version{
-			{
-				ID:          "1.0.0",
-				Description: "for a changelog see http://prodinfo/gaia/1.0.0",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-			{
-				ID:          "1.0.1",
-				Description: "for a changelog see http://prodinfo/gaia/1.0.1",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PENDING,
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-			{
-				ID:          "1.0.2",
-				Description: "for a changelog see http://prodinfo/gaia/1.0.2",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PENDING,
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PENDING,
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PENDING,
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-		},
-	}
-
-	model["siparium"] = Product{
-		ID:          "siparium",
-		Description: "Enterprise Resource Planning (ERP) per le Risorse Umane",
-		Versions: []Version{
-			{
-				ID:          "2.0.0",
-				Description: "for a changelog see http://prodinfo/siparium/2.0.0",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-			{
-				ID:          "2.0.1",
-				Description: "for a changelog see http://prodinfo/siparium/2.0.1",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PERFORMED,
-						Timestamp:   time.Now(),
-						GrantedBy:   "d093154",
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PENDING,
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-			{
-				ID:          "1.0.2",
-				Description: "for a changelog see http://prodinfo/gaia/1.0.2",
-				Deployments: []Deployment{
-					{
-						Order:       0,
-						Environment: "Integration",
-						Status:      PENDING,
-					},
-					{
-						Order:       1,
-						Environment: "Quality",
-						Status:      PENDING,
-					},
-					{
-						Order:       2,
-						Environment: "Certification",
-						Status:      PENDING,
-					},
-					{
-						Order:       3,
-						Environment: "Production",
-						Status:      PENDING,
-					},
-				},
-			},
-		},
-	}
-}
-*/
+// String formats a Build as a JSON-encoded string.
+func (b Build) String() string {
+	bytes, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats an Artifact as a JSON-encoded string.
+func (a Artifact) String() string {
+	bytes, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats an AuditRecord as a JSON-encoded string.
+func (r AuditRecord) String() string {
+	bytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats a Webhook as a JSON-encoded string.
+func (w Webhook) String() string {
+	bytes, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats a Delivery as a JSON-encoded string.
+func (d Delivery) String() string {
+	bytes, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
+
+// String formats a Preference as a JSON-encoded string.
+func (p Preference) String() string {
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bytes[:])
+}
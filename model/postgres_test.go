@@ -0,0 +1,39 @@
+//go:build postgres
+// +build postgres
+
+package model
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+// TestMain runs the tests against an embedded Postgres instance too, unless
+// an external one is provided through BUILDS_TEST_POSTGRES_DSN; the embedded
+// server needs no container, but its binaries are downloaded on first use.
+func TestMain(m *testing.M) {
+	if dsns["postgres"] != "" {
+		os.Exit(m.Run())
+	}
+
+	port := uint32(15432)
+	postgres := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(port).
+		Database("builds").
+		RuntimePath(os.TempDir() + "/builds-embedded-postgres"))
+	if err := postgres.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "error starting embedded postgres: %v\n", err)
+		os.Exit(1)
+	}
+	dsns["postgres"] = fmt.Sprintf("host=localhost port=%d user=postgres password=postgres dbname=builds sslmode=disable", port)
+
+	code := m.Run()
+
+	if err := postgres.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "error stopping embedded postgres: %v\n", err)
+	}
+	os.Exit(code)
+}
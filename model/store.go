@@ -0,0 +1,252 @@
+package model
+
+import (
+	"github.com/dihedron/builds/semver"
+	"github.com/pkg/errors"
+)
+
+// ProductStore manages the persistence of products.
+type ProductStore interface {
+	// GetProducts returns the full list of products.
+	GetProducts() ([]Product, error)
+	// GetProductByCode returns the product with the given code, along with
+	// its versions.
+	GetProductByCode(code string) (Product, error)
+	// CreateProduct creates a new Product, along with its versions.
+	CreateProduct(product *Product) error
+	// UpdateProduct updates an existing product.
+	UpdateProduct(product *Product) error
+	// DeleteProduct deletes an existing product, along with its versions, its
+	// approval policies, its pipeline, its webhooks and its role assignments.
+	DeleteProduct(product *Product) error
+}
+
+// VersionStore manages the persistence of product versions.
+type VersionStore interface {
+	// GetVersions returns the list of versions of the given product, along
+	// with their deployments, sorted by precedence (see CompareVersions).
+	GetVersions(product Product) ([]Version, error)
+	// GetVersionByCode returns the version of the given product having the
+	// given code, along with its deployments.
+	GetVersionByCode(product Product, code string) (Version, error)
+	// CreateVersion creates a new Version, along with its deployments; its
+	// code must be a valid semantic version.
+	CreateVersion(version *Version) error
+	// AllocateVersion atomically creates a new Version of a product, whose
+	// code follows that of its latest version by incrementing the given
+	// part (see NextCode) and whose Branch, unless given, is the default one.
+	AllocateVersion(version *Version, part semver.Part, identifier string) error
+	// UpdateVersion updates an existing version.
+	UpdateVersion(version *Version) error
+	// DeleteVersion deletes an existing version, along with its deployments
+	// and builds.
+	DeleteVersion(version *Version) error
+}
+
+// BuildStore manages the persistence of the builds of product versions.
+type BuildStore interface {
+	// GetBuilds returns the list of builds of the given version, sorted by
+	// their number.
+	GetBuilds(version Version) ([]Build, error)
+	// GetBuildByNumber returns the build of the given version having the
+	// given number.
+	GetBuildByNumber(version Version, number int) (Build, error)
+	// CreateBuild creates a new Build.
+	CreateBuild(build *Build) error
+	// UpdateBuild updates an existing build.
+	UpdateBuild(build *Build) error
+	// DeleteBuild deletes an existing build, along with its artifacts.
+	DeleteBuild(build *Build) error
+}
+
+// ArtifactStore manages the persistence of the artifacts of builds.
+type ArtifactStore interface {
+	// GetArtifacts returns the list of artifacts of the given build, sorted
+	// by name.
+	GetArtifacts(build Build) ([]Artifact, error)
+	// GetArtifactByName returns the artifact of the given build having the
+	// given name.
+	GetArtifactByName(build Build, name string) (Artifact, error)
+	// CreateArtifact creates a new Artifact.
+	CreateArtifact(artifact *Artifact) error
+	// DeleteArtifact deletes an existing artifact.
+	DeleteArtifact(artifact *Artifact) error
+	// FindArtifacts returns the artifacts having the given digest, across
+	// all products, oldest first.
+	FindArtifacts(digest string) ([]ArtifactMatch, error)
+	// FindDeployments returns the deployments which deployed the artifact
+	// having the given digest, across all products, oldest first.
+	FindDeployments(digest string) ([]DeploymentMatch, error)
+	// GetDeployedDigests returns the distinct digests of the artifacts
+	// deployed by all deployments, sorted.
+	GetDeployedDigests() ([]string, error)
+	// GetArtifactDigests returns the distinct digests of the artifacts of
+	// the given product, or of all products if its ID is 0, sorted.
+	GetArtifactDigests(product Product) ([]string, error)
+}
+
+// DeploymentStore manages the persistence of deployments.
+type DeploymentStore interface {
+	// GetDeployments returns the list of deployments of the given version,
+	// sorted by their order and along with their approvals.
+	GetDeployments(version Version) ([]Deployment, error)
+	// GetDeploymentByOrder returns the deployment of the given version having
+	// the given order, along with its approvals, status transitions and
+	// deployed artifacts.
+	GetDeploymentByOrder(version Version, order int) (Deployment, error)
+	// CreateDeployment creates a new Deployment.
+	CreateDeployment(deployment *Deployment) error
+	// UpdateDeployment updates an existing deployment.
+	UpdateDeployment(deployment *Deployment) error
+	// DeleteDeployment deletes an existing deployment, along with its
+	// approvals, status transitions and deployed artifacts.
+	DeleteDeployment(deployment *Deployment) error
+	// SetDeploymentArtifacts replaces the artifacts deployed by an existing
+	// deployment with those having the given digests, which must be
+	// artifacts of the builds of its version, as long as it is PENDING; the
+	// deployment is reloaded along with all its approvals, status
+	// transitions and artifacts.
+	SetDeploymentArtifacts(deployment *Deployment, digests []string) error
+	// ApproveDeployment records the approval of an existing PENDING
+	// deployment and, once the deployment has collected the given number of
+	// approvals, grants it on behalf of the last approver; the deployment is
+	// reloaded along with all its approvals and status transitions.
+	ApproveDeployment(deployment *Deployment, approval *Approval, required int) error
+	// TransitionDeployment moves an existing deployment to the status the
+	// given transition leads to, provided that the state machine allows it
+	// from its current one, and records the transition; the deployment is
+	// reloaded along with all its approvals and status transitions.
+	TransitionDeployment(deployment *Deployment, transition *Transition) error
+	// ChangeDeployment updates the order and environment of an existing
+	// deployment, which can only change while it is PENDING and withdraws
+	// its approvals, and moves it to the status the given transition leads
+	// to, if any, as TransitionDeployment does, all at once; the deployment
+	// is reloaded along with all its approvals, status transitions and
+	// artifacts.
+	ChangeDeployment(deployment *Deployment, transition *Transition) error
+}
+
+// PolicyStore manages the persistence of approval policies.
+type PolicyStore interface {
+	// GetPolicies returns the list of approval policies of the given product.
+	GetPolicies(product Product) ([]Policy, error)
+	// CreatePolicy creates a new approval Policy.
+	CreatePolicy(policy *Policy) error
+	// UpdatePolicy updates an existing approval policy.
+	UpdatePolicy(policy *Policy) error
+	// DeletePolicy deletes an existing approval policy.
+	DeletePolicy(policy *Policy) error
+}
+
+// PipelineStore manages the persistence of promotion pipelines.
+type PipelineStore interface {
+	// GetPipeline returns the stages of the promotion pipeline of the given
+	// product, sorted by position; products without a pipeline have none.
+	GetPipeline(product Product) ([]Stage, error)
+	// SetPipeline replaces the promotion pipeline of the given product with
+	// the given stages, in order; their positions are assigned accordingly.
+	SetPipeline(product Product, stages []Stage) error
+}
+
+// AssignmentStore manages the persistence of role assignments.
+type AssignmentStore interface {
+	// GetAssignments returns the list of role assignments of the given user,
+	// or of all users if the user is empty.
+	GetAssignments(user string) ([]Assignment, error)
+	// GetAssignment returns the role assignment having the given ID.
+	GetAssignment(id uint) (Assignment, error)
+	// CreateAssignment creates a new role Assignment.
+	CreateAssignment(assignment *Assignment) error
+	// DeleteAssignment deletes an existing role assignment.
+	DeleteAssignment(assignment *Assignment) error
+}
+
+// AuditStore manages the persistence of the audit log, which is append-only.
+type AuditStore interface {
+	// GetAuditRecords returns the audit records selected by the given
+	// filter, oldest first.
+	GetAuditRecords(filter AuditFilter) ([]AuditRecord, error)
+	// AppendAuditRecord appends a new record to the audit log, chaining it
+	// to the last one through its Previous and Hash.
+	AppendAuditRecord(record *AuditRecord) error
+}
+
+// WebhookStore manages the persistence of webhooks and of their delivery log.
+type WebhookStore interface {
+	// GetWebhooks returns the list of webhooks of the given product.
+	GetWebhooks(product Product) ([]Webhook, error)
+	// GetWebhook returns the webhook having the given ID.
+	GetWebhook(id uint) (Webhook, error)
+	// CreateWebhook creates a new Webhook.
+	CreateWebhook(webhook *Webhook) error
+	// UpdateWebhook updates an existing webhook.
+	UpdateWebhook(webhook *Webhook) error
+	// DeleteWebhook deletes an existing webhook, along with its deliveries.
+	DeleteWebhook(webhook *Webhook) error
+	// GetDeliveries returns the most recent deliveries to the given webhook,
+	// newest first and at most limit of them (all of them if limit is 0).
+	GetDeliveries(webhook Webhook, limit int) ([]Delivery, error)
+	// CreateDelivery records a new delivery attempt.
+	CreateDelivery(delivery *Delivery) error
+}
+
+// PreferenceStore manages the persistence of the notification preferences of
+// the users.
+type PreferenceStore interface {
+	// GetPreferences returns the notification preferences of all users.
+	GetPreferences() ([]Preference, error)
+	// GetPreference returns the notification preferences of the given user.
+	GetPreference(user string) (Preference, error)
+	// SetPreference creates or replaces the notification preferences of the
+	// user they belong to.
+	SetPreference(preference *Preference) error
+	// DeletePreference deletes the notification preferences of a user.
+	DeletePreference(preference *Preference) error
+}
+
+// Store is the persistent storage of the builds microservice; all its
+// implementations report failures through the errors in this package, so that
+// e.g. a missing item can be told apart from a duplicate one via errors.Cause.
+type Store interface {
+	ProductStore
+	VersionStore
+	BuildStore
+	ArtifactStore
+	DeploymentStore
+	PolicyStore
+	PipelineStore
+	AssignmentStore
+	AuditStore
+	WebhookStore
+	PreferenceStore
+	// Atomically makes the changes of the given function, which it makes
+	// through the store it is passed, in a single transaction: if the
+	// function returns an error, none of them is kept and the error is
+	// returned. Transactions are serialised with the appends to the audit
+	// log, so that changes can be audited in the same transaction.
+	Atomically(changes func(store Store) error) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Open returns the Store for the given driver and data source name: the
+// "memory" driver returns a new, empty MemoryStore (the DSN is ignored),
+// whereas all other drivers are handed to NewGormStore, and the database
+// schema is upgraded to the latest version.
+func Open(driver string, dsn string) (Store, error) {
+	switch driver {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite3", "postgres", "mysql":
+		store, err := NewGormStore(driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Migrate(LatestSchemaVersion()); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.Errorf("unsupported database driver %q", driver)
+}
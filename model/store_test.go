@@ -0,0 +1,1073 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dihedron/builds/semver"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// dsns maps the drivers of the external databases the tests should run
+// against onto their data source names; besides the BUILDS_TEST_POSTGRES_DSN
+// and BUILDS_TEST_MYSQL_DSN environment variables, it can be populated by
+// test helpers that start an embedded database (see the "postgres" build tag).
+var dsns = map[string]string{
+	"postgres": os.Getenv("BUILDS_TEST_POSTGRES_DSN"),
+	"mysql":    os.Getenv("BUILDS_TEST_MYSQL_DSN"),
+}
+
+// stores returns the Store implementations under test, each one empty: the
+// in-memory and SQLITE3 stores are always tested, whereas Postgres and MySQL
+// are only tested if a DSN is available for them.
+func stores(t *testing.T) map[string]Store {
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": open(t, "sqlite3", filepath.Join(t.TempDir(), "test.db")),
+	}
+	for driver, dsn := range dsns {
+		if dsn != "" {
+			stores[driver] = open(t, driver, dsn)
+		}
+	}
+	return stores
+}
+
+// open returns a GormStore on the given database, with the latest schema,
+// after dropping any table left over by previous tests.
+func open(t *testing.T, driver string, dsn string) *GormStore {
+	db, err := gorm.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to %s database: %v", driver, err)
+	}
+	if err := db.DropTableIfExists("schema_migrations", "deployed_artifacts", "artifacts", "builds", "preferences", "deliveries", "webhooks", "audit_records", "assignments", "stages", "transitions", "approvals", "policies", "deployments", "versions", "products").Error; err != nil {
+		t.Fatalf("error cleaning up %s database: %v", driver, err)
+	}
+	db.Close()
+
+	store, err := NewGormStore(driver, dsn)
+	if err != nil {
+		t.Fatalf("error opening %s store: %v", driver, err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(LatestSchemaVersion()); err != nil {
+		t.Fatalf("error migrating %s store: %v", driver, err)
+	}
+	return store
+}
+
+// sample returns a product with two versions, the first of which has two
+// deployments.
+func sample() Product {
+	return Product{
+		Code: "gaia",
+		Name: "G.A.I.A.",
+		Versions: []Version{
+			{
+				Code:   "1.0.0",
+				Branch: "ver_1_0_0",
+				Deployments: []Deployment{
+					{Order: 1, Environment: "Quality"},
+					{Order: 0, Environment: "Integration", Status: PERFORMED},
+				},
+			},
+			{
+				Code:   "1.0.1",
+				Branch: "ver_1_0_1",
+			},
+		},
+	}
+}
+
+func TestStoreProducts(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			if product.ID == 0 {
+				t.Fatalf("product was not assigned an ID")
+			}
+
+			duplicate := Product{Code: "gaia"}
+			if err := store.CreateProduct(&duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+
+			read, err := store.GetProductByCode("gaia")
+			if err != nil {
+				t.Fatalf("error reading product: %v", err)
+			}
+			if read.ID != product.ID || len(read.Versions) != 2 {
+				t.Fatalf("unexpected product read back: %s", read)
+			}
+
+			read.Name = "GAIA"
+			read.Quota = 1 << 30
+			read.Versions = nil
+			if err := store.UpdateProduct(&read); err != nil {
+				t.Fatalf("error updating product: %v", err)
+			}
+			products, err := store.GetProducts()
+			if err != nil || len(products) != 1 || products[0].Name != "GAIA" || products[0].Quota != 1<<30 {
+				t.Fatalf("unexpected products after update: %v (%v)", products, err)
+			}
+
+			missing := Product{ID: 9999, Code: "missing"}
+			if err := store.UpdateProduct(&missing); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			if err := store.DeleteProduct(&read); err != nil {
+				t.Fatalf("error deleting product: %v", err)
+			}
+			if _, err := store.GetProductByCode("gaia"); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+			if versions, _ := store.GetVersions(read); len(versions) != 0 {
+				t.Fatalf("versions were not deleted along with the product")
+			}
+		})
+	}
+}
+
+func TestStoreVersionsAndDeployments(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+
+			orphan := Version{ProductID: 9999, Code: "1.0.0"}
+			if err := store.CreateVersion(&orphan); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			duplicate := Version{ProductID: product.ID, Code: "1.0.1"}
+			if err := store.CreateVersion(&duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+
+			version, err := store.GetVersionByCode(product, "1.0.0")
+			if err != nil {
+				t.Fatalf("error reading version: %v", err)
+			}
+			if len(version.Deployments) != 2 || version.Deployments[0].Environment != "Integration" {
+				t.Fatalf("deployments not sorted by order: %v", version.Deployments)
+			}
+
+			deployment := Deployment{VersionID: version.ID, Order: 2, Environment: "Production"}
+			if err := store.CreateDeployment(&deployment); err != nil {
+				t.Fatalf("error creating deployment: %v", err)
+			}
+			if deployment.Status != PENDING {
+				t.Fatalf("expected new deployment to be PENDING, got %q", deployment.Status)
+			}
+
+			deployment.Status = GRANTED
+			deployment.GrantedBy = "d093154"
+			if err := store.UpdateDeployment(&deployment); err != nil {
+				t.Fatalf("error updating deployment: %v", err)
+			}
+			read, err := store.GetDeploymentByOrder(version, 2)
+			if err != nil || read.Status != GRANTED || read.GrantedBy != "d093154" {
+				t.Fatalf("unexpected deployment read back: %s (%v)", read, err)
+			}
+
+			deployment.Order = 0
+			if err := store.UpdateDeployment(&deployment); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+
+			if err := store.DeleteVersion(&version); err != nil {
+				t.Fatalf("error deleting version: %v", err)
+			}
+			if deployments, _ := store.GetDeployments(version); len(deployments) != 0 {
+				t.Fatalf("deployments were not deleted along with the version")
+			}
+			if err := store.DeleteDeployment(&deployment); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreVersionOrder(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := Product{Code: "gaia", Versions: []Version{{Code: "1.0.10"}, {Code: "1.0.2"}}}
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			for _, code := range []string{"1.0.0", "1.0.0-rc.10", "1.0.0-rc.2", "0.9.0"} {
+				version := Version{ProductID: product.ID, Code: code}
+				if err := store.CreateVersion(&version); err != nil {
+					t.Fatalf("error creating version %q: %v", code, err)
+				}
+			}
+			invalid := Version{ProductID: product.ID, Code: "1.1"}
+			if err := store.CreateVersion(&invalid); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			other := Product{Code: "uranus", Versions: []Version{{Code: "latest"}}}
+			if err := store.CreateProduct(&other); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			versions, err := store.GetVersions(product)
+			if err != nil {
+				t.Fatalf("error listing versions: %v", err)
+			}
+			codes := []string{}
+			for _, version := range versions {
+				codes = append(codes, version.Code)
+			}
+			if strings.Join(codes, " ") != "0.9.0 1.0.0-rc.2 1.0.0-rc.10 1.0.0 1.0.2 1.0.10" {
+				t.Fatalf("versions not sorted by precedence: %v", codes)
+			}
+			if read, _ := store.GetProductByCode("gaia"); len(read.Versions) != 6 || read.Versions[5].Code != "1.0.10" {
+				t.Fatalf("product versions not sorted by precedence: %v", read.Versions)
+			}
+
+			version := versions[0]
+			version.Code = "0.9"
+			if err := store.UpdateVersion(&version); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			version.Code = "2.0.0-beta"
+			if err := store.UpdateVersion(&version); err != nil {
+				t.Fatalf("error updating version: %v", err)
+			}
+			if versions, _ := store.GetVersions(product); versions[5].Code != "2.0.0-beta" || versions[5].PreRelease != "beta" {
+				t.Fatalf("versions not sorted by precedence after update: %v", versions)
+			}
+		})
+	}
+}
+
+func TestStoreVersionAllocation(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := Product{Code: "gaia"}
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			first := Version{ProductID: product.ID}
+			if err := store.AllocateVersion(&first, semver.MINOR, ""); err != nil {
+				t.Fatalf("error allocating version: %v", err)
+			}
+			if first.Code != "0.1.0" || first.Branch != "ver_0_1_0" || first.ID == 0 {
+				t.Fatalf("unexpected first version: %v", first)
+			}
+
+			// concurrent allocations must all get a different version
+			var wg sync.WaitGroup
+			allocated := make(chan string, 8)
+			for i := 0; i < cap(allocated); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					version := Version{ProductID: product.ID, Branch: "main"}
+					if err := store.AllocateVersion(&version, semver.PATCH, ""); err != nil {
+						t.Errorf("error allocating version: %v", err)
+						return
+					}
+					allocated <- version.Code
+				}()
+			}
+			wg.Wait()
+			close(allocated)
+			codes := map[string]bool{}
+			for code := range allocated {
+				codes[code] = true
+			}
+			if len(codes) != cap(allocated) || !codes["0.1.1"] || !codes["0.1.8"] {
+				t.Fatalf("unexpected allocated versions: %v", codes)
+			}
+
+			rc := Version{ProductID: product.ID}
+			if err := store.AllocateVersion(&rc, semver.PRERELEASE, "beta"); err != nil || rc.Code != "0.1.9-beta.0" || rc.Branch != "ver_0_1_9_beta_0" {
+				t.Fatalf("unexpected pre-release version: %v (%v)", rc, err)
+			}
+			if err := store.AllocateVersion(&Version{ProductID: product.ID}, "build", ""); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			if err := store.AllocateVersion(&Version{ProductID: product.ID + 100}, semver.PATCH, ""); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			if versions, _ := store.GetVersions(product); len(versions) != 10 {
+				t.Fatalf("expected 10 versions, got %d", len(versions))
+			}
+		})
+	}
+}
+
+func TestStoreBuilds(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			version := product.Versions[0]
+			started := time.Now().Add(-time.Hour).Truncate(time.Second)
+			for _, number := range []int{12, 3} {
+				build := Build{VersionID: version.ID, Number: number, Commit: "0a1b2c3d", StartedAt: started}
+				if err := store.CreateBuild(&build); err != nil {
+					t.Fatalf("error creating build %d: %v", number, err)
+				}
+				if build.ID == 0 || build.Status != BUILD_RUNNING {
+					t.Fatalf("unexpected build: %v", build)
+				}
+			}
+			if err := store.CreateBuild(&Build{VersionID: version.ID, Number: 3}); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			if err := store.CreateBuild(&Build{VersionID: version.ID + 100, Number: 1}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			builds, err := store.GetBuilds(version)
+			if err != nil || len(builds) != 2 || builds[0].Number != 3 || builds[1].Number != 12 {
+				t.Fatalf("unexpected builds: %v (%v)", builds, err)
+			}
+			build, err := store.GetBuildByNumber(version, 12)
+			if err != nil || build.Commit != "0a1b2c3d" || !build.StartedAt.Equal(started) {
+				t.Fatalf("unexpected build: %v (%v)", build, err)
+			}
+			if _, err := store.GetBuildByNumber(version, 4); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			build.Status = BUILD_SUCCEEDED
+			build.FinishedAt = started.Add(10 * time.Minute)
+			build.Log = "BUILD SUCCESSFUL"
+			if err := store.UpdateBuild(&build); err != nil {
+				t.Fatalf("error updating build: %v", err)
+			}
+			if read, _ := store.GetBuildByNumber(version, 12); read.Status != BUILD_SUCCEEDED || read.Log != "BUILD SUCCESSFUL" {
+				t.Fatalf("build not updated: %v", read)
+			}
+			build.Number = 3
+			if err := store.UpdateBuild(&build); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+
+			first := builds[0]
+			if err := store.DeleteBuild(&first); err != nil {
+				t.Fatalf("error deleting build: %v", err)
+			}
+			if err := store.DeleteBuild(&first); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+			if err := store.DeleteVersion(&version); err != nil {
+				t.Fatalf("error deleting version: %v", err)
+			}
+			if builds, _ := store.GetBuilds(version); len(builds) != 0 {
+				t.Fatalf("builds not deleted along with their version: %v", builds)
+			}
+		})
+	}
+}
+
+func TestStoreArtifacts(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			version, _ := store.GetVersionByCode(product, "1.0.0")
+			build := Build{VersionID: version.ID, Number: 1}
+			if err := store.CreateBuild(&build); err != nil {
+				t.Fatalf("error creating build: %v", err)
+			}
+			server := "sha256:" + strings.Repeat("ab", 32)
+			client := "sha256:" + strings.Repeat("cd", 32)
+			for _, artifact := range []Artifact{
+				{BuildID: build.ID, Name: "server.tar.gz", Type: "archive", Size: 1024, Digest: server, URI: "s3://artifacts/server.tar.gz"},
+				{BuildID: build.ID, Name: "client.zip", Type: "archive", Size: 512, Digest: client},
+				{BuildID: build.ID, Name: "server-image", Type: "oci", Digest: server, Image: "registry.example.com/gaia/server@" + server},
+			} {
+				if err := store.CreateArtifact(&artifact); err != nil || artifact.ID == 0 {
+					t.Fatalf("error creating artifact %s: %v", artifact.Name, err)
+				}
+			}
+			if err := store.CreateArtifact(&Artifact{BuildID: build.ID, Name: "client.zip", Digest: client}); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			if err := store.CreateArtifact(&Artifact{BuildID: build.ID + 100, Name: "client.zip", Digest: client}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			artifacts, err := store.GetArtifacts(build)
+			if err != nil || len(artifacts) != 3 || artifacts[0].Name != "client.zip" || artifacts[2].Name != "server.tar.gz" {
+				t.Fatalf("unexpected artifacts: %v (%v)", artifacts, err)
+			}
+			artifact, err := store.GetArtifactByName(build, "server.tar.gz")
+			if err != nil || artifact.Size != 1024 || artifact.Digest != server {
+				t.Fatalf("unexpected artifact: %v (%v)", artifact, err)
+			}
+			if _, err := store.GetArtifactByName(build, "missing"); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			deployment, _ := store.GetDeploymentByOrder(version, 1)
+			if err := store.SetDeploymentArtifacts(&deployment, []string{server, client, server}); err != nil {
+				t.Fatalf("error setting deployment artifacts: %v", err)
+			}
+			if len(deployment.Artifacts) != 2 || deployment.Artifacts[0].Digest != server || deployment.Artifacts[1].Digest != client {
+				t.Fatalf("unexpected deployed artifacts: %v", deployment.Artifacts)
+			}
+			unknown := "sha256:" + strings.Repeat("ef", 32)
+			if err := store.SetDeploymentArtifacts(&deployment, []string{client, unknown}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			if read, _ := store.GetDeploymentByOrder(version, 1); len(read.Artifacts) != 2 {
+				t.Fatalf("deployed artifacts modified by a failed update: %v", read.Artifacts)
+			}
+			cancellation := Transition{To: CANCELLED, User: "alice", Timestamp: time.Now()}
+			if err := store.TransitionDeployment(&deployment, &cancellation); err != nil {
+				t.Fatalf("error cancelling deployment: %v", err)
+			}
+			if err := store.SetDeploymentArtifacts(&deployment, []string{client}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint once the deployment is no longer PENDING, got %v", err)
+			}
+
+			found, err := store.FindArtifacts(server)
+			if err != nil || len(found) != 2 || found[0].Name != "server.tar.gz" || found[0].ProductCode != product.Code || found[0].VersionCode != "1.0.0" || found[0].BuildNumber != 1 {
+				t.Fatalf("unexpected artifacts found: %v (%v)", found, err)
+			}
+			deployments, err := store.FindDeployments(server)
+			if err != nil || len(deployments) != 1 || deployments[0].Order != 1 || deployments[0].ProductID != product.ID || deployments[0].VersionCode != "1.0.0" {
+				t.Fatalf("unexpected deployments found: %v (%v)", deployments, err)
+			}
+			if digests, err := store.GetDeployedDigests(); err != nil || len(digests) != 2 || digests[0] != server || digests[1] != client {
+				t.Fatalf("unexpected deployed digests: %v (%v)", digests, err)
+			}
+			if found, err := store.FindArtifacts(unknown); err != nil || len(found) != 0 {
+				t.Fatalf("unexpected artifacts found: %v (%v)", found, err)
+			}
+			for _, owner := range []Product{product, {}} {
+				if digests, err := store.GetArtifactDigests(owner); err != nil || len(digests) != 2 || digests[0] != server || digests[1] != client {
+					t.Fatalf("unexpected artifact digests of product %d: %v (%v)", owner.ID, digests, err)
+				}
+			}
+			if digests, err := store.GetArtifactDigests(Product{ID: product.ID + 100}); err != nil || len(digests) != 0 {
+				t.Fatalf("unexpected artifact digests: %v (%v)", digests, err)
+			}
+
+			if err := store.DeleteArtifact(&artifact); err != nil {
+				t.Fatalf("error deleting artifact: %v", err)
+			}
+			if err := store.DeleteArtifact(&artifact); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+			if err := store.DeleteDeployment(&deployment); err != nil {
+				t.Fatalf("error deleting deployment: %v", err)
+			}
+			if deployments, _ := store.FindDeployments(server); len(deployments) != 0 {
+				t.Fatalf("deployed artifacts not deleted along with their deployment: %v", deployments)
+			}
+			if digests, err := store.GetDeployedDigests(); err != nil || len(digests) != 0 {
+				t.Fatalf("unexpected deployed digests: %v (%v)", digests, err)
+			}
+			if err := store.DeleteBuild(&build); err != nil {
+				t.Fatalf("error deleting build: %v", err)
+			}
+			if found, _ := store.FindArtifacts(client); len(found) != 0 {
+				t.Fatalf("artifacts not deleted along with their build: %v", found)
+			}
+		})
+	}
+}
+
+func TestStoreApprovals(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+
+			policy := Policy{ProductID: product.ID, Environment: "Quality", Approvals: 2, ExcludeAuthor: true}
+			if err := store.CreatePolicy(&policy); err != nil {
+				t.Fatalf("error creating policy: %v", err)
+			}
+			duplicate := Policy{ProductID: product.ID, Environment: "Quality", Approvals: 1}
+			if err := store.CreatePolicy(&duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			policy.Approvals = 3
+			if err := store.UpdatePolicy(&policy); err != nil {
+				t.Fatalf("error updating policy: %v", err)
+			}
+			if policies, err := store.GetPolicies(product); err != nil || len(policies) != 1 || policies[0].Approvals != 3 || !policies[0].ExcludeAuthor {
+				t.Fatalf("unexpected policies: %v (%v)", policies, err)
+			}
+
+			version, _ := store.GetVersionByCode(product, "1.0.0")
+			deployment, _ := store.GetDeploymentByOrder(version, 1)
+			for i, user := range []string{"alice", "bob"} {
+				approval := Approval{User: user, Timestamp: time.Now()}
+				if err := store.ApproveDeployment(&deployment, &approval, 2); err != nil {
+					t.Fatalf("error approving deployment: %v", err)
+				}
+				if len(deployment.Approvals) != i+1 || deployment.Approvals[i].User != user {
+					t.Fatalf("unexpected approvals: %v", deployment.Approvals)
+				}
+				if i == 0 {
+					again := Approval{User: user, Timestamp: time.Now()}
+					if err := store.ApproveDeployment(&deployment, &again, 2); errors.Cause(err) != ErrorDuplicate {
+						t.Fatalf("expected ErrorDuplicate, got %v", err)
+					}
+					if deployment.Status != PENDING {
+						t.Fatalf("deployment granted after a single approval")
+					}
+				}
+			}
+			if deployment.Status != GRANTED || deployment.GrantedBy != "bob" {
+				t.Fatalf("deployment not granted by the last approver: %s", deployment)
+			}
+			late := Approval{User: "carl", Timestamp: time.Now()}
+			if err := store.ApproveDeployment(&deployment, &late, 2); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			version, _ = store.GetVersionByCode(product, "1.0.0")
+			if len(version.Deployments[1].Approvals) != 2 {
+				t.Fatalf("approvals not loaded along with the version: %v", version.Deployments[1])
+			}
+
+			if err := store.DeleteProduct(&product); err != nil {
+				t.Fatalf("error deleting product: %v", err)
+			}
+			if policies, _ := store.GetPolicies(product); len(policies) != 0 {
+				t.Fatalf("policies were not deleted along with the product")
+			}
+		})
+	}
+}
+
+func TestStoreTransitions(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			version, _ := store.GetVersionByCode(product, "1.0.0")
+
+			integration, _ := store.GetDeploymentByOrder(version, 0)
+			rollback := Transition{To: ROLLED_BACK, User: "alice", Reason: "broken login page", Timestamp: time.Now()}
+			if err := store.TransitionDeployment(&integration, &rollback); err != nil {
+				t.Fatalf("error rolling back deployment: %v", err)
+			}
+			if integration.Status != ROLLED_BACK || len(integration.Transitions) != 1 || integration.Transitions[0].From != PERFORMED || integration.Transitions[0].Reason != "broken login page" {
+				t.Fatalf("unexpected deployment after rollback: %s", integration)
+			}
+			again := Transition{To: PERFORMED, User: "alice", Timestamp: time.Now()}
+			if err := store.TransitionDeployment(&integration, &again); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			quality, _ := store.GetDeploymentByOrder(version, 1)
+			approval := Approval{User: "bob", Timestamp: time.Now()}
+			if err := store.ApproveDeployment(&quality, &approval, 1); err != nil {
+				t.Fatalf("error approving deployment: %v", err)
+			}
+			failure := Transition{To: FAILED, User: "carl", Reason: "disk full", Timestamp: time.Now()}
+			if err := store.TransitionDeployment(&quality, &failure); err != nil {
+				t.Fatalf("error failing deployment: %v", err)
+			}
+			quality, err := store.GetDeploymentByOrder(version, 1)
+			if err != nil || quality.Status != FAILED || quality.GrantedBy != "bob" || len(quality.Transitions) != 2 {
+				t.Fatalf("unexpected deployment: %s (%v)", quality, err)
+			}
+			if granted := quality.Transitions[0]; granted.From != PENDING || granted.To != GRANTED || granted.User != "bob" || granted.Reason != "approved by bob" {
+				t.Fatalf("unexpected grant transition: %s", granted)
+			}
+
+			missing := Deployment{ID: 999, Order: 9}
+			if err := store.TransitionDeployment(&missing, &Transition{To: CANCELLED, Timestamp: time.Now()}); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			quality.Environment = "Production"
+			if err := store.ChangeDeployment(&quality, nil); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			staging := Deployment{VersionID: version.ID, Order: 2, Environment: "Staging"}
+			if err := store.CreateDeployment(&staging); err != nil {
+				t.Fatalf("error creating deployment: %v", err)
+			}
+			vote := Approval{User: "bob", Timestamp: time.Now()}
+			if err := store.ApproveDeployment(&staging, &vote, 2); err != nil {
+				t.Fatalf("error approving deployment: %v", err)
+			}
+			if err := store.ChangeDeployment(&staging, nil); err != nil || len(staging.Approvals) != 1 {
+				t.Fatalf("approvals withdrawn from an unchanged deployment: %s (%v)", staging, err)
+			}
+			staging.Environment = "Preview"
+			if err := store.ChangeDeployment(&staging, nil); err != nil || len(staging.Approvals) != 0 {
+				t.Fatalf("approvals kept by a deployment changing environment: %s (%v)", staging, err)
+			}
+			if read, _ := store.GetDeploymentByOrder(version, 2); read.Environment != "Preview" || len(read.Approvals) != 0 {
+				t.Fatalf("unexpected deployment after changing environment: %s", read)
+			}
+			staging.Order = 0
+			if err := store.ChangeDeployment(&staging, nil); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			staging.Order, staging.Environment = 3, "Production"
+			if err := store.ChangeDeployment(&staging, &Transition{To: PERFORMED, Timestamp: time.Now()}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			if read, _ := store.GetDeploymentByOrder(version, 2); read.Environment != "Preview" {
+				t.Fatalf("deployment changed despite the invalid transition: %s", read)
+			}
+			cancel := Transition{To: CANCELLED, User: "alice", Reason: "superseded", Timestamp: time.Now()}
+			if err := store.ChangeDeployment(&staging, &cancel); err != nil {
+				t.Fatalf("error changing deployment: %v", err)
+			}
+			if staging.Order != 3 || staging.Environment != "Production" || staging.Status != CANCELLED || len(staging.Transitions) != 1 {
+				t.Fatalf("unexpected deployment after change: %s", staging)
+			}
+
+			if err := store.DeleteVersion(&version); err != nil {
+				t.Fatalf("error deleting version: %v", err)
+			}
+		})
+	}
+}
+
+func TestStorePipelines(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			if stages, err := store.GetPipeline(product); err != nil || len(stages) != 0 {
+				t.Fatalf("unexpected pipeline: %v (%v)", stages, err)
+			}
+
+			stages := []Stage{{Environment: "Integration"}, {Environment: "Quality"}, {Environment: "Production"}}
+			if err := store.SetPipeline(product, stages); err != nil {
+				t.Fatalf("error setting pipeline: %v", err)
+			}
+			stages = []Stage{{Environment: "Integration"}, {Environment: "Quality"}, {Environment: "Certification"}, {Environment: "Production"}}
+			if err := store.SetPipeline(product, stages); err != nil {
+				t.Fatalf("error replacing pipeline: %v", err)
+			}
+			read, err := store.GetPipeline(product)
+			if err != nil || len(read) != 4 || read[2].Environment != "Certification" || read[2].Position != 3 {
+				t.Fatalf("unexpected pipeline: %v (%v)", read, err)
+			}
+
+			duplicate := []Stage{{Environment: "Integration"}, {Environment: "Integration"}}
+			if err := store.SetPipeline(product, duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			if read, _ := store.GetPipeline(product); len(read) != 4 {
+				t.Fatalf("pipeline modified by failed replacement: %v", read)
+			}
+
+			if err := store.DeleteProduct(&product); err != nil {
+				t.Fatalf("error deleting product: %v", err)
+			}
+			if read, _ := store.GetPipeline(product); len(read) != 0 {
+				t.Fatalf("pipeline was not deleted along with the product")
+			}
+		})
+	}
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			if err := store.CreateWebhook(&Webhook{ProductID: product.ID + 1, URL: "http://localhost/hook"}); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+			webhook := Webhook{ProductID: product.ID, URL: "http://localhost/hook", Events: "version.created,deployment.*", Secret: "s3cr3t", Active: true}
+			if err := store.CreateWebhook(&webhook); err != nil {
+				t.Fatalf("error creating webhook: %v", err)
+			}
+			webhook.Events = "deployment.granted"
+			if err := store.UpdateWebhook(&webhook); err != nil {
+				t.Fatalf("error updating webhook: %v", err)
+			}
+			read, err := store.GetWebhook(webhook.ID)
+			if err != nil || read.Events != "deployment.granted" || read.Secret != "s3cr3t" {
+				t.Fatalf("unexpected webhook: %v (%v)", read, err)
+			}
+			if !read.Subscribes(StatusEvent(GRANTED)) || read.Subscribes(VERSION_CREATED) {
+				t.Fatalf("unexpected subscriptions of webhook: %v", read)
+			}
+
+			for attempt := 1; attempt <= 3; attempt++ {
+				delivery := Delivery{WebhookID: webhook.ID, EventID: 1, Event: VERSION_CREATED, Attempt: attempt, StatusCode: 500, Timestamp: time.Now()}
+				if err := store.CreateDelivery(&delivery); err != nil {
+					t.Fatalf("error recording delivery: %v", err)
+				}
+			}
+			deliveries, err := store.GetDeliveries(webhook, 2)
+			if err != nil || len(deliveries) != 2 || deliveries[0].Attempt != 3 {
+				t.Fatalf("unexpected deliveries: %v (%v)", deliveries, err)
+			}
+
+			other := Webhook{ProductID: product.ID, URL: "http://localhost/other"}
+			if err := store.CreateWebhook(&other); err != nil {
+				t.Fatalf("error creating webhook: %v", err)
+			}
+			if err := store.DeleteWebhook(&other); err != nil {
+				t.Fatalf("error deleting webhook: %v", err)
+			}
+			if err := store.DeleteWebhook(&other); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			if err := store.DeleteProduct(&product); err != nil {
+				t.Fatalf("error deleting product: %v", err)
+			}
+			if _, err := store.GetWebhook(webhook.ID); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("webhook was not deleted along with the product: %v", err)
+			}
+			if deliveries, _ := store.GetDeliveries(webhook, 0); len(deliveries) != 0 {
+				t.Fatalf("deliveries were not deleted along with the product: %v", deliveries)
+			}
+		})
+	}
+}
+
+func TestStorePreferences(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.GetPreference("alice"); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+			preference := Preference{User: "alice", Email: "alice@example.com", Events: "deployment.*"}
+			if err := store.SetPreference(&preference); err != nil {
+				t.Fatalf("error setting preferences: %v", err)
+			}
+			replaced := Preference{User: "alice", Email: "alice@example.com", Products: "gaia", Events: "deployment.granted"}
+			if err := store.SetPreference(&replaced); err != nil {
+				t.Fatalf("error replacing preferences: %v", err)
+			}
+			if replaced.ID != preference.ID {
+				t.Fatalf("expected preferences %d to be replaced, got %d", preference.ID, replaced.ID)
+			}
+			other := Preference{User: "bob", Email: "bob@example.com"}
+			if err := store.SetPreference(&other); err != nil {
+				t.Fatalf("error setting preferences: %v", err)
+			}
+
+			preferences, err := store.GetPreferences()
+			if err != nil || len(preferences) != 2 || preferences[0].Products != "gaia" {
+				t.Fatalf("unexpected preferences: %v (%v)", preferences, err)
+			}
+			if !preferences[0].Subscribes("gaia", StatusEvent(GRANTED)) || preferences[0].Subscribes("uranus", StatusEvent(GRANTED)) || preferences[1].Subscribes("gaia", StatusEvent(GRANTED)) {
+				t.Fatalf("unexpected subscriptions: %v", preferences)
+			}
+
+			if err := store.DeletePreference(&other); err != nil {
+				t.Fatalf("error deleting preferences: %v", err)
+			}
+			if err := store.DeletePreference(&other); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreAssignments(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+
+			admin := Assignment{User: "root", Role: ADMIN}
+			if err := store.CreateAssignment(&admin); err != nil {
+				t.Fatalf("error creating global assignment: %v", err)
+			}
+			manager := Assignment{User: "alice", ProductID: product.ID, Environment: "Production", Role: RELEASE_MANAGER}
+			if err := store.CreateAssignment(&manager); err != nil {
+				t.Fatalf("error creating assignment: %v", err)
+			}
+			developer := Assignment{User: "alice", ProductID: product.ID, Role: DEVELOPER}
+			if err := store.CreateAssignment(&developer); err != nil {
+				t.Fatalf("error creating assignment: %v", err)
+			}
+
+			duplicate := Assignment{User: "alice", ProductID: product.ID, Environment: "Production", Role: VIEWER}
+			if err := store.CreateAssignment(&duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate, got %v", err)
+			}
+			orphan := Assignment{User: "alice", ProductID: 9999, Role: VIEWER}
+			if err := store.CreateAssignment(&orphan); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint, got %v", err)
+			}
+
+			assignments, err := store.GetAssignments("alice")
+			if err != nil || len(assignments) != 2 || assignments[0].ID != manager.ID {
+				t.Fatalf("unexpected assignments of alice: %v (%v)", assignments, err)
+			}
+			if assignments, _ := store.GetAssignments(""); len(assignments) != 3 {
+				t.Fatalf("unexpected assignments: %v", assignments)
+			}
+			if read, err := store.GetAssignment(admin.ID); err != nil || read.User != "root" || read.Role != ADMIN {
+				t.Fatalf("unexpected assignment read back: %s (%v)", read, err)
+			}
+
+			if err := store.DeleteAssignment(&developer); err != nil {
+				t.Fatalf("error deleting assignment: %v", err)
+			}
+			if err := store.DeleteAssignment(&developer); errors.Cause(err) != ErrorNotFound {
+				t.Fatalf("expected ErrorNotFound, got %v", err)
+			}
+
+			if err := store.DeleteProduct(&product); err != nil {
+				t.Fatalf("error deleting product: %v", err)
+			}
+			if assignments, _ := store.GetAssignments(""); len(assignments) != 1 || assignments[0].ID != admin.ID {
+				t.Fatalf("assignments were not deleted along with the product: %v", assignments)
+			}
+		})
+	}
+}
+
+func TestStoreAudit(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			start := time.Now()
+			for _, change := range []struct {
+				user   string
+				action Action
+				before interface{}
+				after  interface{}
+			}{
+				{"alice", CREATE, nil, product},
+				{"bob", UPDATE, product, Product{Code: "gaia", Name: "Gaia"}},
+				{"alice", DELETE, Product{Code: "gaia", Name: "Gaia"}, nil},
+			} {
+				record, err := NewAuditRecord(change.user, change.action, "product", "gaia", "gaia", change.before, change.after)
+				if err != nil {
+					t.Fatalf("error creating audit record: %v", err)
+				}
+				if err := store.AppendAuditRecord(&record); err != nil {
+					t.Fatalf("error appending audit record: %v", err)
+				}
+			}
+			other, _ := NewAuditRecord("alice", CREATE, "product", "siparium", "siparium", nil, Product{Code: "siparium"})
+			if err := store.AppendAuditRecord(&other); err != nil {
+				t.Fatalf("error appending audit record: %v", err)
+			}
+
+			records, err := store.GetAuditRecords(AuditFilter{Product: "gaia"})
+			if err != nil || len(records) != 3 || records[1].User != "bob" || records[1].Action != UPDATE {
+				t.Fatalf("unexpected audit records: %v (%v)", records, err)
+			}
+			if records[0].Before != "" || !strings.Contains(records[0].After, `"code":"gaia"`) || records[2].After != "" {
+				t.Fatalf("unexpected entity states: %v", records)
+			}
+			if records, _ := store.GetAuditRecords(AuditFilter{User: "alice"}); len(records) != 3 {
+				t.Fatalf("unexpected audit records by user: %v", records)
+			}
+			if records, _ := store.GetAuditRecords(AuditFilter{Since: start.Add(-time.Minute), Until: time.Now().Add(time.Minute)}); len(records) != 4 {
+				t.Fatalf("unexpected audit records in time range: %v", records)
+			}
+			if records, _ := store.GetAuditRecords(AuditFilter{Until: start.Add(-time.Minute)}); len(records) != 0 {
+				t.Fatalf("unexpected audit records before time range: %v", records)
+			}
+			if after, _ := store.GetAuditRecords(AuditFilter{After: records[1].ID}); len(after) != 2 || after[0].ID <= records[1].ID {
+				t.Fatalf("unexpected audit records after record %d: %v", records[1].ID, after)
+			}
+
+			if count, err := VerifyAuditLog(store); err != nil || count != 4 {
+				t.Fatalf("unexpected verification result: %d records (%v)", count, err)
+			}
+			tamper(t, store, 2, "mallory")
+			if _, err := VerifyAuditLog(store); err == nil || !strings.Contains(err.Error(), "audit record 2 has been modified") {
+				t.Fatalf("modified record not detected: %v", err)
+			}
+			tamper(t, store, 2, "bob")
+			if _, err := VerifyAuditLog(store); err != nil {
+				t.Fatalf("unexpected verification error: %v", err)
+			}
+			tamper(t, store, 2, "")
+			if count, err := VerifyAuditLog(store); err == nil || count != 1 || !strings.Contains(err.Error(), "audit record 3 does not follow record 1") {
+				t.Fatalf("removed record not detected: %v", err)
+			}
+		})
+	}
+}
+
+// tamper changes the user of an audit record behind the back of the store, or
+// removes the record if the user is empty.
+func tamper(t *testing.T, store Store, id uint, user string) {
+	switch store := store.(type) {
+	case *GormStore:
+		db := store.db.Table("audit_records").Where("id = ?", id)
+		if user == "" {
+			db = db.Delete(&AuditRecord{})
+		} else {
+			db = db.UpdateColumn("username", user)
+		}
+		if db.Error != nil {
+			t.Fatalf("error tampering with audit record %d: %v", id, db.Error)
+		}
+	case *MemoryStore:
+		for i, record := range store.records {
+			if record.ID == id && user == "" {
+				store.records = append(store.records[:i], store.records[i+1:]...)
+				break
+			}
+			if record.ID == id {
+				store.records[i].User = user
+			}
+		}
+	}
+}
+
+func TestStoreAtomically(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			product := sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+
+			failure := errors.New("failure")
+			err := store.Atomically(func(store Store) error {
+				product.Name = "GAIA"
+				if err := store.UpdateProduct(&product); err != nil {
+					return err
+				}
+				record, _ := NewAuditRecord("admin", UPDATE, "product", "gaia", "gaia", nil, product)
+				if err := store.AppendAuditRecord(&record); err != nil {
+					return err
+				}
+				return failure
+			})
+			if err != failure {
+				t.Fatalf("expected the error of the changes, got %v", err)
+			}
+			if read, _ := store.GetProductByCode("gaia"); read.Name != "G.A.I.A." {
+				t.Fatalf("changes were not rolled back: %s", read)
+			}
+			if records, _ := store.GetAuditRecords(AuditFilter{}); len(records) != 0 {
+				t.Fatalf("audit records were not rolled back: %v", records)
+			}
+
+			if err := store.Atomically(func(store Store) error {
+				return store.UpdateProduct(&product)
+			}); err != nil {
+				t.Fatalf("error changing product: %v", err)
+			}
+			if read, _ := store.GetProductByCode("gaia"); read.Name != "GAIA" {
+				t.Fatalf("changes were not kept: %s", read)
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	for name, store := range stores(t) {
+		store, ok := store.(*GormStore)
+		if !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			if version, err := store.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+				t.Fatalf("expected schema version %d, got %d (%v)", LatestSchemaVersion(), version, err)
+			}
+
+			product := sample()
+			product.Versions[0].Author = "d093154"
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product: %v", err)
+			}
+			if err := store.Migrate(3); err != nil {
+				t.Fatalf("error reverting to version 3: %v", err)
+			}
+			if store.db.HasTable("approvals") || store.db.Table("versions").Dialect().HasColumn("versions", "author") {
+				t.Fatalf("unexpected tables or columns at version 3")
+			}
+			var count int
+			if err := store.db.Table("versions").Where("code = ?", "1.0.0").Count(&count).Error; err != nil || count != 1 {
+				t.Fatalf("versions were lost reverting to version 3 (%v)", err)
+			}
+			for _, code := range []string{"R2", "0.0.0-alpha"} {
+				if err := store.db.Exec("INSERT INTO versions (product_id, code) VALUES (?, ?)", product.ID, code).Error; err != nil {
+					t.Fatalf("error inserting version %q at version 3: %v", code, err)
+				}
+			}
+			if err := store.Migrate(LatestSchemaVersion()); err != nil {
+				t.Fatalf("error upgrading to version %d: %v", LatestSchemaVersion(), err)
+			}
+			duplicate := Version{ProductID: product.ID, Code: "1.0.0"}
+			if err := store.CreateVersion(&duplicate); errors.Cause(err) != ErrorDuplicate {
+				t.Fatalf("expected ErrorDuplicate after reverting to version 3, got %v", err)
+			}
+			versions, err := store.GetVersions(product)
+			if err != nil || len(versions) != 4 || versions[3].Code != "1.0.1" || versions[3].Patch != 1 {
+				t.Fatalf("semantic versions not set on upgrade: %v (%v)", versions, err)
+			}
+			if legacy := versions[0]; legacy.Code != "R2" || !legacy.Legacy || versions[1].Code != "0.0.0-alpha" || versions[1].Legacy {
+				t.Fatalf("legacy versions not marked on upgrade: %v", versions)
+			}
+			legacy := versions[0]
+			legacy.Deployments = nil
+			legacy.Description = "before semantic versions"
+			if err := store.UpdateVersion(&legacy); err != nil {
+				t.Fatalf("error updating legacy version: %v", err)
+			}
+			legacy.Code = "R3"
+			if err := store.UpdateVersion(&legacy); errors.Cause(err) != ErrorConstraint {
+				t.Fatalf("expected ErrorConstraint changing the code of a legacy version, got %v", err)
+			}
+			legacy.Code = "0.2.0"
+			if err := store.UpdateVersion(&legacy); err != nil || legacy.Legacy {
+				t.Fatalf("expected legacy version to lose its mark, got %v (%v)", legacy, err)
+			}
+
+			if err := store.Migrate(1); err != nil {
+				t.Fatalf("error reverting to version 1: %v", err)
+			}
+			if store.db.HasTable("deployments") || !store.db.HasTable("versions") {
+				t.Fatalf("unexpected tables at version 1")
+			}
+
+			if err := store.Migrate(0); err != nil {
+				t.Fatalf("error reverting to version 0: %v", err)
+			}
+			if store.db.HasTable("products") {
+				t.Fatalf("unexpected tables at version 0")
+			}
+
+			if err := store.Migrate(LatestSchemaVersion()); err != nil {
+				t.Fatalf("error upgrading to version %d: %v", LatestSchemaVersion(), err)
+			}
+			product = sample()
+			if err := store.CreateProduct(&product); err != nil {
+				t.Fatalf("error creating product on migrated schema: %v", err)
+			}
+			if err := store.Migrate(LatestSchemaVersion() + 1); err == nil {
+				t.Fatalf("expected error migrating to unknown version")
+			}
+		})
+	}
+}
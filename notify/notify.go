@@ -0,0 +1,250 @@
+// Package notify e-mails the people concerned about the deployments of the
+// builds microservice: when a deployment awaits approval, is granted or is
+// rejected, the contact of its product and the users who asked to be notified
+// (see model.Preference) receive a message rendered from a template.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/pkg/errors"
+)
+
+// AWAITING_APPROVAL is the name of the template of the notifications of new
+// deployments awaiting approval, i.e. of the deployment.created events of
+// PENDING deployments.
+const AWAITING_APPROVAL = "deployment.pending"
+
+// templates are the default templates of the notifications, by name; the
+// first line is the subject of the message, the rest its body.
+var templates = map[string]string{
+	AWAITING_APPROVAL: `[builds] {{.Product.Code}} {{.Version}} awaits approval for {{.Deployment.Environment}}
+Version {{.Version}} of {{or .Product.Name .Product.Code}} is waiting to be deployed to {{.Deployment.Environment}} (deployment #{{.Deployment.Order}}) and needs to be approved.
+{{if .Link}}
+{{.Link}}
+{{end}}`,
+	string(model.StatusEvent(model.GRANTED)): `[builds] {{.Product.Code}} {{.Version}} granted for {{.Deployment.Environment}}
+The deployment of version {{.Version}} of {{or .Product.Name .Product.Code}} to {{.Deployment.Environment}} (deployment #{{.Deployment.Order}}) has been granted{{with .Deployment.GrantedBy}} by {{.}}{{end}}.
+{{if .Link}}
+{{.Link}}
+{{end}}`,
+	string(model.StatusEvent(model.REJECTED)): `[builds] {{.Product.Code}} {{.Version}} rejected for {{.Deployment.Environment}}
+The deployment of version {{.Version}} of {{or .Product.Name .Product.Code}} to {{.Deployment.Environment}} (deployment #{{.Deployment.Order}}) has been rejected{{with .User}} by {{.}}{{end}}.
+{{if .Link}}
+{{.Link}}
+{{end}}`,
+}
+
+// Config holds the settings of a Notifier.
+type Config struct {
+	// Address is the host:port of the SMTP server.
+	Address string
+	// From is the sender address of the messages.
+	From string
+	// Username and Password are the credentials of the SMTP server, if it
+	// requires authentication.
+	Username string
+	Password string
+	// Templates is the directory holding the templates overriding the default
+	// ones, named after them with a ".tmpl" extension, e.g.
+	// "deployment.granted.tmpl".
+	Templates string
+	// URL is the public base URL of the server, used to link the deployments
+	// in the messages.
+	URL string
+}
+
+// Message is the data the notification templates are executed with.
+type Message struct {
+	Event      model.Event
+	User       string
+	Product    model.Product
+	Version    string
+	Deployment model.Deployment
+	Link       string
+}
+
+// Notifier e-mails the notifications of the events of the deployments, in the
+// background.
+type Notifier struct {
+	store     model.Store
+	config    Config
+	templates map[string]*template.Template
+	pending   sync.WaitGroup
+}
+
+// NewNotifier returns a notifier sending the notifications of the events to
+// the product contacts and to the users in the given store, through the SMTP
+// server in the given configuration.
+func NewNotifier(store model.Store, config Config) (*Notifier, error) {
+	if config.Address == "" || config.From == "" {
+		return nil, errors.New("both an SMTP server and a sender address are required")
+	}
+	n := &Notifier{
+		store:     store,
+		config:    config,
+		templates: map[string]*template.Template{},
+	}
+	for name, text := range templates {
+		if config.Templates != "" {
+			path := filepath.Join(config.Templates, name+".tmpl")
+			data, err := os.ReadFile(path)
+			if err == nil {
+				text = string(data)
+			} else if !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "error reading template %q", path)
+			}
+		}
+		t, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template %q", name)
+		}
+		n.templates[name] = t
+	}
+	return n, nil
+}
+
+// Publish e-mails, in the background, the notification of the given event to
+// the people concerned, if it is about a deployment awaiting approval, granted
+// or rejected.
+func (n *Notifier) Publish(event model.Event) {
+	var deployment model.Deployment
+	if err := json.Unmarshal(event.Data, &deployment); err != nil {
+		return
+	}
+	name := string(event.Type)
+	if event.Type == model.DEPLOYMENT_CREATED && deployment.Status == model.PENDING {
+		name = AWAITING_APPROVAL
+	}
+	t, ok := n.templates[name]
+	if !ok {
+		return
+	}
+
+	product, err := n.store.GetProductByCode(event.Product)
+	if err != nil {
+		log.Printf("error notifying event %d: %v\n", event.ID, err)
+		return
+	}
+	recipients, err := n.recipients(product, event.Type)
+	if err != nil {
+		log.Printf("error notifying event %d: %v\n", event.ID, err)
+		return
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	message := Message{
+		Event:      event,
+		User:       event.User,
+		Product:    product,
+		Version:    version(event),
+		Deployment: deployment,
+	}
+	if n.config.URL != "" {
+		message.Link = strings.Join([]string{strings.TrimSuffix(n.config.URL, "/"),
+			"products", product.Code, "versions", message.Version, "deployments", fmt.Sprint(deployment.Order)}, "/")
+	}
+	var text bytes.Buffer
+	if err := t.Execute(&text, message); err != nil {
+		log.Printf("error rendering notification of event %d: %v\n", event.ID, err)
+		return
+	}
+
+	n.pending.Add(1)
+	go func() {
+		defer n.pending.Done()
+		if err := n.send(recipients, text.String()); err != nil {
+			log.Printf("error sending notification of event %d: %v\n", event.ID, err)
+		}
+	}()
+}
+
+// Wait blocks until all the notifications in progress have been sent.
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
+
+// recipients returns the addresses to notify of the events of the given type
+// about the given product: its contact, unless there are preferences for the
+// same address not subscribing to them, and the users whose preferences do.
+func (n *Notifier) recipients(product model.Product, event model.EventType) ([]string, error) {
+	preferences, err := n.store.GetPreferences()
+	if err != nil {
+		return nil, err
+	}
+	recipients := []string{}
+	contact := strings.TrimSpace(product.Contact)
+	for _, preference := range preferences {
+		if strings.EqualFold(preference.Email, contact) {
+			contact = ""
+		}
+		if preference.Email != "" && preference.Subscribes(product.Code, event) && !contains(recipients, preference.Email) {
+			recipients = append(recipients, preference.Email)
+		}
+	}
+	if contact != "" && !contains(recipients, contact) {
+		recipients = append([]string{contact}, recipients...)
+	}
+	return recipients, nil
+}
+
+// send e-mails the given text, whose first line is the subject, to the given
+// recipients.
+func (n *Notifier) send(recipients []string, text string) error {
+	subject, body, _ := strings.Cut(text, "\n")
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", strings.TrimSpace(subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(strings.TrimLeft(body, "\n"), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.config.Username != "" {
+		host, _, err := net.SplitHostPort(n.config.Address)
+		if err != nil {
+			return errors.Wrapf(err, "invalid SMTP server address %q", n.config.Address)
+		}
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, host)
+	}
+	if err := smtp.SendMail(n.config.Address, auth, n.config.From, recipients, message.Bytes()); err != nil {
+		return errors.Wrapf(err, "error sending mail to %s", strings.Join(recipients, ", "))
+	}
+	return nil
+}
+
+// version returns the code of the version of the deployment the given event
+// is about, whose key is "<product>/<version>/<order>".
+func version(event model.Event) string {
+	key := strings.TrimPrefix(event.Key, event.Product+"/")
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// contains returns whether the given addresses include the given one.
+func contains(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package notify
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dihedron/builds/model"
+)
+
+// mail is a message received by the SMTP stand-in.
+type mail struct {
+	from       string
+	recipients []string
+	data       string
+}
+
+// mailbox is a minimal SMTP server accepting any message, and recording it.
+type mailbox struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	mails    []mail
+}
+
+// listen starts an SMTP stand-in on a local port.
+func listen(t *testing.T) *mailbox {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	m := &mailbox{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+// serve holds an SMTP session on the given connection.
+func (m *mailbox) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var current mail
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			current = mail{from: strings.Trim(strings.TrimSpace(line)[10:], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			current.recipients = append(current.recipients, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			current.data = data.String()
+			m.mutex.Lock()
+			m.mails = append(m.mails, current)
+			m.mutex.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// received returns the messages received so far.
+func (m *mailbox) received() []mail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]mail{}, m.mails...)
+}
+
+// notifier returns a notifier sending to the given mailbox, with a store
+// holding product gaia, whose contact is alice.
+func notifier(t *testing.T, m *mailbox, templates string) (*Notifier, model.Store) {
+	store := model.NewMemoryStore()
+	product := model.Product{Code: "gaia", Name: "Gaia", Contact: "alice@example.com"}
+	if err := store.CreateProduct(&product); err != nil {
+		t.Fatalf("error creating product: %v", err)
+	}
+	n, err := NewNotifier(store, Config{
+		Address:   m.listener.Addr().String(),
+		From:      "builds@example.com",
+		Templates: templates,
+		URL:       "https://builds.example.com/",
+	})
+	if err != nil {
+		t.Fatalf("error creating notifier: %v", err)
+	}
+	return n, store
+}
+
+// event returns an event of the given type about the deployment with the
+// given status of gaia 1.0.0 to Production.
+func event(id uint, kind model.EventType, status model.Status) model.Event {
+	deployment := model.Deployment{Order: 3, Environment: "Production", Status: status, GrantedBy: "bob"}
+	return model.Event{ID: id, Type: kind, User: "bob", Product: "gaia", Key: "gaia/1.0.0/3", Data: []byte(deployment.String())}
+}
+
+func TestNotify(t *testing.T) {
+	m := listen(t)
+	n, store := notifier(t, m, "")
+	for _, preference := range []model.Preference{
+		{User: "carol", Email: "carol@example.com", Events: "deployment.granted"},
+		{User: "dave", Email: "dave@example.com", Products: "uranus", Events: "deployment.*"},
+	} {
+		if err := store.SetPreference(&preference); err != nil {
+			t.Fatalf("error setting preferences: %v", err)
+		}
+	}
+
+	n.Publish(event(1, model.DEPLOYMENT_CREATED, model.PENDING))
+	n.Publish(event(2, model.DEPLOYMENT_CREATED, model.GRANTED))
+	n.Publish(event(3, model.StatusEvent(model.PERFORMED), model.PERFORMED))
+	n.Publish(model.Event{ID: 4, Type: model.VERSION_CREATED, Product: "gaia", Key: "gaia/1.0.0", Data: []byte(`{"code":"1.0.0"}`)})
+	n.Wait()
+	mails := m.received()
+	if len(mails) != 1 || strings.Join(mails[0].recipients, ",") != "alice@example.com" {
+		t.Fatalf("expected a single notification to the contact, got %v", mails)
+	}
+	if !strings.Contains(mails[0].data, "Subject: [builds] gaia 1.0.0 awaits approval for Production\r\n") ||
+		!strings.Contains(mails[0].data, "https://builds.example.com/products/gaia/versions/1.0.0/deployments/3") {
+		t.Fatalf("unexpected notification:\n%s", mails[0].data)
+	}
+
+	n.Publish(event(5, model.StatusEvent(model.GRANTED), model.GRANTED))
+	n.Wait()
+	mails = m.received()
+	if len(mails) != 2 || strings.Join(mails[1].recipients, ",") != "alice@example.com,carol@example.com" {
+		t.Fatalf("expected the contact and carol to be notified, got %v", mails[1:])
+	}
+	if !strings.Contains(mails[1].data, "has been granted by bob.") || mails[1].from != "builds@example.com" {
+		t.Fatalf("unexpected notification:\n%s", mails[1].data)
+	}
+
+	// the contact opts out of all but the rejections
+	optout := model.Preference{User: "alice", Email: "Alice@example.com", Events: "deployment.rejected"}
+	if err := store.SetPreference(&optout); err != nil {
+		t.Fatalf("error setting preferences: %v", err)
+	}
+	n.Publish(event(6, model.StatusEvent(model.GRANTED), model.GRANTED))
+	n.Publish(event(7, model.StatusEvent(model.REJECTED), model.REJECTED))
+	n.Wait()
+	mails = m.received()
+	recipients := map[string]bool{}
+	for _, mail := range mails[2:] {
+		recipients[strings.Join(mail.recipients, ",")] = true
+	}
+	if len(mails) != 4 || !recipients["carol@example.com"] || !recipients["Alice@example.com"] {
+		t.Fatalf("unexpected notifications after opting out: %v", mails[2:])
+	}
+}
+
+func TestNotifyTemplates(t *testing.T) {
+	dir := t.TempDir()
+	custom := "Go {{.Product.Code}}!\n{{.Version}} is on its way to {{.Deployment.Environment}}.\n"
+	if err := os.WriteFile(filepath.Join(dir, "deployment.granted.tmpl"), []byte(custom), 0644); err != nil {
+		t.Fatalf("error writing template: %v", err)
+	}
+	m := listen(t)
+	n, _ := notifier(t, m, dir)
+	n.Publish(event(1, model.StatusEvent(model.GRANTED), model.GRANTED))
+	n.Wait()
+	mails := m.received()
+	if len(mails) != 1 || !strings.Contains(mails[0].data, "Subject: Go gaia!\r\n") || !strings.Contains(mails[0].data, "1.0.0 is on its way to Production.") {
+		t.Fatalf("unexpected notification: %v", mails)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "deployment.rejected.tmpl"), []byte("{{.Oops"), 0644); err != nil {
+		t.Fatalf("error writing template: %v", err)
+	}
+	if _, err := NewNotifier(model.NewMemoryStore(), Config{Address: "localhost:25", From: "builds@example.com", Templates: dir}); err == nil {
+		t.Fatalf("expected invalid template to be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/dihedron/builds/model"
+)
+
+// seed populates the given store with some sample products.
+func seed(store model.Store) {
+	product := model.Product{
+		Code:        "gaia",
+		Name:        "G.A.I.A. - Servizi per il Personale",
+		Description: "GAIA è il portale web dei servizi aziendali non altrimenti disponibili su piattaforma SAP.",
+		Contact:     "fabio.angeli@bancaditalia.it",
+		Repository:  "https://gitlab.utenze.bankit.it/gaia",
+		WebSite:     "http://infogaia/",
+		Versions: []model.Version{
+			{
+				Code:        "1.0.0",
+				Description: "First major release, 1.0 series",
+				Repository:  "https://gitlab.utenze.bankit.it/gaia",
+				Branch:      "ver_1_0_0",
+				Deployments: []model.Deployment{
+					{Order: 0, Environment: "Integration", Status: model.PERFORMED, GrantedBy: "d093154", Timestamp: time.Now()},
+					{Order: 1, Environment: "Quality", Status: model.GRANTED, GrantedBy: "d093154", Timestamp: time.Now()},
+					{Order: 2, Environment: "Certification", Status: model.PENDING},
+					{Order: 3, Environment: "Production", Status: model.PENDING},
+				},
+			},
+			{
+				Code:        "1.0.1",
+				Description: "First bugfix release of the 1.0 series",
+				Branch:      "ver_1_0_1",
+			},
+		},
+	}
+	if err := store.CreateProduct(&product); err != nil {
+		log.Printf("error saving product: %v\n", err)
+	} else {
+		log.Printf("product after save: %s\n", product)
+	}
+
+	product = model.Product{
+		Code:        "siparium",
+		Name:        "SIPARIUM - Sistema Integrato Processi Aziendali per le Risorse UMane",
+		Description: "GAIA è il portale web dei servizi aziendali per le risorse umane su piattaforma SAP.",
+		Contact:     "roberto iapichino@bancaditalia.it",
+		Repository:  "https://gitlab.utenze.bankit.it/siparium",
+		WebSite:     "http://portale-sap/",
+		Versions: []model.Version{
+			{
+				Code:        "1.0.0",
+				Description: "First major release, 1.0 series",
+				Repository:  "https://gitlab.utenze.bankit.it/siparium",
+				Branch:      "ver_1_0_0",
+			},
+			{
+				Code:        "1.0.1",
+				Description: "First bugfix release of the 1.0 series",
+				Branch:      "ver_1_0_1",
+			},
+		},
+	}
+	if err := store.CreateProduct(&product); err != nil {
+		log.Printf("error saving product: %v\n", err)
+	} else {
+		log.Printf("product after save: %s\n", product)
+	}
+}
@@ -0,0 +1,230 @@
+package semver
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// comparator is a primitive constraint on versions, e.g. ">=1.2.0".
+type comparator struct {
+	operator string
+	version  Version
+}
+
+// matches returns whether the given version satisfies the comparator.
+func (c comparator) matches(version Version) bool {
+	result := Compare(version, c.version)
+	switch c.operator {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return result == 0
+}
+
+// Range is a set of versions, as described by an expression made of
+// alternatives separated by "||", each of them a space-separated list of
+// constraints which must all be satisfied. Constraints are versions, possibly
+// partial ("1.2", "1.x" or "*"), prefixed by an operator:
+//
+//   - "=" (the default) matches the version, or all those starting with a
+//     partial one;
+//   - "<", "<=", ">" and ">=" compare versions by precedence;
+//   - "~" allows patch-level changes ("~1.2.3" stands for ">=1.2.3 <1.3.0");
+//   - "^" allows changes not modifying the leftmost non-zero number ("^1.2.3"
+//     stands for ">=1.2.3 <2.0.0", "^0.2.3" for ">=0.2.3 <0.3.0").
+//
+// Pre-releases only belong to a range if one of the constraints of the
+// alternative explicitly refers to a pre-release with the same major, minor
+// and patch numbers, e.g. ">=2.0.0-rc.1 <2.0.0" contains "2.0.0-rc.2".
+type Range struct {
+	expression string
+	sets       [][]comparator
+}
+
+// ParseRange parses the given range expression.
+func ParseRange(expression string) (Range, error) {
+	r := Range{expression: expression}
+	for _, alternative := range strings.Split(expression, "||") {
+		set := []comparator{}
+		tokens := strings.Fields(alternative)
+		for i := 0; i < len(tokens); i++ {
+			token := tokens[i]
+			// operators may be separated from their version
+			if strings.Trim(token, "<>=~^") == "" && i+1 < len(tokens) {
+				i++
+				token += tokens[i]
+			}
+			comparators, err := parseConstraint(token)
+			if err != nil {
+				return Range{}, errors.Wrapf(err, "invalid range %q", expression)
+			}
+			set = append(set, comparators...)
+		}
+		r.sets = append(r.sets, set)
+	}
+	return r, nil
+}
+
+// Contains returns whether the given version belongs to the range.
+func (r Range) Contains(version Version) bool {
+	for _, set := range r.sets {
+		if matches(set, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the expression the range was parsed from.
+func (r Range) String() string {
+	return r.expression
+}
+
+// matches returns whether the given version satisfies all the comparators in
+// the given set, following the rules for pre-releases described in Range.
+func matches(set []comparator, version Version) bool {
+	for _, c := range set {
+		if !c.matches(version) {
+			return false
+		}
+	}
+	if version.Stable() {
+		return true
+	}
+	for _, c := range set {
+		if !c.version.Stable() && c.version.Major == version.Major && c.version.Minor == version.Minor && c.version.Patch == version.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConstraint parses a constraint, i.e. an optional operator followed by
+// a possibly partial version, into the primitive comparators it stands for.
+func parseConstraint(constraint string) ([]comparator, error) {
+	operator := constraint[:len(constraint)-len(strings.TrimLeft(constraint, "<>=~^"))]
+	switch operator {
+	case "", "=", "<", "<=", ">", ">=", "~", "^":
+	default:
+		return nil, errors.Errorf("invalid operator %q", operator)
+	}
+	v, n, err := parsePartial(constraint[len(operator):])
+	if err != nil {
+		return nil, err
+	}
+
+	// the first version following those starting with the partial version,
+	// and its first pre-release
+	next := Version{}
+	switch n {
+	case 1:
+		next.Major = v.Major + 1
+	case 2, 3:
+		next.Major, next.Minor = v.Major, v.Minor+1
+	}
+	below := func(v Version) comparator {
+		return comparator{"<", Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch, PreRelease: []string{"0"}}}
+	}
+	none := []comparator{below(Version{})}
+
+	switch operator {
+	case "", "=":
+		switch n {
+		case 0:
+			return nil, nil
+		case 3:
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, below(next)}, nil
+	case ">":
+		switch n {
+		case 0:
+			return none, nil
+		case 3:
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", next}}, nil
+	case ">=":
+		if n == 0 {
+			return nil, nil
+		}
+		return []comparator{{">=", v}}, nil
+	case "<":
+		switch n {
+		case 0:
+			return none, nil
+		case 3:
+			return []comparator{{"<", v}}, nil
+		}
+		return []comparator{below(v)}, nil
+	case "<=":
+		switch n {
+		case 0:
+			return nil, nil
+		case 3:
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{below(next)}, nil
+	case "~":
+		if n == 0 {
+			return nil, nil
+		}
+		return []comparator{{">=", v}, below(next)}, nil
+	}
+	// caret ranges
+	switch {
+	case n == 0:
+		return nil, nil
+	case v.Major > 0 || n == 1:
+		next = Version{Major: v.Major + 1}
+	case v.Minor > 0 || n == 2:
+		next = Version{Minor: v.Minor + 1}
+	default:
+		next = Version{Patch: v.Patch + 1}
+	}
+	return []comparator{{">=", v}, below(next)}, nil
+}
+
+// parsePartial parses a possibly partial version, where missing or wildcard
+// ("x", "X" or "*") numbers are zero, and returns the number of numbers given;
+// only complete versions can have a pre-release.
+func parsePartial(partial string) (Version, int, error) {
+	if partial == "" {
+		return Version{}, 0, errors.New("missing version")
+	}
+	numbers := strings.SplitN(partial, ".", 3)
+	n := 0
+	for ; n < len(numbers); n++ {
+		if numbers[n] == "x" || numbers[n] == "X" || numbers[n] == "*" {
+			break
+		}
+	}
+	if n == 3 {
+		v, err := Parse(partial)
+		return v, 3, err
+	}
+	var v Version
+	for i, target := range []*uint64{&v.Major, &v.Minor} {
+		if i == n {
+			break
+		}
+		number, err := parseNumber(numbers[i])
+		if err != nil {
+			return Version{}, 0, err
+		}
+		*target = number
+	}
+	for _, wildcard := range numbers[n:] {
+		if wildcard != "x" && wildcard != "X" && wildcard != "*" {
+			return Version{}, 0, errors.Errorf("invalid partial version %q", partial)
+		}
+	}
+	return v, n, nil
+}
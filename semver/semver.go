@@ -0,0 +1,243 @@
+// Package semver parses and orders version codes according to Semantic
+// Versioning 2.0.0 (https://semver.org), and matches them against ranges such
+// as ">=1.0.0 <2.0.0" or "^1.2 || ~2.0.3".
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is a parsed semantic version.
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	PreRelease []string
+	Build      []string
+}
+
+// Parse parses the given code as a semantic version, e.g. "1.0.0",
+// "2.1.0-rc.1" or "1.0.0+20240101"; a leading "v" is not accepted.
+func Parse(code string) (Version, error) {
+	var version Version
+	rest := code
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		build := strings.Split(rest[i+1:], ".")
+		for _, identifier := range build {
+			if !isIdentifier(identifier) {
+				return Version{}, errors.Errorf("invalid build metadata in version %q", code)
+			}
+		}
+		version.Build, rest = build, rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		prerelease := strings.Split(rest[i+1:], ".")
+		for _, identifier := range prerelease {
+			if !isIdentifier(identifier) || (isNumeric(identifier) && len(identifier) > 1 && identifier[0] == '0') {
+				return Version{}, errors.Errorf("invalid pre-release in version %q", code)
+			}
+		}
+		version.PreRelease, rest = prerelease, rest[:i]
+	}
+	numbers := strings.Split(rest, ".")
+	if len(numbers) != 3 {
+		return Version{}, errors.Errorf("invalid version %q: expected major.minor.patch", code)
+	}
+	for i, target := range []*uint64{&version.Major, &version.Minor, &version.Patch} {
+		number, err := parseNumber(numbers[i])
+		if err != nil {
+			return Version{}, errors.Wrapf(err, "invalid version %q", code)
+		}
+		*target = number
+	}
+	return version, nil
+}
+
+// Stable returns whether the version is a release, i.e. not a pre-release.
+func (v Version) Stable() bool {
+	return len(v.PreRelease) == 0
+}
+
+// String returns the canonical representation of the version.
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + strings.Join(v.Build, ".")
+	}
+	return s
+}
+
+// Part identifies the part of a version incremented to obtain the next one.
+type Part string
+
+const (
+	// MAJOR increments the major number, for incompatible changes.
+	MAJOR Part = "major"
+	// MINOR increments the minor number, for compatible features.
+	MINOR Part = "minor"
+	// PATCH increments the patch number, for compatible fixes.
+	PATCH Part = "patch"
+	// PRERELEASE increments the pre-release number of a pre-release, or
+	// starts a pre-release of the next patch.
+	PRERELEASE Part = "prerelease"
+)
+
+// Next returns the version following v by incrementing the given part. The
+// pre-releases of a version are followed by the version itself: the next
+// major version of 2.0.0-rc.1 is 2.0.0, while that of 2.1.0-rc.1 is 3.0.0.
+// Pre-releases are numbered by a trailing numeric identifier, e.g. 2.0.0-rc.1
+// is followed by 2.0.0-rc.2; the pre-release following a release, or using
+// another identifier than the current one, is labelled with the given
+// identifier ("rc" if empty), e.g. 1.0.1-rc.0 follows 1.0.0. Build metadata is
+// dropped.
+func (v Version) Next(part Part, identifier string) (Version, error) {
+	next := Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+	switch part {
+	case MAJOR:
+		if v.Stable() || v.Minor != 0 || v.Patch != 0 {
+			next = Version{Major: v.Major + 1}
+		}
+	case MINOR:
+		if v.Stable() || v.Patch != 0 {
+			next = Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+	case PATCH:
+		if v.Stable() {
+			next.Patch++
+		}
+	case PRERELEASE:
+		if identifier != "" && !isIdentifier(identifier) {
+			return Version{}, errors.Errorf("invalid pre-release identifier %q", identifier)
+		}
+		switch {
+		case v.Stable():
+			if identifier == "" {
+				identifier = "rc"
+			}
+			next.Patch++
+			next.PreRelease = []string{identifier, "0"}
+		case identifier != "" && v.PreRelease[0] != identifier:
+			next.PreRelease = []string{identifier, "0"}
+		default:
+			next.PreRelease = append([]string{}, v.PreRelease...)
+			last := len(next.PreRelease) - 1
+			if number, err := strconv.ParseUint(next.PreRelease[last], 10, 64); err == nil {
+				next.PreRelease[last] = strconv.FormatUint(number+1, 10)
+			} else {
+				next.PreRelease = append(next.PreRelease, "0")
+			}
+		}
+	default:
+		return Version{}, errors.Errorf("invalid version part %q", part)
+	}
+	return next, nil
+}
+
+// Compare returns -1, 0 or +1 depending on whether a precedes, has the same
+// precedence as, or follows b; build metadata does not affect precedence.
+func Compare(a, b Version) int {
+	switch {
+	case a.Major != b.Major:
+		return compareNumbers(a.Major, b.Major)
+	case a.Minor != b.Minor:
+		return compareNumbers(a.Minor, b.Minor)
+	case a.Patch != b.Patch:
+		return compareNumbers(a.Patch, b.Patch)
+	}
+	return ComparePreReleases(strings.Join(a.PreRelease, "."), strings.Join(b.PreRelease, "."))
+}
+
+// ComparePreReleases compares the given dot-separated pre-release identifiers
+// of two versions having the same major, minor and patch numbers, as Compare
+// does; an empty pre-release (i.e. a release) follows all others.
+func ComparePreReleases(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			return compareNumbers(an, bn)
+		case aerr == nil:
+			// numeric identifiers precede alphanumeric ones
+			return -1
+		case berr == nil:
+			return 1
+		case as[i] < bs[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return compareNumbers(uint64(len(as)), uint64(len(bs)))
+}
+
+// parseNumber parses a major, minor or patch number, which must not have
+// leading zeroes.
+func parseNumber(s string) (uint64, error) {
+	if !isNumeric(s) || (len(s) > 1 && s[0] == '0') {
+		return 0, errors.Errorf("invalid version number %q", s)
+	}
+	number, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid version number %q", s)
+	}
+	return number, nil
+}
+
+// compareNumbers returns -1, 0 or +1 depending on whether a is less than,
+// equal to or greater than b.
+func compareNumbers(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// isIdentifier returns whether s is a non-empty pre-release or build
+// identifier, made of ASCII alphanumerics and hyphens.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isNumeric returns whether s is a non-empty sequence of decimal digits.
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package semver
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, code := range []string{"0.0.0", "1.0.10", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-0.3.7", "1.0.0-x.7.z.92", "1.0.0+20130313144700", "1.0.0-beta+exp.sha.5114f85", "1.0.0-x-y-z.--"} {
+		version, err := Parse(code)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", code, err)
+		} else if version.String() != code {
+			t.Errorf("expected %q to be formatted as such, got %q", code, version)
+		}
+	}
+	for _, code := range []string{"", "1", "1.0", "v1.0.0", "1.0.0.0", "01.0.0", "1.00.0", "1.0.-1", "1.0.0-", "1.0.0-01", "1.0.0-a..b", "1.0.0+", "1.0.0+a_b", "1.0.0 ", "latest"} {
+		if _, err := Parse(code); err == nil {
+			t.Errorf("expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	ordered := []string{
+		"0.9.9", "1.0.0-0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2",
+		"1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.2", "1.0.10", "1.1.0", "2.0.0",
+	}
+	versions := make([]Version, 0, len(ordered))
+	for i := len(ordered) - 1; i >= 0; i-- {
+		version, err := Parse(ordered[i])
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", ordered[i], err)
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return Compare(versions[i], versions[j]) < 0 })
+	sorted := make([]string, 0, len(versions))
+	for _, version := range versions {
+		sorted = append(sorted, version.String())
+	}
+	if strings.Join(sorted, " ") != strings.Join(ordered, " ") {
+		t.Fatalf("unexpected order: %v", sorted)
+	}
+
+	a, _ := Parse("1.0.0+build.1")
+	b, _ := Parse("1.0.0+build.2")
+	if Compare(a, b) != 0 {
+		t.Fatalf("expected build metadata to be ignored")
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		version    string
+		part       Part
+		identifier string
+		next       string
+	}{
+		{"1.2.3", MAJOR, "", "2.0.0"},
+		{"1.2.3", MINOR, "", "1.3.0"},
+		{"1.2.3+build", PATCH, "", "1.2.4"},
+		{"1.2.3", PRERELEASE, "", "1.2.4-rc.0"},
+		{"1.2.3", PRERELEASE, "beta", "1.2.4-beta.0"},
+		{"2.0.0-rc.1", MAJOR, "", "2.0.0"},
+		{"2.1.0-rc.1", MAJOR, "", "3.0.0"},
+		{"2.1.0-rc.1", MINOR, "", "2.1.0"},
+		{"2.1.1-rc.1", MINOR, "", "2.2.0"},
+		{"2.1.1-rc.1", PATCH, "", "2.1.1"},
+		{"2.1.1-rc.9", PRERELEASE, "", "2.1.1-rc.10"},
+		{"2.1.1-rc.9", PRERELEASE, "rc", "2.1.1-rc.10"},
+		{"2.1.1-beta.3", PRERELEASE, "rc", "2.1.1-rc.0"},
+		{"2.1.1-alpha", PRERELEASE, "", "2.1.1-alpha.0"},
+		{"0.0.0", MINOR, "", "0.1.0"},
+	}
+	for _, test := range tests {
+		version, _ := Parse(test.version)
+		next, err := version.Next(test.part, test.identifier)
+		if err != nil || next.String() != test.next {
+			t.Errorf("expected %s after %s (%s %q), got %s (%v)", test.next, test.version, test.part, test.identifier, next, err)
+		}
+	}
+	version, _ := Parse("1.0.0")
+	if _, err := version.Next("build", ""); err == nil {
+		t.Errorf("expected invalid part to be rejected")
+	}
+	if _, err := version.Next(PRERELEASE, "r.c"); err == nil {
+		t.Errorf("expected invalid pre-release identifier to be rejected")
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		expression string
+		contained  string
+		excluded   string
+	}{
+		{">=1.0.0 <2.0.0", "1.0.0 1.0.10 1.9.9", "0.9.0 2.0.0 2.0.0-rc.1 1.5.0-beta"},
+		{">= 1.0.0 < 2.0.0", "1.0.0 1.9.9", "2.0.0"},
+		{"1.2", "1.2.0 1.2.9", "1.1.9 1.3.0 1.2.0-rc.1"},
+		{"1.x || 3.0.0", "1.0.0 1.9.0 3.0.0", "2.0.0 3.0.1"},
+		{"*", "0.0.1 9.9.9", "1.0.0-rc.1"},
+		{"~1.2.3", "1.2.3 1.2.9", "1.2.2 1.3.0"},
+		{"^1.2.3", "1.2.3 1.9.0", "1.2.2 2.0.0 2.0.0-0"},
+		{"^0.2.3", "0.2.3 0.2.9", "0.3.0"},
+		{"^0.0.3", "0.0.3", "0.0.4"},
+		{">1.2", "1.3.0", "1.2.9"},
+		{"<=1.2", "1.2.9", "1.3.0"},
+		{">=2.0.0-rc.1 <2.0.0", "2.0.0-rc.1 2.0.0-rc.2", "2.0.0 1.9.0-rc.1 2.0.0-beta"},
+		{"=1.0.0", "1.0.0 1.0.0+build", "1.0.1"},
+	}
+	for _, test := range tests {
+		r, err := ParseRange(test.expression)
+		if err != nil {
+			t.Errorf("unexpected error parsing range %q: %v", test.expression, err)
+			continue
+		}
+		for _, code := range strings.Fields(test.contained) {
+			if version, _ := Parse(code); !r.Contains(version) {
+				t.Errorf("expected range %q to contain %s", test.expression, code)
+			}
+		}
+		for _, code := range strings.Fields(test.excluded) {
+			if version, _ := Parse(code); r.Contains(version) {
+				t.Errorf("expected range %q not to contain %s", test.expression, code)
+			}
+		}
+	}
+	for _, expression := range []string{">=", "=>1.0.0", "1.x.3", "1.2.3.4", "!1.0.0", ">=1.0.0 <"} {
+		if _, err := ParseRange(expression); err == nil {
+			t.Errorf("expected range %q to be rejected", expression)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// ArtifactInfo is the representation of an artifact produced by a build.
+type ArtifactInfo struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type,omitempty"`
+	Size    int64     `json:"size"`
+	Digest  string    `json:"digest"`
+	URI     string    `json:"uri,omitempty"`
+	Image   string    `json:"image,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Links   []Link    `json:"_links,omitempty"`
+}
+
+// GetArtifacts returns the list of artifacts produced by a build, sorted by
+// their name.
+func (s *Server) GetArtifacts(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	artifacts, err := s.store.GetArtifacts(build)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	results := make([]ArtifactInfo, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		results = append(results, artifactInfo(c, product.Code, version.Code, build.Number, artifact))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"artifacts": results})
+}
+
+// GetArtifact returns an artifact produced by a build, identified by its name.
+func (s *Server) GetArtifact(c *gin.Context) {
+	product, version, build, artifact, ok := s.lookupArtifact(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"artifact": artifactInfo(c, product.Code, version.Code, build.Number, artifact)})
+}
+
+// artifactRequest is the payload of artifact registration requests.
+type artifactRequest struct {
+	Name   string `json:"name" binding:"required,max=255"`
+	Type   string `json:"type" binding:"max=63"`
+	Size   int64  `json:"size" binding:"min=0"`
+	Digest string `json:"digest" binding:"required"`
+	URI    string `json:"uri" binding:"omitempty,uri,max=1024"`
+	Image  string `json:"image" binding:"max=1024"`
+}
+
+// CreateArtifact registers an artifact produced by a build; artifacts are
+// immutable, and must be deleted and registered again to be replaced.
+func (s *Server) CreateArtifact(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	var request artifactRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+	if strings.Contains(request.Name, "/") {
+		invalid(c, errors.Errorf("invalid artifact name %q: names cannot contain slashes", request.Name))
+		return
+	}
+	if !model.ValidDigest(request.Digest) {
+		invalid(c, errors.Errorf("invalid digest %q: expected sha256:<64 hexadecimal digits>", request.Digest))
+		return
+	}
+
+	artifact := model.Artifact{
+		BuildID: build.ID,
+		Name:    request.Name,
+		Type:    request.Type,
+		Size:    request.Size,
+		Digest:  request.Digest,
+		URI:     request.URI,
+		Image:   request.Image,
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateArtifact(&artifact); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "artifact", product.Code, artifactKey(product, version, build, artifact), nil, artifact)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code, "versions", version.Code, "builds", strconv.Itoa(build.Number), "artifacts", artifact.Name))
+	c.JSON(http.StatusCreated, gin.H{"artifact": artifactInfo(c, product.Code, version.Code, build.Number, artifact)})
+}
+
+// DeleteArtifact deletes an artifact of a build; the deployments which
+// reference its digest are left untouched.
+func (s *Server) DeleteArtifact(c *gin.Context) {
+	product, version, build, artifact, ok := s.lookupArtifact(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteArtifact(&artifact); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "artifact", product.Code, artifactKey(product, version, build, artifact), artifact, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// deployedArtifactsRequest is the payload of requests setting the artifacts
+// of a deployment.
+type deployedArtifactsRequest struct {
+	Digests []string `json:"digests" binding:"max=256"`
+}
+
+// PutDeploymentArtifacts replaces the list of the digests of the artifacts
+// to be deployed by a deployment; all of them must have been produced by a
+// build of the version. It requires the developer role on the environment of
+// the deployment, and the deployment to be still PENDING, so that approvers
+// (and the approval tokens of GRANTED deployments) vouch for its artifacts.
+func (s *Server) PutDeploymentArtifacts(c *gin.Context) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, deployment.Environment) {
+		return
+	}
+	if deployment.Status != model.PENDING {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("deployment %d of version %q is %s: its artifacts can only change while %s", deployment.Order, version.Code, deployment.Status, model.PENDING)})
+		return
+	}
+	current := deployment
+
+	var request deployedArtifactsRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+	for _, digest := range request.Digests {
+		if !model.ValidDigest(digest) {
+			invalid(c, errors.Errorf("invalid digest %q: expected sha256:<64 hexadecimal digits>", digest))
+			return
+		}
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.SetDeploymentArtifacts(&deployment, request.Digests); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "deployment", product.Code, deploymentKey(product, version, current), current, deployment)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployment": deployment})
+}
+
+// FindArtifact returns the artifacts having the digest in the request path,
+// along with the deployments which deployed them, across all the products the
+// user issuing the request can view.
+func (s *Server) FindArtifact(c *gin.Context) {
+	digest := c.Param("digest")
+	if !model.ValidDigest(digest) {
+		invalid(c, errors.Errorf("invalid digest %q: expected sha256:<64 hexadecimal digits>", digest))
+		return
+	}
+
+	type DeploymentInfo struct {
+		Product     string       `json:"product"`
+		Version     string       `json:"version"`
+		Order       int          `json:"order"`
+		Environment string       `json:"environment,omitempty"`
+		Status      model.Status `json:"status,omitempty"`
+		Timestamp   time.Time    `json:"timestamp,omitempty"`
+		Link        Link         `json:"_link,omitempty"`
+	}
+
+	type ArtifactMatch struct {
+		Product string `json:"product"`
+		Version string `json:"version"`
+		Build   int    `json:"build"`
+		ArtifactInfo
+	}
+
+	// the products the user can view, by ID
+	visible := map[uint]bool{}
+	allowed := func(id uint) (bool, error) {
+		if ok, found := visible[id]; found {
+			return ok, nil
+		}
+		ok, err := s.allowed(c, model.VIEWER, model.Product{ID: id}, "")
+		if err != nil {
+			return false, err
+		}
+		visible[id] = ok
+		return ok, nil
+	}
+
+	matches, err := s.store.FindArtifacts(digest)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	artifacts := make([]ArtifactMatch, 0, len(matches))
+	for _, match := range matches {
+		if ok, err := allowed(match.ProductID); err != nil {
+			abort(c, err)
+			return
+		} else if !ok {
+			continue
+		}
+		artifacts = append(artifacts, ArtifactMatch{
+			Product:      match.ProductCode,
+			Version:      match.VersionCode,
+			Build:        match.BuildNumber,
+			ArtifactInfo: artifactInfo(c, match.ProductCode, match.VersionCode, match.BuildNumber, match.Artifact),
+		})
+	}
+
+	found, err := s.store.FindDeployments(digest)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	deployments := make([]DeploymentInfo, 0, len(found))
+	for _, match := range found {
+		if ok, err := allowed(match.ProductID); err != nil {
+			abort(c, err)
+			return
+		} else if !ok {
+			continue
+		}
+		deployments = append(deployments, DeploymentInfo{
+			Product:     match.ProductCode,
+			Version:     match.VersionCode,
+			Order:       match.Order,
+			Environment: match.Environment,
+			Status:      match.Status,
+			Timestamp:   match.Timestamp,
+			Link: Link{
+				Relation: "self",
+				URI:      href(c, "products", match.ProductCode, "versions", match.VersionCode, "deployments", strconv.Itoa(match.Order)),
+			},
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"digest": digest, "artifacts": artifacts, "deployments": deployments})
+}
+
+// lookupArtifact retrieves the product, version, build and artifact addressed
+// by the request path; if any of them does not exist, the request is aborted
+// and false returned.
+func (s *Server) lookupArtifact(c *gin.Context) (model.Product, model.Version, model.Build, model.Artifact, bool) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok {
+		return model.Product{}, model.Version{}, model.Build{}, model.Artifact{}, false
+	}
+
+	artifact, err := s.store.GetArtifactByName(build, c.Param("artifactId"))
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Version{}, model.Build{}, model.Artifact{}, false
+	}
+	return product, version, build, artifact, true
+}
+
+// artifactKey returns the key identifying an artifact in the audit log.
+func artifactKey(product model.Product, version model.Version, build model.Build, artifact model.Artifact) string {
+	return buildKey(product, version, build) + "/" + artifact.Name
+}
+
+// artifactInfo returns the representation of the given artifact, produced by
+// the given build of a product version.
+func artifactInfo(c *gin.Context, product, version string, build int, artifact model.Artifact) ArtifactInfo {
+	return ArtifactInfo{
+		Name:    artifact.Name,
+		Type:    artifact.Type,
+		Size:    artifact.Size,
+		Digest:  artifact.Digest,
+		URI:     artifact.URI,
+		Image:   artifact.Image,
+		Created: artifact.CreatedAt,
+		Links: []Link{
+			{
+				Relation: "self",
+				URI:      href(c, "products", product, "versions", version, "builds", strconv.Itoa(build), "artifacts", artifact.Name),
+			},
+			{
+				Relation: "build",
+				URI:      href(c, "products", product, "versions", version, "builds", strconv.Itoa(build)),
+			},
+			{
+				Relation: "digest",
+				URI:      href(c, "artifacts", artifact.Digest),
+			},
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// AssignmentInfo is the representation of a role assignment, where the
+// product is identified by its code.
+type AssignmentInfo struct {
+	ID          uint       `json:"id"`
+	User        string     `json:"user"`
+	Product     string     `json:"product,omitempty"`
+	Environment string     `json:"environment,omitempty"`
+	Role        model.Role `json:"role"`
+	Self        Link       `json:"_link,omitempty"`
+}
+
+// GetAssignments returns the list of role assignments; administrators of all
+// products see all assignments, other users only their own.
+func (s *Server) GetAssignments(c *gin.Context) {
+	user, _ := auth.User(c)
+	admin, err := s.allowed(c, model.ADMIN, model.Product{}, "")
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if admin {
+		user = c.Query("user")
+	}
+
+	assignments, err := s.store.GetAssignments(user)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	codes, err := s.productCodes()
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]AssignmentInfo, 0, len(assignments))
+	for _, assignment := range assignments {
+		results = append(results, assignmentInfo(c, assignment, codes))
+	}
+	c.JSON(http.StatusOK, gin.H{"assignments": results})
+}
+
+// assignmentRequest is the payload of role assignment creation requests; an
+// empty product or environment stands for all products or environments.
+type assignmentRequest struct {
+	User        string     `json:"user" binding:"required,max=255"`
+	Product     string     `json:"product" binding:"max=63"`
+	Environment string     `json:"environment" binding:"max=63"`
+	Role        model.Role `json:"role" binding:"required,oneof=VIEWER DEVELOPER RELEASE_MANAGER ADMIN"`
+}
+
+// CreateAssignment assigns a role to a user; only administrators of the
+// product (or of all products, for assignments spanning all products) can
+// assign roles.
+func (s *Server) CreateAssignment(c *gin.Context) {
+	var request assignmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	var product model.Product
+	if request.Product != "" {
+		var err error
+		if product, err = s.store.GetProductByCode(request.Product); err != nil {
+			if errors.Cause(err) == model.ErrorNotFound {
+				err = errors.Wrapf(model.ErrorConstraint, "reference to non-existing product %q", request.Product)
+			}
+			abort(c, err)
+			return
+		}
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	assignment := model.Assignment{
+		User:        request.User,
+		ProductID:   product.ID,
+		Environment: request.Environment,
+		Role:        request.Role,
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateAssignment(&assignment); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "assignment", product.Code, strconv.FormatUint(uint64(assignment.ID), 10), nil, assignment)
+	}) {
+		return
+	}
+
+	result := assignmentInfo(c, assignment, map[uint]string{product.ID: product.Code})
+	c.Header("Location", result.Self.URI)
+	c.JSON(http.StatusCreated, gin.H{"assignment": result})
+}
+
+// DeleteAssignment revokes a role assignment; only administrators of the
+// product (or of all products, for assignments spanning all products) can
+// revoke roles.
+func (s *Server) DeleteAssignment(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("assignmentId"), 10, 0)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid role assignment id"})
+		return
+	}
+
+	assignment, err := s.store.GetAssignment(uint(id))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, model.Product{ID: assignment.ProductID}, "") {
+		return
+	}
+
+	codes, err := s.productCodes()
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteAssignment(&assignment); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "assignment", codes[assignment.ProductID], c.Param("assignmentId"), assignment, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// productCodes returns the codes of all products, by ID.
+func (s *Server) productCodes() (map[uint]string, error) {
+	products, err := s.store.GetProducts()
+	if err != nil {
+		return nil, err
+	}
+	codes := make(map[uint]string, len(products))
+	for _, product := range products {
+		codes[product.ID] = product.Code
+	}
+	return codes, nil
+}
+
+// assignmentInfo returns the representation of a role assignment, given the
+// codes of the products by ID.
+func assignmentInfo(c *gin.Context, assignment model.Assignment, codes map[uint]string) AssignmentInfo {
+	return AssignmentInfo{
+		ID:          assignment.ID,
+		User:        assignment.User,
+		Product:     codes[assignment.ProductID],
+		Environment: assignment.Environment,
+		Role:        assignment.Role,
+		Self: Link{
+			Relation: "self",
+			URI:      href(c, "assignments", strconv.FormatUint(uint64(assignment.ID), 10)),
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// AuditInfo is the representation of an audit record.
+type AuditInfo struct {
+	ID        uint            `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	User      string          `json:"user,omitempty"`
+	Action    model.Action    `json:"action"`
+	Entity    string          `json:"entity"`
+	Product   string          `json:"product,omitempty"`
+	Key       string          `json:"key"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Previous  string          `json:"previous,omitempty"`
+	Hash      string          `json:"hash"`
+}
+
+// auditQuery is the query string of audit log requests; From and To are
+// RFC 3339 timestamps.
+type auditQuery struct {
+	Product string    `form:"product"`
+	User    string    `form:"user"`
+	From    time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To      time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// GetAudit returns the audit log, oldest record first, optionally restricted
+// to a product, a user and a time range; only administrators of the product
+// (or of all products, if no product is given) can read it.
+func (s *Server) GetAudit(c *gin.Context) {
+	var query auditQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	var product model.Product
+	if query.Product != "" {
+		var err error
+		if product, err = s.store.GetProductByCode(query.Product); err != nil && errors.Cause(err) != model.ErrorNotFound {
+			abort(c, err)
+			return
+		}
+		// the records about deleted products are only available to the
+		// administrators of all products
+		product.Code = query.Product
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	records, err := s.store.GetAuditRecords(model.AuditFilter{
+		Product: query.Product,
+		User:    query.User,
+		Since:   query.From,
+		Until:   query.To,
+	})
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]AuditInfo, 0, len(records))
+	for _, record := range records {
+		result := AuditInfo{
+			ID:        record.ID,
+			Timestamp: record.Timestamp,
+			User:      record.User,
+			Action:    record.Action,
+			Entity:    record.Entity,
+			Product:   record.Product,
+			Key:       record.Key,
+			Previous:  record.Previous,
+			Hash:      record.Hash,
+		}
+		if record.Before != "" {
+			result.Before = json.RawMessage(record.Before)
+		}
+		if record.After != "" {
+			result.After = json.RawMessage(record.After)
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusOK, gin.H{"audit": results})
+}
+
+// auditor appends to the audit log the record of a change made by the user
+// issuing a request to an entity of a product, identified by key; before and
+// after are the states of the entity, nil when it is being created or deleted.
+type auditor func(action model.Action, entity string, product string, key string, before interface{}, after interface{}) error
+
+// change makes a change to the store along with the audit records it appends
+// through audit, in a single transaction, so that no change is kept without
+// being audited. The events generated by the change, if any, are then queued
+// for the listeners of the server, which are notified in the order of the
+// records, as event streams resume after the ID of the last event received,
+// once the change is no longer holding up other ones. If the change fails,
+// the request is aborted and false returned; if it cannot be audited, it is
+// rolled back and the request aborted with an Internal Server Error status
+// code.
+func (s *Server) change(c *gin.Context, change func(store model.Store, audit auditor) error) bool {
+	user, _ := auth.User(c)
+	var records []model.AuditRecord
+	s.auditing.Lock()
+	defer s.auditing.Unlock()
+	err := s.store.Atomically(func(store model.Store) error {
+		return change(store, func(action model.Action, entity string, product string, key string, before interface{}, after interface{}) error {
+			record, err := model.NewAuditRecord(user, action, entity, product, key, before, after)
+			if err == nil {
+				err = store.AppendAuditRecord(&record)
+			}
+			if err != nil {
+				log.Printf("error auditing %s of %s %q of product %q by %q: %v\n", action, entity, key, product, user, err)
+				return errors.Errorf("error auditing %s of %s %q: %v", action, entity, key, err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		abort(c, err)
+		return false
+	}
+	var events []model.Event
+	for _, record := range records {
+		if event, ok := model.NewEvent(record); ok {
+			events = append(events, event)
+		}
+	}
+	s.publisher.enqueue(events...)
+	return true
+}
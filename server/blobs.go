@@ -0,0 +1,320 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/blobs"
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// collectGrace is the minimum age of the blobs removed by garbage collection,
+// so that the contents being uploaded are not lost.
+var collectGrace = time.Hour
+
+// BlobInfo is the representation of the stored contents of an artifact.
+type BlobInfo struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	Links  []Link `json:"_links,omitempty"`
+}
+
+// StorageInfo is the representation of the storage used by a product; a
+// Quota of 0 means that the product storage is not limited.
+type StorageInfo struct {
+	Quota int64  `json:"quota"`
+	Used  int64  `json:"used"`
+	Blobs int    `json:"blobs"`
+	Links []Link `json:"_links,omitempty"`
+}
+
+// UploadArtifact stores the contents of a registered artifact, which must
+// match its digest and, unless it is 0, its size; contents already stored for
+// another artifact having the same digest are not uploaded again. Uploads
+// which would exceed the storage quota of the product are rejected, and the
+// uploads of products with a quota are serialised for that purpose.
+func (s *Server) UploadArtifact(c *gin.Context) {
+	if !s.storing(c) {
+		return
+	}
+	product, version, build, artifact, ok := s.lookupArtifact(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	quota := s.quotaOf(product)
+	if quota > 0 {
+		lock, _ := s.uploads.LoadOrStore(product.ID, &sync.Mutex{})
+		lock.(*sync.Mutex).Lock()
+		defer lock.(*sync.Mutex).Unlock()
+	}
+	if size, err := s.blobs.Stat(artifact.Digest); err == nil {
+		if artifact.Size > 0 && size != artifact.Size {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("contents of artifact %q are %d bytes long, not %d", artifact.Name, size, artifact.Size)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"blob": blobInfo(c, product.Code, version.Code, build.Number, artifact, size)})
+		return
+	} else if errors.Cause(err) != blobs.ErrorNotFound {
+		abort(c, err)
+		return
+	}
+
+	limit, expected := int64(-1), int64(-1)
+	if artifact.Size > 0 {
+		expected = artifact.Size
+	}
+	if quota > 0 {
+		used, _, err := s.usage(product)
+		if err != nil {
+			abort(c, err)
+			return
+		}
+		if limit = quota - used; limit < 0 {
+			limit = 0
+		}
+		if artifact.Size > limit || c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("storage quota of product %q exceeded: %d of %d bytes used", product.Code, used, quota)})
+			return
+		}
+	}
+
+	size, err := s.blobs.Put(artifact.Digest, c.Request.Body, expected, limit)
+	switch errors.Cause(err) {
+	case nil:
+	case blobs.ErrorTooLarge:
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case blobs.ErrorSizeMismatch, blobs.ErrorDigestMismatch:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	default:
+		abort(c, err)
+		return
+	}
+	info := blobInfo(c, product.Code, version.Code, build.Number, artifact, size)
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		return audit(model.CREATE, "blob", product.Code, artifactKey(product, version, build, artifact), nil, gin.H{"digest": info.Digest, "size": info.Size})
+	}) {
+		return
+	}
+
+	c.Header("Location", info.Links[0].URI)
+	c.JSON(http.StatusCreated, gin.H{"blob": info})
+}
+
+// DownloadArtifact returns the stored contents of an artifact; HEAD requests
+// only return their size and digest, and ranges of the contents can be
+// requested.
+func (s *Server) DownloadArtifact(c *gin.Context) {
+	if !s.storing(c) {
+		return
+	}
+	product, _, _, artifact, ok := s.lookupArtifact(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	s.serveBlob(c, artifact.Digest, artifact.Name)
+}
+
+// GetBlob returns the stored contents having the digest in the request path,
+// provided that the user issuing the request can view one of the products
+// having an artifact with that digest.
+func (s *Server) GetBlob(c *gin.Context) {
+	if !s.storing(c) {
+		return
+	}
+	digest := c.Param("digest")
+	if !model.ValidDigest(digest) {
+		invalid(c, errors.Errorf("invalid digest %q: expected sha256:<64 hexadecimal digits>", digest))
+		return
+	}
+
+	matches, err := s.store.FindArtifacts(digest)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	for _, match := range matches {
+		if ok, err := s.allowed(c, model.VIEWER, model.Product{ID: match.ProductID}, ""); err != nil {
+			abort(c, err)
+			return
+		} else if ok {
+			s.serveBlob(c, digest, match.Name)
+			return
+		}
+	}
+	abort(c, errors.Wrapf(model.ErrorNotFound, "no artifact has digest %q", digest))
+}
+
+// CollectBlobs removes the stored contents which no artifact nor deployment
+// refers to any longer, as deployed artifacts keep their contents even after
+// being deleted; it requires the administrator role on all products.
+func (s *Server) CollectBlobs(c *gin.Context) {
+	if !s.storing(c) || !s.allow(c, model.ADMIN, model.Product{}, "") {
+		return
+	}
+
+	digests, err := s.store.GetArtifactDigests(model.Product{})
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	deployed, err := s.store.GetDeployedDigests()
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	referenced := map[string]bool{}
+	for _, digest := range append(digests, deployed...) {
+		referenced[digest] = true
+	}
+	removed, freed, err := s.blobs.Collect(func(digest string) bool { return referenced[digest] }, collectGrace)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	result := gin.H{"removed": removed, "freed": freed}
+	if removed > 0 && !s.change(c, func(store model.Store, audit auditor) error {
+		return audit(model.DELETE, "blob", "", "*", nil, result)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetStorage returns the storage used by the contents of the artifacts of a
+// product, along with its quota.
+func (s *Server) GetStorage(c *gin.Context) {
+	if !s.storing(c) {
+		return
+	}
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	used, count, err := s.usage(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"storage": StorageInfo{
+		Quota: s.quotaOf(product),
+		Used:  used,
+		Blobs: count,
+		Links: []Link{
+			{
+				Relation: "self",
+				URI:      href(c, "products", product.Code, "storage"),
+			},
+			{
+				Relation: "product",
+				URI:      href(c, "products", product.Code),
+			},
+		},
+	}})
+}
+
+// storing checks that the server stores the contents of artifacts; if not,
+// the request is aborted and false returned.
+func (s *Server) storing(c *gin.Context) bool {
+	if s.blobs == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "the server does not store artifact contents"})
+		return false
+	}
+	return true
+}
+
+// allowQuota checks that the user issuing the request can change the storage
+// quota of a product from the current to the requested one, which requires
+// the administrator role on all products; if not, the request is aborted and
+// false returned.
+func (s *Server) allowQuota(c *gin.Context, current model.Product, product model.Product) bool {
+	return product.Quota == current.Quota || s.allow(c, model.ADMIN, model.Product{}, "")
+}
+
+// quotaOf returns the storage quota of the given product, in bytes; 0 means
+// that its storage is not limited.
+func (s *Server) quotaOf(product model.Product) int64 {
+	if product.Quota > 0 {
+		return product.Quota
+	}
+	return s.quota
+}
+
+// usage returns the number of bytes and blobs stored for the artifacts of the
+// given product; blobs shared with other products count for each of them.
+func (s *Server) usage(product model.Product) (int64, int, error) {
+	digests, err := s.store.GetArtifactDigests(product)
+	if err != nil {
+		return 0, 0, err
+	}
+	used, count := int64(0), 0
+	for _, digest := range digests {
+		size, err := s.blobs.Stat(digest)
+		if errors.Cause(err) == blobs.ErrorNotFound {
+			continue
+		} else if err != nil {
+			return 0, 0, err
+		}
+		used += size
+		count++
+	}
+	return used, count, nil
+}
+
+// serveBlob writes the blob having the given digest as the contents of the
+// file having the given name; if the blob is not stored, the request is
+// aborted with a Not Found status code.
+func (s *Server) serveBlob(c *gin.Context, digest string, name string) {
+	file, info, err := s.blobs.Open(digest)
+	if errors.Cause(err) == blobs.ErrorNotFound {
+		abort(c, errors.Wrapf(model.ErrorNotFound, "contents of artifact %q are not stored", name))
+		return
+	} else if err != nil {
+		abort(c, err)
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Header("ETag", strconv.Quote(digest))
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), file)
+}
+
+// blobInfo returns the representation of the stored contents of the given
+// artifact.
+func blobInfo(c *gin.Context, product, version string, build int, artifact model.Artifact, size int64) BlobInfo {
+	return BlobInfo{
+		Digest: artifact.Digest,
+		Size:   size,
+		Links: []Link{
+			{
+				Relation: "self",
+				URI:      href(c, "products", product, "versions", version, "builds", strconv.Itoa(build), "artifacts", artifact.Name, "content"),
+			},
+			{
+				Relation: "artifact",
+				URI:      href(c, "products", product, "versions", version, "builds", strconv.Itoa(build), "artifacts", artifact.Name),
+			},
+			{
+				Relation: "blob",
+				URI:      href(c, "blobs", artifact.Digest),
+			},
+		},
+	}
+}
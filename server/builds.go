@@ -0,0 +1,288 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+)
+
+// BuildInfo is the representation of a build of a product version.
+type BuildInfo struct {
+	Number   int               `json:"number"`
+	Commit   string            `json:"commit,omitempty"`
+	Status   model.BuildStatus `json:"status,omitempty"`
+	Started  time.Time         `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	JobURL   string            `json:"jobUrl,omitempty"`
+	Log      string            `json:"log,omitempty"`
+	Links    []Link            `json:"_links,omitempty"`
+}
+
+// GetBuilds returns the list of builds of a product version, sorted by their
+// number.
+func (s *Server) GetBuilds(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	builds, err := s.store.GetBuilds(version)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	results := make([]BuildInfo, 0, len(builds))
+	for _, build := range builds {
+		info := buildInfo(c, product, version, build)
+		info.Log = ""
+		results = append(results, info)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"builds": results})
+}
+
+// GetBuild returns a build of a product version, identified by its number,
+// along with the excerpt of its log.
+func (s *Server) GetBuild(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"build": buildInfo(c, product, version, build)})
+}
+
+// buildRequest is the payload of build registration and replacement
+// requests; Started defaults to the time of the registration.
+type buildRequest struct {
+	Number   int               `json:"number" binding:"required,min=1"`
+	Commit   string            `json:"commit" binding:"omitempty,hexadecimal,max=64"`
+	Status   model.BuildStatus `json:"status" binding:"omitempty,oneof=RUNNING SUCCEEDED FAILED ABORTED"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	JobURL   string            `json:"jobUrl" binding:"omitempty,url,max=1024"`
+	Log      string            `json:"log" binding:"max=4096"`
+}
+
+// buildPatch is the payload of build partial update requests, e.g. to record
+// the outcome of a build once finished; only the provided fields are
+// modified.
+type buildPatch struct {
+	Number   *int               `json:"number" binding:"omitempty,min=1"`
+	Commit   *string            `json:"commit" binding:"omitempty,hexadecimal,max=64"`
+	Status   *model.BuildStatus `json:"status" binding:"omitempty,oneof=RUNNING SUCCEEDED FAILED ABORTED"`
+	Started  *time.Time         `json:"started"`
+	Finished *time.Time         `json:"finished"`
+	JobURL   *string            `json:"jobUrl" binding:"omitempty,url,max=1024"`
+	Log      *string            `json:"log" binding:"omitempty,max=4096"`
+}
+
+// CreateBuild registers a new build of a product version; new builds are
+// RUNNING unless otherwise specified.
+func (s *Server) CreateBuild(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	var request buildRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	build := model.Build{
+		VersionID:  version.ID,
+		Number:     request.Number,
+		Commit:     request.Commit,
+		Status:     request.Status,
+		StartedAt:  request.Started,
+		FinishedAt: request.Finished,
+		JobURL:     request.JobURL,
+		Log:        request.Log,
+	}
+	if build.StartedAt.IsZero() {
+		build.StartedAt = time.Now()
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateBuild(&build); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "build", product.Code, buildKey(product, version, build), nil, build)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code, "versions", version.Code, "builds", strconv.Itoa(build.Number)))
+	c.JSON(http.StatusCreated, gin.H{"build": buildInfo(c, product, version, build)})
+}
+
+// UpdateBuild replaces all the attributes of an existing build.
+func (s *Server) UpdateBuild(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+	current := build
+
+	var request buildRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	build.Number = request.Number
+	build.Commit = request.Commit
+	build.Status = request.Status
+	if build.Status == "" {
+		build.Status = model.BUILD_RUNNING
+	}
+	build.StartedAt = request.Started
+	if build.StartedAt.IsZero() {
+		build.StartedAt = current.StartedAt
+	}
+	build.FinishedAt = request.Finished
+	build.JobURL = request.JobURL
+	build.Log = request.Log
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateBuild(&build); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "build", product.Code, buildKey(product, version, current), current, build)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"build": buildInfo(c, product, version, build)})
+}
+
+// PatchBuild modifies some of the attributes of an existing build.
+func (s *Server) PatchBuild(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+	current := build
+
+	var patch buildPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	if patch.Number != nil {
+		build.Number = *patch.Number
+	}
+	if patch.Commit != nil {
+		build.Commit = *patch.Commit
+	}
+	if patch.Status != nil {
+		build.Status = *patch.Status
+	}
+	if patch.Started != nil {
+		build.StartedAt = *patch.Started
+	}
+	if patch.Finished != nil {
+		build.FinishedAt = *patch.Finished
+	}
+	if patch.JobURL != nil {
+		build.JobURL = *patch.JobURL
+	}
+	if patch.Log != nil {
+		build.Log = *patch.Log
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateBuild(&build); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "build", product.Code, buildKey(product, version, current), current, build)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"build": buildInfo(c, product, version, build)})
+}
+
+// DeleteBuild deletes a build of a product version.
+func (s *Server) DeleteBuild(c *gin.Context) {
+	product, version, build, ok := s.lookupBuild(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteBuild(&build); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "build", product.Code, buildKey(product, version, build), build, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// lookupBuild retrieves the product, version and build addressed by the
+// request path; if any of them does not exist, the request is aborted and
+// false returned.
+func (s *Server) lookupBuild(c *gin.Context) (model.Product, model.Version, model.Build, bool) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok {
+		return model.Product{}, model.Version{}, model.Build{}, false
+	}
+
+	number, err := strconv.Atoi(c.Param("buildId"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid build number"})
+		return model.Product{}, model.Version{}, model.Build{}, false
+	}
+
+	build, err := s.store.GetBuildByNumber(version, number)
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Version{}, model.Build{}, false
+	}
+	return product, version, build, true
+}
+
+// buildKey returns the key identifying a build in the audit log.
+func buildKey(product model.Product, version model.Version, build model.Build) string {
+	return versionKey(product, version) + "/builds/" + strconv.Itoa(build.Number)
+}
+
+// buildInfo returns the representation of the given build.
+func buildInfo(c *gin.Context, product model.Product, version model.Version, build model.Build) BuildInfo {
+	info := BuildInfo{
+		Number:  build.Number,
+		Commit:  build.Commit,
+		Status:  build.Status,
+		Started: build.StartedAt,
+		JobURL:  build.JobURL,
+		Log:     build.Log,
+		Links: []Link{
+			{
+				Relation: "self",
+				URI:      href(c, "products", product.Code, "versions", version.Code, "builds", strconv.Itoa(build.Number)),
+			},
+			{
+				Relation: "collection",
+				URI:      href(c, "products", product.Code, "versions", version.Code, "builds"),
+			},
+			{
+				Relation: "artifacts",
+				URI:      href(c, "products", product.Code, "versions", version.Code, "builds", strconv.Itoa(build.Number), "artifacts"),
+			},
+			{
+				Relation: "version",
+				URI:      href(c, "products", product.Code, "versions", version.Code),
+			},
+		},
+	}
+	if !build.FinishedAt.IsZero() {
+		info.Finished = &build.FinishedAt
+	}
+	return info
+}
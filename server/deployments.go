@@ -0,0 +1,510 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// GetDeployments returns the list of deployments of a product version.
+func (s *Server) GetDeployments(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	type DeploymentInfo struct {
+		Order       int            `json:"order"`
+		Environment string         `json:"environment,omitempty"`
+		Status      model.Status   `json:"status,omitempty"`
+		GrantedBy   string         `json:"grantedBy,omitempty"`
+		Timestamp   time.Time      `json:"timestamp,omitempty"`
+		Approvals   []ApprovalInfo `json:"approvals,omitempty"`
+		Links       []Link         `json:"_links,omitempty"`
+	}
+
+	deployments := make([]DeploymentInfo, 0, len(version.Deployments))
+	for _, deployment := range version.Deployments {
+		deployments = append(deployments, DeploymentInfo{
+			Order:       deployment.Order,
+			Environment: deployment.Environment,
+			Status:      deployment.Status,
+			GrantedBy:   deployment.GrantedBy,
+			Timestamp:   deployment.Timestamp,
+			Approvals:   approvalInfos(deployment.Approvals),
+			Links:       deploymentLinks(c, product, version, deployment),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployments": deployments})
+}
+
+// GetDeployment returns a deployment of a product version, identified by its
+// order.
+func (s *Server) GetDeployment(c *gin.Context) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	type DeploymentInfo struct {
+		Order       int                      `json:"order"`
+		Environment string                   `json:"environment,omitempty"`
+		Status      model.Status             `json:"status,omitempty"`
+		GrantedBy   string                   `json:"grantedBy,omitempty"`
+		Timestamp   time.Time                `json:"timestamp,omitempty"`
+		Approvals   []ApprovalInfo           `json:"approvals,omitempty"`
+		Transitions []TransitionInfo         `json:"transitions,omitempty"`
+		Artifacts   []model.DeployedArtifact `json:"artifacts,omitempty"`
+		Links       []Link                   `json:"_links,omitempty"`
+	}
+
+	result := DeploymentInfo{
+		Order:       deployment.Order,
+		Environment: deployment.Environment,
+		Status:      deployment.Status,
+		GrantedBy:   deployment.GrantedBy,
+		Timestamp:   deployment.Timestamp,
+		Approvals:   approvalInfos(deployment.Approvals),
+		Transitions: transitionInfos(deployment.Transitions),
+		Artifacts:   deployment.Artifacts,
+		Links:       deploymentLinks(c, product, version, deployment),
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployment": result})
+}
+
+// ApproveDeployment records the approval of a deployment by the authenticated
+// user, who must be a release manager of the product on the deployment
+// environment; the deployment is granted once it has collected the approvals
+// required by the policy of the product for the environment. Approvals are
+// rejected until the version has been deployed onto the previous stage of the
+// promotion pipeline of the product, if any.
+func (s *Server) ApproveDeployment(c *gin.Context) {
+	user, ok := auth.User(c)
+	if !ok {
+		auth.Unauthorized(c, s.authenticators, errors.New("approvals require an authenticated user"))
+		return
+	}
+
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok || !s.allow(c, model.RELEASE_MANAGER, product, deployment.Environment) || !s.allowPromotion(c, product, version, deployment) {
+		return
+	}
+
+	policy, err := s.policy(product, deployment.Environment)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if policy.ExcludeAuthor && version.Author == user {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("user %q is the author of version %q and cannot approve its deployments onto %q", user, version.Code, deployment.Environment)})
+		return
+	}
+
+	current := deployment
+	approval := model.Approval{User: user, Timestamp: time.Now()}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.ApproveDeployment(&deployment, &approval, policy.Approvals); err != nil {
+			return err
+		}
+		return audit(model.APPROVE, "deployment", product.Code, deploymentKey(product, version, current), current, deployment)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"deployment": deployment})
+}
+
+// transitionRequest is the payload of deployment status change requests.
+type transitionRequest struct {
+	Reason string `json:"reason" binding:"required,max=1024"`
+}
+
+// RejectDeployment denies the authorisation of a PENDING deployment, or
+// withdraws it from a GRANTED one; it requires the release manager role.
+func (s *Server) RejectDeployment(c *gin.Context) {
+	s.transition(c, model.REJECTED)
+}
+
+// FailDeployment records that a GRANTED deployment could not be carried out,
+// or that a PERFORMED one turned out to be faulty.
+func (s *Server) FailDeployment(c *gin.Context) {
+	s.transition(c, model.FAILED)
+}
+
+// RollbackDeployment records that a PERFORMED or FAILED deployment has been
+// reverted.
+func (s *Server) RollbackDeployment(c *gin.Context) {
+	s.transition(c, model.ROLLED_BACK)
+}
+
+// CancelDeployment records that a PENDING or GRANTED deployment is no longer
+// going to be carried out.
+func (s *Server) CancelDeployment(c *gin.Context) {
+	s.transition(c, model.CANCELLED)
+}
+
+// transition moves the deployment addressed by the request to the given
+// status, recording the reason provided in the request.
+func (s *Server) transition(c *gin.Context, status model.Status) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok {
+		return
+	}
+
+	var request transitionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	after := deployment
+	after.Status = status
+	if !s.allowChange(c, product, deployment, after) {
+		return
+	}
+	if deployment.Status == status {
+		abort(c, errors.Wrapf(model.ErrorConstraint, "deployment %d is already %s", deployment.Order, status))
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := saveDeployment(c, store, deployment, &after, request.Reason); err != nil {
+			return err
+		}
+		return audit(model.TRANSITION, "deployment", product.Code, deploymentKey(product, version, deployment), deployment, after)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployment": after})
+}
+
+// deploymentRequest is the payload of deployment creation and replacement
+// requests; when replacing a deployment, its Status is only modified if
+// provided, and the Reason is recorded along with the status transition.
+// Deployments can only be GRANTED through their approval, so that the
+// approval policies cannot be bypassed.
+type deploymentRequest struct {
+	Order       *int          `json:"order" binding:"required,min=0"`
+	Environment string        `json:"environment" binding:"required,max=63"`
+	Status      *model.Status `json:"status" binding:"omitempty,oneof=PENDING PERFORMED REJECTED FAILED ROLLED_BACK CANCELLED"`
+	Reason      string        `json:"reason" binding:"max=1024"`
+}
+
+// deploymentPatch is the payload of deployment partial update requests; only
+// the provided fields are modified, and the Reason is recorded along with the
+// status transition, if any.
+type deploymentPatch struct {
+	Order       *int          `json:"order" binding:"omitempty,min=0"`
+	Environment *string       `json:"environment" binding:"omitempty,min=1,max=63"`
+	Status      *model.Status `json:"status" binding:"omitempty,oneof=PENDING PERFORMED REJECTED FAILED ROLLED_BACK CANCELLED"`
+	Reason      string        `json:"reason" binding:"max=1024"`
+}
+
+// CreateDeployment creates a new deployment of a product version; new
+// deployments are always PENDING, and any other status is rejected.
+func (s *Server) CreateDeployment(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok {
+		return
+	}
+
+	var request deploymentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	deployment := model.Deployment{
+		VersionID:   version.ID,
+		Order:       *request.Order,
+		Environment: request.Environment,
+	}
+	if !s.allowChange(c, product, model.Deployment{}, deployment) {
+		return
+	}
+	if request.Status != nil && *request.Status != model.PENDING {
+		abort(c, errors.Wrapf(model.ErrorConstraint, "new deployments are %s, not %s", model.PENDING, *request.Status))
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateDeployment(&deployment); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "deployment", product.Code, deploymentKey(product, version, deployment), nil, deployment)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code, "versions", version.Code, "deployments", strconv.Itoa(deployment.Order)))
+	c.JSON(http.StatusCreated, gin.H{"deployment": deployment})
+}
+
+// UpdateDeployment replaces the attributes of an existing deployment; its
+// status can only be changed as allowed by the deployment state machine, and
+// its order and environment only while it is PENDING.
+func (s *Server) UpdateDeployment(c *gin.Context) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok {
+		return
+	}
+	current := deployment
+
+	var request deploymentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	deployment.Order = *request.Order
+	deployment.Environment = request.Environment
+	if request.Status != nil {
+		deployment.Status = *request.Status
+	}
+	if !s.allowChange(c, product, current, deployment) {
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := saveDeployment(c, store, current, &deployment, request.Reason); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "deployment", product.Code, deploymentKey(product, version, current), current, deployment)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployment": deployment})
+}
+
+// PatchDeployment modifies some of the attributes of an existing deployment;
+// its status can only be changed as allowed by the deployment state machine,
+// and its order and environment only while it is PENDING.
+func (s *Server) PatchDeployment(c *gin.Context) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok {
+		return
+	}
+	current := deployment
+
+	var patch deploymentPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	if patch.Order != nil {
+		deployment.Order = *patch.Order
+	}
+	if patch.Environment != nil {
+		deployment.Environment = *patch.Environment
+	}
+	if patch.Status != nil {
+		deployment.Status = *patch.Status
+	}
+	if !s.allowChange(c, product, current, deployment) {
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := saveDeployment(c, store, current, &deployment, patch.Reason); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "deployment", product.Code, deploymentKey(product, version, current), current, deployment)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deployment": deployment})
+}
+
+// DeleteDeployment deletes a deployment of a product version.
+func (s *Server) DeleteDeployment(c *gin.Context) {
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok || !s.allowChange(c, product, deployment, model.Deployment{}) {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteDeployment(&deployment); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "deployment", product.Code, deploymentKey(product, version, deployment), deployment, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ApprovalInfo is the representation of the approval of a deployment.
+type ApprovalInfo struct {
+	User      string    `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// approvalInfos returns the representations of the given approvals.
+func approvalInfos(approvals []model.Approval) []ApprovalInfo {
+	if len(approvals) == 0 {
+		return nil
+	}
+	infos := make([]ApprovalInfo, 0, len(approvals))
+	for _, approval := range approvals {
+		infos = append(infos, ApprovalInfo{User: approval.User, Timestamp: approval.Timestamp})
+	}
+	return infos
+}
+
+// TransitionInfo is the representation of a change of the status of a
+// deployment.
+type TransitionInfo struct {
+	From      model.Status `json:"from"`
+	To        model.Status `json:"to"`
+	User      string       `json:"user,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+// transitionInfos returns the representations of the given status
+// transitions.
+func transitionInfos(transitions []model.Transition) []TransitionInfo {
+	if len(transitions) == 0 {
+		return nil
+	}
+	infos := make([]TransitionInfo, 0, len(transitions))
+	for _, transition := range transitions {
+		infos = append(infos, TransitionInfo{
+			From:      transition.From,
+			To:        transition.To,
+			User:      transition.User,
+			Reason:    transition.Reason,
+			Timestamp: transition.Timestamp,
+		})
+	}
+	return infos
+}
+
+// saveDeployment stores the changes the request makes to a deployment at
+// once in the given store: its status is moved through the deployment state
+// machine, recording the transition along with the given reason and the user
+// issuing the request, whereas its order and environment are updated
+// directly, provided that it is still PENDING, withdrawing its approvals. It
+// returns an error if the change is not allowed, or it cannot be stored.
+func saveDeployment(c *gin.Context, store model.Store, current model.Deployment, deployment *model.Deployment, reason string) error {
+	var transition *model.Transition
+	if status := deployment.Status; status != current.Status {
+		if !current.Status.CanTransition(status) {
+			return errors.Wrapf(model.ErrorConstraint, "deployment %d cannot move from %s to %s", current.Order, current.Status, status)
+		}
+		user, _ := auth.User(c)
+		transition = &model.Transition{To: status, User: user, Reason: reason, Timestamp: time.Now()}
+	} else if deployment.Order == current.Order && deployment.Environment == current.Environment {
+		return nil
+	}
+
+	return store.ChangeDeployment(deployment, transition)
+}
+
+// statusRoles maps the statuses that can only be set by users having more
+// than the developer role onto the role they require; GRANTED is not among
+// them, as it can only be reached through ApproveDeployment.
+var statusRoles = map[model.Status]model.Role{
+	model.REJECTED: model.RELEASE_MANAGER,
+}
+
+// allowChange checks that the user issuing the request can turn a deployment
+// of a version into another one, where an empty deployment stands for a
+// deployment being created or deleted: this requires the developer role on
+// the environments of both, or the role given by statusRoles on the resulting
+// environment if the change sets a status there. If not allowed, the request
+// is aborted and false returned.
+func (s *Server) allowChange(c *gin.Context, product model.Product, before model.Deployment, after model.Deployment) bool {
+	if before.Environment != "" && !s.allow(c, model.DEVELOPER, product, before.Environment) {
+		return false
+	}
+	if after.Environment == "" {
+		return true
+	}
+	role, ok := statusRoles[after.Status]
+	if !ok || before.Status == after.Status && before.Environment == after.Environment {
+		return s.allow(c, model.DEVELOPER, product, after.Environment)
+	}
+	return s.allow(c, role, product, after.Environment)
+}
+
+// lookupVersion retrieves the product and version addressed by the request
+// path; if either does not exist, the request is aborted and false returned.
+func (s *Server) lookupVersion(c *gin.Context) (model.Product, model.Version, bool) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Version{}, false
+	}
+
+	version, err := s.store.GetVersionByCode(product, c.Param("versionId"))
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Version{}, false
+	}
+	return product, version, true
+}
+
+// lookupDeployment retrieves the product, version and deployment addressed by
+// the request path; if any of them does not exist, the request is aborted and
+// false returned.
+func (s *Server) lookupDeployment(c *gin.Context) (model.Product, model.Version, model.Deployment, bool) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok {
+		return model.Product{}, model.Version{}, model.Deployment{}, false
+	}
+
+	order, err := strconv.Atoi(c.Param("deploymentId"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid deployment order"})
+		return model.Product{}, model.Version{}, model.Deployment{}, false
+	}
+
+	deployment, err := s.store.GetDeploymentByOrder(version, order)
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Version{}, model.Deployment{}, false
+	}
+	return product, version, deployment, true
+}
+
+// versionKey returns the key identifying a version in the audit log.
+func versionKey(product model.Product, version model.Version) string {
+	return product.Code + "/" + version.Code
+}
+
+// deploymentKey returns the key identifying a deployment in the audit log.
+func deploymentKey(product model.Product, version model.Version, deployment model.Deployment) string {
+	return versionKey(product, version) + "/" + strconv.Itoa(deployment.Order)
+}
+
+// deploymentLinks returns the hypermedia links of a deployment.
+func deploymentLinks(c *gin.Context, product model.Product, version model.Version, deployment model.Deployment) []Link {
+	return []Link{
+		{
+			Relation: "self",
+			URI:      href(c, "products", product.Code, "versions", version.Code, "deployments", strconv.Itoa(deployment.Order)),
+		},
+		{
+			Relation: "collection",
+			URI:      href(c, "products", product.Code, "versions", version.Code, "deployments"),
+		},
+		{
+			Relation: "version",
+			URI:      href(c, "products", product.Code, "versions", version.Code),
+		},
+		{
+			Relation: "product",
+			URI:      href(c, "products", product.Code),
+		},
+	}
+}
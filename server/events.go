@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// keepAlive is the interval between the comments sent on idle event streams,
+// preventing proxies from closing them.
+var keepAlive = 30 * time.Second
+
+// publisher notifies listeners of events from a goroutine of its own, in the
+// order the events are queued, so that the requests making changes neither
+// wait for the listeners nor hold up each other while they are notified.
+type publisher struct {
+	listeners []Listener
+	mutex     sync.Mutex
+	ready     *sync.Cond
+	queue     []model.Event
+}
+
+// newPublisher returns a publisher notifying the given listeners, which starts
+// publishing the events queued from now on.
+func newPublisher(listeners []Listener) *publisher {
+	p := &publisher{listeners: listeners}
+	p.ready = sync.NewCond(&p.mutex)
+	go p.run()
+	return p
+}
+
+// enqueue queues the given events, to be published after those queued before.
+func (p *publisher) enqueue(events ...model.Event) {
+	if len(events) == 0 {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.queue = append(p.queue, events...)
+	p.ready.Signal()
+}
+
+// run publishes the queued events, in order, to all the listeners.
+func (p *publisher) run() {
+	for {
+		p.mutex.Lock()
+		for len(p.queue) == 0 {
+			p.ready.Wait()
+		}
+		events := p.queue
+		p.queue = nil
+		p.mutex.Unlock()
+
+		for _, event := range events {
+			for _, listener := range p.listeners {
+				listener.Publish(event)
+			}
+		}
+	}
+}
+
+// broker is a Listener relaying the events to the open event streams.
+type broker struct {
+	mutex       sync.Mutex
+	subscribers map[chan model.Event]struct{}
+}
+
+// subscribe returns a channel receiving the events published from now on; the
+// channel is closed if the subscriber falls too far behind.
+func (b *broker) subscribe() chan model.Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = map[chan model.Event]struct{}{}
+	}
+	events := make(chan model.Event, 64)
+	b.subscribers[events] = struct{}{}
+	return events
+}
+
+// unsubscribe stops relaying events to the given channel.
+func (b *broker) unsubscribe(events chan model.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.subscribers[events]; ok {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// Publish relays the given event to all the subscribers, without blocking:
+// the subscribers whose buffer is full are dropped, and can resume from the
+// last event they received.
+func (b *broker) Publish(event model.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// eventsQuery is the query string of event stream requests; LastEventID is an
+// alternative to the Last-Event-ID header for clients which cannot set it.
+type eventsQuery struct {
+	Products    []string `form:"product"`
+	LastEventID string   `form:"lastEventId"`
+}
+
+// GetEvents streams the changes to versions and deployments as Server-Sent
+// Events, optionally restricted to the given products; streaming products
+// requires the VIEWER role on each of them, or on all products if none is
+// given. Clients resuming a stream after the event in the Last-Event-ID header
+// first receive the events they missed, from the audit log.
+func (s *Server) GetEvents(c *gin.Context) {
+	var query eventsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		invalid(c, err)
+		return
+	}
+	products := map[string]bool{}
+	for _, code := range query.Products {
+		product, err := s.store.GetProductByCode(code)
+		if err != nil {
+			abort(c, err)
+			return
+		}
+		if !s.allow(c, model.VIEWER, product, "") {
+			return
+		}
+		products[code] = true
+	}
+	if len(products) == 0 && !s.allow(c, model.VIEWER, model.Product{}, "") {
+		return
+	}
+	last := c.GetHeader("Last-Event-ID")
+	if last == "" {
+		last = query.LastEventID
+	}
+	var after uint64
+	if last != "" {
+		var err error
+		if after, err = strconv.ParseUint(last, 10, 0); err != nil {
+			invalid(c, errors.Errorf("invalid last event id %q", last))
+			return
+		}
+	}
+
+	// subscribe before reading the audit log, so that no event is lost in
+	// between; the events read from both are only sent once
+	events := s.broker.subscribe()
+	defer s.broker.unsubscribe(events)
+	var missed []model.Event
+	if last != "" {
+		filter := model.AuditFilter{After: uint(after)}
+		if len(query.Products) == 1 {
+			filter.Product = query.Products[0]
+		}
+		records, err := s.store.GetAuditRecords(filter)
+		if err != nil {
+			abort(c, err)
+			return
+		}
+		for _, record := range records {
+			if event, ok := model.NewEvent(record); ok {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	send := func(event model.Event) bool {
+		if (len(products) > 0 && !products[event.Product]) || uint64(event.ID) <= after {
+			return true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		after = uint64(event.ID)
+		_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		return err == nil
+	}
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok || !send(event) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
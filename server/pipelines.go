@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+)
+
+// StageInfo is the representation of a stage of a promotion pipeline.
+type StageInfo struct {
+	Stage       int    `json:"stage"`
+	Environment string `json:"environment"`
+}
+
+// GetPipeline returns the promotion pipeline of a product, i.e. the ordered
+// list of the environments its versions are promoted through.
+func (s *Server) GetPipeline(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	stages, err := s.store.GetPipeline(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pipeline": stageInfos(stages)})
+}
+
+// pipelineRequest is the payload of pipeline replacement requests.
+type pipelineRequest struct {
+	Environments []string `json:"environments" binding:"required,min=1,dive,required,max=63"`
+}
+
+// PutPipeline replaces the promotion pipeline of a product.
+func (s *Server) PutPipeline(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	var request pipelineRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	current, err := s.store.GetPipeline(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	stages := make([]model.Stage, 0, len(request.Environments))
+	for _, environment := range request.Environments {
+		stages = append(stages, model.Stage{Environment: environment})
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.SetPipeline(product, stages); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "pipeline", product.Code, product.Code, stageInfos(current), stageInfos(stages))
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pipeline": stageInfos(stages)})
+}
+
+// DeletePipeline removes the promotion pipeline of a product, so that its
+// deployments can be granted in any order.
+func (s *Server) DeletePipeline(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	current, err := s.store.GetPipeline(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.SetPipeline(product, nil); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "pipeline", product.Code, product.Code, stageInfos(current), nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// allowPromotion checks that the promotion pipeline of the product allows
+// granting the deployment of a version: if the deployment environment is a
+// stage of the pipeline, the version must have been PERFORMED onto the
+// environment of the previous stage. If not allowed, the request is aborted
+// with a conflict naming the blocking stage and false returned.
+func (s *Server) allowPromotion(c *gin.Context, product model.Product, version model.Version, deployment model.Deployment) bool {
+	stages, err := s.store.GetPipeline(product)
+	if err != nil {
+		abort(c, err)
+		return false
+	}
+
+	for i, stage := range stages {
+		if stage.Environment != deployment.Environment {
+			continue
+		}
+		if i == 0 {
+			return true
+		}
+		previous := stages[i-1]
+		status := model.Status("")
+		for _, d := range version.Deployments {
+			if d.Environment == previous.Environment && (status == "" || d.Status == model.PERFORMED) {
+				status = d.Status
+			}
+		}
+		if status == model.PERFORMED {
+			return true
+		}
+		message := fmt.Sprintf("deployment of version %q onto %q is blocked by stage %d (%s) of the pipeline: ", version.Code, deployment.Environment, previous.Position, previous.Environment)
+		if status == "" {
+			message += fmt.Sprintf("the version has no deployment onto %q", previous.Environment)
+		} else {
+			message += fmt.Sprintf("its deployment onto %q is %s, not PERFORMED", previous.Environment, status)
+		}
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": message})
+		return false
+	}
+	return true
+}
+
+// stageInfos returns the representations of the given pipeline stages.
+func stageInfos(stages []model.Stage) []StageInfo {
+	infos := make([]StageInfo, 0, len(stages))
+	for _, stage := range stages {
+		infos = append(infos, StageInfo{Stage: stage.Position, Environment: stage.Environment})
+	}
+	return infos
+}
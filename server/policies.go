@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// allEnvironments is the path element identifying the policy that applies to
+// all the environments having no policy of their own.
+const allEnvironments = "*"
+
+// PolicyInfo is the representation of an approval policy.
+type PolicyInfo struct {
+	Environment   string `json:"environment"`
+	Approvals     int    `json:"approvals"`
+	ExcludeAuthor bool   `json:"excludeAuthor"`
+	Self          Link   `json:"_link,omitempty"`
+}
+
+// GetPolicies returns the list of approval policies of a product.
+func (s *Server) GetPolicies(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	policies, err := s.store.GetPolicies(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]PolicyInfo, 0, len(policies))
+	for _, policy := range policies {
+		results = append(results, policyInfo(c, product, policy))
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": results})
+}
+
+// GetPolicy returns the approval policy of a product for an environment, or
+// for all environments if the environment is "*".
+func (s *Server) GetPolicy(c *gin.Context) {
+	product, policy, ok := s.lookupPolicy(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+	if policy.ID == 0 {
+		abort(c, errors.Wrapf(model.ErrorNotFound, "error reading policy for environment %q", c.Param("environment")))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policyInfo(c, product, policy)})
+}
+
+// policyRequest is the payload of policy creation and replacement requests.
+type policyRequest struct {
+	Approvals     int  `json:"approvals" binding:"required,min=1,max=16"`
+	ExcludeAuthor bool `json:"excludeAuthor"`
+}
+
+// PutPolicy creates or replaces the approval policy of a product for an
+// environment, or for all environments if the environment is "*".
+func (s *Server) PutPolicy(c *gin.Context) {
+	product, policy, ok := s.lookupPolicy(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	var request policyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	current := policy
+	policy.Approvals = request.Approvals
+	policy.ExcludeAuthor = request.ExcludeAuthor
+	if policy.ID == 0 {
+		if !s.change(c, func(store model.Store, audit auditor) error {
+			if err := store.CreatePolicy(&policy); err != nil {
+				return err
+			}
+			return audit(model.CREATE, "policy", product.Code, policyKey(product, policy), nil, policy)
+		}) {
+			return
+		}
+		result := policyInfo(c, product, policy)
+		c.Header("Location", result.Self.URI)
+		c.JSON(http.StatusCreated, gin.H{"policy": result})
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdatePolicy(&policy); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "policy", product.Code, policyKey(product, policy), current, policy)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policyInfo(c, product, policy)})
+}
+
+// DeletePolicy deletes the approval policy of a product for an environment,
+// or for all environments if the environment is "*".
+func (s *Server) DeletePolicy(c *gin.Context) {
+	product, policy, ok := s.lookupPolicy(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeletePolicy(&policy); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "policy", product.Code, policyKey(product, policy), policy, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// lookupPolicy retrieves the product and the policy addressed by the request
+// path; if the product has no such policy, a new one (with a zero ID) is
+// returned. If the product does not exist, the request is aborted and false
+// returned.
+func (s *Server) lookupPolicy(c *gin.Context) (model.Product, model.Policy, bool) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Policy{}, false
+	}
+
+	environment := c.Param("environment")
+	if environment == allEnvironments {
+		environment = ""
+	}
+	policies, err := s.store.GetPolicies(product)
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Policy{}, false
+	}
+	for _, policy := range policies {
+		if policy.Environment == environment {
+			return product, policy, true
+		}
+	}
+	return product, model.Policy{ProductID: product.ID, Environment: environment}, true
+}
+
+// policy returns the approval policy applying to the deployments of a
+// product onto an environment: the policy of the product for the
+// environment, if any, otherwise the one for all environments, if any,
+// otherwise the default policy.
+func (s *Server) policy(product model.Product, environment string) (model.Policy, error) {
+	policies, err := s.store.GetPolicies(product)
+	if err != nil {
+		return model.Policy{}, err
+	}
+	result := model.DefaultPolicy
+	for _, policy := range policies {
+		switch policy.Environment {
+		case environment:
+			return policy, nil
+		case "":
+			result = policy
+		}
+	}
+	return result, nil
+}
+
+// policyKey returns the key identifying an approval policy in the audit log.
+func policyKey(product model.Product, policy model.Policy) string {
+	if policy.Environment == "" {
+		return product.Code + "/" + allEnvironments
+	}
+	return product.Code + "/" + policy.Environment
+}
+
+// policyInfo returns the representation of an approval policy.
+func policyInfo(c *gin.Context, product model.Product, policy model.Policy) PolicyInfo {
+	environment := policy.Environment
+	if environment == "" {
+		environment = allEnvironments
+	}
+	return PolicyInfo{
+		Environment:   environment,
+		Approvals:     policy.Approvals,
+		ExcludeAuthor: policy.ExcludeAuthor,
+		Self: Link{
+			Relation: "self",
+			URI:      href(c, "products", product.Code, "policies", environment),
+		},
+	}
+}
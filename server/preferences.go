@@ -0,0 +1,177 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// PreferenceInfo is the representation of the notification preferences of a
+// user.
+type PreferenceInfo struct {
+	User     string    `json:"user"`
+	Email    string    `json:"email"`
+	Products []string  `json:"products,omitempty"`
+	Events   []string  `json:"events,omitempty"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Self     Link      `json:"_link,omitempty"`
+}
+
+// GetPreferences returns the notification preferences of the user issuing the
+// request.
+func (s *Server) GetPreferences(c *gin.Context) {
+	user, ok := s.preferencesUser(c)
+	if !ok {
+		return
+	}
+
+	preference, err := s.store.GetPreference(user)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": preferenceInfo(c, preference)})
+}
+
+// preferenceRequest is the payload of notification preference requests;
+// Products and Events list the patterns of the codes of the products, all of
+// them if empty, and of the types of the events, none of them if empty, the
+// user wants to be notified of.
+type preferenceRequest struct {
+	Email    string   `json:"email" binding:"required,email,max=255"`
+	Products []string `json:"products" binding:"max=32,dive,required,max=63,excludesall=0x2C"`
+	Events   []string `json:"events" binding:"max=32,dive,required,max=63,excludesall=0x2C"`
+}
+
+// PutPreferences creates or replaces the notification preferences of the user
+// issuing the request, who must be able to view the products whose events they
+// subscribe to: products listed by code require the VIEWER role on each of
+// them, patterns and the empty list the VIEWER role on all products.
+func (s *Server) PutPreferences(c *gin.Context) {
+	user, ok := s.preferencesUser(c)
+	if !ok {
+		return
+	}
+
+	var request preferenceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+	for _, pattern := range append(request.Products, request.Events...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			invalid(c, errors.Wrapf(err, "invalid pattern %q", pattern))
+			return
+		}
+	}
+	all := len(request.Products) == 0
+	for _, code := range request.Products {
+		if strings.ContainsAny(code, `*?[\`) {
+			all = true
+			continue
+		}
+		product, err := s.store.GetProductByCode(code)
+		if err != nil {
+			if errors.Cause(err) == model.ErrorNotFound {
+				err = errors.Wrapf(model.ErrorConstraint, "reference to non-existing product %q", code)
+			}
+			abort(c, err)
+			return
+		}
+		if !s.allow(c, model.VIEWER, product, "") {
+			return
+		}
+	}
+	if all && !s.allow(c, model.VIEWER, model.Product{}, "") {
+		return
+	}
+
+	var current interface{}
+	if preference, err := s.store.GetPreference(user); err == nil {
+		current = preference
+	} else if errors.Cause(err) != model.ErrorNotFound {
+		abort(c, err)
+		return
+	}
+	preference := model.Preference{
+		User:     user,
+		Email:    request.Email,
+		Products: strings.Join(request.Products, ","),
+		Events:   strings.Join(request.Events, ","),
+	}
+	action := model.UPDATE
+	if current == nil {
+		action = model.CREATE
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.SetPreference(&preference); err != nil {
+			return err
+		}
+		return audit(action, "preference", "", user, current, preference)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preferences": preferenceInfo(c, preference)})
+}
+
+// DeletePreferences deletes the notification preferences of the user issuing
+// the request, who is then only notified as the contact of products.
+func (s *Server) DeletePreferences(c *gin.Context) {
+	user, ok := s.preferencesUser(c)
+	if !ok {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		preference, err := store.GetPreference(user)
+		if err == nil {
+			err = store.DeletePreference(&preference)
+		}
+		if err != nil {
+			return err
+		}
+		return audit(model.DELETE, "preference", "", user, preference, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// preferencesUser returns the user issuing the request, whose preferences it
+// is about; anonymous requests, which are only possible when the server runs
+// without authentication, are aborted with an Unauthorized status code.
+func (s *Server) preferencesUser(c *gin.Context) (string, bool) {
+	user, ok := auth.User(c)
+	if !ok {
+		auth.Unauthorized(c, s.authenticators, errors.New("notification preferences require an authenticated user"))
+	}
+	return user, ok
+}
+
+// preferenceInfo returns the representation of the given notification
+// preferences.
+func preferenceInfo(c *gin.Context, preference model.Preference) PreferenceInfo {
+	info := PreferenceInfo{
+		User:    preference.User,
+		Email:   preference.Email,
+		Created: preference.CreatedAt,
+		Updated: preference.UpdatedAt,
+		Self:    Link{Relation: "self", URI: href(c, "preferences")},
+	}
+	if preference.Products != "" {
+		info.Products = strings.Split(preference.Products, ",")
+	}
+	if preference.Events != "" {
+		info.Events = strings.Split(preference.Events, ",")
+	}
+	return info
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+)
+
+// GetProducts returns the list of all products the user can view.
+func (s *Server) GetProducts(c *gin.Context) {
+
+	type ProductInfo struct {
+		ID   uint   `json:"id"`
+		Code string `json:"code,omitempty"`
+		Self Link   `json:"_link,omitempty"`
+	}
+
+	products, err := s.store.GetProducts()
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]ProductInfo, 0, len(products))
+	for _, product := range products {
+		if ok, err := s.allowed(c, model.VIEWER, product, ""); err != nil {
+			abort(c, err)
+			return
+		} else if !ok {
+			continue
+		}
+		results = append(results, ProductInfo{
+			ID:   product.ID,
+			Code: product.Code,
+			Self: Link{
+				Relation: "self",
+				URI:      href(c, "products", product.Code),
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"products": results})
+}
+
+// GetProduct returns the product identified by its code, along with links to
+// its versions.
+func (s *Server) GetProduct(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	type VersionInfo struct {
+		ID   uint   `json:"id"`
+		Code string `json:"code,omitempty"`
+		Link Link   `json:"_link,omitempty"`
+	}
+
+	type ProductInfo struct {
+		ID          uint          `json:"id"`
+		Code        string        `json:"code,omitempty"`
+		Name        string        `json:"name,omitempty"`
+		Description string        `json:"description,omitempty"`
+		Contact     string        `json:"contact,omitempty"`
+		Repository  string        `json:"repository,omitempty"`
+		WebSite     string        `json:"website,omitempty"`
+		Quota       int64         `json:"quota,omitempty"`
+		Links       []Link        `json:"_links,omitempty"`
+		Versions    []VersionInfo `json:"versions,omitempty"`
+	}
+
+	var versions []VersionInfo
+	if len(product.Versions) > 0 {
+		versions = make([]VersionInfo, 0, len(product.Versions))
+		for _, version := range product.Versions {
+			versions = append(versions, VersionInfo{
+				ID:   version.ID,
+				Code: version.Code,
+				Link: Link{
+					Relation: "self",
+					URI:      href(c, "products", product.Code, "versions", version.Code),
+				},
+			})
+		}
+	}
+
+	result := ProductInfo{
+		ID:          product.ID,
+		Code:        product.Code,
+		Name:        product.Name,
+		Description: product.Description,
+		Contact:     product.Contact,
+		Repository:  product.Repository,
+		WebSite:     product.WebSite,
+		Quota:       product.Quota,
+		Links: []Link{
+			{
+				Relation: "self",
+				URI:      href(c, "products", product.Code),
+			},
+			{
+				Relation: "collection",
+				URI:      href(c, "products"),
+			},
+			{
+				Relation: "versions",
+				URI:      href(c, "products", product.Code, "versions"),
+			},
+			{
+				Relation: "storage",
+				URI:      href(c, "products", product.Code, "storage"),
+			},
+		},
+		Versions: versions,
+	}
+
+	c.JSON(http.StatusOK, gin.H{"product": result})
+}
+
+// productRequest is the payload of product creation and replacement requests;
+// when replacing a product, its Quota is only modified if provided.
+type productRequest struct {
+	Code        string `json:"code" binding:"required,max=63"`
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Contact     string `json:"contact"`
+	Repository  string `json:"repository" binding:"omitempty,url"`
+	WebSite     string `json:"website" binding:"omitempty,url"`
+	Quota       *int64 `json:"quota" binding:"omitempty,min=0"`
+}
+
+// productPatch is the payload of product partial update requests; only the
+// provided fields are modified.
+type productPatch struct {
+	Code        *string `json:"code" binding:"omitempty,min=1,max=63"`
+	Name        *string `json:"name" binding:"omitempty,min=1"`
+	Description *string `json:"description"`
+	Contact     *string `json:"contact"`
+	Repository  *string `json:"repository" binding:"omitempty,url"`
+	WebSite     *string `json:"website" binding:"omitempty,url"`
+	Quota       *int64  `json:"quota" binding:"omitempty,min=0"`
+}
+
+// CreateProduct creates a new product.
+func (s *Server) CreateProduct(c *gin.Context) {
+	if !s.allow(c, model.ADMIN, model.Product{}, "") {
+		return
+	}
+
+	var request productRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	product := model.Product{
+		Code:        request.Code,
+		Name:        request.Name,
+		Description: request.Description,
+		Contact:     request.Contact,
+		Repository:  request.Repository,
+		WebSite:     request.WebSite,
+	}
+	if request.Quota != nil {
+		product.Quota = *request.Quota
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateProduct(&product); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "product", product.Code, product.Code, nil, product)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code))
+	c.JSON(http.StatusCreated, gin.H{"product": product})
+}
+
+// UpdateProduct replaces all the attributes of an existing product.
+func (s *Server) UpdateProduct(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+	product.Versions = nil
+	current := product
+
+	var request productRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	product.Code = request.Code
+	product.Name = request.Name
+	product.Description = request.Description
+	product.Contact = request.Contact
+	product.Repository = request.Repository
+	product.WebSite = request.WebSite
+	if request.Quota != nil {
+		product.Quota = *request.Quota
+	}
+	if !s.allowQuota(c, current, product) {
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateProduct(&product); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "product", current.Code, current.Code, current, product)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
+// PatchProduct modifies some of the attributes of an existing product.
+func (s *Server) PatchProduct(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+	product.Versions = nil
+	current := product
+
+	var patch productPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	if patch.Code != nil {
+		product.Code = *patch.Code
+	}
+	if patch.Name != nil {
+		product.Name = *patch.Name
+	}
+	if patch.Description != nil {
+		product.Description = *patch.Description
+	}
+	if patch.Contact != nil {
+		product.Contact = *patch.Contact
+	}
+	if patch.Repository != nil {
+		product.Repository = *patch.Repository
+	}
+	if patch.WebSite != nil {
+		product.WebSite = *patch.WebSite
+	}
+	if patch.Quota != nil {
+		product.Quota = *patch.Quota
+	}
+	if !s.allowQuota(c, current, product) {
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateProduct(&product); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "product", current.Code, current.Code, current, product)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"product": product})
+}
+
+// DeleteProduct deletes a product, along with all its versions and their
+// deployments.
+func (s *Server) DeleteProduct(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteProduct(&product); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "product", product.Code, product.Code, product, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,283 @@
+// Package server implements the REST API of the builds microservice.
+package server
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/blobs"
+	"github.com/dihedron/builds/model"
+	"github.com/dihedron/builds/signing"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Link represents a hypermedia link to a related resource.
+type Link struct {
+	Relation string `json:"rel,omitempty"`
+	URI      string `json:"href,omitempty"`
+}
+
+// Server exposes the contents of a Store through the builds REST API.
+type Server struct {
+	store          model.Store
+	authenticators []auth.Authenticator
+	signer         *signing.Signer
+	retired        []ed25519.PublicKey
+	lifetime       time.Duration
+	listeners      []Listener
+	broker         *broker
+	publisher      *publisher
+	// auditing serialises the appends to the audit log along with the
+	// queueing of their events, so that listeners receive the events in the
+	// order of their IDs.
+	auditing sync.Mutex
+	blobs    *blobs.Store
+	quota    int64
+	// uploads maps the IDs of the products with a storage quota to the
+	// mutexes serialising their uploads, so that the usage checked against
+	// the quota is not outdated by the time the contents are stored.
+	uploads sync.Map
+}
+
+// Listener is notified of the events generated by the changes made through
+// the API, e.g. to deliver them to webhooks; listeners are invoked one event
+// at a time, in the order of the events, from a goroutine of the server, and
+// should not block, as they hold up the following events.
+type Listener interface {
+	Publish(event model.Event)
+}
+
+// Option configures an optional feature of the Server.
+type Option func(*Server)
+
+// WithAuthenticators makes the server identify its callers through the given
+// authenticators: only authenticated users can then access resources,
+// according to the roles assigned to them, otherwise anybody can.
+func WithAuthenticators(authenticators ...auth.Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, authenticators...)
+	}
+}
+
+// WithSigner makes the server issue signed approval tokens for the granted
+// deployments, and publish the public key of the signer, along with the given
+// retired keys, so that tokens issued before a key rotation can still be
+// verified.
+func WithSigner(signer *signing.Signer, retired ...ed25519.PublicKey) Option {
+	return func(s *Server) {
+		s.signer = signer
+		s.retired = retired
+	}
+}
+
+// WithTokenLifetime makes the approval tokens issued by the server expire
+// after the given time, instead of defaultTokenLifetime.
+func WithTokenLifetime(lifetime time.Duration) Option {
+	return func(s *Server) {
+		s.lifetime = lifetime
+	}
+}
+
+// WithListeners makes the server notify the given listeners of the events
+// generated by the changes made through the API.
+func WithListeners(listeners ...Listener) Option {
+	return func(s *Server) {
+		s.listeners = append(s.listeners, listeners...)
+	}
+}
+
+// WithBlobs makes the server store the contents of artifacts in the given
+// blob store, limiting the storage of each product to its own quota or, if it
+// has none, to the given number of bytes (0 for no limit).
+func WithBlobs(store *blobs.Store, quota int64) Option {
+	return func(s *Server) {
+		s.blobs = store
+		s.quota = quota
+	}
+}
+
+// New returns a router exposing the contents of the given store through the
+// builds REST API, configured by the given options. Approvals always require
+// an authenticated user.
+func New(store model.Store, options ...Option) *gin.Engine {
+	s := &Server{store: store, broker: &broker{}, lifetime: defaultTokenLifetime}
+	for _, option := range options {
+		option(s)
+	}
+	s.listeners = append(s.listeners, s.broker)
+	s.publisher = newPublisher(s.listeners)
+
+	router := gin.Default()
+	router.Use(auth.Authenticate(s.authenticators...), s.authorize)
+
+	router.GET("/products", s.GetProducts)
+	router.POST("/products", s.CreateProduct)
+	router.GET("/products/:productId", s.GetProduct)
+	router.PUT("/products/:productId", s.UpdateProduct)
+	router.PATCH("/products/:productId", s.PatchProduct)
+	router.DELETE("/products/:productId", s.DeleteProduct)
+
+	router.GET("/products/:productId/policies", s.GetPolicies)
+	router.GET("/products/:productId/policies/:environment", s.GetPolicy)
+	router.PUT("/products/:productId/policies/:environment", s.PutPolicy)
+	router.DELETE("/products/:productId/policies/:environment", s.DeletePolicy)
+	router.GET("/products/:productId/pipeline", s.GetPipeline)
+	router.PUT("/products/:productId/pipeline", s.PutPipeline)
+	router.DELETE("/products/:productId/pipeline", s.DeletePipeline)
+	router.GET("/products/:productId/webhooks", s.GetWebhooks)
+	router.POST("/products/:productId/webhooks", s.CreateWebhook)
+	router.GET("/products/:productId/webhooks/:webhookId", s.GetWebhook)
+	router.PUT("/products/:productId/webhooks/:webhookId", s.UpdateWebhook)
+	router.DELETE("/products/:productId/webhooks/:webhookId", s.DeleteWebhook)
+	router.GET("/products/:productId/webhooks/:webhookId/deliveries", s.GetDeliveries)
+	router.GET("/products/:productId/storage", s.GetStorage)
+
+	router.GET("/products/:productId/versions", s.GetVersions)
+	router.POST("/products/:productId/versions", s.CreateVersion)
+	router.GET("/products/:productId/versions/next", s.GetNextVersion)
+	router.POST("/products/:productId/versions/next", s.AllocateVersion)
+	router.GET("/products/:productId/versions/:versionId", s.GetVersion)
+	router.PUT("/products/:productId/versions/:versionId", s.UpdateVersion)
+	router.PATCH("/products/:productId/versions/:versionId", s.PatchVersion)
+	router.DELETE("/products/:productId/versions/:versionId", s.DeleteVersion)
+
+	router.GET("/products/:productId/versions/:versionId/builds", s.GetBuilds)
+	router.POST("/products/:productId/versions/:versionId/builds", s.CreateBuild)
+	router.GET("/products/:productId/versions/:versionId/builds/:buildId", s.GetBuild)
+	router.PUT("/products/:productId/versions/:versionId/builds/:buildId", s.UpdateBuild)
+	router.PATCH("/products/:productId/versions/:versionId/builds/:buildId", s.PatchBuild)
+	router.DELETE("/products/:productId/versions/:versionId/builds/:buildId", s.DeleteBuild)
+	router.GET("/products/:productId/versions/:versionId/builds/:buildId/artifacts", s.GetArtifacts)
+	router.POST("/products/:productId/versions/:versionId/builds/:buildId/artifacts", s.CreateArtifact)
+	router.GET("/products/:productId/versions/:versionId/builds/:buildId/artifacts/:artifactId", s.GetArtifact)
+	router.DELETE("/products/:productId/versions/:versionId/builds/:buildId/artifacts/:artifactId", s.DeleteArtifact)
+	router.GET("/products/:productId/versions/:versionId/builds/:buildId/artifacts/:artifactId/content", s.DownloadArtifact)
+	router.HEAD("/products/:productId/versions/:versionId/builds/:buildId/artifacts/:artifactId/content", s.DownloadArtifact)
+	router.PUT("/products/:productId/versions/:versionId/builds/:buildId/artifacts/:artifactId/content", s.UploadArtifact)
+
+	router.GET("/products/:productId/versions/:versionId/deployments", s.GetDeployments)
+	router.POST("/products/:productId/versions/:versionId/deployments", s.CreateDeployment)
+	router.GET("/products/:productId/versions/:versionId/deployments/:deploymentId", s.GetDeployment)
+	router.PUT("/products/:productId/versions/:versionId/deployments/:deploymentId", s.UpdateDeployment)
+	router.PATCH("/products/:productId/versions/:versionId/deployments/:deploymentId", s.PatchDeployment)
+	router.DELETE("/products/:productId/versions/:versionId/deployments/:deploymentId", s.DeleteDeployment)
+	router.POST("/products/:productId/versions/:versionId/deployments/:deploymentId/approve", s.ApproveDeployment)
+	router.POST("/products/:productId/versions/:versionId/deployments/:deploymentId/reject", s.RejectDeployment)
+	router.POST("/products/:productId/versions/:versionId/deployments/:deploymentId/fail", s.FailDeployment)
+	router.POST("/products/:productId/versions/:versionId/deployments/:deploymentId/rollback", s.RollbackDeployment)
+	router.POST("/products/:productId/versions/:versionId/deployments/:deploymentId/cancel", s.CancelDeployment)
+	router.GET("/products/:productId/versions/:versionId/deployments/:deploymentId/token", s.GetDeploymentToken)
+	router.PUT("/products/:productId/versions/:versionId/deployments/:deploymentId/artifacts", s.PutDeploymentArtifacts)
+
+	router.GET("/artifacts/:digest", s.FindArtifact)
+	router.GET("/blobs/:digest", s.GetBlob)
+	router.HEAD("/blobs/:digest", s.GetBlob)
+	router.POST("/blobs/gc", s.CollectBlobs)
+
+	router.GET("/assignments", s.GetAssignments)
+	router.POST("/assignments", s.CreateAssignment)
+	router.DELETE("/assignments/:assignmentId", s.DeleteAssignment)
+
+	router.GET("/preferences", s.GetPreferences)
+	router.PUT("/preferences", s.PutPreferences)
+	router.DELETE("/preferences", s.DeletePreferences)
+
+	router.GET("/audit", s.GetAudit)
+	router.GET("/events", s.GetEvents)
+
+	router.GET("/keys", s.GetKeys)
+	return router
+}
+
+// authorize rejects anonymous requests, unless the server runs without
+// authentication.
+func (s *Server) authorize(c *gin.Context) {
+	if _, ok := auth.User(c); !ok && len(s.authenticators) > 0 {
+		auth.Unauthorized(c, s.authenticators, errors.New("authentication required"))
+	}
+}
+
+// allowed returns whether the user issuing the request holds the given role
+// on the given product (or on all products, if its ID is 0) and environment;
+// roles are only enforced when the server runs with authentication.
+func (s *Server) allowed(c *gin.Context, role model.Role, product model.Product, environment string) (bool, error) {
+	if len(s.authenticators) == 0 {
+		return true, nil
+	}
+	user, ok := auth.User(c)
+	if !ok {
+		return false, nil
+	}
+	assignments, err := s.store.GetAssignments(user)
+	if err != nil {
+		return false, err
+	}
+	for _, assignment := range assignments {
+		if assignment.Allows(role, product.ID, environment) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// allow checks that the user issuing the request holds the given role on the
+// given product and environment (see allowed); if not, the request is aborted
+// with a Forbidden status code and false returned.
+func (s *Server) allow(c *gin.Context, role model.Role, product model.Product, environment string) bool {
+	ok, err := s.allowed(c, role, product, environment)
+	if err != nil {
+		abort(c, err)
+		return false
+	}
+	if ok {
+		return true
+	}
+	user, _ := auth.User(c)
+	message := fmt.Sprintf("user %q does not have the %s role on ", user, role)
+	switch {
+	case product.Code != "":
+		message += fmt.Sprintf("product %q", product.Code)
+	case product.ID != 0:
+		message += fmt.Sprintf("product %d", product.ID)
+	default:
+		message += "all products"
+	}
+	if environment != "" {
+		message += fmt.Sprintf(" for environment %q", environment)
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": message})
+	return false
+}
+
+// href returns the absolute URI of the resource at the given path elements,
+// on the same host the request was addressed to.
+func href(c *gin.Context, elements ...string) string {
+	return "http://" + c.Request.Host + "/" + strings.Join(elements, "/")
+}
+
+// abort interrupts the request with the HTTP status code corresponding to the
+// given error.
+func abort(c *gin.Context, err error) {
+	switch errors.Cause(err) {
+	case model.ErrorNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case model.ErrorDuplicate:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case model.ErrorConstraint:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// invalid interrupts the request with a Bad Request status code, reporting
+// why the request payload could not be accepted.
+func invalid(c *gin.Context, err error) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,1290 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/blobs"
+	"github.com/dihedron/builds/model"
+	"github.com/dihedron/builds/signing"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// userAuthenticator trusts the user name in the X-User header, so that tests
+// can impersonate any user.
+type userAuthenticator struct{}
+
+func (userAuthenticator) Authenticate(request *http.Request) (string, error) {
+	if user := request.Header.Get("X-User"); user != "" {
+		return user, nil
+	}
+	return "", auth.ErrorNoCredentials
+}
+
+func (userAuthenticator) Challenge() string {
+	return ""
+}
+
+// serve returns a router with authentication, on an in-memory store holding
+// a product with a version to be deployed onto Integration and Production,
+// and the given role assignments on the product.
+func serve(t *testing.T, assignments ...model.Assignment) (*gin.Engine, model.Store) {
+	gin.SetMode(gin.TestMode)
+	store := model.NewMemoryStore()
+	product := model.Product{
+		Code: "gaia",
+		Versions: []model.Version{
+			{
+				Code: "1.0.0",
+				Deployments: []model.Deployment{
+					{Order: 0, Environment: "Integration"},
+					{Order: 1, Environment: "Production"},
+				},
+			},
+		},
+	}
+	if err := store.CreateProduct(&product); err != nil {
+		t.Fatalf("error creating product: %v", err)
+	}
+	for _, assignment := range assignments {
+		assignment.ProductID = product.ID
+		if err := store.CreateAssignment(&assignment); err != nil {
+			t.Fatalf("error assigning role: %v", err)
+		}
+	}
+	return New(store, WithAuthenticators(userAuthenticator{})), store
+}
+
+// call sends a request on behalf of the given user (if any) and returns the
+// response status code.
+func call(router *gin.Engine, user string, method string, path string, body string) int {
+	request := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if user != "" {
+		request.Header.Set("X-User", user)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestRoles(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+		model.Assignment{User: "team", Environment: "Integration", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+	if err := store.CreateAssignment(&model.Assignment{User: "root", Role: model.ADMIN}); err != nil {
+		t.Fatalf("error assigning role: %v", err)
+	}
+
+	deployments := "/products/gaia/versions/1.0.0/deployments/"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", http.MethodGet, "/products/gaia", "", http.StatusUnauthorized},
+		{"stranger", http.MethodGet, "/products/gaia", "", http.StatusForbidden},
+		{"viewer", http.MethodGet, "/products/gaia", "", http.StatusOK},
+		{"team", http.MethodGet, "/products/gaia/versions", "", http.StatusOK},
+		{"viewer", http.MethodPost, "/products/gaia/versions", `{"code":"1.0.1"}`, http.StatusForbidden},
+		{"developer", http.MethodPost, "/products/gaia/versions", `{"code":"1.0.1"}`, http.StatusCreated},
+		{"developer", http.MethodPost, deployments + "0/approve", "", http.StatusForbidden},
+		{"developer", http.MethodPatch, deployments + "0", `{"status":"GRANTED"}`, http.StatusBadRequest},
+		{"team", http.MethodPost, deployments + "0/approve", "", http.StatusAccepted},
+		{"team", http.MethodPost, deployments + "1/approve", "", http.StatusForbidden},
+		{"manager", http.MethodPost, deployments + "1/approve", "", http.StatusAccepted},
+		{"developer", http.MethodPatch, deployments + "1", `{"status":"PERFORMED"}`, http.StatusOK},
+		{"manager", http.MethodPost, "/products", `{"code":"siparium","name":"Siparium"}`, http.StatusForbidden},
+		{"admin", http.MethodPost, "/products", `{"code":"siparium","name":"Siparium"}`, http.StatusForbidden},
+		{"admin", http.MethodPatch, "/products/gaia", `{"name":"G.A.I.A."}`, http.StatusOK},
+		{"admin", http.MethodPost, "/assignments", `{"user":"carl","product":"gaia","role":"VIEWER"}`, http.StatusCreated},
+		{"admin", http.MethodPost, "/assignments", `{"user":"carl","role":"ADMIN"}`, http.StatusForbidden},
+		{"root", http.MethodPost, "/products", `{"code":"siparium","name":"Siparium"}`, http.StatusCreated},
+		{"viewer", http.MethodGet, "/products/siparium", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+	}
+
+	product, _ := store.GetProductByCode("gaia")
+	version, _ := store.GetVersionByCode(product, "1.0.0")
+	if version.Deployments[0].GrantedBy != "team" || version.Deployments[1].GrantedBy != "manager" {
+		t.Fatalf("unexpected approvers: %v", version.Deployments)
+	}
+}
+
+func TestApprovalPolicies(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "author", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "alice", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "bob", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+
+	production := "/products/gaia/versions/1.1.0/deployments/1"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"alice", http.MethodPut, "/products/gaia/policies/Production", `{"approvals":2,"excludeAuthor":true}`, http.StatusForbidden},
+		{"admin", http.MethodPut, "/products/gaia/policies/Production", `{"approvals":0}`, http.StatusBadRequest},
+		{"admin", http.MethodPut, "/products/gaia/policies/Production", `{"approvals":2,"excludeAuthor":true}`, http.StatusCreated},
+		{"admin", http.MethodPut, "/products/gaia/policies/*", `{"approvals":1}`, http.StatusCreated},
+		{"alice", http.MethodGet, "/products/gaia/policies/Production", "", http.StatusOK},
+		{"author", http.MethodPost, "/products/gaia/versions", `{"code":"1.1.0","author":"carl"}`, http.StatusCreated},
+		{"author", http.MethodPost, "/products/gaia/versions/1.1.0/deployments", `{"order":1,"environment":"Production"}`, http.StatusCreated},
+		{"author", http.MethodPost, production + "/approve", "", http.StatusForbidden},
+		{"alice", http.MethodPatch, production, `{"status":"GRANTED"}`, http.StatusBadRequest},
+		{"alice", http.MethodPut, production, `{"order":1,"environment":"Production","status":"GRANTED"}`, http.StatusBadRequest},
+		{"alice", http.MethodPost, "/products/gaia/versions/1.1.0/deployments", `{"order":2,"environment":"Production","status":"GRANTED"}`, http.StatusBadRequest},
+		{"alice", http.MethodPost, production + "/approve", "", http.StatusAccepted},
+		{"alice", http.MethodPost, production + "/approve", "", http.StatusConflict},
+		{"bob", http.MethodPost, production + "/approve", "", http.StatusAccepted},
+		{"bob", http.MethodPost, production + "/approve", "", http.StatusUnprocessableEntity},
+		{"admin", http.MethodDelete, "/products/gaia/policies/Production", "", http.StatusNoContent},
+		{"admin", http.MethodDelete, "/products/gaia/policies/Production", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		status := call(router, test.user, test.method, test.path, test.body)
+		if status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+		if test.path == production+"/approve" && status == http.StatusAccepted {
+			product, _ := store.GetProductByCode("gaia")
+			version, _ := store.GetVersionByCode(product, "1.1.0")
+			deployment := version.Deployments[0]
+			if granted := deployment.Status == model.GRANTED; granted != (test.user == "bob") {
+				t.Errorf("unexpected status after approval by %q: %s", test.user, deployment.Status)
+			}
+		}
+	}
+}
+
+func TestApprovalWithdrawal(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "integrator", Environment: "Integration", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "producer", Environment: "Production", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+
+	// an approval given for an environment must not count for another one
+	deployment := "/products/gaia/versions/1.0.0/deployments/0"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"admin", http.MethodPut, "/products/gaia/policies/*", `{"approvals":2}`, http.StatusCreated},
+		{"integrator", http.MethodPost, deployment + "/approve", "", http.StatusAccepted},
+		{"developer", http.MethodPatch, deployment, `{"environment":"Production"}`, http.StatusOK},
+		{"producer", http.MethodPost, deployment + "/approve", "", http.StatusAccepted},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+	}
+
+	product, _ := store.GetProductByCode("gaia")
+	version, _ := store.GetVersionByCode(product, "1.0.0")
+	read, _ := store.GetDeploymentByOrder(version, 0)
+	if read.Status != model.PENDING || len(read.Approvals) != 1 || read.Approvals[0].User != "producer" {
+		t.Fatalf("unexpected deployment after changing environment: %s", read)
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+
+	deployments := "/products/gaia/versions/1.0.0/deployments"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"manager", http.MethodPut, "/products/gaia/pipeline", `{"environments":["Integration","Quality","Production"]}`, http.StatusForbidden},
+		{"admin", http.MethodPut, "/products/gaia/pipeline", `{"environments":[]}`, http.StatusBadRequest},
+		{"admin", http.MethodPut, "/products/gaia/pipeline", `{"environments":["Integration","Integration"]}`, http.StatusConflict},
+		{"admin", http.MethodPut, "/products/gaia/pipeline", `{"environments":["Integration","Quality","Production"]}`, http.StatusOK},
+		{"manager", http.MethodGet, "/products/gaia/pipeline", "", http.StatusOK},
+		{"manager", http.MethodPost, deployments + "/1/approve", "", http.StatusConflict},
+		{"manager", http.MethodPost, deployments, `{"order":2,"environment":"Quality"}`, http.StatusCreated},
+		{"manager", http.MethodPost, deployments + "/2/approve", "", http.StatusConflict},
+		{"manager", http.MethodPost, deployments + "/0/approve", "", http.StatusAccepted},
+		{"manager", http.MethodPost, deployments + "/2/approve", "", http.StatusConflict},
+		{"manager", http.MethodPatch, deployments + "/0", `{"status":"PERFORMED"}`, http.StatusOK},
+		{"manager", http.MethodPost, deployments + "/2/approve", "", http.StatusAccepted},
+		{"manager", http.MethodPatch, deployments + "/2", `{"status":"PERFORMED"}`, http.StatusOK},
+		{"manager", http.MethodPost, deployments + "/1/approve", "", http.StatusAccepted},
+		{"admin", http.MethodDelete, "/products/gaia/pipeline", "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+	}
+
+	product, _ := store.GetProductByCode("gaia")
+	if stages, _ := store.GetPipeline(product); len(stages) != 0 {
+		t.Fatalf("unexpected pipeline after deletion: %v", stages)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+	)
+
+	deployments := "/products/gaia/versions/1.0.0/deployments/"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"developer", http.MethodPost, deployments + "0/reject", `{"reason":"not ready"}`, http.StatusForbidden},
+		{"manager", http.MethodPost, deployments + "0/reject", `{}`, http.StatusBadRequest},
+		{"manager", http.MethodPost, deployments + "0/reject", `{"reason":"not ready"}`, http.StatusOK},
+		{"manager", http.MethodPost, deployments + "0/reject", `{"reason":"still not ready"}`, http.StatusUnprocessableEntity},
+		{"manager", http.MethodPost, deployments + "0/approve", "", http.StatusUnprocessableEntity},
+		{"developer", http.MethodPatch, deployments + "0", `{"status":"PENDING"}`, http.StatusUnprocessableEntity},
+		{"manager", http.MethodPost, deployments + "1/approve", "", http.StatusAccepted},
+		{"developer", http.MethodPost, deployments + "1/rollback", `{"reason":"oops"}`, http.StatusUnprocessableEntity},
+		{"developer", http.MethodPatch, deployments + "1", `{"status":"PERFORMED","reason":"deployed by pipeline"}`, http.StatusOK},
+		{"developer", http.MethodPatch, deployments + "1", `{"environment":"Integration"}`, http.StatusUnprocessableEntity},
+		{"developer", http.MethodPost, strings.TrimSuffix(deployments, "/"), `{"order":2,"environment":"Quality","status":"PERFORMED"}`, http.StatusUnprocessableEntity},
+		{"developer", http.MethodPost, strings.TrimSuffix(deployments, "/"), `{"order":2,"environment":"Quality"}`, http.StatusCreated},
+		{"developer", http.MethodPatch, deployments + "2", `{"order":1,"environment":"Staging"}`, http.StatusConflict},
+		{"developer", http.MethodPatch, deployments + "2", `{"order":3,"environment":"Staging","status":"CANCELLED","reason":"superseded"}`, http.StatusOK},
+		{"developer", http.MethodPost, deployments + "1/fail", `{"reason":"health checks failing"}`, http.StatusOK},
+		{"developer", http.MethodPost, deployments + "1/rollback", `{"reason":"restored 0.9.0"}`, http.StatusOK},
+		{"developer", http.MethodPost, deployments + "1/cancel", `{"reason":"too late"}`, http.StatusUnprocessableEntity},
+		{"developer", http.MethodGet, deployments + "1", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+	}
+
+	product, _ := store.GetProductByCode("gaia")
+	version, _ := store.GetVersionByCode(product, "1.0.0")
+	deployment, _ := store.GetDeploymentByOrder(version, 1)
+	expected := []model.Status{model.GRANTED, model.PERFORMED, model.FAILED, model.ROLLED_BACK}
+	if deployment.Status != model.ROLLED_BACK || len(deployment.Transitions) != len(expected) {
+		t.Fatalf("unexpected deployment: %s", deployment)
+	}
+	for i, transition := range deployment.Transitions {
+		if transition.To != expected[i] {
+			t.Errorf("transition %d: expected %s, got %s", i, expected[i], transition.To)
+		}
+	}
+	if performed := deployment.Transitions[1]; performed.User != "developer" || performed.Reason != "deployed by pipeline" {
+		t.Errorf("unexpected transition: %s", performed)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	router, _ := serve(t,
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+
+	deployments := "/products/gaia/versions/1.0.0/deployments/"
+	for _, request := range []struct {
+		user   string
+		method string
+		path   string
+		body   string
+	}{
+		{"admin", http.MethodPatch, "/products/gaia", `{"name":"G.A.I.A."}`},
+		{"manager", http.MethodPost, deployments + "0/approve", ""},
+		{"manager", http.MethodPost, deployments + "1/reject", `{"reason":"not yet"}`},
+		{"admin", http.MethodPut, "/products/gaia/policies/*", `{"approvals":2}`},
+	} {
+		if status := call(router, request.user, request.method, request.path, request.body); status >= http.StatusBadRequest {
+			t.Fatalf("%s %s as %q: unexpected status %d", request.method, request.path, request.user, status)
+		}
+	}
+
+	if status := call(router, "manager", http.MethodGet, "/audit?product=gaia", ""); status != http.StatusForbidden {
+		t.Fatalf("expected status %d reading the audit log as a release manager, got %d", http.StatusForbidden, status)
+	}
+	if status := call(router, "admin", http.MethodGet, "/audit?from=yesterday", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d with an invalid time range, got %d", http.StatusBadRequest, status)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/audit?product=gaia&user=manager&from="+url.QueryEscape(time.Now().Add(-time.Minute).Format(time.RFC3339)), nil)
+	request.Header.Set("X-User", "admin")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var response struct {
+		Audit []AuditInfo `json:"audit"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", recorder.Code, recorder.Body)
+	}
+	if len(response.Audit) != 2 || response.Audit[0].Action != model.APPROVE || response.Audit[1].Action != model.TRANSITION {
+		t.Fatalf("unexpected audit records: %+v", response.Audit)
+	}
+	var before, after model.Deployment
+	if err := json.Unmarshal(response.Audit[1].Before, &before); err != nil || before.Status != model.PENDING {
+		t.Fatalf("unexpected state before the transition: %s (%v)", response.Audit[1].Before, err)
+	}
+	if err := json.Unmarshal(response.Audit[1].After, &after); err != nil || after.Status != model.REJECTED {
+		t.Fatalf("unexpected state after the transition: %s (%v)", response.Audit[1].After, err)
+	}
+	if response.Audit[1].Key != "gaia/1.0.0/1" || response.Audit[1].User != "manager" {
+		t.Fatalf("unexpected audit record: %+v", response.Audit[1])
+	}
+}
+
+// failingAudit is a store which cannot append audit records.
+type failingAudit struct {
+	model.Store
+}
+
+func (failingAudit) AppendAuditRecord(*model.AuditRecord) error {
+	return errors.New("audit log unavailable")
+}
+
+func (s failingAudit) Atomically(changes func(model.Store) error) error {
+	return s.Store.Atomically(func(store model.Store) error {
+		return changes(failingAudit{store})
+	})
+}
+
+func TestAuditFailure(t *testing.T) {
+	_, store := serve(t, model.Assignment{User: "admin", Role: model.ADMIN})
+	events := &recorder{}
+	router := New(failingAudit{store}, WithAuthenticators(userAuthenticator{}), WithListeners(events))
+
+	// the change is rolled back as it cannot be audited, and no event is
+	// published for it
+	if status := call(router, "admin", http.MethodPatch, "/products/gaia", `{"name":"G.A.I.A."}`); status != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, status)
+	}
+	if product, _ := store.GetProductByCode("gaia"); product.Name == "G.A.I.A." {
+		t.Fatalf("unexpected product after failed audit: %v", product)
+	}
+	if records, _ := store.GetAuditRecords(model.AuditFilter{}); len(records) != 0 {
+		t.Fatalf("unexpected audit records: %v", records)
+	}
+	if events := events.wait(0); len(events) != 0 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	unsigned, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+	)
+	token := "/products/gaia/versions/1.0.0/deployments/0/token"
+	if status := call(unsigned, "viewer", http.MethodGet, token, ""); status != http.StatusNotImplemented {
+		t.Fatalf("expected status %d without a signing key, got %d", http.StatusNotImplemented, status)
+	}
+
+	_, retired, _ := ed25519.GenerateKey(rand.Reader)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	router := New(store, WithAuthenticators(userAuthenticator{}), WithSigner(signing.NewSigner(key), retired.Public().(ed25519.PublicKey)))
+	if status := call(router, "viewer", http.MethodGet, token, ""); status != http.StatusConflict {
+		t.Fatalf("expected status %d for a PENDING deployment, got %d", http.StatusConflict, status)
+	}
+
+	digest := "sha256:" + strings.Repeat("5e", 32)
+	product, _ := store.GetProductByCode("gaia")
+	version, _ := store.GetVersionByCode(product, "1.0.0")
+	build := model.Build{VersionID: version.ID, Number: 1}
+	if err := store.CreateBuild(&build); err != nil {
+		t.Fatalf("error creating build: %v", err)
+	}
+	if err := store.CreateArtifact(&model.Artifact{BuildID: build.ID, Name: "server.jar", Digest: digest}); err != nil {
+		t.Fatalf("error creating artifact: %v", err)
+	}
+	deployment, _ := store.GetDeploymentByOrder(version, 0)
+	if err := store.SetDeploymentArtifacts(&deployment, []string{digest}); err != nil {
+		t.Fatalf("error setting deployed artifacts: %v", err)
+	}
+	if status := call(router, "manager", http.MethodPost, "/products/gaia/versions/1.0.0/deployments/0/approve", ""); status != http.StatusAccepted {
+		t.Fatalf("unexpected status approving deployment: %d", status)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/keys", nil)
+	request.Header.Set("X-User", "viewer")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var keys struct {
+		Keys []signing.JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &keys); err != nil || len(keys.Keys) != 2 {
+		t.Fatalf("unexpected keys: %d %s", recorder.Code, recorder.Body)
+	}
+	public, err := keys.Keys[0].PublicKey()
+	if err != nil || !public.Equal(key.Public()) {
+		t.Fatalf("unexpected signing key: %v (%v)", keys.Keys[0], err)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, token, nil)
+	request.Header.Set("X-User", "viewer")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", recorder.Code, recorder.Body)
+	}
+	claims, err := signing.Verify(response.Token, []ed25519.PublicKey{public})
+	if err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+	if claims.Product != "gaia" || claims.Version != "1.0.0" || claims.Environment != "Integration" || claims.GrantedBy != "manager" || len(claims.Approvers) != 1 {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+	if lifetime := claims.Expires.Sub(claims.Issued); lifetime != defaultTokenLifetime {
+		t.Fatalf("unexpected token lifetime: %v", lifetime)
+	}
+	if len(claims.Digests) != 1 || claims.Digests[0] != digest {
+		t.Fatalf("unexpected deployed artifacts in claims: %v", claims.Digests)
+	}
+}
+
+// recorder is a Listener keeping track of the events it is notified of.
+type recorder struct {
+	mutex  sync.Mutex
+	events []model.Event
+}
+
+func (r *recorder) Publish(event model.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+// wait returns the events notified so far, once there are at least the given
+// number of them or, failing that, after a while.
+func (r *recorder) wait(count int) []model.Event {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mutex.Lock()
+		events := append([]model.Event(nil), r.events...)
+		r.mutex.Unlock()
+		if len(events) >= count || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	_, store := serve(t,
+		model.Assignment{User: "manager", Role: model.RELEASE_MANAGER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+	events := &recorder{}
+	router := New(store, WithAuthenticators(userAuthenticator{}), WithListeners(events))
+
+	webhooks := "/products/gaia/webhooks"
+	if status := call(router, "manager", http.MethodPost, webhooks, `{"url":"http://localhost/hook"}`); status != http.StatusForbidden {
+		t.Fatalf("expected status %d creating a webhook as a release manager, got %d", http.StatusForbidden, status)
+	}
+	if status := call(router, "admin", http.MethodPost, webhooks, `{"url":"http://localhost/hook","events":["deployment.[granted"]}`); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d with an invalid event pattern, got %d", http.StatusBadRequest, status)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, webhooks, bytes.NewBufferString(`{"url":"http://localhost/hook","events":["deployment.*"]}`))
+	request.Header.Set("X-User", "admin")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	var created struct {
+		Webhook WebhookInfo `json:"webhook"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &created); err != nil || response.Code != http.StatusCreated || len(created.Webhook.Secret) != 64 {
+		t.Fatalf("unexpected response: %d %s", response.Code, response.Body)
+	}
+	webhook := webhooks + "/" + strconv.FormatUint(uint64(created.Webhook.ID), 10)
+	for _, request := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPut, webhook, `{"url":"http://localhost/hook","events":["deployment.granted"],"active":false}`, http.StatusOK},
+		{http.MethodGet, webhook, "", http.StatusOK},
+		{http.MethodGet, webhook + "/deliveries?limit=10", "", http.StatusOK},
+		{http.MethodGet, "/products/gaia/webhooks/999", "", http.StatusNotFound},
+	} {
+		if status := call(router, "admin", request.method, request.path, request.body); status != request.status {
+			t.Fatalf("%s %s: expected status %d, got %d", request.method, request.path, request.status, status)
+		}
+	}
+	if read, _ := store.GetWebhook(created.Webhook.ID); read.Active || read.Secret != created.Webhook.Secret {
+		t.Fatalf("unexpected webhook after update: %v", read)
+	}
+
+	if status := call(router, "admin", http.MethodPost, "/products/gaia/versions", `{"code":"1.0.1"}`); status != http.StatusCreated {
+		t.Fatalf("unexpected status creating version: %d", status)
+	}
+	if status := call(router, "manager", http.MethodPost, "/products/gaia/versions/1.0.0/deployments/0/approve", ""); status != http.StatusAccepted {
+		t.Fatalf("unexpected status approving deployment: %d", status)
+	}
+	if events := events.wait(2); len(events) != 2 || events[0].Type != model.VERSION_CREATED || events[1].Type != model.StatusEvent(model.GRANTED) || events[1].Key != "gaia/1.0.0/0" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	if status := call(router, "admin", http.MethodDelete, webhook, ""); status != http.StatusNoContent {
+		t.Fatalf("unexpected status deleting webhook: %d", status)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", ProductID: 1, Role: model.VIEWER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+
+	for _, request := range []struct {
+		user   string
+		method string
+		body   string
+		status int
+	}{
+		{"", http.MethodGet, "", http.StatusUnauthorized},
+		{"viewer", http.MethodGet, "", http.StatusNotFound},
+		{"viewer", http.MethodPut, `{"email":"not an address"}`, http.StatusBadRequest},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","events":["deployment.[granted"]}`, http.StatusBadRequest},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","events":["deployment.*"]}`, http.StatusForbidden},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","products":["g*"],"events":["deployment.*"]}`, http.StatusForbidden},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","products":["uranus"],"events":["deployment.*"]}`, http.StatusUnprocessableEntity},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","products":["gaia"],"events":["deployment.*"]}`, http.StatusOK},
+		{"viewer", http.MethodPut, `{"email":"viewer@example.com","products":["gaia"],"events":["deployment.granted"]}`, http.StatusOK},
+		{"viewer", http.MethodGet, "", http.StatusOK},
+		{"admin", http.MethodPut, `{"email":"admin@example.com"}`, http.StatusForbidden},
+		{"admin", http.MethodPut, `{"email":"admin@example.com","products":["gaia"]}`, http.StatusOK},
+		{"admin", http.MethodDelete, "", http.StatusNoContent},
+		{"admin", http.MethodDelete, "", http.StatusNotFound},
+	} {
+		if status := call(router, request.user, request.method, "/preferences", request.body); status != request.status {
+			t.Fatalf("%s /preferences as %q: expected status %d, got %d", request.method, request.user, request.status, status)
+		}
+	}
+
+	preferences, err := store.GetPreferences()
+	if err != nil || len(preferences) != 1 || preferences[0].User != "viewer" || preferences[0].Events != "deployment.granted" {
+		t.Fatalf("unexpected preferences: %v (%v)", preferences, err)
+	}
+	records, err := store.GetAuditRecords(model.AuditFilter{User: "viewer"})
+	if err != nil || len(records) != 2 || records[0].Action != model.CREATE || records[1].Action != model.UPDATE || records[1].Entity != "preference" {
+		t.Fatalf("unexpected audit records: %v (%v)", records, err)
+	}
+}
+
+// stream opens the event stream at the given path on behalf of the given
+// user, resuming after the given event ID (if any), and returns a channel
+// receiving the IDs and types of the events.
+func stream(t *testing.T, ts *httptest.Server, user string, path string, last string) <-chan string {
+	request, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	request.Header.Set("X-User", user)
+	if last != "" {
+		request.Header.Set("Last-Event-ID", last)
+	}
+	response, err := ts.Client().Do(request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response opening event stream: %v (%v)", response, err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+		var id string
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			switch line := scanner.Text(); {
+			case strings.HasPrefix(line, "id: "):
+				id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				events <- id + " " + line[7:]
+			}
+		}
+	}()
+	return events
+}
+
+// next returns the next event received from the given stream.
+func next(t *testing.T, events <-chan string) string {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for an event")
+		return ""
+	}
+}
+
+func TestEvents(t *testing.T) {
+	router, _ := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "admin", Role: model.ADMIN},
+	)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+
+	if status := call(router, "viewer", http.MethodGet, "/events", ""); status != http.StatusForbidden {
+		t.Fatalf("expected status %d streaming all products, got %d", http.StatusForbidden, status)
+	}
+	if status := call(router, "viewer", http.MethodGet, "/events?product=uranus", ""); status != http.StatusNotFound {
+		t.Fatalf("expected status %d streaming an unknown product, got %d", http.StatusNotFound, status)
+	}
+	if status := call(router, "viewer", http.MethodGet, "/events?product=gaia&lastEventId=x", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d with an invalid last event id, got %d", http.StatusBadRequest, status)
+	}
+
+	events := stream(t, ts, "viewer", "/events?product=gaia", "")
+	if status := call(router, "admin", http.MethodPost, "/products/gaia/versions", `{"code":"1.0.1"}`); status != http.StatusCreated {
+		t.Fatalf("unexpected status creating version: %d", status)
+	}
+	created := next(t, events)
+	if !strings.HasSuffix(created, " version.created") {
+		t.Fatalf("unexpected event: %q", created)
+	}
+	if status := call(router, "admin", http.MethodPost, "/products/gaia/versions/1.0.0/deployments/1/cancel", `{"reason":"superseded"}`); status != http.StatusOK {
+		t.Fatalf("unexpected status cancelling deployment: %d", status)
+	}
+	cancelled := next(t, events)
+	if !strings.HasSuffix(cancelled, " deployment.cancelled") {
+		t.Fatalf("unexpected event: %q", cancelled)
+	}
+
+	resumed := stream(t, ts, "viewer", "/events?product=gaia", strings.Fields(created)[0])
+	if event := next(t, resumed); event != cancelled {
+		t.Fatalf("expected missed event %q on resumption, got %q", cancelled, event)
+	}
+}
+
+// slowReader is a reader which is slow to return its first bytes.
+type slowReader struct {
+	io.Reader
+	once sync.Once
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { time.Sleep(50 * time.Millisecond) })
+	return r.Reader.Read(p)
+}
+
+// slowAudit is a store which is slow to return from its first append to the
+// audit log.
+type slowAudit struct {
+	model.Store
+	appended *int32
+}
+
+func (s slowAudit) AppendAuditRecord(record *model.AuditRecord) error {
+	err := s.Store.AppendAuditRecord(record)
+	if atomic.AddInt32(s.appended, 1) == 1 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+func (s slowAudit) Atomically(changes func(model.Store) error) error {
+	return s.Store.Atomically(func(store model.Store) error {
+		return changes(slowAudit{store, s.appended})
+	})
+}
+
+func TestEventOrder(t *testing.T) {
+	_, store := serve(t, model.Assignment{User: "admin", Role: model.ADMIN})
+	events := &recorder{}
+	router := New(slowAudit{store, new(int32)}, WithAuthenticators(userAuthenticator{}), WithListeners(events))
+
+	// concurrent changes must be notified in the order of their records, or
+	// streams would skip the events notified after those following them
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(patch int) {
+			defer wg.Done()
+			call(router, "admin", http.MethodPost, "/products/gaia/versions", `{"code":"1.1.`+strconv.Itoa(patch)+`"}`)
+		}(i)
+	}
+	wg.Wait()
+	notified := events.wait(20)
+	if len(notified) != 20 {
+		t.Fatalf("expected 20 events, got %d", len(notified))
+	}
+	for i := 1; i < len(notified); i++ {
+		if notified[i].ID <= notified[i-1].ID {
+			t.Fatalf("event %d notified after event %d", notified[i].ID, notified[i-1].ID)
+		}
+	}
+}
+
+// blockingListener is a Listener which does not return until it is released.
+type blockingListener chan struct{}
+
+func (l blockingListener) Publish(model.Event) {
+	<-l
+}
+
+func TestBlockingListener(t *testing.T) {
+	_, store := serve(t, model.Assignment{User: "admin", Role: model.ADMIN})
+	release := make(blockingListener)
+	defer close(release)
+	events := &recorder{}
+	router := New(store, WithAuthenticators(userAuthenticator{}), WithListeners(release, events))
+
+	// changes are not held up by the listeners of their events, nor by those
+	// of the events of other changes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 3; i++ {
+			call(router, "admin", http.MethodPost, "/products/gaia/versions", `{"code":"1.1.`+strconv.Itoa(i)+`"}`)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("changes held up by a blocking listener")
+	}
+	if events := events.wait(0); len(events) != 0 {
+		t.Fatalf("events notified out of order: %v", events)
+	}
+	release <- struct{}{}
+	if events := events.wait(1); len(events) != 1 || events[0].Key != "gaia/1.1.1" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestVersionQueries(t *testing.T) {
+	router, _ := serve(t, model.Assignment{User: "admin", Role: model.ADMIN})
+	for code, status := range map[string]int{"1.0.10": http.StatusCreated, "1.0.2": http.StatusCreated, "2.0.0-rc.1": http.StatusCreated, "1.1": http.StatusBadRequest, "v1.2.0": http.StatusBadRequest} {
+		if actual := call(router, "admin", http.MethodPost, "/products/gaia/versions", `{"code":"`+code+`"}`); actual != status {
+			t.Fatalf("expected status %d creating version %q, got %d", status, code, actual)
+		}
+	}
+	if status := call(router, "admin", http.MethodPatch, "/products/gaia/versions/1.0.2", `{"code":"1.0"}`); status != http.StatusBadRequest {
+		t.Fatalf("expected status %d patching an invalid code, got %d", http.StatusBadRequest, status)
+	}
+
+	get := func(path string) (int, []string) {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("X-User", "admin")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		var body struct {
+			Versions []struct {
+				Code string `json:"code"`
+			} `json:"versions"`
+			Version struct {
+				Code string `json:"code"`
+			} `json:"version"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &body)
+		codes := []string{}
+		for _, version := range body.Versions {
+			codes = append(codes, version.Code)
+		}
+		if body.Version.Code != "" {
+			codes = append(codes, body.Version.Code)
+		}
+		return response.Code, codes
+	}
+	for _, test := range []struct {
+		path   string
+		status int
+		codes  string
+	}{
+		{"/products/gaia/versions", http.StatusOK, "1.0.0 1.0.2 1.0.10 2.0.0-rc.1"},
+		{"/products/gaia/versions?range=" + url.QueryEscape(">=1.0.1 <2.0.0"), http.StatusOK, "1.0.2 1.0.10"},
+		{"/products/gaia/versions?range=" + url.QueryEscape("^2.0.0-rc.0"), http.StatusOK, "2.0.0-rc.1"},
+		{"/products/gaia/versions?stable=true", http.StatusOK, "1.0.0 1.0.2 1.0.10"},
+		{"/products/gaia/versions?range=" + url.QueryEscape("=>1"), http.StatusBadRequest, ""},
+		{"/products/gaia/versions/latest", http.StatusOK, "2.0.0-rc.1"},
+		{"/products/gaia/versions/latest-stable", http.StatusOK, "1.0.10"},
+		{"/products/gaia/versions/latest?range=" + url.QueryEscape("<1.0.5"), http.StatusOK, "1.0.2"},
+		{"/products/gaia/versions/latest?range=3.x", http.StatusNotFound, ""},
+	} {
+		status, codes := get(test.path)
+		if status != test.status || strings.Join(codes, " ") != test.codes {
+			t.Errorf("GET %s: expected %d %q, got %d %q", test.path, test.status, test.codes, status, strings.Join(codes, " "))
+		}
+	}
+}
+
+func TestLegacyVersions(t *testing.T) {
+	router, store := serve(t, model.Assignment{User: "admin", Role: model.ADMIN})
+	product, _ := store.GetProductByCode("gaia")
+	if err := store.CreateVersion(&model.Version{ProductID: product.ID, Code: "R2019-b", Legacy: true}); err != nil {
+		t.Fatalf("error creating legacy version: %v", err)
+	}
+
+	// legacy versions can be updated as long as they keep their code, or
+	// are given a semantic one
+	legacy := "/products/gaia/versions/R2019-b"
+	for _, request := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPut, legacy, `{"code":"R2019-b","description":"Winter release"}`, http.StatusOK},
+		{http.MethodPatch, legacy, `{"code":"R2019-b","branch":"r2019b"}`, http.StatusOK},
+		{http.MethodPut, legacy, `{"code":"R2019-c"}`, http.StatusBadRequest},
+		{http.MethodPatch, legacy, `{"code":"R2019-c"}`, http.StatusBadRequest},
+		{http.MethodPut, "/products/gaia/versions/1.0.0", `{"code":"R2019-b"}`, http.StatusBadRequest},
+	} {
+		if status := call(router, "admin", request.method, request.path, request.body); status != request.status {
+			t.Fatalf("%s %s %s: expected status %d, got %d", request.method, request.path, request.body, request.status, status)
+		}
+	}
+	version, err := store.GetVersionByCode(product, "R2019-b")
+	if err != nil || !version.Legacy || version.Description != "Winter release" || version.Branch != "r2019b" {
+		t.Fatalf("unexpected legacy version: %v (%v)", version, err)
+	}
+
+	if status := call(router, "admin", http.MethodPut, legacy, `{"code":"0.9.0"}`); status != http.StatusOK {
+		t.Fatalf("unexpected status giving a semantic code: %d", status)
+	}
+	if version, err := store.GetVersionByCode(product, "0.9.0"); err != nil || version.Legacy {
+		t.Fatalf("unexpected version with a semantic code: %v (%v)", version, err)
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+	)
+
+	request := httptest.NewRequest(http.MethodGet, "/products/gaia/versions/next?bump=minor", nil)
+	request.Header.Set("X-User", "viewer")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"code":"1.1.0"`) || !strings.Contains(response.Body.String(), `"branch":"ver_1_1_0"`) {
+		t.Fatalf("unexpected suggestion: %d %s", response.Code, response.Body)
+	}
+	for path, status := range map[string]int{"/products/gaia/versions/next": http.StatusBadRequest, "/products/gaia/versions/next?bump=build": http.StatusBadRequest, "/products/uranus/versions/next?bump=patch": http.StatusNotFound} {
+		if actual := call(router, "viewer", http.MethodGet, path, ""); actual != status {
+			t.Errorf("GET %s: expected status %d, got %d", path, status, actual)
+		}
+	}
+
+	tests := []struct {
+		user   string
+		body   string
+		status int
+		code   string
+		branch string
+	}{
+		{"viewer", `{"bump":"patch"}`, http.StatusForbidden, "", ""},
+		{"developer", `{"bump":"patch"}`, http.StatusCreated, "1.0.1", "ver_1_0_1"},
+		{"developer", `{"bump":"prerelease","preid":"beta","branch":"release"}`, http.StatusCreated, "1.0.2-beta.0", "release"},
+		{"developer", `{"bump":"major","description":"Next generation"}`, http.StatusCreated, "2.0.0", "ver_2_0_0"},
+		{"developer", `{"bump":"prerelease","preid":"r.c"}`, http.StatusBadRequest, "", ""},
+		{"developer", `{"bump":"build"}`, http.StatusBadRequest, "", ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/products/gaia/versions/next", strings.NewReader(test.body))
+		request.Header.Set("X-User", test.user)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("%s allocating %s: expected status %d, got %d", test.user, test.body, test.status, response.Code)
+			continue
+		}
+		if test.status != http.StatusCreated {
+			continue
+		}
+		if location := response.Header().Get("Location"); !strings.HasSuffix(location, "/products/gaia/versions/"+test.code) {
+			t.Errorf("unexpected location of version %s: %q", test.code, location)
+		}
+		product, _ := store.GetProductByCode("gaia")
+		version, err := store.GetVersionByCode(product, test.code)
+		if err != nil || version.Branch != test.branch || version.Author != test.user {
+			t.Errorf("unexpected version %s: %v (%v)", test.code, version, err)
+		}
+	}
+}
+
+func TestBuilds(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+	)
+
+	builds := "/products/gaia/versions/1.0.0/builds"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"viewer", http.MethodPost, builds, `{"number":1}`, http.StatusForbidden},
+		{"developer", http.MethodPost, builds, `{"number":7,"commit":"9f86d081884c7d65","jobUrl":"https://ci.example.com/job/gaia/7"}`, http.StatusCreated},
+		{"developer", http.MethodPost, builds, `{"number":8,"status":"FAILED","started":"2024-01-01T10:00:00Z","finished":"2024-01-01T10:05:00Z"}`, http.StatusCreated},
+		{"developer", http.MethodPost, builds, `{"number":7}`, http.StatusConflict},
+		{"developer", http.MethodPost, builds, `{"number":0}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, builds, `{"number":9,"commit":"not-a-sha"}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, builds, `{"number":9,"status":"DONE"}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, "/products/gaia/versions/9.9.9/builds", `{"number":1}`, http.StatusNotFound},
+		{"viewer", http.MethodGet, builds + "/7", "", http.StatusOK},
+		{"viewer", http.MethodGet, builds + "/9", "", http.StatusNotFound},
+		{"viewer", http.MethodGet, builds + "/latest", "", http.StatusBadRequest},
+		{"viewer", http.MethodPatch, builds + "/7", `{"status":"SUCCEEDED"}`, http.StatusForbidden},
+		{"developer", http.MethodPatch, builds + "/7", `{"status":"SUCCEEDED","finished":"2030-01-01T00:00:00Z","log":"BUILD SUCCESSFUL"}`, http.StatusOK},
+		{"developer", http.MethodPut, builds + "/8", `{"number":8,"status":"ABORTED"}`, http.StatusOK},
+		{"developer", http.MethodPatch, builds + "/8", `{"number":7}`, http.StatusConflict},
+		{"developer", http.MethodDelete, builds + "/8", "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s %s as %s: expected status %d, got %d", test.method, test.path, test.body, test.user, test.status, status)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, builds, nil)
+	request.Header.Set("X-User", "viewer")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	var body struct {
+		Builds []struct {
+			Number   int        `json:"number"`
+			Commit   string     `json:"commit"`
+			Status   string     `json:"status"`
+			Finished *time.Time `json:"finished"`
+			Log      string     `json:"log"`
+		} `json:"builds"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || len(body.Builds) != 1 {
+		t.Fatalf("unexpected builds: %s (%v)", response.Body, err)
+	}
+	if build := body.Builds[0]; build.Number != 7 || build.Commit != "9f86d081884c7d65" || build.Status != "SUCCEEDED" || build.Finished == nil || build.Log != "" {
+		t.Fatalf("unexpected build: %+v", build)
+	}
+
+	records, _ := store.GetAuditRecords(model.AuditFilter{User: "developer"})
+	if len(records) != 5 || records[0].Entity != "build" || records[0].Key != "gaia/1.0.0/builds/7" {
+		t.Fatalf("unexpected audit records: %v", records)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+		model.Assignment{User: "integrator", Environment: "Integration", Role: model.DEVELOPER},
+	)
+	server := "sha256:" + strings.Repeat("5e", 32)
+	client := "sha256:" + strings.Repeat("c1", 32)
+
+	// another product, which the users cannot view, built from the same sources
+	other := model.Product{Code: "hera", Versions: []model.Version{{Code: "2.0.0"}}}
+	if err := store.CreateProduct(&other); err != nil {
+		t.Fatalf("error creating product: %v", err)
+	}
+	build := model.Build{VersionID: other.Versions[0].ID, Number: 1}
+	if err := store.CreateBuild(&build); err != nil {
+		t.Fatalf("error creating build: %v", err)
+	}
+	if err := store.CreateArtifact(&model.Artifact{BuildID: build.ID, Name: "server.jar", Digest: server}); err != nil {
+		t.Fatalf("error creating artifact: %v", err)
+	}
+
+	artifacts := "/products/gaia/versions/1.0.0/builds/3/artifacts"
+	deployments := "/products/gaia/versions/1.0.0/deployments"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"developer", http.MethodPost, "/products/gaia/versions/1.0.0/builds", `{"number":3}`, http.StatusCreated},
+		{"viewer", http.MethodPost, artifacts, `{"name":"server.jar","digest":"` + server + `"}`, http.StatusForbidden},
+		{"developer", http.MethodPost, artifacts, `{"name":"server.jar","type":"jar","size":2048,"digest":"` + server + `","uri":"https://repo.example.com/gaia/server.jar"}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"client.zip","size":512,"digest":"` + client + `"}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"client.zip","digest":"` + client + `"}`, http.StatusConflict},
+		{"developer", http.MethodPost, artifacts, `{"name":"client.tgz","digest":"md5:0123"}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, artifacts, `{"name":"lib/client.tgz","digest":"` + client + `"}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, artifacts, `{"name":"client.tgz","size":-1,"digest":"` + client + `"}`, http.StatusBadRequest},
+		{"developer", http.MethodPost, "/products/gaia/versions/1.0.0/builds/4/artifacts", `{"name":"client.zip","digest":"` + client + `"}`, http.StatusNotFound},
+		{"viewer", http.MethodGet, artifacts, "", http.StatusOK},
+		{"viewer", http.MethodGet, artifacts + "/server.jar", "", http.StatusOK},
+		{"viewer", http.MethodGet, artifacts + "/server.war", "", http.StatusNotFound},
+		{"integrator", http.MethodPut, deployments + "/1/artifacts", `{"digests":["` + server + `"]}`, http.StatusForbidden},
+		{"integrator", http.MethodPut, deployments + "/0/artifacts", `{"digests":["` + server + `","sha256:` + strings.Repeat("00", 32) + `"]}`, http.StatusUnprocessableEntity},
+		{"integrator", http.MethodPut, deployments + "/0/artifacts", `{"digests":["sha256:XYZ"]}`, http.StatusBadRequest},
+		{"integrator", http.MethodPut, deployments + "/0/artifacts", `{"digests":["` + server + `","` + client + `"]}`, http.StatusOK},
+		{"developer", http.MethodPost, deployments + "/0/cancel", `{"reason":"superseded"}`, http.StatusOK},
+		{"integrator", http.MethodPut, deployments + "/0/artifacts", `{"digests":["` + server + `"]}`, http.StatusConflict},
+		{"developer", http.MethodDelete, artifacts + "/client.zip", "", http.StatusNoContent},
+		{"viewer", http.MethodGet, "/artifacts/sha256:0123", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s %s as %s: expected status %d, got %d", test.method, test.path, test.body, test.user, test.status, status)
+		}
+	}
+
+	get := func(path string, body interface{}) {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("X-User", "viewer")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if err := json.Unmarshal(response.Body.Bytes(), body); response.Code != http.StatusOK || err != nil {
+			t.Fatalf("unexpected response to GET %s: %d %s (%v)", path, response.Code, response.Body, err)
+		}
+	}
+
+	var deployment struct {
+		Deployment struct {
+			Artifacts []struct {
+				Digest string `json:"digest"`
+			} `json:"artifacts"`
+		} `json:"deployment"`
+	}
+	get(deployments+"/0", &deployment)
+	if len(deployment.Deployment.Artifacts) != 2 {
+		t.Fatalf("unexpected deployed artifacts: %v", deployment.Deployment.Artifacts)
+	}
+
+	var found struct {
+		Artifacts []struct {
+			Product string `json:"product"`
+			Version string `json:"version"`
+			Build   int    `json:"build"`
+			Name    string `json:"name"`
+			Size    int64  `json:"size"`
+		} `json:"artifacts"`
+		Deployments []struct {
+			Product     string `json:"product"`
+			Version     string `json:"version"`
+			Order       int    `json:"order"`
+			Environment string `json:"environment"`
+		} `json:"deployments"`
+	}
+	get("/artifacts/"+server, &found)
+	if len(found.Artifacts) != 1 || found.Artifacts[0].Product != "gaia" || found.Artifacts[0].Build != 3 || found.Artifacts[0].Size != 2048 {
+		t.Fatalf("unexpected artifacts found: %+v", found.Artifacts)
+	}
+	if len(found.Deployments) != 1 || found.Deployments[0].Version != "1.0.0" || found.Deployments[0].Environment != "Integration" {
+		t.Fatalf("unexpected deployments found: %+v", found.Deployments)
+	}
+	get("/artifacts/"+client, &found)
+	if len(found.Artifacts) != 0 || len(found.Deployments) != 1 {
+		t.Fatalf("unexpected matches of a deleted artifact: %+v", found)
+	}
+
+	records, _ := store.GetAuditRecords(model.AuditFilter{User: "integrator"})
+	if len(records) != 1 || records[0].Entity != "deployment" || records[0].Action != model.UPDATE {
+		t.Fatalf("unexpected audit records: %v", records)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	router, store := serve(t,
+		model.Assignment{User: "viewer", Role: model.VIEWER},
+		model.Assignment{User: "developer", Role: model.DEVELOPER},
+	)
+	if err := store.CreateAssignment(&model.Assignment{User: "root", Role: model.ADMIN}); err != nil {
+		t.Fatalf("error assigning role: %v", err)
+	}
+	if status := call(router, "developer", http.MethodPut, "/products/gaia/versions/1.0.0/builds/1/artifacts/small.txt/content", "hello"); status != http.StatusNotImplemented {
+		t.Fatalf("expected artifact storage to be disabled, got status %d", status)
+	}
+	storage, err := blobs.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	router = New(store, WithAuthenticators(userAuthenticator{}), WithBlobs(storage, 0))
+
+	digest := func(contents string) string {
+		sum := sha256.Sum256([]byte(contents))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	small, large := "hello", strings.Repeat("x", 1000)
+	artifacts := "/products/gaia/versions/1.0.0/builds/1/artifacts"
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"developer", http.MethodPost, "/products/gaia/versions/1.0.0/builds", `{"number":1}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"small.txt","size":5,"digest":"` + digest(small) + `"}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"copy.txt","size":5,"digest":"` + digest(small) + `"}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"large.bin","size":1000,"digest":"` + digest(large) + `"}`, http.StatusCreated},
+		{"developer", http.MethodPost, artifacts, `{"name":"short.txt","size":4,"digest":"` + digest(small) + `"}`, http.StatusCreated},
+		{"developer", http.MethodPatch, "/products/gaia", `{"quota":600}`, http.StatusForbidden},
+		{"root", http.MethodPatch, "/products/gaia", `{"quota":600}`, http.StatusOK},
+		{"viewer", http.MethodPut, artifacts + "/small.txt/content", small, http.StatusForbidden},
+		{"developer", http.MethodPut, artifacts + "/small.txt/content", "hellO", http.StatusUnprocessableEntity},
+		{"developer", http.MethodPut, artifacts + "/short.txt/content", small, http.StatusUnprocessableEntity},
+		{"developer", http.MethodPut, artifacts + "/small.txt/content", small, http.StatusCreated},
+		{"developer", http.MethodPut, artifacts + "/small.txt/content", small, http.StatusOK},
+		{"developer", http.MethodPut, artifacts + "/copy.txt/content", small, http.StatusOK},
+		{"developer", http.MethodPut, artifacts + "/short.txt/content", small, http.StatusUnprocessableEntity},
+		{"developer", http.MethodDelete, artifacts + "/short.txt", "", http.StatusNoContent},
+		{"developer", http.MethodPut, artifacts + "/large.bin/content", large, http.StatusRequestEntityTooLarge},
+		{"developer", http.MethodPut, artifacts + "/missing.bin/content", large, http.StatusNotFound},
+		{"viewer", http.MethodGet, artifacts + "/large.bin/content", "", http.StatusNotFound},
+		{"viewer", http.MethodHead, artifacts + "/small.txt/content", "", http.StatusOK},
+		{"viewer", http.MethodGet, "/blobs/" + digest(small), "", http.StatusOK},
+		{"stranger", http.MethodGet, "/blobs/" + digest(small), "", http.StatusNotFound},
+		{"viewer", http.MethodGet, "/blobs/sha256:0123", "", http.StatusBadRequest},
+		{"developer", http.MethodPost, "/blobs/gc", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := call(router, test.user, test.method, test.path, test.body); status != test.status {
+			t.Errorf("%s %s %s as %s: expected status %d, got %d", test.method, test.path, test.body, test.user, test.status, status)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, artifacts+"/small.txt/content", nil)
+	request.Header.Set("X-User", "viewer")
+	request.Header.Set("Range", "bytes=1-2")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusPartialContent || response.Body.String() != "el" || response.Header().Get("ETag") != strconv.Quote(digest(small)) {
+		t.Fatalf("unexpected partial contents: %d %q %v", response.Code, response.Body, response.Header())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/products/gaia/storage", nil)
+	request.Header.Set("X-User", "viewer")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	var body struct {
+		Storage struct {
+			Quota int64 `json:"quota"`
+			Used  int64 `json:"used"`
+			Blobs int   `json:"blobs"`
+		} `json:"storage"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Storage.Quota != 600 || body.Storage.Used != 5 || body.Storage.Blobs != 1 {
+		t.Fatalf("unexpected storage: %s (%v)", response.Body, err)
+	}
+
+	// concurrent uploads, which all fit in the quota on their own, must not
+	// exceed it together
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < 4; i++ {
+		contents := strings.Repeat(strconv.Itoa(i), 300)
+		name := "part" + strconv.Itoa(i) + ".bin"
+		if status := call(router, "developer", http.MethodPost, artifacts, `{"name":"`+name+`","size":300,"digest":"`+digest(contents)+`"}`); status != http.StatusCreated {
+			t.Fatalf("error creating artifact %s: %d", name, status)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := httptest.NewRequest(http.MethodPut, artifacts+"/"+name+"/content", &slowReader{Reader: strings.NewReader(contents)})
+			request.Header.Set("X-User", "developer")
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code == http.StatusCreated {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("expected a single upload within the quota, got %d", created)
+	}
+
+	collect := func() (int, int64) {
+		request := httptest.NewRequest(http.MethodPost, "/blobs/gc", nil)
+		request.Header.Set("X-User", "root")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		var result struct {
+			Removed int   `json:"removed"`
+			Freed   int64 `json:"freed"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &result); response.Code != http.StatusOK || err != nil {
+			t.Fatalf("unexpected garbage collection: %d %s (%v)", response.Code, response.Body, err)
+		}
+		return result.Removed, result.Freed
+	}
+	defer func(grace time.Duration) { collectGrace = grace }(collectGrace)
+	collectGrace = -time.Second
+	for _, name := range []string{"small.txt", "copy.txt"} {
+		if status := call(router, "developer", http.MethodDelete, artifacts+"/"+name, ""); status != http.StatusNoContent {
+			t.Fatalf("error deleting artifact %s: %d", name, status)
+		}
+		removed, freed := collect()
+		if name == "small.txt" && removed != 0 {
+			t.Fatalf("blob still referenced by another artifact collected")
+		} else if name == "copy.txt" && (removed != 1 || freed != 5) {
+			t.Fatalf("unexpected garbage collection: %d blobs, %d bytes", removed, freed)
+		}
+	}
+	if _, err := storage.Stat(digest(small)); errors.Cause(err) != blobs.ErrorNotFound {
+		t.Fatalf("unreferenced blob not collected: %v", err)
+	}
+
+	// the contents of deployed artifacts outlive the artifacts themselves
+	deployed := "deployed"
+	if status := call(router, "developer", http.MethodPost, artifacts, `{"name":"deployed.txt","size":8,"digest":"`+digest(deployed)+`"}`); status != http.StatusCreated {
+		t.Fatalf("error creating artifact: %d", status)
+	}
+	if status := call(router, "developer", http.MethodPut, artifacts+"/deployed.txt/content", deployed); status != http.StatusCreated {
+		t.Fatalf("error uploading artifact: %d", status)
+	}
+	product, _ := store.GetProductByCode("gaia")
+	version, _ := store.GetVersionByCode(product, "1.0.0")
+	deployment, _ := store.GetDeploymentByOrder(version, 0)
+	if err := store.SetDeploymentArtifacts(&deployment, []string{digest(deployed)}); err != nil {
+		t.Fatalf("error deploying artifact: %v", err)
+	}
+	if status := call(router, "developer", http.MethodDelete, artifacts+"/deployed.txt", ""); status != http.StatusNoContent {
+		t.Fatalf("error deleting artifact: %d", status)
+	}
+	if removed, _ := collect(); removed != 0 {
+		t.Fatalf("deployed blob collected")
+	}
+	if _, err := storage.Stat(digest(deployed)); err != nil {
+		t.Fatalf("deployed blob not kept: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/dihedron/builds/signing"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTokenLifetime is the time approval tokens are valid for, unless
+// otherwise configured.
+const defaultTokenLifetime = 15 * time.Minute
+
+// GetDeploymentToken returns a signed approval token for a GRANTED
+// deployment, which deploy jobs can verify offline against the keys published
+// by GetKeys; the token states the product, version, order and environment of
+// the deployment, who approved it and when it was granted and the digests of
+// the artifacts to be deployed, if any, and expires after the token lifetime
+// of the server, since the deployment may be rejected or cancelled in the
+// meantime.
+func (s *Server) GetDeploymentToken(c *gin.Context) {
+	if s.signer == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "the server has no signing key"})
+		return
+	}
+
+	product, version, deployment, ok := s.lookupDeployment(c)
+	if !ok || !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+	if deployment.Status != model.GRANTED {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("deployment %d of version %q is %s, not %s", deployment.Order, version.Code, deployment.Status, model.GRANTED)})
+		return
+	}
+
+	claims := signing.Claims{
+		Product:     product.Code,
+		Version:     version.Code,
+		Order:       deployment.Order,
+		Environment: deployment.Environment,
+		GrantedBy:   deployment.GrantedBy,
+		Granted:     deployment.Timestamp.UTC(),
+		Issued:      time.Now().UTC(),
+	}
+	claims.Expires = claims.Issued.Add(s.lifetime)
+	for _, approval := range deployment.Approvals {
+		claims.Approvers = append(claims.Approvers, approval.User)
+	}
+	for _, artifact := range deployment.Artifacts {
+		claims.Digests = append(claims.Digests, artifact.Digest)
+	}
+	token, err := s.signer.Sign(claims)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "claims": claims})
+}
+
+// GetKeys returns the public keys approval tokens are verified against, as a
+// JSON Web Key Set: the key currently signing tokens comes first, followed by
+// the retired ones. Servers without a signing key publish no keys.
+func (s *Server) GetKeys(c *gin.Context) {
+	keys := []signing.JWK{}
+	if s.signer != nil {
+		for _, key := range append([]ed25519.PublicKey{s.signer.PublicKey()}, s.retired...) {
+			keys = append(keys, signing.NewJWK(key))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,531 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dihedron/builds/auth"
+	"github.com/dihedron/builds/model"
+	"github.com/dihedron/builds/semver"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// versionsQuery is the query string of version listing and lookup requests:
+// Range restricts the versions to those in a semantic version range (e.g.
+// ">=1.0.0 <2.0.0", see semver.Range), Stable to releases.
+type versionsQuery struct {
+	Range  string `form:"range" binding:"max=255"`
+	Stable bool   `form:"stable"`
+}
+
+// filter returns the given versions selected by the query; if any criteria
+// is given, versions whose code is not a semantic version are left out.
+func (q versionsQuery) filter(versions []model.Version) ([]model.Version, error) {
+	if q.Range == "" && !q.Stable {
+		return versions, nil
+	}
+	r, err := semver.ParseRange(q.Range)
+	if err != nil {
+		return nil, err
+	}
+	selected := []model.Version{}
+	for _, version := range versions {
+		semantic, err := version.Semantic()
+		if err != nil || (q.Stable && !semantic.Stable()) {
+			continue
+		}
+		if (q.Range == "" && semantic.Stable()) || r.Contains(semantic) {
+			selected = append(selected, version)
+		}
+	}
+	return selected, nil
+}
+
+// GetVersions returns the list of versions of a product, sorted by precedence
+// and along with links to their deployments; the range and stable parameters
+// select some of them (see versionsQuery).
+func (s *Server) GetVersions(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+	var query versionsQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	type DeploymentInfo struct {
+		Order       int          `json:"order"`
+		Environment string       `json:"environment,omitempty"`
+		Status      model.Status `json:"status,omitempty"`
+		GrantedBy   string       `json:"grantedBy,omitempty"`
+		Timestamp   time.Time    `json:"timestamp,omitempty"`
+		Link        Link         `json:"_link,omitempty"`
+	}
+
+	type VersionInfo struct {
+		ID          uint             `json:"id"`
+		Code        string           `json:"code,omitempty"`
+		Branch      string           `json:"branch,omitempty"`
+		Links       []Link           `json:"_links,omitempty"`
+		Deployments []DeploymentInfo `json:"deployments,omitempty"`
+	}
+
+	versions, err := s.store.GetVersions(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if versions, err = query.filter(versions); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	results := make([]VersionInfo, 0, len(versions))
+	for _, version := range versions {
+		var deployments []DeploymentInfo
+		if len(version.Deployments) > 0 {
+			deployments = make([]DeploymentInfo, 0, len(version.Deployments))
+			for _, deployment := range version.Deployments {
+				deployments = append(deployments, DeploymentInfo{
+					Order:       deployment.Order,
+					Environment: deployment.Environment,
+					Status:      deployment.Status,
+					GrantedBy:   deployment.GrantedBy,
+					Timestamp:   deployment.Timestamp,
+					Link: Link{
+						Relation: "self",
+						URI:      href(c, "products", product.Code, "versions", version.Code, "deployments", strconv.Itoa(deployment.Order)),
+					},
+				})
+			}
+		}
+		results = append(results, VersionInfo{
+			ID:          version.ID,
+			Code:        version.Code,
+			Branch:      version.Branch,
+			Links:       versionLinks(c, product, version),
+			Deployments: deployments,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": results})
+}
+
+// GetVersion returns a version of a product, identified by its code; the
+// "latest" and "latest-stable" codes stand for the version with the highest
+// precedence and the latest release respectively, optionally restricted to a
+// range given as parameter (see versionsQuery).
+func (s *Server) GetVersion(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+
+	var version model.Version
+	switch code := c.Param("versionId"); code {
+	case "latest", "latest-stable":
+		query := versionsQuery{Stable: code == "latest-stable"}
+		if err := c.ShouldBindQuery(&query); err != nil {
+			invalid(c, err)
+			return
+		}
+		versions, err := s.store.GetVersions(product)
+		if err == nil {
+			versions, err = query.filter(versions)
+			if err != nil {
+				invalid(c, err)
+				return
+			}
+			if len(versions) == 0 {
+				err = errors.Wrapf(model.ErrorNotFound, "no %s version of product %q", code, product.Code)
+			} else {
+				version = versions[len(versions)-1]
+			}
+		}
+		if err != nil {
+			abort(c, err)
+			return
+		}
+	default:
+		if version, err = s.store.GetVersionByCode(product, code); err != nil {
+			abort(c, err)
+			return
+		}
+	}
+
+	type DeploymentInfo struct {
+		Order       int            `json:"order"`
+		Environment string         `json:"environment,omitempty"`
+		Status      model.Status   `json:"status,omitempty"`
+		GrantedBy   string         `json:"grantedBy,omitempty"`
+		Timestamp   time.Time      `json:"timestamp,omitempty"`
+		Approvals   []ApprovalInfo `json:"approvals,omitempty"`
+		Link        Link           `json:"_link,omitempty"`
+	}
+
+	type VersionInfo struct {
+		ID          uint             `json:"id"`
+		Code        string           `json:"code,omitempty"`
+		Description string           `json:"description,omitempty"`
+		Repository  string           `json:"repository,omitempty"`
+		Branch      string           `json:"branch,omitempty"`
+		Author      string           `json:"author,omitempty"`
+		Links       []Link           `json:"_links,omitempty"`
+		Deployments []DeploymentInfo `json:"deployments,omitempty"`
+	}
+
+	var deployments []DeploymentInfo
+	if len(version.Deployments) > 0 {
+		deployments = make([]DeploymentInfo, 0, len(version.Deployments))
+		for _, deployment := range version.Deployments {
+			deployments = append(deployments, DeploymentInfo{
+				Order:       deployment.Order,
+				Environment: deployment.Environment,
+				Status:      deployment.Status,
+				GrantedBy:   deployment.GrantedBy,
+				Timestamp:   deployment.Timestamp,
+				Approvals:   approvalInfos(deployment.Approvals),
+				Link: Link{
+					Relation: "self",
+					URI:      href(c, "products", product.Code, "versions", version.Code, "deployments", strconv.Itoa(deployment.Order)),
+				},
+			})
+		}
+	}
+
+	result := VersionInfo{
+		ID:          version.ID,
+		Code:        version.Code,
+		Description: version.Description,
+		Repository:  version.Repository,
+		Branch:      version.Branch,
+		Author:      version.Author,
+		Links:       versionLinks(c, product, version),
+		Deployments: deployments,
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": result})
+}
+
+// versionLinks returns the hypermedia links of a version.
+func versionLinks(c *gin.Context, product model.Product, version model.Version) []Link {
+	return []Link{
+		{
+			Relation: "self",
+			URI:      href(c, "products", product.Code, "versions", version.Code),
+		},
+		{
+			Relation: "collection",
+			URI:      href(c, "products", product.Code, "versions"),
+		},
+		{
+			Relation: "product",
+			URI:      href(c, "products", product.Code),
+		},
+		{
+			Relation: "deployments",
+			URI:      href(c, "products", product.Code, "versions", version.Code, "deployments"),
+		},
+		{
+			Relation: "builds",
+			URI:      href(c, "products", product.Code, "versions", version.Code, "builds"),
+		},
+	}
+}
+
+// versionRequest is the payload of version creation and replacement requests;
+// codes are semantic versions, e.g. "1.0.2" or "2.0.0-rc.1".
+type versionRequest struct {
+	Code        string `json:"code" binding:"required,max=63"`
+	Description string `json:"description" binding:"max=1024"`
+	Repository  string `json:"repository" binding:"omitempty,url"`
+	Branch      string `json:"branch"`
+	// Author is only taken into account when creating a version on a server
+	// which does not authenticate users, see versionAuthor; it cannot be
+	// changed afterwards.
+	Author string `json:"author" binding:"max=255"`
+}
+
+// bind reads the request payload, and returns whether it is valid, i.e. its
+// code is a semantic version, unless it is the unchanged code of the legacy
+// version being replaced (empty when creating one); if not, the request is
+// aborted with a Bad Request status code.
+func (r *versionRequest) bind(c *gin.Context, current model.Version) bool {
+	if err := c.ShouldBindJSON(r); err != nil {
+		invalid(c, err)
+		return false
+	}
+	return validCode(c, r.Code, current)
+}
+
+// validCode returns whether the given code can be set on the given version,
+// i.e. it is a semantic version, or the unchanged code of a legacy version;
+// if not, the request is aborted with a Bad Request status code.
+func validCode(c *gin.Context, code string, current model.Version) bool {
+	if current.Legacy && code == current.Code {
+		return true
+	}
+	if _, err := semver.Parse(code); err != nil {
+		invalid(c, err)
+		return false
+	}
+	return true
+}
+
+// versionPatch is the payload of version partial update requests; only the
+// provided fields are modified.
+type versionPatch struct {
+	Code        *string `json:"code" binding:"omitempty,min=1,max=63"`
+	Description *string `json:"description" binding:"omitempty,max=1024"`
+	Repository  *string `json:"repository" binding:"omitempty,url"`
+	Branch      *string `json:"branch"`
+}
+
+// CreateVersion creates a new version of a product.
+func (s *Server) CreateVersion(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	var request versionRequest
+	if !request.bind(c, model.Version{}) {
+		return
+	}
+
+	version := model.Version{
+		ProductID:   product.ID,
+		Code:        request.Code,
+		Description: request.Description,
+		Repository:  request.Repository,
+		Branch:      request.Branch,
+		Author:      versionAuthor(c, request.Author),
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateVersion(&version); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "version", product.Code, versionKey(product, version), nil, version)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code, "versions", version.Code))
+	c.JSON(http.StatusCreated, gin.H{"version": version})
+}
+
+// bumpQuery is the query string of next version suggestion requests: Bump is
+// the part of the latest version to increment, Identifier the label of
+// pre-releases (see semver.Version.Next).
+type bumpQuery struct {
+	Bump       string `form:"bump" binding:"required,oneof=major minor patch prerelease"`
+	Identifier string `form:"preid" binding:"max=63"`
+}
+
+// GetNextVersion returns the code and default branch of the version which
+// would follow the latest version of a product, by incrementing the part given
+// as parameter; it is only a suggestion, since another version may be created
+// in the meantime, see AllocateVersion.
+func (s *Server) GetNextVersion(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.VIEWER, product, "") {
+		return
+	}
+	var query bumpQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	versions, err := s.store.GetVersions(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	code, err := model.NextCode(versions, semver.Part(query.Bump), query.Identifier)
+	if err != nil {
+		invalid(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": gin.H{"code": code, "branch": model.DefaultBranch(code)}})
+}
+
+// allocationRequest is the payload of version allocation requests; the code of
+// the version is computed from the latest one (see bumpQuery), its branch
+// defaults to the one following the ver_X_Y_Z convention, and its Author is
+// treated as in versionRequest.
+type allocationRequest struct {
+	Bump        string `json:"bump" binding:"required,oneof=major minor patch prerelease"`
+	Identifier  string `json:"preid" binding:"max=63"`
+	Description string `json:"description" binding:"max=1024"`
+	Repository  string `json:"repository" binding:"omitempty,url"`
+	Branch      string `json:"branch"`
+	Author      string `json:"author" binding:"max=255"`
+}
+
+// AllocateVersion creates the version following the latest version of a
+// product, by incrementing the part given in the request; concurrent requests,
+// e.g. from pipelines building the same product, are each given a different
+// version.
+func (s *Server) AllocateVersion(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	var request allocationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		invalid(c, err)
+		return
+	}
+	if _, err := (semver.Version{}).Next(semver.Part(request.Bump), request.Identifier); err != nil {
+		invalid(c, err)
+		return
+	}
+
+	version := model.Version{
+		ProductID:   product.ID,
+		Description: request.Description,
+		Repository:  request.Repository,
+		Branch:      request.Branch,
+		Author:      versionAuthor(c, request.Author),
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.AllocateVersion(&version, semver.Part(request.Bump), request.Identifier); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "version", product.Code, versionKey(product, version), nil, version)
+	}) {
+		return
+	}
+
+	c.Header("Location", href(c, "products", product.Code, "versions", version.Code))
+	c.JSON(http.StatusCreated, gin.H{"version": version})
+}
+
+// UpdateVersion replaces all the attributes of an existing version.
+func (s *Server) UpdateVersion(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+	version.Deployments = nil
+	current := version
+
+	var request versionRequest
+	if !request.bind(c, current) {
+		return
+	}
+
+	version.Code = request.Code
+	version.Description = request.Description
+	version.Repository = request.Repository
+	version.Branch = request.Branch
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateVersion(&version); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "version", product.Code, versionKey(product, current), current, version)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
+
+// PatchVersion modifies some of the attributes of an existing version.
+func (s *Server) PatchVersion(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+	version.Deployments = nil
+	current := version
+
+	var patch versionPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		invalid(c, err)
+		return
+	}
+	if patch.Code != nil && !validCode(c, *patch.Code, current) {
+		return
+	}
+
+	if patch.Code != nil {
+		version.Code = *patch.Code
+	}
+	if patch.Description != nil {
+		version.Description = *patch.Description
+	}
+	if patch.Repository != nil {
+		version.Repository = *patch.Repository
+	}
+	if patch.Branch != nil {
+		version.Branch = *patch.Branch
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateVersion(&version); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "version", product.Code, versionKey(product, current), current, version)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
+
+// DeleteVersion deletes a version of a product, along with its deployments.
+func (s *Server) DeleteVersion(c *gin.Context) {
+	product, version, ok := s.lookupVersion(c)
+	if !ok || !s.allow(c, model.DEVELOPER, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteVersion(&version); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "version", product.Code, versionKey(product, version), version, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// versionAuthor returns the author of a version being created: on servers
+// authenticating users, the user issuing the request, so that the approval
+// policies excluding authors cannot be bypassed by naming someone else;
+// otherwise the one given in the request, if any.
+func versionAuthor(c *gin.Context, requested string) string {
+	if user, ok := auth.User(c); ok {
+		return user
+	}
+	return requested
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// WebhookInfo is the representation of a webhook; its secret is only
+// returned when the webhook is created.
+type WebhookInfo struct {
+	ID      uint      `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events,omitempty"`
+	Active  bool      `json:"active"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Links   []Link    `json:"_links,omitempty"`
+}
+
+// DeliveryInfo is the representation of an attempt to deliver an event to a
+// webhook.
+type DeliveryInfo struct {
+	EventID    uint            `json:"eventId"`
+	Event      model.EventType `json:"event"`
+	Attempt    int             `json:"attempt"`
+	StatusCode int             `json:"statusCode,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Succeeded  bool            `json:"succeeded"`
+	Timestamp  time.Time       `json:"timestamp"`
+}
+
+// GetWebhooks returns the list of webhooks of a product.
+func (s *Server) GetWebhooks(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	webhooks, err := s.store.GetWebhooks(product)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]WebhookInfo, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		results = append(results, webhookInfo(c, product, webhook))
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": results})
+}
+
+// GetWebhook returns a webhook of a product.
+func (s *Server) GetWebhook(c *gin.Context) {
+	product, webhook, ok := s.lookupWebhook(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhook": webhookInfo(c, product, webhook)})
+}
+
+// webhookRequest is the payload of webhook creation and replacement requests;
+// Events lists the patterns of the event types the webhook subscribes to (all
+// of them, if empty), and a random Secret is generated if none is provided
+// on creation. Webhooks are active unless otherwise specified.
+type webhookRequest struct {
+	URL    string   `json:"url" binding:"required,url,max=1024"`
+	Events []string `json:"events" binding:"max=32,dive,required,max=63,excludesall=0x2C"`
+	Secret string   `json:"secret" binding:"max=255"`
+	Active *bool    `json:"active"`
+}
+
+// bind reads the request payload into the given webhook, and returns whether
+// it is valid; if not, the request is aborted with a Bad Request status code.
+func (r *webhookRequest) bind(c *gin.Context, webhook *model.Webhook) bool {
+	if err := c.ShouldBindJSON(r); err != nil {
+		invalid(c, err)
+		return false
+	}
+	for _, pattern := range r.Events {
+		if _, err := path.Match(pattern, ""); err != nil {
+			invalid(c, errors.Wrapf(err, "invalid event pattern %q", pattern))
+			return false
+		}
+	}
+	webhook.URL = r.URL
+	webhook.Events = strings.Join(r.Events, ",")
+	if r.Secret != "" {
+		webhook.Secret = r.Secret
+	}
+	webhook.Active = r.Active == nil || *r.Active
+	return true
+}
+
+// CreateWebhook subscribes a new webhook to the events of a product; the
+// response holds the secret the deliveries are signed with.
+func (s *Server) CreateWebhook(c *gin.Context) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return
+	}
+	if !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	var request webhookRequest
+	webhook := model.Webhook{ProductID: product.ID}
+	if !request.bind(c, &webhook) {
+		return
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			abort(c, errors.Wrap(err, "error generating webhook secret"))
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.CreateWebhook(&webhook); err != nil {
+			return err
+		}
+		return audit(model.CREATE, "webhook", product.Code, webhookKey(product, webhook), nil, webhook)
+	}) {
+		return
+	}
+
+	result := webhookInfo(c, product, webhook)
+	result.Secret = webhook.Secret
+	c.Header("Location", result.Links[0].URI)
+	c.JSON(http.StatusCreated, gin.H{"webhook": result})
+}
+
+// UpdateWebhook replaces the URL, the event patterns and the status of a
+// webhook; its secret is only replaced if a new one is provided.
+func (s *Server) UpdateWebhook(c *gin.Context) {
+	product, webhook, ok := s.lookupWebhook(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	current := webhook
+	var request webhookRequest
+	if !request.bind(c, &webhook) {
+		return
+	}
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.UpdateWebhook(&webhook); err != nil {
+			return err
+		}
+		return audit(model.UPDATE, "webhook", product.Code, webhookKey(product, webhook), current, webhook)
+	}) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhook": webhookInfo(c, product, webhook)})
+}
+
+// DeleteWebhook deletes a webhook of a product, along with its delivery log.
+func (s *Server) DeleteWebhook(c *gin.Context) {
+	product, webhook, ok := s.lookupWebhook(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	if !s.change(c, func(store model.Store, audit auditor) error {
+		if err := store.DeleteWebhook(&webhook); err != nil {
+			return err
+		}
+		return audit(model.DELETE, "webhook", product.Code, webhookKey(product, webhook), webhook, nil)
+	}) {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// deliveriesQuery holds the parameters of delivery log requests.
+type deliveriesQuery struct {
+	Limit int `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// GetDeliveries returns the delivery log of a webhook, newest first: by
+// default the latest 50 attempts, or as many as the limit parameter requests.
+func (s *Server) GetDeliveries(c *gin.Context) {
+	product, webhook, ok := s.lookupWebhook(c)
+	if !ok || !s.allow(c, model.ADMIN, product, "") {
+		return
+	}
+
+	query := deliveriesQuery{Limit: 50}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		invalid(c, err)
+		return
+	}
+	deliveries, err := s.store.GetDeliveries(webhook, query.Limit)
+	if err != nil {
+		abort(c, err)
+		return
+	}
+
+	results := make([]DeliveryInfo, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		results = append(results, DeliveryInfo{
+			EventID:    delivery.EventID,
+			Event:      delivery.Event,
+			Attempt:    delivery.Attempt,
+			StatusCode: delivery.StatusCode,
+			Error:      delivery.Error,
+			Succeeded:  delivery.Succeeded(),
+			Timestamp:  delivery.Timestamp,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": results})
+}
+
+// lookupWebhook retrieves the product and the webhook addressed by the request
+// path; if either does not exist, or the webhook belongs to another product,
+// the request is aborted and false returned.
+func (s *Server) lookupWebhook(c *gin.Context) (model.Product, model.Webhook, bool) {
+	product, err := s.store.GetProductByCode(c.Param("productId"))
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Webhook{}, false
+	}
+
+	id, err := strconv.ParseUint(c.Param("webhookId"), 10, 0)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return model.Product{}, model.Webhook{}, false
+	}
+	webhook, err := s.store.GetWebhook(uint(id))
+	if err == nil && webhook.ProductID != product.ID {
+		err = errors.Wrapf(model.ErrorNotFound, "error reading webhook %d", id)
+	}
+	if err != nil {
+		abort(c, err)
+		return model.Product{}, model.Webhook{}, false
+	}
+	return product, webhook, true
+}
+
+// webhookKey returns the key identifying a webhook in the audit log.
+func webhookKey(product model.Product, webhook model.Webhook) string {
+	return product.Code + "/" + strconv.FormatUint(uint64(webhook.ID), 10)
+}
+
+// webhookInfo returns the representation of a webhook, without its secret.
+func webhookInfo(c *gin.Context, product model.Product, webhook model.Webhook) WebhookInfo {
+	id := strconv.FormatUint(uint64(webhook.ID), 10)
+	return WebhookInfo{
+		ID:      webhook.ID,
+		URL:     webhook.URL,
+		Events:  webhook.Patterns(),
+		Active:  webhook.Active,
+		Created: webhook.CreatedAt,
+		Updated: webhook.UpdatedAt,
+		Links: []Link{
+			{Relation: "self", URI: href(c, "products", product.Code, "webhooks", id)},
+			{Relation: "deliveries", URI: href(c, "products", product.Code, "webhooks", id, "deliveries")},
+		},
+	}
+}
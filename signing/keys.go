@@ -0,0 +1,148 @@
+// Package signing issues and verifies the approval tokens of the builds
+// microservice: compact JWS tokens (RFC 7515) signed with Ed25519 keys
+// (RFC 8037), stating that a deployment has been GRANTED, which deploy jobs
+// can verify offline against the public keys published by the server.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// GenerateKey creates a new Ed25519 key pair and writes its private key to
+// the given file, PEM-encoded in PKCS #8 format and readable by its owner
+// only; existing files are never overwritten. The public key is returned.
+func GenerateKey(path string) (ed25519.PublicKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating key")
+	}
+	data, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding private key")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating private key file %q", path)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: data}); err != nil {
+		return nil, errors.Wrapf(err, "error writing private key to %q", path)
+	}
+	return public, nil
+}
+
+// LoadPrivateKey reads the PEM-encoded PKCS #8 Ed25519 private key in the
+// given file, as written by GenerateKey or by "openssl genpkey -algorithm
+// ed25519".
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading private key from %q", path)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.Errorf("no PEM-encoded private key in %q", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key in %q", path)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("private key in %q is not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+// LoadPublicKeys reads the PEM-encoded Ed25519 public keys in the given file,
+// as written by EncodePublicKey; the file must hold at least one key.
+func LoadPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading public keys from %q", path)
+	}
+	keys := []ed25519.PublicKey{}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid public key in %q", path)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("public key in %q is not an Ed25519 key", path)
+		}
+		keys = append(keys, public)
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no PEM-encoded public keys in %q", path)
+	}
+	return keys, nil
+}
+
+// EncodePublicKey returns the given public key, PEM-encoded in PKIX format.
+func EncodePublicKey(key ed25519.PublicKey) []byte {
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		// only happens with unsupported key types
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: data})
+}
+
+// KeyID returns the identifier of the given public key, i.e. the first 16
+// hex digits of its SHA-256 digest; tokens carry the identifier of the key
+// they are signed with, so that verifiers can pick the right one.
+func KeyID(key ed25519.PublicKey) string {
+	digest := sha256.Sum256(key)
+	return hex.EncodeToString(digest[:8])
+}
+
+// JWK is the JSON Web Key (RFC 8037) representation of an Ed25519 public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+}
+
+// NewJWK returns the JSON Web Key representation of the given public key.
+func NewJWK(key ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(key),
+		KeyID:     KeyID(key),
+		Use:       "sig",
+		Algorithm: "EdDSA",
+	}
+}
+
+// PublicKey returns the Ed25519 public key represented by the JSON Web Key.
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	if k.KeyType != "OKP" || k.Curve != "Ed25519" {
+		return nil, errors.Errorf("unsupported key type %s/%s", k.KeyType, k.Curve)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("invalid Ed25519 public key %q", k.X)
+	}
+	return ed25519.PublicKey(x), nil
+}
@@ -0,0 +1,114 @@
+package signing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// signer returns a signer on a new key, written to and loaded from a
+// temporary file.
+func signer(t *testing.T) *Signer {
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	public, err := GenerateKey(path)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	if _, err := GenerateKey(path); err == nil {
+		t.Fatalf("expected existing key file not to be overwritten")
+	}
+	private, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatalf("error loading key: %v", err)
+	}
+	if !public.Equal(private.Public()) {
+		t.Fatalf("loaded key does not match the generated one")
+	}
+	return NewSigner(private)
+}
+
+func TestSignVerify(t *testing.T) {
+	current, retired := signer(t), signer(t)
+	claims := Claims{
+		Product:     "gaia",
+		Version:     "1.0.0",
+		Order:       1,
+		Environment: "Production",
+		GrantedBy:   "bob",
+		Approvers:   []string{"alice", "bob"},
+		Granted:     time.Now().UTC().Truncate(time.Second),
+		Issued:      time.Now().UTC().Truncate(time.Second),
+		Expires:     time.Now().UTC().Truncate(time.Second).Add(time.Hour),
+	}
+	token, err := current.Sign(claims)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+
+	keys := filepath.Join(t.TempDir(), "keys.pem")
+	data := append(EncodePublicKey(retired.PublicKey()), EncodePublicKey(current.PublicKey())...)
+	if err := os.WriteFile(keys, data, 0644); err != nil {
+		t.Fatalf("error writing keys: %v", err)
+	}
+	public, err := LoadPublicKeys(keys)
+	if err != nil || len(public) != 2 {
+		t.Fatalf("unexpected public keys: %v (%v)", public, err)
+	}
+
+	verified, err := Verify(token, public)
+	if err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+	if verified.String() != claims.String() {
+		t.Fatalf("expected claims %v, got %v", claims, verified)
+	}
+	if err := verified.Check("gaia", "1.0.0", ""); err != nil {
+		t.Fatalf("unexpected error checking claims: %v", err)
+	}
+	if err := verified.Check("gaia", "", "Integration"); errors.Cause(err) != ErrorInvalidToken {
+		t.Fatalf("expected %v checking another environment, got %v", ErrorInvalidToken, err)
+	}
+
+	if _, err := Verify(token, public[:1]); errors.Cause(err) != ErrorUnknownKey {
+		t.Fatalf("expected %v with retired keys only, got %v", ErrorUnknownKey, err)
+	}
+	parts := strings.Split(token, ".")
+	forged, _ := current.Sign(Claims{Product: "gaia", Version: "6.6.6", Environment: "Production"})
+	if _, err := Verify(parts[0]+"."+strings.Split(forged, ".")[1]+"."+parts[2], public); errors.Cause(err) != ErrorInvalidSignature {
+		t.Fatalf("expected %v with forged claims, got %v", ErrorInvalidSignature, err)
+	}
+	if _, err := Verify("not.a-token", public); errors.Cause(err) != ErrorInvalidToken {
+		t.Fatalf("expected %v with a malformed token, got %v", ErrorInvalidToken, err)
+	}
+
+	claims.Expires = time.Now().Add(-time.Minute)
+	expired, _ := current.Sign(claims)
+	if _, err := Verify(expired, public); errors.Cause(err) != ErrorExpiredToken {
+		t.Fatalf("expected %v with an expired token, got %v", ErrorExpiredToken, err)
+	}
+	claims.Expires = time.Time{}
+	eternal, _ := current.Sign(claims)
+	if _, err := Verify(eternal, public); errors.Cause(err) != ErrorInvalidToken {
+		t.Fatalf("expected %v with a token without expiry, got %v", ErrorInvalidToken, err)
+	}
+}
+
+func TestJWK(t *testing.T) {
+	key := signer(t).PublicKey()
+	jwk := NewJWK(key)
+	if jwk.KeyID != KeyID(key) || jwk.Curve != "Ed25519" {
+		t.Fatalf("unexpected JSON Web Key: %+v", jwk)
+	}
+	public, err := jwk.PublicKey()
+	if err != nil || !public.Equal(key) {
+		t.Fatalf("unexpected public key: %v (%v)", public, err)
+	}
+	jwk.X = jwk.X[1:]
+	if _, err := jwk.PublicKey(); err == nil {
+		t.Fatalf("expected truncated key to be rejected")
+	}
+}
@@ -0,0 +1,177 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrorInvalidToken is returned when a token is malformed, or does not
+	// state what it is expected to.
+	ErrorInvalidToken = fmt.Errorf("invalid token")
+	// ErrorUnknownKey is returned when a token is signed with none of the
+	// keys it is verified against.
+	ErrorUnknownKey = fmt.Errorf("unknown signing key")
+	// ErrorInvalidSignature is returned when the signature of a token does
+	// not match its contents.
+	ErrorInvalidSignature = fmt.Errorf("invalid signature")
+	// ErrorExpiredToken is returned when a token is verified after its
+	// expiry.
+	ErrorExpiredToken = fmt.Errorf("expired token")
+)
+
+// Claims are the statements of an approval token: the deployment of a
+// version of a product onto an environment has been GRANTED.
+type Claims struct {
+	Product     string `json:"product"`
+	Version     string `json:"version"`
+	Order       int    `json:"order"`
+	Environment string `json:"environment"`
+	// GrantedBy is the user who granted the deployment, i.e. the last
+	// approver, whereas Approvers lists all those who approved it.
+	GrantedBy string    `json:"grantedBy"`
+	Approvers []string  `json:"approvers,omitempty"`
+	Granted   time.Time `json:"granted"`
+	// Digests lists the digests of the artifacts to be deployed, if the
+	// deployment states them; deploy jobs should deploy no others.
+	Digests []string `json:"digests,omitempty"`
+	// Issued is the time the token was signed.
+	Issued time.Time `json:"issued"`
+	// Expires is the time after which the token is no longer valid, so that
+	// a grant withdrawn after the token was issued does not stay valid for
+	// long.
+	Expires time.Time `json:"exp"`
+}
+
+// Check returns an ErrorInvalidToken if the claims are not about the given
+// product, version and environment; empty arguments match anything.
+func (c Claims) Check(product string, version string, environment string) error {
+	for _, expected := range []struct{ name, actual, wanted string }{
+		{"product", c.Product, product},
+		{"version", c.Version, version},
+		{"environment", c.Environment, environment},
+	} {
+		if expected.wanted != "" && expected.actual != expected.wanted {
+			return errors.Wrapf(ErrorInvalidToken, "token grants %s %q, not %q", expected.name, expected.actual, expected.wanted)
+		}
+	}
+	return nil
+}
+
+// String returns a JSON representation of the claims.
+func (c Claims) String() string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// header is the protected JWS header of approval tokens.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// tokenType is the media type of approval tokens, as per RFC 7515 4.1.9.
+const tokenType = "builds-approval+jws"
+
+// Signer issues approval tokens with an Ed25519 private key.
+type Signer struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+// NewSigner returns a signer issuing tokens with the given private key.
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key, id: KeyID(key.Public().(ed25519.PublicKey))}
+}
+
+// PublicKey returns the public key tokens issued by the signer are verified
+// against.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// KeyID returns the identifier of the key of the signer.
+func (s *Signer) KeyID() string {
+	return s.id
+}
+
+// Sign returns the compact JWS serialisation of the given claims, signed with
+// the key of the signer and carrying its identifier.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	protected, err := json.Marshal(header{Algorithm: "EdDSA", KeyID: s.id, Type: tokenType})
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding token header")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding token claims")
+	}
+	input := base64.RawURLEncoding.EncodeToString(protected) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(s.key, []byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of the given token against the key it names
+// among the given ones, and returns its claims; verification requires no
+// access to the server that issued the token. Tokens which have expired are
+// rejected with ErrorExpiredToken, those without expiry with
+// ErrorInvalidToken.
+func Verify(token string, keys []ed25519.PublicKey) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return claims, errors.Wrap(ErrorInvalidToken, "not a compact JWS")
+	}
+	var protected header
+	if err := decode(parts[0], &protected); err != nil {
+		return claims, errors.Wrapf(ErrorInvalidToken, "invalid header: %v", err)
+	}
+	if protected.Algorithm != "EdDSA" {
+		return claims, errors.Wrapf(ErrorInvalidToken, "unsupported algorithm %q", protected.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.Wrapf(ErrorInvalidToken, "invalid signature encoding: %v", err)
+	}
+
+	var key ed25519.PublicKey
+	for _, candidate := range keys {
+		if KeyID(candidate) == protected.KeyID {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		return claims, errors.Wrapf(ErrorUnknownKey, "token is signed with key %q", protected.KeyID)
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, errors.Wrapf(ErrorInvalidSignature, "token does not match its signature by key %q", protected.KeyID)
+	}
+
+	if err := decode(parts[1], &claims); err != nil {
+		return claims, errors.Wrapf(ErrorInvalidToken, "invalid claims: %v", err)
+	}
+	if claims.Expires.IsZero() {
+		return claims, errors.Wrap(ErrorInvalidToken, "token has no expiry")
+	}
+	if time.Now().After(claims.Expires) {
+		return claims, errors.Wrapf(ErrorExpiredToken, "token expired at %s", claims.Expires.Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+// decode unmarshals the given base64url-encoded JSON object into value.
+func decode(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,171 @@
+// Package webhooks delivers the events of the builds microservice to the
+// external endpoints subscribed to them, e.g. chat or ticketing systems: each
+// event is POSTed as JSON, signed with the secret of the webhook, and retried
+// with exponential backoff until it is accepted; every attempt is recorded in
+// the delivery log of the webhook.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dihedron/builds/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EventHeader is the request header holding the type of the event.
+	EventHeader = "X-Builds-Event"
+	// DeliveryHeader is the request header holding the ID of the event, which
+	// is the same across all the attempts to deliver it.
+	DeliveryHeader = "X-Builds-Delivery"
+	// SignatureHeader is the request header holding the signature of the
+	// payload (see Sign).
+	SignatureHeader = "X-Builds-Signature"
+)
+
+// Sign returns the signature of the given payload with the given secret, i.e.
+// "sha256=" followed by the hex-encoded HMAC-SHA256 of the payload.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns whether the given signature of the payload, as found in the
+// SignatureHeader of a delivery, was made with the given secret.
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
+
+// Dispatcher delivers events to the webhooks subscribed to them, in the
+// background.
+type Dispatcher struct {
+	store    model.Store
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	pending  sync.WaitGroup
+}
+
+// NewDispatcher returns a dispatcher delivering events to the webhooks in the
+// given store, making at most the given number of attempts per delivery: the
+// first retry happens after backoff, and each further one after twice the
+// previous delay.
+func NewDispatcher(store model.Store, attempts int, backoff time.Duration) *Dispatcher {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &Dispatcher{
+		store:    store,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+// Publish delivers the given event, in the background, to the active webhooks
+// of its product subscribed to its type.
+func (d *Dispatcher) Publish(event model.Event) {
+	product, err := d.store.GetProductByCode(event.Product)
+	if err != nil {
+		log.Printf("error dispatching event %d: %v\n", event.ID, err)
+		return
+	}
+	webhooks, err := d.store.GetWebhooks(product)
+	if err != nil {
+		log.Printf("error dispatching event %d: %v\n", event.ID, err)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding event %d: %v\n", event.ID, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Subscribes(event.Type) {
+			d.pending.Add(1)
+			go d.deliver(webhook, event, payload)
+		}
+	}
+}
+
+// Wait blocks until all the deliveries in progress have either succeeded or
+// run out of attempts.
+func (d *Dispatcher) Wait() {
+	d.pending.Wait()
+}
+
+// deliver POSTs the payload of the event to the webhook until it is accepted,
+// it is refused for good or the attempts run out, recording each attempt;
+// deliveries to deleted webhooks are abandoned.
+func (d *Dispatcher) deliver(webhook model.Webhook, event model.Event, payload []byte) {
+	defer d.pending.Done()
+	delay := d.backoff
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		delivery := model.Delivery{WebhookID: webhook.ID, EventID: event.ID, Event: event.Type, Attempt: attempt, Timestamp: time.Now()}
+		retry := true
+		status, err := d.post(webhook, event, payload)
+		if err != nil {
+			delivery.Error = truncate(err.Error(), 1024)
+		} else {
+			delivery.StatusCode = status
+			// client errors other than throttling will not go away by retrying
+			retry = status >= 500 || status == http.StatusTooManyRequests
+		}
+		if err := d.store.CreateDelivery(&delivery); err != nil {
+			log.Printf("error recording delivery of event %d to webhook %d: %v\n", event.ID, webhook.ID, err)
+			if errors.Cause(err) == model.ErrorConstraint {
+				return
+			}
+		}
+		if delivery.Succeeded() || !retry {
+			return
+		}
+	}
+}
+
+// post sends the payload of the event to the webhook, and returns the status
+// code of the response.
+func (d *Dispatcher) post(webhook model.Webhook, event model.Event, payload []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "error preparing request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "builds-webhooks")
+	request.Header.Set(EventHeader, string(event.Type))
+	request.Header.Set(DeliveryHeader, fmt.Sprint(event.ID))
+	if webhook.Secret != "" {
+		request.Header.Set(SignatureHeader, Sign(webhook.Secret, payload))
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	return response.StatusCode, nil
+}
+
+// truncate shortens the given text to at most the given number of bytes.
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return strings.ToValidUTF8(text[:length], "")
+}
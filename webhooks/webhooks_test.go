@@ -0,0 +1,104 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dihedron/builds/model"
+)
+
+// receiver is a webhook endpoint failing the first requests with the given
+// status codes, and accepting the following ones.
+type receiver struct {
+	mutex    sync.Mutex
+	failures []int
+	events   []model.Event
+	invalid  int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	payload, _ := io.ReadAll(request.Body)
+	if !Verify("s3cr3t", payload, request.Header.Get(SignatureHeader)) {
+		r.invalid++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(r.failures) > 0 {
+		w.WriteHeader(r.failures[0])
+		r.failures = r.failures[1:]
+		return
+	}
+	var event model.Event
+	json.Unmarshal(payload, &event)
+	r.events = append(r.events, event)
+}
+
+// subscribe returns a store holding product gaia, with a webhook subscribed
+// to the given events of the product on the given receiver.
+func subscribe(t *testing.T, target http.Handler, events string) (model.Store, model.Webhook) {
+	ts := httptest.NewServer(target)
+	t.Cleanup(ts.Close)
+	store := model.NewMemoryStore()
+	product := model.Product{Code: "gaia"}
+	if err := store.CreateProduct(&product); err != nil {
+		t.Fatalf("error creating product: %v", err)
+	}
+	webhook := model.Webhook{ProductID: product.ID, URL: ts.URL, Events: events, Secret: "s3cr3t", Active: true}
+	if err := store.CreateWebhook(&webhook); err != nil {
+		t.Fatalf("error creating webhook: %v", err)
+	}
+	return store, webhook
+}
+
+func TestDeliver(t *testing.T) {
+	target := &receiver{failures: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	store, webhook := subscribe(t, target, "deployment.*")
+	dispatcher := NewDispatcher(store, 3, 10*time.Millisecond)
+
+	dispatcher.Publish(model.Event{ID: 1, Type: model.VERSION_CREATED, Product: "gaia", Key: "gaia/1.0.0"})
+	dispatcher.Publish(model.Event{ID: 2, Type: model.StatusEvent(model.GRANTED), Product: "gaia", Key: "gaia/1.0.0/0"})
+	dispatcher.Publish(model.Event{ID: 3, Type: model.StatusEvent(model.GRANTED), Product: "uranus", Key: "uranus/1.0.0/0"})
+	dispatcher.Wait()
+
+	if target.invalid != 0 || len(target.events) != 1 || target.events[0].ID != 2 {
+		t.Fatalf("unexpected events delivered: %v (%d with invalid signatures)", target.events, target.invalid)
+	}
+	deliveries, err := store.GetDeliveries(webhook, 0)
+	if err != nil || len(deliveries) != 3 {
+		t.Fatalf("unexpected deliveries: %v (%v)", deliveries, err)
+	}
+	if !deliveries[0].Succeeded() || deliveries[0].Attempt != 3 || deliveries[2].StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected delivery log: %v", deliveries)
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	target := &receiver{failures: []int{http.StatusBadRequest}}
+	store, webhook := subscribe(t, target, "")
+	dispatcher := NewDispatcher(store, 3, time.Millisecond)
+
+	dispatcher.Publish(model.Event{ID: 1, Type: model.VERSION_CREATED, Product: "gaia", Key: "gaia/1.0.0"})
+	dispatcher.Wait()
+	deliveries, _ := store.GetDeliveries(webhook, 0)
+	if len(deliveries) != 1 || deliveries[0].Succeeded() {
+		t.Fatalf("expected a single failed attempt on client errors, got %v", deliveries)
+	}
+
+	webhook.URL = "http://127.0.0.1:1/unreachable"
+	if err := store.UpdateWebhook(&webhook); err != nil {
+		t.Fatalf("error updating webhook: %v", err)
+	}
+	dispatcher.Publish(model.Event{ID: 2, Type: model.VERSION_CREATED, Product: "gaia", Key: "gaia/1.0.1"})
+	dispatcher.Wait()
+	deliveries, _ = store.GetDeliveries(webhook, 0)
+	if len(deliveries) != 4 || deliveries[0].Error == "" || deliveries[0].Attempt != 3 {
+		t.Fatalf("expected three failed attempts on unreachable webhooks, got %v", deliveries)
+	}
+}